@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 
+	"YAMATO/unitconv"
 	"YAMATO/usage"
 )
 
@@ -35,10 +36,23 @@ type Detail struct {
 	ExpiryDate    string `json:"expiryDate"`
 	LotNumber     string `json:"lotNumber"`
 	OroshiCode    string `json:"oroshiCode"`
+	OroshiName    string `json:"oroshiName"`
 	ReceiptNumber string `json:"receiptNumber"`
 	LineNumber    string `json:"lineNumber"`
 
+	// 棚卸のみ: 開封済みのバラ数（包装単位）
+	Loose string `json:"loose,omitempty"`
+
+	// USAGE のみ: 元の数量・単位
+	RawQuantity string `json:"rawQuantity,omitempty"`
+	RawUnit     string `json:"rawUnit,omitempty"`
+	// 包装の基本単位への換算ができなかった理由
+	Conversion string `json:"conversion,omitempty"`
+
 	// 内部用
+	JAN          string `json:"-"`
+	UnitCode     string `json:"-"` // 数量の単位コード（USAGE は RawUnit のコード）
+	HUCode       string `json:"-"` // 基本単位（包装単位）のコード
 	RawCount     string `json:"-"`
 	HK           string `json:"-"`
 	HS           string `json:"-"`
@@ -67,6 +81,48 @@ func parseParams(r *http.Request) (from, to string, q url.Values, errMsg string,
 	return from, to, q, "", 0
 }
 
+// oroshiNameSQL は卸コード列 col から卸マスターの名称を引く副問い合わせです。
+func oroshiNameSQL(col string) string {
+	return `COALESCE((SELECT o.name FROM oroshi o WHERE o.oroshiCode = ` + col +
+		` AND o.oroshiCode <> '' ORDER BY o.oroshiNo LIMIT 1), '')`
+}
+
+// writeMasterFilters は MA0（別名 m）の項目による共通の絞り込み条件を sb と args に追加します。
+//   - doyaku / gekiyaku / mayaku / kakuseizai / kakuseizaiGenryou = 1
+//   - kouseishinyaku = 向精神薬区分（カンマ区切り）
+//   - maker = 販売元コード（JC029）または製造元／輸入元コード（JC033）
+func writeMasterFilters(sb *strings.Builder, args *[]interface{}, q url.Values) {
+	// 毒薬／劇薬／麻薬フラグ
+	for _, c := range []struct{ name, col string }{
+		{"doyaku", "MA061JC061Doyaku"},
+		{"gekiyaku", "MA062JC062Gekiyaku"},
+		{"mayaku", "MA063JC063Mayaku"},
+		{"kakuseizai", "MA065JC065Kakuseizai"},
+		{"kakuseizaiGenryou", "MA066JC066KakuseizaiGenryou"},
+	} {
+		if q.Get(c.name) == "1" {
+			sb.WriteString(" AND m." + c.col + "='1'")
+		}
+	}
+
+	// 向精神薬フラグ
+	if ks := q.Get("kouseishinyaku"); ks != "" {
+		parts := strings.Split(ks, ",")
+		ph := make([]string, len(parts))
+		for i, v := range parts {
+			ph[i] = "?"
+			*args = append(*args, v)
+		}
+		sb.WriteString(" AND m.MA064JC064Kouseishinyaku IN(" + strings.Join(ph, ",") + ")")
+	}
+
+	// メーカー
+	if mk := q.Get("maker"); mk != "" {
+		sb.WriteString(" AND (m.MA029JC029HanbaiMotoCode = ? OR m.MA033JC033SeizouMotoYunyuuMotoCode = ?)")
+		*args = append(*args, mk, mk)
+	}
+}
+
 // fetchDatDetails は DAT レコードを取り Detail に変換
 func fetchDatDetails(from, to string, q url.Values) ([]Detail, error) {
 	var details []Detail
@@ -91,6 +147,7 @@ SELECT
   d.DatExpiryDate                                                          AS expiryDate,
   d.DatLotNumber                                                           AS lotNumber,
   d.CurrentOroshiCode                                                      AS oroshiCode,
+  ` + oroshiNameSQL("d.CurrentOroshiCode") + `                                AS oroshiName,
   d.DatReceiptNumber                                                       AS receiptNumber,
   d.DatLineNumber                                                          AS lineNumber,
   -- 包装情報: MA0 → MA2
@@ -99,7 +156,8 @@ SELECT
   COALESCE(NULLIF(m.MA039JC039HousouTaniTani,''), m2.HousouTaniUnit, '')    AS hu,
   COALESCE(NULLIF(m.MA131JA006HousouSuuryouSuuchi,''), CAST(m2.JanHousouSuuryouNumber AS TEXT), '') AS jsn,
   COALESCE(NULLIF(m.MA132JA007HousouSuuryouTaniCode,''), m2.JanHousouSuuryouUnit, '')   AS jsu,
-  COALESCE(NULLIF(m.MA133JA008HousouSouryouSuuchi,''), CAST(m2.JanHousouSouryouNumber AS TEXT), '')    AS jssn
+  COALESCE(NULLIF(m.MA133JA008HousouSouryouSuuchi,''), CAST(m2.JanHousouSouryouNumber AS TEXT), '')    AS jssn,
+  d.DatJanCode                                                             AS jan
 FROM datrecords d
 LEFT JOIN ma0 m  ON d.DatJanCode = m.MA000JC000JanCode
 LEFT JOIN ma2 m2 ON d.DatJanCode = m2.MA2JanCode
@@ -110,26 +168,8 @@ WHERE d.DatDate BETWEEN ? AND ?
 
 		args = append(args, "%"+f+"%")
 	}
-	for _, c := range []struct{ name, col string }{
-		{"doyaku", "MA061JC061Doyaku"},
-		{"gekiyaku", "MA062JC062Gekiyaku"},
-		{"mayaku", "MA063JC063Mayaku"},
-		{"kakuseizai", "MA065JC065Kakuseizai"},
-		{"kakuseizaiGenryou", "MA066JC066KakuseizaiGenryou"},
-	} {
-		if q.Get(c.name) == "1" {
-			sb.WriteString(" AND m." + c.col + "='1'")
-		}
-	}
-	if ks := q.Get("kouseishinyaku"); ks != "" {
-		parts := strings.Split(ks, ",")
-		ph := make([]string, len(parts))
-		for i, v := range parts {
-			ph[i] = "?"
-			args = append(args, v)
-		}
-		sb.WriteString(" AND m.MA064JC064Kouseishinyaku IN(" + strings.Join(ph, ",") + ")")
-	}
+	// 毒劇麻・向精神薬・メーカーなど MA0 の項目による絞り込み
+	writeMasterFilters(sb, &args, q)
 
 	query := sb.String()
 	log.Printf("▶ DAT SQL: %s\n   args=%v", query, args)
@@ -147,13 +187,15 @@ WHERE d.DatDate BETWEEN ? AND ?
 			&d.YJ, &d.ProductName, &d.Date, &d.Type,
 			&d.RawCount, &d.Unit, &d.Packaging,
 			&d.UnitPrice, &d.Subtotal, &d.ExpiryDate,
-			&d.LotNumber, &d.OroshiCode, &d.ReceiptNumber, &d.LineNumber,
+			&d.LotNumber, &d.OroshiCode, &d.OroshiName, &d.ReceiptNumber, &d.LineNumber,
 			&d.HK, &d.HS, &d.HU, &d.JSN, &d.JSU, &d.JSSN,
+			&d.JAN,
 		); err != nil {
 			log.Printf("▶ DAT Scan error: %v", err)
 			continue
 		}
 		// 単位・包装単位コード→名称
+		d.HUCode = d.HU
 		if nm := usage.GetTaniName(d.Unit); nm != "" {
 			d.Unit = nm
 		}
@@ -162,9 +204,7 @@ WHERE d.DatDate BETWEEN ? AND ?
 		}
 
 		// 数量計算
-		hsVal, _ := strconv.Atoi(strings.TrimLeft(d.HS, "0"))
-		rcVal, _ := strconv.Atoi(strings.TrimLeft(d.RawCount, "0"))
-		d.Quantity = strconv.Itoa(hsVal * rcVal)
+		d.Quantity = strconv.FormatFloat(parseQty(d.HS)*parseQty(d.RawCount), 'f', -1, 64)
 		d.Count = d.RawCount
 
 		// Packaging文字列
@@ -195,6 +235,7 @@ SELECT
   -- 商品名 フォールバック
   COALESCE(NULLIF(m.MA018JC018ShouhinMei,''), m2.Shouhinmei, '') AS productName,
   u.usageAmount                                            AS rawCount,
+  u.usageUnit                                              AS unitCode,
   u.usageUnitName                                          AS unit,
   -- 包装情報: MA0 → MA2
   COALESCE(NULLIF(m.MA037JC037HousouKeitai,''), m2.HousouKeitai, '')        AS hk,
@@ -202,7 +243,9 @@ SELECT
   COALESCE(NULLIF(m.MA039JC039HousouTaniTani,''), m2.HousouTaniUnit, '')    AS hu,
   COALESCE(NULLIF(m.MA131JA006HousouSuuryouSuuchi,''), CAST(m2.JanHousouSuuryouNumber AS TEXT), '') AS jsn,
   COALESCE(NULLIF(m.MA132JA007HousouSuuryouTaniCode,''), m2.JanHousouSuuryouUnit, '')   AS jsu,
-  COALESCE(NULLIF(m.MA133JA008HousouSouryouSuuchi,''), CAST(m2.JanHousouSouryouNumber AS TEXT), '')    AS jssn
+  COALESCE(NULLIF(m.MA133JA008HousouSouryouSuuchi,''), CAST(m2.JanHousouSouryouNumber AS TEXT), '')    AS jssn,
+  u.usageJanCode                                           AS jan,
+  u.usageLineNo                                            AS lineNo
 FROM usagerecords u
 LEFT JOIN ma0  m  ON u.usageJanCode = m.MA000JC000JanCode
 LEFT JOIN ma2  m2 ON u.usageJanCode = m2.MA2JanCode
@@ -215,29 +258,8 @@ WHERE u.usageDate BETWEEN ? AND ?
 		args = append(args, "%"+f+"%")
 	}
 
-	// 毒薬／劇薬／麻薬フラグ
-	for _, c := range []struct{ name, col string }{
-		{"doyaku", "MA061JC061Doyaku"},
-		{"gekiyaku", "MA062JC062Gekiyaku"},
-		{"mayaku", "MA063JC063Mayaku"},
-		{"kakuseizai", "MA065JC065Kakuseizai"},
-		{"kakuseizaiGenryou", "MA066JC066KakuseizaiGenryou"},
-	} {
-		if q.Get(c.name) == "1" {
-			sb.WriteString(" AND m." + c.col + "='1'")
-		}
-	}
-
-	// 向1/2/3 フィルタ
-	if ks := q.Get("kouseishinyaku"); ks != "" {
-		parts := strings.Split(ks, ",")
-		ph := make([]string, len(parts))
-		for i, v := range parts {
-			ph[i] = "?"
-			args = append(args, v)
-		}
-		sb.WriteString(" AND m.MA064JC064Kouseishinyaku IN(" + strings.Join(ph, ",") + ")")
-	}
+	// 毒劇麻・向精神薬・メーカーなど MA0 の項目による絞り込み
+	writeMasterFilters(sb, &args, q)
 
 	query := sb.String()
 	log.Printf("▶ USAGE SQL: %s\n   args=%v", query, args)
@@ -251,15 +273,18 @@ WHERE u.usageDate BETWEEN ? AND ?
 
 	for rows.Next() {
 		var d Detail
-		var rawCount, unitName string
+		var rawCount, unitCode, unitName string
 
 		if err := rows.Scan(
 			&d.Date,
 			&d.YJ,
 			&d.ProductName,
 			&rawCount,
+			&unitCode,
 			&unitName,
 			&d.HK, &d.HS, &d.HU, &d.JSN, &d.JSU, &d.JSSN,
+			&d.JAN,
+			&d.LineNumber,
 		); err != nil {
 			log.Printf("▶ USAGE Scan error: %v", err)
 			continue
@@ -268,14 +293,27 @@ WHERE u.usageDate BETWEEN ? AND ?
 		d.Type = "処方"
 		d.Quantity = rawCount
 		d.Unit = unitName
+		d.RawQuantity = rawCount
+		d.RawUnit = unitName
+		d.UnitCode = unitCode
 
 		// 単位名称補完
+		d.HUCode = d.HU
 		if nm := usage.GetTaniName(d.HU); nm != "" {
 			d.HU = nm
 		}
 
 		d.Count = ""
 
+		// 調剤単位の数量を基本単位・包装数に換算（できなければ元の数量のまま理由を付ける）
+		if c := convertUsage(d); c.OK {
+			d.Quantity = unitconv.Format(c.BaseAmount)
+			d.Unit = c.BaseUnit
+			d.Count = unitconv.Format(c.Packages)
+		} else {
+			d.Conversion = c.Reason
+		}
+
 		// PackagingKey + Packaging 組み立て
 		d.PackagingKey = d.HK + d.JSN + d.HU
 		inner := d.JSN + d.HU + "×" + d.JSSN
@@ -335,6 +373,14 @@ func renderResponse(w http.ResponseWriter, data map[string]YJResult) error {
 	return json.NewEncoder(w).Encode(data)
 }
 
+// writeJSON は任意の値を JSON で返します
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[AGGREGATE] writeJSON error: %v", err)
+	}
+}
+
 // AggregateHandler は /aggregate エンドポイント
 func AggregateHandler(w http.ResponseWriter, r *http.Request) {
 	defer func() {
@@ -351,6 +397,17 @@ func AggregateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 台帳モード
+	if q.Get("mode") == "ledger" {
+		ledgerHandler(w, from, to, q)
+		return
+	}
+	// 同一成分（一般名・YJ 先頭９桁）まとめモード
+	if q.Get("mode") == "generic" {
+		genericHandler(w, from, to, q)
+		return
+	}
+
 	// ① 各種フェッチ処理
 	dats, err := fetchDatDetails(from, to, q)
 	if err != nil {
@@ -412,15 +469,19 @@ SELECT
   '棚卸'                                                 AS type,
   -- 生数量／包装単位
   CAST(inv.invJanHousouSuuryouNumber AS TEXT)            AS rawCount,
-  inv.InvHousouTaniUnit                                  AS unit,
+  inv.InvHousouTaniUnit                                  AS unitCode,
+  COALESCE(inv.HousouTaniUnit, '')                       AS unit,
   CAST(inv.qty AS TEXT)                                  AS quantity,
+  inv.packCount                                          AS packCount,
+  inv.looseQty                                           AS looseQty,
   -- 包装情報: MA0→MA2 フォールバック
   COALESCE(NULLIF(m.MA037JC037HousouKeitai,''), m2.HousouKeitai, '')                          AS hk,
   COALESCE(NULLIF(m.MA044JC044HousouSouryouSuuchi,''), CAST(m2.HousouSouryouNumber AS TEXT), '') AS hs,
   COALESCE(NULLIF(m.MA039JC039HousouTaniTani,''), m2.HousouTaniUnit, '')                         AS hu,
   COALESCE(NULLIF(m.MA131JA006HousouSuuryouSuuchi,''), CAST(m2.JanHousouSuuryouNumber AS TEXT), '') AS jsn,
   COALESCE(NULLIF(m.MA132JA007HousouSuuryouTaniCode,''), m2.JanHousouSuuryouUnit, '')             AS jsu,
-  COALESCE(NULLIF(m.MA133JA008HousouSouryouSuuchi,''), CAST(m2.JanHousouSouryouNumber AS TEXT), '') AS jssn
+  COALESCE(NULLIF(m.MA133JA008HousouSouryouSuuchi,''), CAST(m2.JanHousouSouryouNumber AS TEXT), '') AS jssn,
+  inv.invJanCode                                         AS jan
 FROM inventory inv
 LEFT JOIN ma0  m  ON inv.invJanCode = m.MA000JC000JanCode
 LEFT JOIN ma2  m2 ON inv.invJanCode = m2.MA2JanCode
@@ -432,29 +493,8 @@ WHERE inv.invDate BETWEEN ? AND ?`)
 		args = append(args, "%"+f+"%")
 	}
 
-	// 毒薬／劇薬／麻薬フラグ
-	for _, c := range []struct{ name, col string }{
-		{"doyaku", "MA061JC061Doyaku"},
-		{"gekiyaku", "MA062JC062Gekiyaku"},
-		{"mayaku", "MA063JC063Mayaku"},
-		{"kakuseizai", "MA065JC065Kakuseizai"},
-		{"kakuseizaiGenryou", "MA066JC066KakuseizaiGenryou"},
-	} {
-		if q.Get(c.name) == "1" {
-			sb.WriteString(" AND m." + c.col + "='1'")
-		}
-	}
-
-	// 向精神薬フラグ
-	if ks := q.Get("kouseishinyaku"); ks != "" {
-		parts := strings.Split(ks, ",")
-		ph := make([]string, len(parts))
-		for i, v := range parts {
-			ph[i] = "?"
-			args = append(args, v)
-		}
-		sb.WriteString(" AND m.MA064JC064Kouseishinyaku IN(" + strings.Join(ph, ",") + ")")
-	}
+	// 毒劇麻・向精神薬・メーカーなど MA0 の項目による絞り込み
+	writeMasterFilters(sb, &args, q)
 
 	query := sb.String()
 	log.Printf("▶ INV SQL: %s\n   args=%v", query, args)
@@ -467,41 +507,47 @@ WHERE inv.invDate BETWEEN ? AND ?`)
 
 	for rows.Next() {
 		var d Detail
+		var packCount, looseQty float64
 		if err := rows.Scan(
 			&d.Date,
 			&d.YJ,
 			&d.ProductName,
 			&d.Type,
 			&d.RawCount,
-			&d.Unit, // ここにコードが入っている
+			&d.UnitCode,
+			&d.Unit,
 			&d.Quantity,
+			&packCount, &looseQty,
 			&d.HK, &d.HS, &d.HU, &d.JSN, &d.JSU, &d.JSSN,
+			&d.JAN,
 		); err != nil {
 			log.Printf("▶ INV Scan error: %v", err)
 			continue
 		}
 
-		// ↓↓↓ 追加 ↓↓↓
-		// コード→名称変換: Unit, HU, JSU
-		if nm := usage.GetTaniName(d.Unit); nm != "" {
+		// コード→名称変換: Unit, HU
+		if nm := usage.GetTaniName(d.UnitCode); nm != "" {
 			d.Unit = nm
 		}
+		d.HUCode = d.HU
 		if nm := usage.GetTaniName(d.HU); nm != "" {
 			d.HU = nm
 		}
-		if nm := usage.GetTaniName(d.JSU); nm != "" {
-			d.JSU = nm
-		}
-		// ↑↑↑ 追加 ↑↑↑
 
-		// Count はパック数表示用
+		// Count は未開封の包装数、Loose は開封済みのバラ数（列追加前の棚卸は qty のみ）
 		d.Count = ""
+		if packCount != 0 || looseQty != 0 {
+			d.Count = strconv.FormatFloat(packCount, 'f', -1, 64)
+			d.Loose = strconv.FormatFloat(looseQty, 'f', -1, 64)
+		}
 
 		// PackagingKey & Packaging 組み立て
 		d.PackagingKey = d.HK + d.JSN + d.HU
 		inner := d.JSN + d.HU + "×" + d.JSSN
 		if d.JSU != "" && d.JSU != "0" {
-			inner += d.JSU
+			if nm := usage.GetTaniName(d.JSU); nm != "" {
+				inner += nm
+			}
 		}
 		d.Packaging = d.HK + d.HS + d.HU + "(" + inner + ")"
 
@@ -536,8 +582,10 @@ SELECT
   COALESCE(NULLIF(m.MA132JA007HousouSuuryouTaniCode,''), m2.JanHousouSuuryouUnit, '')        AS jsu,
   COALESCE(NULLIF(m.MA133JA008HousouSouryouSuuchi,''), CAST(m2.JanHousouSouryouNumber AS TEXT), '') AS jssn,
   iod.iodOroshiCode                                              AS oroshiCode,
+  ` + oroshiNameSQL("iod.iodOroshiCode") + `                        AS oroshiName,
   iod.iodReceiptNumber                                           AS receiptNumber,
-  CAST(iod.iodLineNumber  AS TEXT)                               AS lineNumber
+  CAST(iod.iodLineNumber  AS TEXT)                               AS lineNumber,
+  iod.iodJan                                                     AS jan
 FROM iod
 LEFT JOIN ma0  m  ON iod.iodJan = m.MA000JC000JanCode
 LEFT JOIN ma2  m2 ON iod.iodJan = m2.MA2JanCode
@@ -549,29 +597,8 @@ WHERE iod.iodDate BETWEEN ? AND ?`)
 		args = append(args, "%"+f+"%")
 	}
 
-	// 毒薬／劇薬／麻薬フラグ
-	for _, c := range []struct{ name, col string }{
-		{"doyaku", "MA061JC061Doyaku"},
-		{"gekiyaku", "MA062JC062Gekiyaku"},
-		{"mayaku", "MA063JC063Mayaku"},
-		{"kakuseizai", "MA065JC065Kakuseizai"},
-		{"kakuseizaiGenryou", "MA066JC066KakuseizaiGenryou"},
-	} {
-		if q.Get(c.name) == "1" {
-			sb.WriteString(" AND m." + c.col + "='1'")
-		}
-	}
-
-	// 向精神薬フラグ
-	if ks := q.Get("kouseishinyaku"); ks != "" {
-		parts := strings.Split(ks, ",")
-		ph := make([]string, len(parts))
-		for i, v := range parts {
-			ph[i] = "?"
-			args = append(args, v)
-		}
-		sb.WriteString(" AND m.MA064JC064Kouseishinyaku IN(" + strings.Join(ph, ",") + ")")
-	}
+	// 毒劇麻・向精神薬・メーカーなど MA0 の項目による絞り込み
+	writeMasterFilters(sb, &args, q)
 
 	query := sb.String()
 	log.Printf("▶ IOD SQL: %s\n   args=%v", query, args)
@@ -594,8 +621,10 @@ WHERE iod.iodDate BETWEEN ? AND ?`)
 			&d.Quantity,
 			&d.HK, &d.HS, &d.HU, &d.JSN, &d.JSU, &d.JSSN,
 			&d.OroshiCode,
+			&d.OroshiName,
 			&d.ReceiptNumber,
 			&d.LineNumber,
+			&d.JAN,
 		); err != nil {
 			log.Printf("▶ IOD Scan error: %v", err)
 			continue
@@ -603,8 +632,13 @@ WHERE iod.iodDate BETWEEN ? AND ?`)
 
 		// ← ここでコード→名称に変換
 		if nm := usage.GetTaniName(d.Unit); nm != "" {
+			d.UnitCode = d.Unit
 			d.Unit = nm
 		}
+		d.HUCode = d.HU
+		if nm := usage.GetTaniName(d.HU); nm != "" {
+			d.HU = nm
+		}
 
 		// Count はパック数
 		d.Count = d.RawCount
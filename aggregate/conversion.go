@@ -0,0 +1,82 @@
+package aggregate
+
+import (
+	"net/http"
+
+	"YAMATO/unitconv"
+	"YAMATO/usage"
+)
+
+// packagingOf は明細の包装情報（MA0 → MA2）を換算用に組み立てます。
+func packagingOf(d Detail) unitconv.Packaging {
+	return unitconv.Packaging{
+		BaseUnit:       d.HU,
+		BaseUnitCode:   d.HUCode,
+		BasePerPackage: parseQty(d.HS),
+		SubUnitCode:    d.JSU,
+		SubUnit:        usage.GetTaniName(d.JSU),
+		BasePerSub:     parseQty(d.JSN),
+		SubPerPackage:  parseQty(d.JSSN),
+	}
+}
+
+// convertUsage は USAGE 明細の元の数量（RawQuantity・RawUnit）を包装に合わせて換算します。
+func convertUsage(d Detail) unitconv.Result {
+	return unitconv.Convert(parseQty(d.RawQuantity), d.UnitCode, d.RawUnit, packagingOf(d))
+}
+
+// convertLedger は台帳に載せる明細の数量を包装の基本単位に換算します。
+// DAT は包装数（RawCount）、USAGE は元の数量、棚卸・IOD は数量と単位をそのまま換算します。
+func convertLedger(d Detail) unitconv.Result {
+	switch d.Type {
+	case "納品", "返品":
+		return unitconv.Convert(parseQty(d.RawCount), unitconv.UnitPackage, "", packagingOf(d))
+	case "処方":
+		return convertUsage(d)
+	}
+	return unitconv.Convert(parseQty(d.Quantity), d.UnitCode, d.Unit, packagingOf(d))
+}
+
+// ConversionRow は /api/usage/conversion の１行です。
+type ConversionRow struct {
+	Date        string `json:"date"`
+	JAN         string `json:"jan"`
+	YJ          string `json:"yj"`
+	ProductName string `json:"productName"`
+	RawQuantity string `json:"rawQuantity"`
+	RawUnit     string `json:"rawUnit"`
+	Quantity    string `json:"quantity"`
+	Unit        string `json:"unit"`
+	Packages    string `json:"packages"`
+	Packaging   string `json:"packaging"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// UsageConversionHandler は /api/usage/conversion?from=&to= の GET で
+// 期間内の USAGE の換算結果を返します。all=1 が無ければ換算できなかった行のみです。
+func UsageConversionHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, q, errMsg, code := parseParams(r)
+	if errMsg != "" {
+		http.Error(w, errMsg, code)
+		return
+	}
+	details, err := fetchUsageDetails(from, to, q)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	all := q.Get("all") == "1"
+	out := make([]ConversionRow, 0)
+	for _, d := range details {
+		if !all && d.Conversion == "" {
+			continue
+		}
+		out = append(out, ConversionRow{
+			Date: d.Date, JAN: d.JAN, YJ: d.YJ, ProductName: d.ProductName,
+			RawQuantity: d.RawQuantity, RawUnit: d.RawUnit,
+			Quantity: d.Quantity, Unit: d.Unit, Packages: d.Count,
+			Packaging: d.Packaging, Reason: d.Conversion,
+		})
+	}
+	writeJSON(w, out)
+}
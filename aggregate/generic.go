@@ -0,0 +1,357 @@
+package aggregate
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"YAMATO/usage"
+)
+
+// 同一成分のまとめ方
+const (
+	GroupByIppan = "ippan" // 一般名 (JC024)
+	GroupByYJ9   = "yj9"   // YJ コード先頭９桁（成分・剤形・規格）
+)
+
+// 先発・後発の区分
+const (
+	KindBrand   = "先発"
+	KindGeneric = "後発"
+	KindAG      = "AG"
+)
+
+// kindOrder は区分の並び順です（先発、AG、後発、不明）。
+var kindOrder = map[string]int{KindBrand: 0, KindAG: 1, KindGeneric: 2, "": 3}
+
+// Substitute は欠品品目の代替候補（同じまとまりで在庫のある品目）です。
+type Substitute struct {
+	YJ           string  `json:"yj"`
+	ProductName  string  `json:"productName"`
+	Spec         string  `json:"spec"`
+	Kind         string  `json:"kind"`
+	Stock        float64 `json:"stock"`
+	BaseUnit     string  `json:"baseUnit"`
+	SameStrength bool    `json:"sameStrength"` // 規格容量が同じ（規格容量の無い品目は YJ 先頭９桁で比べる）
+}
+
+// GenericMember は同一成分のまとまりに属する１品目（YJ）です。
+// 在庫台帳の基本単位が複数ある品目は、単位ごとに別の行になります。
+type GenericMember struct {
+	YJ          string       `json:"yj"`
+	ProductName string       `json:"productName"`
+	Spec        string       `json:"spec"` // 規格容量 (JC020)
+	Kind        string       `json:"kind"` // 先発・後発・AG
+	BaseUnit    string       `json:"baseUnit"`
+	Stock       float64      `json:"stock"`    // to 時点の残高
+	Usage       float64      `json:"usage"`    // 期間の処方量
+	InLedger    bool         `json:"inLedger"` // 在庫台帳がある（無ければマスターにあるだけの品目）
+	OutOfStock  bool         `json:"outOfStock"`
+	Substitutes []Substitute `json:"substitutes,omitempty"`
+}
+
+// GenericTotal はまとまりの基本単位ごとの合計です。
+type GenericTotal struct {
+	BaseUnit string  `json:"baseUnit"`
+	Stock    float64 `json:"stock"`
+	Usage    float64 `json:"usage"`
+}
+
+// GenericGroup は一般名または YJ 先頭９桁でまとめた先発・後発・AG です。
+type GenericGroup struct {
+	Key     string          `json:"key"`
+	Name    string          `json:"name"` // 一般名（無ければ代表品目名）
+	Members []GenericMember `json:"members"`
+	Totals  []GenericTotal  `json:"totals"`
+}
+
+// genericMaster は YJ の一般名・規格と先発・後発の区分です。
+type genericMaster struct {
+	YJ       string
+	Name     string
+	Ippan    string
+	Spec     string
+	Kind     string
+	BaseUnit string
+}
+
+// flagSet はマスターの区分値が設定されているかを返します（空・"0" は未設定）。
+func flagSet(s string) bool {
+	s = strings.TrimSpace(s)
+	return s != "" && s != "0"
+}
+
+// kindOf は後発品・先発品（後発品のある）・AG の区分値から区分を返します。
+func kindOf(kouhatsu, senpatsu, ag string) string {
+	switch {
+	case flagSet(ag):
+		return KindAG
+	case flagSet(kouhatsu):
+		return KindGeneric
+	case flagSet(senpatsu):
+		return KindBrand
+	}
+	return ""
+}
+
+// loadGenericMasters は全 YJ の一般名・規格・区分を１回のクエリで読み込みます。
+// YJ ごとに、一般名のある MA0、JCSHMS、一般名の無い MA0 の順で最初の行を使います。
+func loadGenericMasters() (map[string]genericMaster, error) {
+	rows, err := DB.Query(`
+SELECT yj, name, ippan, spec, kouhatsu, senpatsu, ag, unit FROM (
+  SELECT MA009JC009YJCode AS yj, COALESCE(MA018JC018ShouhinMei, '') AS name,
+         COALESCE(MA024JC024IppanMeishou, '') AS ippan, COALESCE(MA020JC020KikakuYouryou, '') AS spec,
+         COALESCE(MA075JC075Kouhatsuhin, '') AS kouhatsu,
+         COALESCE(MA083JC083KouhatsuhinNoAruSenpatsuhinKubun, '') AS senpatsu,
+         COALESCE(MA084JC084AuthorizedGeneric, '') AS ag, COALESCE(MA039JC039HousouTaniTani, '') AS unit,
+         CASE WHEN COALESCE(MA024JC024IppanMeishou, '') <> '' THEN 0 ELSE 2 END AS pri
+    FROM ma0 WHERE COALESCE(MA009JC009YJCode, '') <> ''
+  UNION ALL
+  SELECT JC009YJCode, COALESCE(JC018ShouhinMei, ''),
+         COALESCE(JC024IppanMeishou, ''), COALESCE(JC020KikakuYouryou, ''),
+         COALESCE(JC075Kouhatsuhin, ''), COALESCE(JC083KouhatsuhinNoAruSenpatsuhinKubun, ''),
+         COALESCE(JC084AuthorizedGeneric, ''), COALESCE(JC039HousouTaniTani, ''), 1
+    FROM jcshms WHERE COALESCE(JC009YJCode, '') <> ''
+)
+ORDER BY yj, pri`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]genericMaster)
+	for rows.Next() {
+		var m genericMaster
+		var kouhatsu, senpatsu, ag string
+		if err := rows.Scan(&m.YJ, &m.Name, &m.Ippan, &m.Spec, &kouhatsu, &senpatsu, &ag, &m.BaseUnit); err != nil {
+			return nil, err
+		}
+		if _, ok := out[m.YJ]; ok {
+			continue
+		}
+		m.Kind = kindOf(kouhatsu, senpatsu, ag)
+		if nm := usage.GetTaniName(m.BaseUnit); nm != "" {
+			m.BaseUnit = nm
+		}
+		out[m.YJ] = m
+	}
+	return out, rows.Err()
+}
+
+// key は by でのまとまりのキーです。一般名の無い品目は YJ 先頭９桁でまとめます。
+func (m genericMaster) key(by string) string {
+	if by == GroupByIppan && m.Ippan != "" {
+		return m.Ippan
+	}
+	return yj9(m.YJ)
+}
+
+// yj9 は YJ コードの先頭９桁です（MA2 発番など 12 桁でないものはそのまま）。
+func yj9(yj string) string {
+	if len(yj) == 12 {
+		return yj[:9]
+	}
+	return yj
+}
+
+// BuildGenericGroups は MA0・JCSHMS の品目を一般名（by=ippan）または YJ 先頭９桁（by=yj9）で
+// まとめ、from～to の在庫台帳のある品目のまとまりについて、品目ごとの在庫・処方量、
+// 基本単位ごとの合計と、欠品品目の代替候補を返します。
+// 商品名フィルタ（filter）はまとまり単位で適用し、代替候補は絞り込まずに探します。
+func BuildGenericGroups(from, to, by string, q url.Values) ([]GenericGroup, error) {
+	filter := q.Get("filter")
+	all := url.Values{}
+	for k, v := range q {
+		if k != "filter" {
+			all[k] = v
+		}
+	}
+	ledger, err := BuildLedger(from, to, all)
+	if err != nil {
+		return nil, err
+	}
+
+	masters, err := loadGenericMasters()
+	if err != nil {
+		return nil, err
+	}
+
+	// 台帳のある品目を基本単位ごとの行にし、そのまとまりを決める
+	groups := make(map[string]*GenericGroup)
+	inLedger := make(map[string]bool)
+	for yj, lr := range ledger {
+		gm, ok := masters[yj]
+		if !ok {
+			gm = genericMaster{YJ: yj}
+		}
+		key := gm.key(by)
+		g, ok := groups[key]
+		if !ok {
+			g = &GenericGroup{Key: key, Name: gm.Ippan}
+			groups[key] = g
+		}
+		inLedger[yj] = true
+
+		byUnit := make(map[string]*GenericMember)
+		var units []string
+		for _, lg := range lr.Groups {
+			m, ok := byUnit[lg.BaseUnit]
+			if !ok {
+				m = &GenericMember{YJ: yj, ProductName: lr.ProductName, Spec: gm.Spec, Kind: gm.Kind,
+					BaseUnit: lg.BaseUnit, InLedger: true}
+				byUnit[lg.BaseUnit] = m
+				units = append(units, lg.BaseUnit)
+			}
+			m.Stock += lg.Closing
+			for _, row := range lg.Rows {
+				if row.Type == "処方" {
+					m.Usage -= row.Delta
+				}
+			}
+		}
+		sort.Strings(units)
+		for _, u := range units {
+			m := byUnit[u]
+			m.OutOfStock = m.Stock <= 0
+			g.Members = append(g.Members, *m)
+		}
+	}
+
+	// 同じまとまりでマスターにある他の品目も、在庫 0 の行として加える
+	for yj, gm := range masters {
+		if inLedger[yj] {
+			continue
+		}
+		if g, ok := groups[gm.key(by)]; ok {
+			g.Members = append(g.Members, GenericMember{
+				YJ: yj, ProductName: gm.Name, Spec: gm.Spec, Kind: gm.Kind, BaseUnit: gm.BaseUnit,
+			})
+			if g.Name == "" {
+				g.Name = gm.Ippan
+			}
+		}
+	}
+
+	out := make([]GenericGroup, 0, len(groups))
+	for _, g := range groups {
+		if filter != "" && !g.matches(filter) {
+			continue
+		}
+		sort.Slice(g.Members, func(i, j int) bool {
+			a, b := g.Members[i], g.Members[j]
+			if kindOrder[a.Kind] != kindOrder[b.Kind] {
+				return kindOrder[a.Kind] < kindOrder[b.Kind]
+			}
+			if a.ProductName != b.ProductName {
+				return a.ProductName < b.ProductName
+			}
+			if a.YJ != b.YJ {
+				return a.YJ < b.YJ
+			}
+			return a.BaseUnit < b.BaseUnit
+		})
+		if g.Name == "" && len(g.Members) > 0 {
+			g.Name = g.Members[0].ProductName
+		}
+		g.fillSubstitutes()
+		g.fillTotals()
+		out = append(out, *g)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out, nil
+}
+
+// matches はまとまりの名称か品目名に s を含むかを返します。
+func (g *GenericGroup) matches(s string) bool {
+	if strings.Contains(g.Name, s) {
+		return true
+	}
+	for _, m := range g.Members {
+		if strings.Contains(m.ProductName, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameStrength は２品目の規格容量が同じかを返します。
+// YJ 先頭９桁でまとめたときも規格容量で比べ、規格容量の無い品目だけ YJ 先頭９桁で比べます。
+func sameStrength(a, b GenericMember) bool {
+	if a.Spec == "" || b.Spec == "" {
+		return yj9(a.YJ) == yj9(b.YJ)
+	}
+	norm := func(s string) string { return strings.Join(strings.Fields(s), "") }
+	return norm(a.Spec) == norm(b.Spec)
+}
+
+// fillSubstitutes は欠品品目に、同じまとまりで在庫のある品目を同規格・在庫の多い順に付けます。
+func (g *GenericGroup) fillSubstitutes() {
+	for i := range g.Members {
+		m := &g.Members[i]
+		if !m.OutOfStock {
+			continue
+		}
+		for _, o := range g.Members {
+			if o.YJ == m.YJ || o.Stock <= 0 {
+				continue
+			}
+			m.Substitutes = append(m.Substitutes, Substitute{
+				YJ: o.YJ, ProductName: o.ProductName, Spec: o.Spec, Kind: o.Kind,
+				Stock: o.Stock, BaseUnit: o.BaseUnit, SameStrength: sameStrength(*m, o),
+			})
+		}
+		sort.SliceStable(m.Substitutes, func(a, b int) bool {
+			x, y := m.Substitutes[a], m.Substitutes[b]
+			if x.SameStrength != y.SameStrength {
+				return x.SameStrength
+			}
+			return x.Stock > y.Stock
+		})
+	}
+}
+
+// fillTotals は基本単位ごとに在庫・処方量を合計します（単位の異なる品目は合算しません）。
+// 台帳の無い品目は合計に含めません。
+func (g *GenericGroup) fillTotals() {
+	idx := make(map[string]int)
+	for _, m := range g.Members {
+		if !m.InLedger {
+			continue
+		}
+		i, ok := idx[m.BaseUnit]
+		if !ok {
+			i = len(g.Totals)
+			idx[m.BaseUnit] = i
+			g.Totals = append(g.Totals, GenericTotal{BaseUnit: m.BaseUnit})
+		}
+		g.Totals[i].Stock += m.Stock
+		g.Totals[i].Usage += m.Usage
+	}
+}
+
+// genericHandler は /aggregate?mode=generic&group=ippan|yj9 の処理です
+func genericHandler(w http.ResponseWriter, from, to string, q url.Values) {
+	by := q.Get("group")
+	switch by {
+	case "":
+		by = GroupByIppan
+	case GroupByIppan, GroupByYJ9:
+	default:
+		http.Error(w, "group は ippan または yj9 です", http.StatusBadRequest)
+		return
+	}
+	resp, err := BuildGenericGroups(from, to, by, q)
+	if err != nil {
+		log.Printf("[AGGREGATE] BuildGenericGroups error: %v", err)
+		http.Error(w, "Generic grouping error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[AGGREGATE] generic %d groups", len(resp))
+	writeJSON(w, resp)
+}
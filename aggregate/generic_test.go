@@ -0,0 +1,148 @@
+package aggregate
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+	"testing"
+
+	"YAMATO/ma0"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestFillSubstitutesSameStrength(t *testing.T) {
+	// YJ 先頭９桁でまとめても、規格容量が違えば規格違いとする
+	g := GenericGroup{Members: []GenericMember{
+		{YJ: "217102201011", Spec: "5mg1錠", BaseUnit: "錠", InLedger: true, OutOfStock: true},
+		{YJ: "217102201021", Spec: "5mg 1錠", BaseUnit: "錠", InLedger: true, Stock: 10},
+		{YJ: "217102201031", Spec: "10mg1錠", BaseUnit: "錠", InLedger: true, Stock: 50},
+		{YJ: "217102201041", BaseUnit: "錠", InLedger: true, Stock: 5},
+		{YJ: "217102201051", Spec: "5mg1錠", BaseUnit: "錠"},
+	}}
+	g.fillSubstitutes()
+	subs := g.Members[0].Substitutes
+	want := []struct {
+		yj   string
+		same bool
+	}{
+		{"217102201021", true},  // 空白の違いは無視する
+		{"217102201041", true},  // 規格容量の無い品目は YJ 先頭９桁で比べる
+		{"217102201031", false}, // 在庫が多くても規格違いは後
+	}
+	if len(subs) != len(want) {
+		t.Fatalf("substitutes = %+v", subs)
+	}
+	for i, w := range want {
+		if subs[i].YJ != w.yj || subs[i].SameStrength != w.same {
+			t.Errorf("substitute %d = %s same=%v, want %s same=%v", i, subs[i].YJ, subs[i].SameStrength, w.yj, w.same)
+		}
+	}
+}
+
+func TestBuildGenericGroups(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if err := ma0.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	SetDB(db)
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const ippan = "アムロジピンベシル酸塩錠"
+	// kind は後発品（MA075）か、後発品のある先発品（MA083）か
+	item := func(jan, yj, name, spec, unit, kind string) {
+		var kouhatsu, senpatsu string
+		if kind == KindGeneric {
+			kouhatsu = "1"
+		} else {
+			senpatsu = "1"
+		}
+		exec(`
+INSERT INTO ma0 (MA000JC000JanCode, MA009JC009YJCode, MA018JC018ShouhinMei, MA020JC020KikakuYouryou, MA024JC024IppanMeishou,
+                 MA039JC039HousouTaniTani, MA044JC044HousouSouryouSuuchi, MA075JC075Kouhatsuhin, MA083JC083KouhatsuhinNoAruSenpatsuhinKubun)
+VALUES (?, ?, ?, ?, ?, ?, '100', ?, ?)`, jan, yj, name, spec, ippan, unit, kouhatsu, senpatsu)
+	}
+	count := func(date, jan, yj, name, qty, unit string) {
+		exec(`
+INSERT INTO inventory (invDate, invYjCode, invJanCode, invProductName, invJanHousouSuuryouNumber, qty,
+                       HousouTaniUnit, InvHousouTaniUnit, janqty, JanHousouSuuryouUnit, InvJanHousouSuuryouUnit)
+VALUES (?, ?, ?, ?, 1, ?, ?, ?, 0, '', '')`, date, yj, jan, name, qty, unit, unit)
+	}
+	item("4987000000011", "217102201011", "先発錠5mg", "5mg1錠", "錠", KindBrand)
+	item("4987000000012", "217102201011", "先発錠5mg", "5mg1錠", "包", KindBrand)
+	item("4987000000021", "217102202011", "後発錠5mg", "5mg1錠", "錠", KindGeneric)
+	item("4987000000031", "217102203011", "後発錠10mg", "10mg1錠", "錠", KindGeneric)
+	count("20250401", "4987000000011", "217102201011", "先発錠5mg", "100", "錠")
+	count("20250401", "4987000000012", "217102201011", "先発錠5mg", "3", "包")
+	count("20250401", "4987000000021", "217102202011", "後発錠5mg", "20", "錠")
+	count("20250410", "4987000000021", "217102202011", "後発錠5mg", "0", "錠")
+	count("20250401", "4987000000031", "217102203011", "後発錠10mg", "50", "錠")
+	// 台帳の無い同成分品はマスター（JCSHMS）から加える
+	exec(`
+INSERT INTO jcshms (JC000JanCode, JC009YJCode, JC018ShouhinMei, JC020KikakuYouryou, JC024IppanMeishou, JC039HousouTaniTani, JC075Kouhatsuhin)
+VALUES ('4987000000041', '217102204011', '後発OD錠5mg', '5mg1錠', ?, '錠', '1')`, ippan)
+
+	groups, err := BuildGenericGroups("20250401", "20250430", GroupByIppan, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Key != ippan {
+		t.Fatalf("groups = %+v", groups)
+	}
+	g := groups[0]
+	type member struct {
+		yj, unit   string
+		stock      float64
+		inLedger   bool
+		outOfStock bool
+	}
+	want := []member{
+		{"217102201011", "包", 3, true, false},
+		{"217102201011", "錠", 100, true, false},
+		{"217102204011", "錠", 0, false, false},
+		{"217102203011", "錠", 50, true, false},
+		{"217102202011", "錠", 0, true, true},
+	}
+	if len(g.Members) != len(want) {
+		t.Fatalf("members = %+v", g.Members)
+	}
+	for i, w := range want {
+		m := g.Members[i]
+		got := member{m.YJ, m.BaseUnit, m.Stock, m.InLedger, m.OutOfStock}
+		if got != w {
+			t.Errorf("member %d = %+v, want %+v", i, got, w)
+		}
+	}
+
+	// 単位の違う在庫は合算しない
+	totals := map[string]float64{}
+	for _, tot := range g.Totals {
+		totals[tot.BaseUnit] = tot.Stock
+	}
+	if len(totals) != 2 || totals["錠"] != 150 || totals["包"] != 3 {
+		t.Errorf("totals = %+v", g.Totals)
+	}
+
+	subs := g.Members[4].Substitutes
+	if len(subs) != 3 || subs[0].YJ != "217102201011" || subs[0].BaseUnit != "錠" || !subs[0].SameStrength ||
+		subs[len(subs)-1].YJ != "217102203011" || subs[len(subs)-1].SameStrength {
+		t.Errorf("substitutes = %+v", subs)
+	}
+}
@@ -0,0 +1,254 @@
+package aggregate
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"YAMATO/unitconv"
+)
+
+// LedgerRow は台帳モードの明細行（移動量と残高付き）
+type LedgerRow struct {
+	Detail
+	Delta   float64 `json:"delta"`   // 基本単位での増減
+	Balance float64 `json:"balance"` // この行を反映した後の残高
+}
+
+// LedgerGroup は包装分類キー単位の在庫台帳
+type LedgerGroup struct {
+	BaseUnit    string      `json:"baseUnit"`    // 基本単位（包装単位名称）
+	OpeningDate string      `json:"openingDate"` // 起点とした棚卸日（無ければ空）
+	Opening     float64     `json:"opening"`     // from 開始時点の残高
+	Rows        []LedgerRow `json:"rows"`
+	Closing     float64     `json:"closing"` // to 終了時点の残高
+
+	// 基本単位に換算できず残高に含めなかった明細（理由は Conversion）
+	Excluded []Detail `json:"excluded,omitempty"`
+}
+
+// LedgerResult は YJ コード単位の台帳まとめ
+type LedgerResult struct {
+	ProductName string                 `json:"productName"`
+	Groups      map[string]LedgerGroup `json:"groups"`
+}
+
+// 棚卸はその日の業務開始前の実数とみなします。
+// 同日の納品・処方などは棚卸の後に反映されるため、並び順でも棚卸を先頭にします。
+const typeInventory = "棚卸"
+
+// ledgerSign は明細種別ごとの在庫増減の向きを返します。
+func ledgerSign(typ string) float64 {
+	switch typ {
+	case "納品", "入庫":
+		return 1
+	case "返品", "処方", "出庫":
+		return -1
+	}
+	return 0
+}
+
+// parseQty は数量文字列を float64 に変換します（空・不正値は 0）。
+func parseQty(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// ledgerStartDate は from 以前の最新棚卸日（JAN ごと）のうち最も古い日付を返します。
+// 棚卸が無い場合は from をそのまま返します。
+func ledgerStartDate(from string) (string, error) {
+	var start sql.NullString
+	err := DB.QueryRow(`
+SELECT MIN(d) FROM (
+  SELECT MAX(invDate) AS d FROM inventory WHERE invDate <= ? GROUP BY invJanCode
+)`, from).Scan(&start)
+	if err != nil {
+		return "", err
+	}
+	if !start.Valid || start.String == "" || start.String > from {
+		return from, nil
+	}
+	return start.String, nil
+}
+
+// fetchAllDetails は DAT・USAGE・棚卸・IOD の明細をまとめて取得します。
+func fetchAllDetails(from, to string, q url.Values) ([]Detail, error) {
+	dats, err := fetchDatDetails(from, to, q)
+	if err != nil {
+		return nil, err
+	}
+	usgs, err := fetchUsageDetails(from, to, q)
+	if err != nil {
+		return nil, err
+	}
+	invs, err := fetchInvDetails(from, to, q)
+	if err != nil {
+		return nil, err
+	}
+	iods, err := fetchIodDetails(from, to, q)
+	if err != nil {
+		return nil, err
+	}
+	all := append([]Detail{}, dats...)
+	all = append(all, usgs...)
+	all = append(all, invs...)
+	all = append(all, iods...)
+	return all, nil
+}
+
+// sortLedger は日付順、同日内は棚卸を先頭に並べます。
+func sortLedger(list []Detail) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Date != list[j].Date {
+			return list[i].Date < list[j].Date
+		}
+		return list[i].Type == typeInventory && list[j].Type != typeInventory
+	})
+}
+
+// buildLedgerGroup は１包装分類分の明細から台帳を組み立てます。
+// list は sortLedger 済みで、from より前の明細を含んでいてもかまいません。
+// 残高は JAN ごとに持ち、棚卸はその日に数えた JAN の残高だけを実数に合わせます（数えていない JAN は
+// 在庫ゼロとみなさない）。起点の棚卸も JAN ごとに from 以前の最新の棚卸とし、JAN の無い明細は
+// 包装分類の最新の起点棚卸から数えます。
+// sinceStart が true の場合、from 以前に棚卸の無い JAN は list の先頭（履歴の始め）から積み上げます。
+// 数量はすべて convertLedger で基本単位に換算し、換算できない明細は Excluded に回します。
+func buildLedgerGroup(list []Detail, from string, sinceStart bool) LedgerGroup {
+	var g LedgerGroup
+	if len(list) > 0 {
+		g.BaseUnit = list[0].HU
+	}
+
+	converted := make([]Detail, 0, len(list))
+	qty := make([]float64, 0, len(list))
+	for _, d := range list {
+		c := convertLedger(d)
+		if !c.OK {
+			d.Conversion = c.Reason
+			g.Excluded = append(g.Excluded, d)
+			continue
+		}
+		d.Quantity = unitconv.Format(c.BaseAmount)
+		d.Unit = c.BaseUnit
+		converted = append(converted, d)
+		qty = append(qty, c.BaseAmount)
+	}
+	list = converted
+
+	// JAN ごとの起点棚卸（from 以前の最新の棚卸日）
+	opening := make(map[string]string)
+	for _, d := range list {
+		if d.Type == typeInventory && d.Date <= from {
+			opening[d.JAN] = d.Date
+			g.OpeningDate = max(g.OpeningDate, d.Date)
+		}
+	}
+	if _, ok := opening[""]; !ok {
+		opening[""] = g.OpeningDate
+	}
+
+	var balance float64
+	held := make(map[string]float64) // JAN ごとの残高
+	for i, d := range list {
+		// 起点棚卸より前、または起点棚卸が無い場合の from より前の明細は使わない
+		start := opening[d.JAN]
+		if start != "" && d.Date < start {
+			continue
+		}
+		if start == "" && d.Date < from && !sinceStart {
+			continue
+		}
+		var delta float64
+		if d.Type == typeInventory {
+			// JAN の無い明細の増減は、どの JAN のものか分からないため棚卸で打ち消す
+			delta = qty[i] - held[d.JAN] - held[""]
+			held[d.JAN], held[""] = qty[i], 0
+		} else {
+			delta = ledgerSign(d.Type) * qty[i]
+			held[d.JAN] += delta
+		}
+
+		// from 当日の起点棚卸は期首残高として扱う
+		if d.Date < from || (d.Type == typeInventory && d.Date == start) {
+			balance += delta
+			continue
+		}
+		if len(g.Rows) == 0 {
+			g.Opening = balance
+		}
+		balance += delta
+		g.Rows = append(g.Rows, LedgerRow{Detail: d, Delta: delta, Balance: balance})
+	}
+	if len(g.Rows) == 0 {
+		g.Opening = balance
+	}
+	g.Closing = balance
+	return g
+}
+
+// BuildLedger は from 以前の最新棚卸を起点に、from～to の在庫台帳を
+// YJ→PackagingKey 単位で組み立てます。数量はすべて包装単位（基本単位）に換算します。
+func BuildLedger(from, to string, q url.Values) (map[string]LedgerResult, error) {
+	return buildLedger(from, to, q, false)
+}
+
+// buildLedger は BuildLedger の本体です。
+// excludeFromInv が true の場合は from 当日の棚卸を除外し、それより前の棚卸を起点にします。
+// その際、前回の棚卸が無い包装分類は履歴の始めからの移動を積み上げます（棚卸差異用）。
+func buildLedger(from, to string, q url.Values, excludeFromInv bool) (map[string]LedgerResult, error) {
+	start := ""
+	if !excludeFromInv {
+		var err error
+		if start, err = ledgerStartDate(from); err != nil {
+			return nil, err
+		}
+	}
+	fetched, err := fetchAllDetails(start, to, q)
+	if err != nil {
+		return nil, err
+	}
+	all := fetched[:0]
+	for _, d := range fetched {
+		if excludeFromInv && d.Type == typeInventory && d.Date == from {
+			continue
+		}
+		all = append(all, d)
+	}
+
+	resp := make(map[string]LedgerResult)
+	for yj, res := range groupDetails(all) {
+		lr := LedgerResult{ProductName: res.ProductName, Groups: make(map[string]LedgerGroup, len(res.Groups))}
+		for pk, list := range res.Groups {
+			sortLedger(list)
+			g := buildLedgerGroup(list, from, excludeFromInv)
+			// 期間内に動きも残高も換算できない明細も無いものは省く
+			if len(g.Rows) == 0 && g.Closing == 0 && len(g.Excluded) == 0 {
+				continue
+			}
+			lr.Groups[pk] = g
+		}
+		if len(lr.Groups) > 0 {
+			resp[yj] = lr
+		}
+	}
+	return resp, nil
+}
+
+// ledgerHandler は /aggregate?mode=ledger の処理です
+func ledgerHandler(w http.ResponseWriter, from, to string, q url.Values) {
+	resp, err := BuildLedger(from, to, q)
+	if err != nil {
+		log.Printf("[AGGREGATE] BuildLedger error: %v", err)
+		http.Error(w, "Ledger error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[AGGREGATE] ledger %d products", len(resp))
+	writeJSON(w, resp)
+}
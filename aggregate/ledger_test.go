@@ -0,0 +1,160 @@
+package aggregate
+
+import "testing"
+
+// 100錠包装の錠剤
+func tablet(typ, date string) Detail {
+	return Detail{Type: typ, Date: date, HU: "錠", HS: "100", JAN: "4987000000001"}
+}
+
+func dat(typ, date, packs string) Detail {
+	d := tablet(typ, date)
+	d.RawCount = packs
+	return d
+}
+
+func rx(date, qty, unit string) Detail {
+	d := tablet("処方", date)
+	d.RawQuantity, d.RawUnit = qty, unit
+	return d
+}
+
+func inv(date, qty string) Detail {
+	d := tablet(typeInventory, date)
+	d.Quantity, d.Unit = qty, "錠"
+	return d
+}
+
+// jan2 は同じ包装分類の別の JAN の明細にします。
+func jan2(d Detail) Detail {
+	d.JAN = "4987000000002"
+	return d
+}
+
+func TestBuildLedgerGroup(t *testing.T) {
+	tests := []struct {
+		name        string
+		from        string
+		list        []Detail
+		openingDate string
+		opening     float64
+		deltas      []float64
+		closing     float64
+		excluded    int
+	}{
+		{
+			name:    "納品は包装数×包装総量で増え、返品・処方で減る",
+			from:    "20250401",
+			list:    []Detail{dat("納品", "20250401", "2"), rx("20250402", "30", "錠"), dat("返品", "20250403", "1")},
+			deltas:  []float64{200, -30, -100},
+			closing: 70,
+		},
+		{
+			name:    "同日の棚卸は納品・処方より先に反映する",
+			from:    "20250401",
+			list:    []Detail{dat("納品", "20250405", "1"), rx("20250405", "10", "錠"), inv("20250405", "50")},
+			deltas:  []float64{50, 100, -10},
+			closing: 140,
+		},
+		{
+			name:        "from 以前の最新棚卸を起点に期首残高を求める",
+			from:        "20250410",
+			list:        []Detail{inv("20250401", "500"), rx("20250402", "100", "錠"), inv("20250405", "300"), rx("20250406", "20", "錠"), rx("20250410", "5", "錠")},
+			openingDate: "20250405",
+			opening:     280,
+			deltas:      []float64{-5},
+			closing:     275,
+		},
+		{
+			name:        "from 当日の棚卸は期首残高として扱う",
+			from:        "20250410",
+			list:        []Detail{inv("20250410", "40"), rx("20250410", "5", "錠")},
+			openingDate: "20250410",
+			opening:     40,
+			deltas:      []float64{-5},
+			closing:     35,
+		},
+		{
+			name: "棚卸は数えた JAN だけを実数に合わせ、数えていない JAN の在庫は残す",
+			from: "20250401",
+			list: []Detail{dat("納品", "20250401", "2"), jan2(dat("納品", "20250401", "1")), inv("20250403", "150"),
+				jan2(rx("20250404", "30", "錠"))},
+			deltas:  []float64{200, 100, -50, -30},
+			closing: 220,
+		},
+		{
+			name: "起点棚卸は JAN ごとに from 以前の最新の棚卸",
+			from: "20250410",
+			list: []Detail{inv("20250401", "100"), rx("20250402", "10", "錠"), jan2(inv("20250405", "50")),
+				jan2(rx("20250410", "5", "錠"))},
+			openingDate: "20250405",
+			opening:     140,
+			deltas:      []float64{-5},
+			closing:     135,
+		},
+		{
+			name:     "換算できない単位の処方は残高に含めず Excluded に回す",
+			from:     "20250401",
+			list:     []Detail{dat("納品", "20250401", "1"), rx("20250402", "3", "mL"), rx("20250403", "10", "錠")},
+			deltas:   []float64{100, -10},
+			closing:  90,
+			excluded: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := append([]Detail{}, tt.list...)
+			sortLedger(list)
+			g := buildLedgerGroup(list, tt.from, false)
+			if g.OpeningDate != tt.openingDate {
+				t.Errorf("OpeningDate = %q, want %q", g.OpeningDate, tt.openingDate)
+			}
+			if g.Opening != tt.opening {
+				t.Errorf("Opening = %v, want %v", g.Opening, tt.opening)
+			}
+			if len(g.Rows) != len(tt.deltas) {
+				t.Fatalf("rows = %d, want %d (%+v)", len(g.Rows), len(tt.deltas), g.Rows)
+			}
+			for i, want := range tt.deltas {
+				if g.Rows[i].Delta != want {
+					t.Errorf("row %d (%s) delta = %v, want %v", i, g.Rows[i].Type, g.Rows[i].Delta, want)
+				}
+			}
+			if g.Closing != tt.closing {
+				t.Errorf("Closing = %v, want %v", g.Closing, tt.closing)
+			}
+			if len(g.Excluded) != tt.excluded {
+				t.Errorf("Excluded = %d, want %d", len(g.Excluded), tt.excluded)
+			}
+			for _, d := range g.Excluded {
+				if d.Conversion == "" {
+					t.Errorf("excluded row %s has no reason", d.Date)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildLedgerGroupUnknownPackSize(t *testing.T) {
+	d := dat("納品", "20250401", "3")
+	d.HS = ""
+	g := buildLedgerGroup([]Detail{d}, "20250401", false)
+	if len(g.Rows) != 0 || len(g.Excluded) != 1 || g.Closing != 0 {
+		t.Fatalf("got rows=%d excluded=%d closing=%v, want 0/1/0", len(g.Rows), len(g.Excluded), g.Closing)
+	}
+}
+
+func TestBuildLedgerGroupSinceStart(t *testing.T) {
+	// 前回棚卸の無い品目の初回棚卸: 履歴の始めからの移動を理論在庫に積み上げる
+	list := []Detail{dat("納品", "20250301", "3"), rx("20250315", "120", "錠"), rx("20250401", "5", "錠")}
+	sortLedger(list)
+
+	g := buildLedgerGroup(list, "20250401", true)
+	if g.OpeningDate != "" || g.Opening != 180 || g.Closing != 175 {
+		t.Errorf("sinceStart: openingDate=%q opening=%v closing=%v, want \"\"/180/175", g.OpeningDate, g.Opening, g.Closing)
+	}
+	g = buildLedgerGroup(list, "20250401", false)
+	if g.Opening != 0 || g.Closing != -5 {
+		t.Errorf("ledger: opening=%v closing=%v, want 0/-5", g.Opening, g.Closing)
+	}
+}
@@ -0,0 +1,399 @@
+package aggregate
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"YAMATO/usage"
+	"YAMATO/yakka"
+)
+
+// 仕入単価の求め方
+const (
+	CostLast    = "last"    // 棚卸日以前の最終仕入単価
+	CostAverage = "average" // 移動平均単価（納品ごとに在庫と平均し、返品・処方で在庫を減らし、棚卸で在庫を合わせる）
+)
+
+// ValuationRow は棚卸１行（JAN）の評価額です。
+type ValuationRow struct {
+	JAN         string  `json:"jan"`
+	YJ          string  `json:"yj"`
+	ProductName string  `json:"productName"`
+	YakkouCode  string  `json:"yakkouCode"` // 薬効分類 (JC010)
+	OroshiCode  string  `json:"oroshiCode"` // 最終仕入の卸
+	OroshiName  string  `json:"oroshiName"`
+	Qty         float64 `json:"qty"`      // 在庫数（包装単位）
+	BaseUnit    string  `json:"baseUnit"` // 包装単位
+	UnitYakka   float64 `json:"unitYakka"`
+	YakkaValue  float64 `json:"yakkaValue"`
+	UnitCost    float64 `json:"unitCost"` // 包装単位あたりの仕入単価
+	CostValue   float64 `json:"costValue"`
+	NoYakka     bool    `json:"noYakka"` // 薬価が無い
+	NoCost      bool    `json:"noCost"`  // 棚卸日以前の仕入が無い
+}
+
+// ValuationTotal は分類ごとの合計です。
+type ValuationTotal struct {
+	Key        string  `json:"key"`
+	Name       string  `json:"name"`
+	Items      int     `json:"items"`
+	YakkaValue float64 `json:"yakkaValue"`
+	CostValue  float64 `json:"costValue"`
+}
+
+// ValuationReport は１回の棚卸の在庫評価です。
+type ValuationReport struct {
+	Date       string           `json:"date"`
+	Method     string           `json:"method"`
+	Rows       []ValuationRow   `json:"rows"`
+	ByYakkou   []ValuationTotal `json:"byYakkou"`
+	ByOroshi   []ValuationTotal `json:"byOroshi"`
+	YakkaValue float64          `json:"yakkaValue"`
+	CostValue  float64          `json:"costValue"`
+	NoCost     int              `json:"noCost"` // 仕入単価が求まらなかった行数
+}
+
+func round2(v float64) float64 { return math.Round(v*100) / 100 }
+
+// purchase は JAN の仕入単価（１包装あたり）と最終仕入の卸です。
+type purchase struct {
+	price  float64
+	oroshi string
+}
+
+// 移動平均の計算で在庫を動かす明細の種類（同日内はこの順に反映する）
+const (
+	costInventory = iota // 棚卸: 在庫を実数（JAN包装単位）に合わせる
+	costDelivery         // 納品: 在庫と加重平均する
+	costReturn           // 返品: 平均単価のまま在庫を減らす
+	costUsage            // 処方: 平均単価のまま在庫を減らす
+)
+
+type costEvent struct {
+	date   string
+	kind   int
+	qty    float64 // 包装数
+	price  float64
+	oroshi string
+}
+
+// purchaseCosts は date に棚卸のある JAN ごとに、date 以前の DAT から仕入単価を求めます。
+// average では納品のたびに手元の在庫（包装数）と加重平均し、返品と処方（包装数に換算できたもの）で
+// 在庫を減らし、棚卸で在庫を実数に合わせます。在庫が無くなった後の納品はその単価から始めます。
+func purchaseCosts(date, method string) (map[string]purchase, error) {
+	rows, err := DB.Query(`
+SELECT DatJanCode, DatDate, DatDeliveryFlag, DatQuantity, DatUnitPrice, CurrentOroshiCode
+  FROM datrecords
+ WHERE DatJanCode IN (SELECT invJanCode FROM inventory WHERE invDate = ?)
+   AND DatDate <= ? AND DatDeliveryFlag IN ('1', '2')
+ ORDER BY DatDate, DatReceiptNumber, DatLineNumber`, date, date)
+	if err != nil {
+		return nil, err
+	}
+	events := make(map[string][]costEvent)
+	first := date
+	for rows.Next() {
+		var jan, flag, qty, unitPrice string
+		var e costEvent
+		if err := rows.Scan(&jan, &e.date, &flag, &qty, &unitPrice, &e.oroshi); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.kind, e.qty, e.price = costDelivery, parseQty(qty), parseQty(unitPrice)
+		if flag == "2" {
+			e.kind = costReturn
+		}
+		events[jan] = append(events[jan], e)
+		first = min(first, e.date)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if method == CostAverage && len(events) > 0 {
+		usages, err := fetchUsageDetails(first, date, url.Values{})
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range usages {
+			// 包装数に換算できない処方は在庫を動かさない
+			if _, ok := events[d.JAN]; ok && d.Count != "" {
+				events[d.JAN] = append(events[d.JAN], costEvent{date: d.Date, kind: costUsage, qty: parseQty(d.Count)})
+			}
+		}
+		invs, err := DB.Query(`SELECT invJanCode, invDate, janqty FROM inventory WHERE invDate BETWEEN ? AND ?`, first, date)
+		if err != nil {
+			return nil, err
+		}
+		for invs.Next() {
+			var jan string
+			e := costEvent{kind: costInventory}
+			if err := invs.Scan(&jan, &e.date, &e.qty); err != nil {
+				invs.Close()
+				return nil, err
+			}
+			if _, ok := events[jan]; ok {
+				events[jan] = append(events[jan], e)
+			}
+		}
+		invs.Close()
+		if err := invs.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make(map[string]purchase, len(events))
+	for jan, list := range events {
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].date != list[j].date {
+				return list[i].date < list[j].date
+			}
+			return list[i].kind < list[j].kind
+		})
+		var p purchase
+		var held float64
+		ok := false
+		for _, e := range list {
+			switch e.kind {
+			case costInventory:
+				held = e.qty
+			case costReturn, costUsage:
+				held = math.Max(held-e.qty, 0)
+			case costDelivery:
+				if e.price <= 0 {
+					continue
+				}
+				p.oroshi, ok = e.oroshi, true
+				if method == CostLast || held <= 0 {
+					p.price, held = e.price, held+e.qty
+					continue
+				}
+				p.price = (p.price*held + e.price*e.qty) / (held + e.qty)
+				held += e.qty
+			}
+		}
+		if ok {
+			out[jan] = p
+		}
+	}
+	return out, nil
+}
+
+// BuildValuation は date の棚卸を薬価（JC049 単位薬価、無ければ JC050 包装薬価÷包装総量）と
+// DAT の仕入単価（method: last・average）で評価し、薬効分類・卸ごとに合計します。
+// 薬価は薬価の履歴で date に適用されていたもの（履歴が無ければ MA0 の現薬価）です。
+func BuildValuation(date, method string) (ValuationReport, error) {
+	rep := ValuationReport{Date: date, Method: method}
+	rows, err := DB.Query(`
+SELECT i.invJanCode,
+       COALESCE(NULLIF(m.MA009JC009YJCode, ''), NULLIF(i.invYjCode, ''), m2.MA2YjCode, ''),
+       COALESCE(NULLIF(m.MA018JC018ShouhinMei, ''), NULLIF(i.invProductName, ''), m2.Shouhinmei, ''),
+       COALESCE(m.MA010JC010YakkouBunruiCode, ''),
+       i.qty, i.janqty,
+       COALESCE(NULLIF(m.MA039JC039HousouTaniTani, ''), m2.HousouTaniUnit, ''),
+       COALESCE(NULLIF(m.MA044JC044HousouSouryouSuuchi, ''), CAST(m2.HousouSouryouNumber AS TEXT), ''),
+       COALESCE(m.MA049JC049GenTaniYakka, ''),
+       COALESCE(m.MA050JC050GenHousouYakka, '')
+  FROM inventory i
+  LEFT JOIN ma0 m  ON i.invJanCode = m.MA000JC000JanCode
+  LEFT JOIN ma2 m2 ON i.invJanCode = m2.MA2JanCode
+ WHERE i.invDate = ?
+ ORDER BY i.invJanCode`, date)
+	if err != nil {
+		return rep, err
+	}
+	list := make([]ValuationRow, 0)
+	var perPackage, janQtys []float64
+	for rows.Next() {
+		var r ValuationRow
+		var janQty float64
+		var hs, taniYakka, housouYakka string
+		if err := rows.Scan(&r.JAN, &r.YJ, &r.ProductName, &r.YakkouCode,
+			&r.Qty, &janQty, &r.BaseUnit, &hs, &taniYakka, &housouYakka); err != nil {
+			rows.Close()
+			return rep, err
+		}
+		if nm := usage.GetTaniName(r.BaseUnit); nm != "" {
+			r.BaseUnit = nm
+		}
+		r.UnitYakka = parseQty(taniYakka)
+		if r.UnitYakka <= 0 && parseQty(hs) > 0 {
+			r.UnitYakka = parseQty(housouYakka) / parseQty(hs)
+		}
+		if p, ok, err := yakka.PriceAt(r.JAN, date); err != nil {
+			rows.Close()
+			return rep, err
+		} else if ok && p.Unit(parseQty(hs)) > 0 {
+			r.UnitYakka = p.Unit(parseQty(hs))
+		}
+		r.NoYakka = r.UnitYakka <= 0
+		r.YakkaValue = round2(r.Qty * r.UnitYakka)
+		list = append(list, r)
+		perPackage = append(perPackage, parseQty(hs))
+		janQtys = append(janQtys, janQty)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+
+	yakkou := make(map[string]*ValuationTotal)
+	oroshi := make(map[string]*ValuationTotal)
+	add := func(m map[string]*ValuationTotal, key, name string, r ValuationRow) {
+		t, ok := m[key]
+		if !ok {
+			t = &ValuationTotal{Key: key, Name: name}
+			m[key] = t
+		}
+		t.Items++
+		t.YakkaValue += r.YakkaValue
+		t.CostValue += r.CostValue
+	}
+	costs, err := purchaseCosts(date, method)
+	if err != nil {
+		return rep, err
+	}
+	for i := range list {
+		r := &list[i]
+		pc, ok := costs[r.JAN]
+		price, code := pc.price, pc.oroshi
+		r.NoCost = !ok
+		if ok {
+			// DAT の単価は１包装（JAN）あたり。包装総量が不明なら JAN包装単位の在庫数で評価する
+			if perPackage[i] > 0 {
+				r.UnitCost = price / perPackage[i]
+				r.CostValue = round2(r.Qty * r.UnitCost)
+			} else {
+				r.CostValue = round2(janQtys[i] * price)
+				if r.Qty > 0 {
+					r.UnitCost = r.CostValue / r.Qty
+				}
+			}
+			r.OroshiCode = code
+		} else {
+			rep.NoCost++
+		}
+		rep.YakkaValue += r.YakkaValue
+		rep.CostValue += r.CostValue
+		name := ""
+		if r.YakkouCode == "" {
+			name = "（薬効分類なし）"
+		}
+		add(yakkou, r.YakkouCode, name, *r)
+	}
+	names := oroshiNames(list)
+	for i := range list {
+		r := &list[i]
+		r.OroshiName = names[r.OroshiCode]
+		name := r.OroshiName
+		if r.OroshiCode == "" {
+			name = "（仕入なし）"
+		}
+		add(oroshi, r.OroshiCode, name, *r)
+	}
+
+	rep.Rows = list
+	rep.ByYakkou = sortedTotals(yakkou)
+	rep.ByOroshi = sortedTotals(oroshi)
+	rep.YakkaValue = round2(rep.YakkaValue)
+	rep.CostValue = round2(rep.CostValue)
+	return rep, nil
+}
+
+// oroshiNames は行の卸コードから卸マスターの名称を引きます。
+func oroshiNames(list []ValuationRow) map[string]string {
+	names := make(map[string]string)
+	for _, r := range list {
+		if _, done := names[r.OroshiCode]; done || r.OroshiCode == "" {
+			continue
+		}
+		var name string
+		if err := DB.QueryRow(`SELECT `+oroshiNameSQL("?"), r.OroshiCode).Scan(&name); err != nil {
+			log.Printf("[VALUATION] oroshi lookup error code=%s: %v", r.OroshiCode, err)
+		}
+		names[r.OroshiCode] = name
+	}
+	return names
+}
+
+// sortedTotals は合計をキー順に並べ、金額を丸めます。
+func sortedTotals(m map[string]*ValuationTotal) []ValuationTotal {
+	out := make([]ValuationTotal, 0, len(m))
+	for _, t := range m {
+		t.YakkaValue = round2(t.YakkaValue)
+		t.CostValue = round2(t.CostValue)
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// writeValuationCSV は評価結果を明細・薬効分類別・卸別の順に CSV で出力します。
+func writeValuationCSV(w http.ResponseWriter, rep ValuationReport) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="valuation_%s_%s.csv"`, rep.Date, rep.Method))
+	w.Write([]byte("\xEF\xBB\xBF"))
+	cw := csv.NewWriter(w)
+	f := func(v float64) string { return fmt.Sprintf("%.2f", v) }
+	cw.Write([]string{"JANコード", "YJコード", "商品名", "薬効分類", "卸コード", "卸名",
+		"在庫数", "包装単位", "単位薬価", "薬価金額", "仕入単価", "仕入金額"})
+	for _, r := range rep.Rows {
+		cost := ""
+		if !r.NoCost {
+			cost = f(r.UnitCost)
+		}
+		cw.Write([]string{r.JAN, r.YJ, r.ProductName, r.YakkouCode, r.OroshiCode, r.OroshiName,
+			fmt.Sprint(r.Qty), r.BaseUnit, f(r.UnitYakka), f(r.YakkaValue), cost, f(r.CostValue)})
+	}
+	for _, sec := range []struct {
+		title string
+		list  []ValuationTotal
+	}{{"薬効分類別", rep.ByYakkou}, {"卸別", rep.ByOroshi}} {
+		cw.Write(nil)
+		cw.Write([]string{sec.title, "名称", "品目数", "薬価金額", "仕入金額"})
+		for _, t := range sec.list {
+			cw.Write([]string{t.Key, t.Name, fmt.Sprint(t.Items), f(t.YakkaValue), f(t.CostValue)})
+		}
+	}
+	cw.Write(nil)
+	cw.Write([]string{"合計", "", "", f(rep.YakkaValue), f(rep.CostValue)})
+	cw.Flush()
+}
+
+// ValuationHandler は /api/inventory/valuation?date=YYYYMMDD&method=last|average の GET を処理します。
+// format=csv で CSV を返します。
+func ValuationHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	date := strings.ReplaceAll(q.Get("date"), "-", "")
+	if date == "" {
+		http.Error(w, "date は必須です", http.StatusBadRequest)
+		return
+	}
+	method := q.Get("method")
+	switch method {
+	case "":
+		method = CostLast
+	case CostLast, CostAverage:
+	default:
+		http.Error(w, "method は last または average です", http.StatusBadRequest)
+		return
+	}
+	rep, err := BuildValuation(date, method)
+	if err != nil {
+		log.Printf("[VALUATION] BuildValuation error: %v", err)
+		http.Error(w, "Valuation error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if q.Get("format") == "csv" {
+		writeValuationCSV(w, rep)
+		return
+	}
+	writeJSON(w, rep)
+}
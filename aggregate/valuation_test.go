@@ -0,0 +1,140 @@
+package aggregate
+
+import (
+	"database/sql"
+	"math"
+	"os"
+	"testing"
+
+	"YAMATO/ma0"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestPurchaseCosts(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if err := ma0.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	SetDB(db)
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const jan, date = "4987000000001", "20250410"
+	// 100錠包装の錠剤
+	exec(`
+INSERT INTO ma0 (MA000JC000JanCode, MA009JC009YJCode, MA018JC018ShouhinMei, MA039JC039HousouTaniTani, MA044JC044HousouSouryouSuuchi)
+VALUES (?, '1111', 'テスト錠', '錠', '100')`, jan)
+
+	type event struct {
+		date, kind, qty, price string // kind: 納品・返品・処方（錠）・棚卸（包装数）
+	}
+	tests := []struct {
+		name     string
+		events   []event
+		last     float64
+		average  float64
+		noPrices bool
+	}{
+		{
+			name:    "在庫が残ったままの再仕入は加重平均",
+			events:  []event{{"20250401", "納品", "1", "1000"}, {"20250403", "納品", "1", "1200"}},
+			last:    1200,
+			average: 1100,
+		},
+		{
+			name:    "処方で在庫が無くなった後の再仕入はその単価",
+			events:  []event{{"20250401", "納品", "1", "1000"}, {"20250402", "処方", "100", ""}, {"20250403", "納品", "1", "1200"}},
+			last:    1200,
+			average: 1200,
+		},
+		{
+			name: "処方で減った在庫と加重平均する",
+			events: []event{{"20250401", "納品", "2", "1000"}, {"20250402", "処方", "150", ""},
+				{"20250403", "納品", "1", "1300"}},
+			last:    1300,
+			average: 1200, // (1000×0.5 + 1300×1) ÷ 1.5
+		},
+		{
+			name:    "棚卸で在庫を実数に合わせる",
+			events:  []event{{"20250401", "納品", "3", "1000"}, {"20250403", "棚卸", "1", ""}, {"20250403", "納品", "1", "1200"}},
+			last:    1200,
+			average: 1100,
+		},
+		{
+			name:    "返品は平均単価のまま在庫を減らす",
+			events:  []event{{"20250401", "納品", "2", "1000"}, {"20250402", "返品", "2", "1000"}, {"20250403", "納品", "1", "1200"}},
+			last:    1200,
+			average: 1200,
+		},
+		{
+			name:     "棚卸日より後の仕入は使わない",
+			events:   []event{{"20250411", "納品", "1", "1000"}},
+			noPrices: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, table := range []string{"datrecords", "usagerecords", "inventory"} {
+				exec(`DELETE FROM ` + table)
+			}
+			count := func(d, packs string) {
+				exec(`
+INSERT OR REPLACE INTO inventory (invDate, invYjCode, invJanCode, invProductName, invJanHousouSuuryouNumber, qty,
+                                  HousouTaniUnit, InvHousouTaniUnit, janqty, JanHousouSuuryouUnit, InvJanHousouSuuryouUnit)
+VALUES (?, '1111', ?, 'テスト錠', 1, ?, '錠', '錠', ?, '', '')`, d, jan, parseQty(packs)*100, packs)
+			}
+			count(date, "1")
+			for i, e := range tt.events {
+				switch e.kind {
+				case "納品", "返品":
+					flag := "1"
+					if e.kind == "返品" {
+						flag = "2"
+					}
+					exec(`
+INSERT INTO datrecords (CurrentOroshiCode, DatDate, DatDeliveryFlag, DatReceiptNumber, DatLineNumber, DatJanCode, DatQuantity, DatUnitPrice)
+VALUES ('001', ?, ?, ?, '1', ?, ?, ?)`, e.date, flag, i, jan, e.qty, e.price)
+				case "処方":
+					exec(`
+INSERT INTO usagerecords (usageDate, usageYjCode, usageJanCode, usageAmount, usageUnit, usageUnitName)
+VALUES (?, '1111', ?, ?, '', '錠')`, e.date, jan, e.qty)
+				case "棚卸":
+					count(e.date, e.qty)
+				}
+			}
+			for _, m := range []struct {
+				method string
+				want   float64
+			}{{CostLast, tt.last}, {CostAverage, tt.average}} {
+				costs, err := purchaseCosts(date, m.method)
+				if err != nil {
+					t.Fatal(err)
+				}
+				p, ok := costs[jan]
+				if ok == tt.noPrices {
+					t.Fatalf("%s: ok = %v", m.method, ok)
+				}
+				if math.Abs(p.price-m.want) > 1e-9 {
+					t.Errorf("%s: price = %v, want %v", m.method, p.price, m.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package aggregate
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"YAMATO/yakka"
+)
+
+// VarianceRow は棚卸時点の理論在庫と実棚の差異（包装分類キー単位）
+type VarianceRow struct {
+	YJ           string   `json:"yj"`
+	PackagingKey string   `json:"packagingKey"`
+	ProductName  string   `json:"productName"`
+	JanCodes     []string `json:"janCodes"`
+	BaseUnit     string   `json:"baseUnit"`
+	PrevDate     string   `json:"prevDate"`    // 起点とした前回棚卸日
+	NoBaseline   bool     `json:"noBaseline"`  // 前回棚卸が無く、履歴の始めからの入出庫で理論在庫を求めた
+	Theoretical  float64  `json:"theoretical"` // 前回棚卸＋入出庫から求めた理論在庫
+	Counted      float64  `json:"counted"`     // 今回の実棚数
+	Diff         float64  `json:"diff"`        // 実棚 − 理論
+	UnitYakka    float64  `json:"unitYakka"`   // 単位薬価 (JC049)
+	DiffValue    float64  `json:"diffValue"`   // 差異の薬価金額
+	NotCounted   bool     `json:"notCounted"`  // 理論在庫はあるが今回棚卸に無い
+	Excluded     int      `json:"excluded"`    // 基本単位に換算できず理論在庫・実棚に含めなかった明細の数
+}
+
+// VarianceReport は１回の棚卸に対する差異レポート
+type VarianceReport struct {
+	Date           string        `json:"date"`
+	Rows           []VarianceRow `json:"rows"`
+	TotalDiffValue float64       `json:"totalDiffValue"`
+}
+
+// unitYakka は date に適用されていた JAN の単位薬価を薬価の履歴から取得します。
+// 履歴が無ければ MA0 の現薬価です（無ければ 0）。
+func unitYakka(jan, date string) float64 {
+	if p, ok, err := yakka.PriceAt(jan, date); err != nil {
+		log.Printf("[VARIANCE] yakka history error JAN=%s: %v", jan, err)
+	} else if ok && p.TaniYakka > 0 {
+		return p.TaniYakka
+	}
+	var s sql.NullString
+	err := DB.QueryRow(
+		`SELECT MA049JC049GenTaniYakka FROM ma0 WHERE MA000JC000JanCode = ?`, jan,
+	).Scan(&s)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[VARIANCE] yakka lookup error JAN=%s: %v", jan, err)
+		}
+		return 0
+	}
+	return parseQty(s.String)
+}
+
+// BuildVariance は date の棚卸について、前回棚卸＋DAT・USAGE・IOD の移動から求めた
+// 理論在庫と実棚数を比較し、差異を薬価金額の大きい順に返します。
+// 前回棚卸の無い品目は履歴の始めからの移動で理論在庫を求め、NoBaseline を付けます。
+// 数量はすべて包装の基本単位に換算し、換算できない明細は Excluded に数えます。
+func BuildVariance(date string) (VarianceReport, error) {
+	rep := VarianceReport{Date: date}
+	q := url.Values{}
+
+	theo, err := buildLedger(date, date, q, true)
+	if err != nil {
+		return rep, err
+	}
+	invs, err := fetchInvDetails(date, date, q)
+	if err != nil {
+		return rep, err
+	}
+	counted := groupDetails(invs)
+
+	rowOf := make(map[string]*VarianceRow)
+	var keys []string
+	get := func(yj, pk, name string) *VarianceRow {
+		k := yj + "\x00" + pk
+		if r, ok := rowOf[k]; ok {
+			return r
+		}
+		r := &VarianceRow{YJ: yj, PackagingKey: pk, ProductName: name, NotCounted: true, NoBaseline: true}
+		rowOf[k] = r
+		keys = append(keys, k)
+		return r
+	}
+
+	for yj, res := range counted {
+		for pk, list := range res.Groups {
+			r := get(yj, pk, res.ProductName)
+			r.NotCounted = false
+			seen := make(map[string]bool)
+			for _, d := range list {
+				r.BaseUnit = d.HU
+				if c := convertLedger(d); c.OK {
+					r.Counted += c.BaseAmount
+				} else {
+					r.Excluded++
+				}
+				if !seen[d.JAN] {
+					seen[d.JAN] = true
+					r.JanCodes = append(r.JanCodes, d.JAN)
+				}
+			}
+		}
+	}
+	for yj, lr := range theo {
+		for pk, g := range lr.Groups {
+			r := get(yj, pk, lr.ProductName)
+			r.Theoretical = g.Opening
+			r.PrevDate = g.OpeningDate
+			r.NoBaseline = g.OpeningDate == ""
+			for _, d := range g.Excluded {
+				if d.Date < date {
+					r.Excluded++
+				}
+			}
+			if r.BaseUnit == "" {
+				r.BaseUnit = g.BaseUnit
+			}
+			if len(r.JanCodes) == 0 {
+				seen := make(map[string]bool)
+				for _, row := range g.Rows {
+					if !seen[row.JAN] {
+						seen[row.JAN] = true
+						r.JanCodes = append(r.JanCodes, row.JAN)
+					}
+				}
+			}
+		}
+	}
+
+	for _, k := range keys {
+		r := rowOf[k]
+		r.Diff = r.Counted - r.Theoretical
+		if r.Diff == 0 {
+			continue
+		}
+		// 理論在庫がゼロで棚卸にも無いものは対象外
+		if r.NotCounted && r.Theoretical == 0 {
+			continue
+		}
+		for _, jan := range r.JanCodes {
+			if p := unitYakka(jan, date); p > 0 {
+				r.UnitYakka = p
+				break
+			}
+		}
+		r.DiffValue = math.Round(r.Diff*r.UnitYakka*100) / 100
+		rep.TotalDiffValue += r.DiffValue
+		rep.Rows = append(rep.Rows, *r)
+	}
+	sort.SliceStable(rep.Rows, func(i, j int) bool {
+		return math.Abs(rep.Rows[i].DiffValue) > math.Abs(rep.Rows[j].DiffValue)
+	})
+	rep.TotalDiffValue = math.Round(rep.TotalDiffValue*100) / 100
+	return rep, nil
+}
+
+// VarianceHandler は /api/inventory/variance?date=YYYYMMDD の GET を処理します
+func VarianceHandler(w http.ResponseWriter, r *http.Request) {
+	date := strings.ReplaceAll(r.URL.Query().Get("date"), "-", "")
+	if date == "" {
+		http.Error(w, "date は必須です", http.StatusBadRequest)
+		return
+	}
+	rep, err := BuildVariance(date)
+	if err != nil {
+		log.Printf("[VARIANCE] BuildVariance error: %v", err)
+		http.Error(w, "Variance error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, rep)
+}
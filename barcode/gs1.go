@@ -0,0 +1,208 @@
+// Package barcode は医薬品の包装に表示される GS1 バーコード（GS1-128・GS1 データバー）と
+// JAN を読み、JAN・有効期限・製造番号を取り出します。
+//
+// 読取値は次のいずれかの形式を受け付けます。
+//   - JAN（13桁）、GTIN-14（14桁）
+//   - 括弧付きの表示形式 "(01)14987...(17)270331(10)AB123"
+//   - スキャナーの生データ "0114987...1727033110AB123"（可変長 AI の後の区切りは GS(0x1D)、先頭のシンボル識別子 "]C1" 等は無視）
+package barcode
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 使用するアプリケーション識別子（AI）
+const (
+	AIGTIN   = "01" // 商品コード（GTIN-14）
+	AIExpiry = "17" // 有効期限（YYMMDD）
+	AILot    = "10" // 製造番号・ロット
+	AISerial = "21" // シリアル番号
+)
+
+const gs = "\x1d"
+
+// fixedLength は固定長の AI（GS1 の定義済み長さ、AI を除く桁数）です。
+// ここに無い AI は可変長として GS または末尾までを値とします。
+var fixedLength = map[string]int{
+	"00": 18, "01": 14, "02": 14,
+	"11": 6, "12": 6, "13": 6, "15": 6, "16": 6, "17": 6,
+	"20": 2,
+}
+
+// Data はバーコードから取り出した値です。
+type Data struct {
+	GTIN      string            `json:"gtin"`                // GTIN-14
+	Indicator string            `json:"indicator"`           // GTIN-14 の先頭（包装インジケータ）
+	Expiry    string            `json:"expiry,omitempty"`    // 有効期限 YYYY-MM-DD
+	Lot       string            `json:"lot,omitempty"`       // 製造番号
+	Serial    string            `json:"serial,omitempty"`    // シリアル番号
+	AIs       map[string]string `json:"ais"`                 // 読み取った全 AI
+	Symbology string            `json:"symbology,omitempty"` // "jan"・"gtin"・"gs1"
+}
+
+// Parse は読取値を解釈します。JAN・GTIN-14 の場合はチェックデジットも確認します。
+func Parse(code string) (Data, error) {
+	s := strings.TrimSpace(code)
+	// シンボル識別子（]C1: GS1-128、]e0: データバー、]E0: EAN-13 など）
+	if len(s) > 3 && s[0] == ']' {
+		s = s[3:]
+	}
+	d := Data{AIs: map[string]string{}}
+	switch {
+	case isDigits(s) && len(s) == 13:
+		d.Symbology = "jan"
+		d.AIs[AIGTIN] = "0" + s
+	case isDigits(s) && len(s) == 14:
+		d.Symbology = "gtin"
+		d.AIs[AIGTIN] = s
+	default:
+		d.Symbology = "gs1"
+		var err error
+		if strings.HasPrefix(s, "(") {
+			d.AIs, err = parseBracketed(s)
+		} else {
+			d.AIs, err = parseRaw(s)
+		}
+		if err != nil {
+			return d, fmt.Errorf("バーコード %q: %w", code, err)
+		}
+	}
+
+	d.GTIN = d.AIs[AIGTIN]
+	if d.GTIN == "" {
+		return d, fmt.Errorf("バーコード %q に商品コード（AI 01）がありません", code)
+	}
+	if len(d.GTIN) != 14 || !isDigits(d.GTIN) {
+		return d, fmt.Errorf("商品コード %q は14桁の数字ではありません", d.GTIN)
+	}
+	if CheckDigit(d.GTIN[:13]) != d.GTIN[13] {
+		return d, fmt.Errorf("商品コード %q のチェックデジットが正しくありません", d.GTIN)
+	}
+	d.Indicator = d.GTIN[:1]
+	if v, ok := d.AIs[AIExpiry]; ok {
+		exp, err := parseExpiry(v)
+		if err != nil {
+			return d, err
+		}
+		d.Expiry = exp
+	}
+	d.Lot = d.AIs[AILot]
+	d.Serial = d.AIs[AISerial]
+	return d, nil
+}
+
+// parseBracketed は "(AI)値(AI)値…" 形式を読みます。
+func parseBracketed(s string) (map[string]string, error) {
+	ais := map[string]string{}
+	for s != "" {
+		if s[0] != '(' {
+			return nil, fmt.Errorf("AI の括弧がありません: %q", s)
+		}
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, fmt.Errorf("AI の閉じ括弧がありません: %q", s)
+		}
+		ai := s[1:end]
+		s = s[end+1:]
+		next := strings.IndexByte(s, '(')
+		if next < 0 {
+			next = len(s)
+		}
+		ais[ai] = strings.TrimSuffix(s[:next], gs)
+		s = s[next:]
+	}
+	return ais, nil
+}
+
+// parseRaw は括弧の無い生データを固定長 AI の長さと GS 区切りで読みます。
+func parseRaw(s string) (map[string]string, error) {
+	ais := map[string]string{}
+	s = strings.TrimPrefix(s, gs)
+	for s != "" {
+		if len(s) < 2 {
+			return nil, fmt.Errorf("AI が途中で切れています: %q", s)
+		}
+		ai := s[:2]
+		if !isDigits(ai) {
+			return nil, fmt.Errorf("AI %q が数字ではありません", ai)
+		}
+		s = s[2:]
+		if n, ok := fixedLength[ai]; ok {
+			if len(s) < n {
+				return nil, fmt.Errorf("AI %s の値が %d 桁に足りません", ai, n)
+			}
+			ais[ai] = s[:n]
+			s = strings.TrimPrefix(s[n:], gs)
+			continue
+		}
+		end := strings.Index(s, gs)
+		if end < 0 {
+			end = len(s)
+		}
+		ais[ai] = s[:end]
+		s = strings.TrimPrefix(s[end:], gs)
+	}
+	return ais, nil
+}
+
+// parseExpiry は YYMMDD の有効期限を YYYY-MM-DD にします。日が 00 の場合は月末です。
+func parseExpiry(v string) (string, error) {
+	if len(v) != 6 || !isDigits(v) {
+		return "", fmt.Errorf("有効期限 %q は YYMMDD ではありません", v)
+	}
+	if strings.HasSuffix(v, "00") {
+		t, err := time.Parse("060102", v[:4]+"01")
+		if err != nil {
+			return "", fmt.Errorf("有効期限 %q が正しくありません", v)
+		}
+		return t.AddDate(0, 1, -1).Format("2006-01-02"), nil
+	}
+	t, err := time.Parse("060102", v)
+	if err != nil {
+		return "", fmt.Errorf("有効期限 %q が正しくありません", v)
+	}
+	return t.Format("2006-01-02"), nil
+}
+
+// CheckDigit は GTIN・JAN のチェックデジット（モジュラス10 ウェイト3）を返します。
+// body はチェックデジットを除いた桁です。
+func CheckDigit(body string) byte {
+	sum := 0
+	for i := 0; i < len(body); i++ {
+		n := int(body[len(body)-1-i] - '0')
+		if i%2 == 0 {
+			n *= 3
+		}
+		sum += n
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// JAN は GTIN-14 に対応する JAN を返します。
+// 包装インジケータが 0 なら下13桁がそのまま JAN です。
+// 1〜8（販売包装・元梱包装など）の場合はインジケータを除いた12桁にチェックデジットを付け直したものが
+// 同じ商品の JAN です。9（可変計量）など対応する JAN が無い場合は空です。
+func JAN(gtin string) string {
+	if len(gtin) != 14 || gtin[0] == '9' {
+		return ""
+	}
+	if gtin[0] == '0' {
+		return gtin[1:]
+	}
+	body := gtin[1:13]
+	return body + string(CheckDigit(body))
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
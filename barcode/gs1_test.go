@@ -0,0 +1,93 @@
+package barcode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      string
+		gtin      string
+		indicator string
+		symbology string
+		expiry    string
+		lot       string
+		serial    string
+		errPart   string
+	}{
+		{name: "JAN", code: "4987123456784", gtin: "04987123456784", indicator: "0", symbology: "jan"},
+		{name: "GTIN-14", code: "14987123456781", gtin: "14987123456781", indicator: "1", symbology: "gtin"},
+		{name: "前後の空白", code: " 4987123456784\n", gtin: "04987123456784", indicator: "0", symbology: "jan"},
+		{
+			name: "括弧付きの表示形式", code: "(01)14987123456781(17)270331(10)AB123",
+			gtin: "14987123456781", indicator: "1", symbology: "gs1", expiry: "2027-03-31", lot: "AB123",
+		},
+		{
+			name: "生データ（可変長 AI の後は GS 区切り）", code: "]C1011498712345678110AB123\x1d17270300",
+			gtin: "14987123456781", indicator: "1", symbology: "gs1", expiry: "2027-03-31", lot: "AB123",
+		},
+		{
+			name: "シリアル番号", code: "0104987123456784172704302112345",
+			gtin: "04987123456784", indicator: "0", symbology: "gs1", expiry: "2027-04-30", serial: "12345",
+		},
+		{name: "JAN のチェックデジット誤り", code: "4987123456785", errPart: "チェックデジット"},
+		{name: "GTIN-14 のチェックデジット誤り", code: "14987123456782", errPart: "チェックデジット"},
+		{name: "GS1 のチェックデジット誤り", code: "(01)14987123456780(10)A", errPart: "チェックデジット"},
+		{name: "商品コードが無い", code: "(10)AB123", errPart: "AI 01"},
+		{name: "固定長 AI の桁不足", code: "01149871234", errPart: "14 桁に足りません"},
+		{name: "有効期限の月が不正", code: "(01)14987123456781(17)271331", errPart: "有効期限"},
+		{name: "閉じ括弧が無い", code: "(01", errPart: "閉じ括弧"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Parse(tt.code)
+			if tt.errPart != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errPart) {
+					t.Fatalf("err = %v, want %q", err, tt.errPart)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.GTIN != tt.gtin || d.Indicator != tt.indicator || d.Symbology != tt.symbology {
+				t.Errorf("got gtin=%s indicator=%s symbology=%s, want %s/%s/%s",
+					d.GTIN, d.Indicator, d.Symbology, tt.gtin, tt.indicator, tt.symbology)
+			}
+			if d.Expiry != tt.expiry || d.Lot != tt.lot || d.Serial != tt.serial {
+				t.Errorf("got expiry=%q lot=%q serial=%q, want %q/%q/%q",
+					d.Expiry, d.Lot, d.Serial, tt.expiry, tt.lot, tt.serial)
+			}
+		})
+	}
+}
+
+func TestJAN(t *testing.T) {
+	tests := []struct {
+		name string
+		gtin string
+		want string
+	}{
+		{"インジケータ 0 は下13桁", "04987123456784", "4987123456784"},
+		{"インジケータ 1 はチェックデジットを付け直す", "14987123456781", "4987123456784"},
+		{"インジケータ 8", "84987123456780", "4987123456784"},
+		{"インジケータ 9（可変計量）は対応する JAN が無い", "94987123456787", ""},
+		{"14桁でない", "4987123456784", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JAN(tt.gtin); got != tt.want {
+				t.Errorf("JAN(%s) = %q, want %q", tt.gtin, got, tt.want)
+			}
+		})
+	}
+	// インジケータ 1〜8 はすべて同じ JAN に戻る
+	for i := byte('1'); i <= '8'; i++ {
+		body := string(i) + "498712345678"
+		if got := JAN(body + string(CheckDigit(body))); got != "4987123456784" {
+			t.Errorf("indicator %c: JAN = %q", i, got)
+		}
+	}
+}
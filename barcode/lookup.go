@@ -0,0 +1,77 @@
+package barcode
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"YAMATO/jancode"
+	"YAMATO/jcshms"
+)
+
+var DB *sql.DB
+
+// Result は読取値と、対応する JAN のマスター情報です。
+type Result struct {
+	Data
+	JAN             string `json:"jan"`
+	Found           bool   `json:"found"`  // JANCODE・JCSHMS のいずれかに登録がある
+	Source          string `json:"source"` // "jancode"・"jcshms"（見つからなければ空）
+	YjCode          string `json:"yj"`
+	ProductName     string `json:"name"`
+	Spec            string `json:"spec"`
+	UnitName        string `json:"unitName"`        // JC039 包装単位
+	PackQtyNumber   string `json:"packQtyNumber"`   // JA006 包装数量数値
+	PackQtyUnitCode string `json:"packQtyUnitCode"` // JA007 包装数量単位コード
+	PackTotal       string `json:"packTotal"`       // JA008 包装総量数値
+}
+
+// Lookup は読取値を解釈し、JAN を JANCODE・JCSHMS から引きます。
+// マスターに無い場合も JAN・有効期限・製造番号は返します（Found が false）。
+func Lookup(code string) (Result, error) {
+	d, err := Parse(code)
+	res := Result{Data: d}
+	if err != nil {
+		return res, err
+	}
+	res.JAN = JAN(d.GTIN)
+	if res.JAN == "" {
+		return res, nil
+	}
+
+	ja, err := jancode.QueryByJan(DB, res.JAN)
+	if err != nil {
+		log.Printf("[BARCODE] jancode lookup error JAN=%s: %v", res.JAN, err)
+	} else if len(ja) > 0 {
+		res.Found, res.Source = true, "jancode"
+		res.PackQtyNumber = ja[0].JA006HousouSuuryouSuuchi
+		res.PackQtyUnitCode = ja[0].JA007HousouSuuryouTaniCode
+		res.PackTotal = ja[0].JA008HousouSouryouSuuchi
+	}
+	jc, err := jcshms.QueryByJan(DB, res.JAN)
+	if err != nil {
+		log.Printf("[BARCODE] jcshms lookup error JAN=%s: %v", res.JAN, err)
+	} else if len(jc) > 0 {
+		if !res.Found {
+			res.Found, res.Source = true, "jcshms"
+		}
+		res.YjCode = jc[0].JC009YJCode
+		res.ProductName = jc[0].JC018ShouhinMei
+		res.Spec = jc[0].JC020KikakuYouryou
+		res.UnitName = jc[0].JC039HousouTaniTani
+	}
+	return res, nil
+}
+
+// Handler は /api/barcode?code= の GET で読取値の解釈結果と商品を返します。
+// 解釈できない読取値は 400 です。
+func Handler(w http.ResponseWriter, r *http.Request) {
+	res, err := Lookup(r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
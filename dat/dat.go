@@ -3,18 +3,18 @@ package dat
 
 import (
 	"bufio"
+	"database/sql"
 	"fmt"
 	"io"
 	"log"
 	"strconv"
 	"strings"
 
+	"YAMATO/importer"
 	"YAMATO/jcshms"
 	"YAMATO/ma0"
 	"YAMATO/model"
-
-	"golang.org/x/text/encoding/japanese"
-	"golang.org/x/text/transform"
+	"YAMATO/oroshi"
 )
 
 // getOrganizedFlag は JAN が JCShms マスターにあれば1、なければ0を返します。
@@ -29,77 +29,137 @@ func getOrganizedFlag(jan string) (int, error) {
 	return 0, nil
 }
 
-// ParseDATFile は DAT ファイルを読み込み、
-// model.DATRecord スライスと統計値を返します。
-// MA0 未登録品はすべて MA2 テーブルに登録します。
-func ParseDATFile(
-	r io.Reader,
-) (
-	records []model.DATRecord,
-	totalCount, ma0CreatedCount, duplicateCount int,
-	err error,
-) {
+// ReadDATFile は DAT ファイルを読み込み、DB へは書き込まずに
+// model.DATRecord スライスとファイル検証結果を返します。
+// S（ヘッダ）・D（明細）・T（合計）・E（エンド）の各レコードを解釈し、
+// 明細件数・小計合計を合計レコードと照合します。
+// 各行は生の Shift-JIS バイト列のままレイアウト定義で項目に分解します。
+// layoutName が空の場合はヘッダの卸コードからレイアウトを選びます。
+func ReadDATFile(r io.Reader, layoutName string) (records []model.DATRecord, validation Validation, err error) {
 	scanner := bufio.NewScanner(r)
-	var currentOroshiCode string
-
-	// 固定長フィールド取得ヘルパー
-	getField := func(s string, start, end int) string {
-		if len(s) >= end {
-			return s[start:end]
-		} else if len(s) > start {
-			return s[start:]
+	var currentOroshiCode, currentOroshiName string
+	vd := newValidator()
+
+	layout := LayoutFor("")
+	fixed := false
+	if layoutName != "" {
+		l, ok := LayoutByName(layoutName)
+		if !ok {
+			err = fmt.Errorf("DAT レイアウト %q が定義されていません", layoutName)
+			return
 		}
-		return ""
+		layout, fixed = l, true
 	}
 
+	lineNo := 0
 	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) < 3 {
+		line := scanner.Bytes()
+		lineNo++
+		if len(strings.TrimSpace(string(line))) == 0 {
 			continue
 		}
-		if strings.HasPrefix(line, "S20") {
-			currentOroshiCode = strings.TrimSpace(getField(line, 3, 12))
-			continue
+		vd.v.RecordTypes[string(bytesOf(line, 0, 3))]++
+
+		// ヘッダ行は直前の卸のレイアウトではなく、行そのものの卸コードで選んだレイアウトで読む
+		if !fixed {
+			if l, ok := headerLayout(line); ok {
+				layout = l
+			}
 		}
-		if !strings.HasPrefix(line, "D20") {
+		code, ok := layout.match(line)
+		if !ok {
+			vd.unknown(lineNo, string(line))
 			continue
 		}
-		totalCount++
-
-		// DATRecord 組み立て
-		datDate := getField(line, 4, 12)
-		datFlag := getField(line, 3, 4)
-		datRecNo := getField(line, 12, 22)
-		datLineNo := getField(line, 22, 24)
-		datJan := getField(line, 25, 38)
-		rawName := getField(line, 38, 78)
-		name, _, convErr := transform.String(japanese.ShiftJIS.NewDecoder(), rawName)
-		if convErr != nil {
-			name = rawName
+		f := layout.Decode(code, line)
+
+		switch kindOf(code) {
+		case recHeader:
+			currentOroshiCode = strings.TrimSpace(f[FieldOroshiCode])
+			currentOroshiName = oroshi.NameOf(currentOroshiCode)
+			vd.header(lineNo, currentOroshiCode, layout.defines(recTrailer))
+			continue
+		case recTrailer:
+			vd.trailer(lineNo, f[FieldDetailCount], f[FieldTotalAmount])
+			continue
+		case recEnd:
+			vd.end(lineNo)
+			continue
+		case recDetail:
+		default:
+			vd.unknown(lineNo, string(line))
+			continue
 		}
-		datQty := getField(line, 78, 83)
-		datUnit := getField(line, 83, 92)
-		datSub := getField(line, 92, 101)
-		datPkg := getField(line, 101, 109)
-		datExp := getField(line, 109, 115)
-		datLot := getField(line, 115, 121)
-
-		rec := model.DATRecord{
-			CurrentOroshiCode: currentOroshiCode,
-			DatDate:           datDate,
-			DatFlag:           datFlag,
-			DatRecNo:          datRecNo,
-			DatLineNo:         datLineNo,
-			DatJan:            datJan,
-			DatProductName:    name,
-			DatQty:            datQty,
-			DatUnit:           datUnit,
-			DatSub:            datSub,
-			DatPkg:            datPkg,
-			DatExp:            datExp,
-			DatLot:            datLot,
+
+		// DATRecord 組み立て（型・値が不正な行は取り込まない）
+		vd.detail(lineNo, len(line), layout.recordLen(code), f[FieldSubtotal])
+		rec, lineErrs := decodeDetail(layout, code, f)
+		if len(lineErrs) > 0 {
+			vd.reject(lineNo, lineErrs)
+			continue
 		}
+		rec.CurrentOroshiCode = currentOroshiCode
+		rec.CurrentOroshiName = currentOroshiName
 		records = append(records, rec)
+	}
+
+	if scanErr := scanner.Err(); scanErr != nil {
+		err = scanErr
+	}
+	validation = vd.result()
+	return
+}
+
+// numericColumns は datrecords の数値項目の列です（TEXT 列に最短表記で保存します）。
+var numericColumns = []string{"DatQuantity", "DatUnitPrice", "DatSubtotal", "DatPackagingDrugPrice"}
+
+// Migrate は schema.sql 適用後に呼び出し、旧形式で保存した datrecords の行を現在の形式に揃えます。
+// 旧形式は固定長の項目をそのまま保存しており、数値はゼロ埋め（"00010"）、有効期限は YYMMDD でした。
+// 現在は数値を最短表記（"10"）、有効期限を YYYYMMDD（無しは空）で保存します。
+// 主キー列の表記は両形式で同じなので、揃えた後は同じ明細を再取込しても INSERT OR IGNORE で１行にまとまります。
+func Migrate(db *sql.DB) error {
+	const exp = `TRIM(DatExpiryDate)`
+	sets := []string{`DatExpiryDate = CASE
+    WHEN TRIM(DatExpiryDate, '0 ') = '' THEN ''
+    WHEN LENGTH(` + exp + `) = 6 THEN
+      (CASE WHEN SUBSTR(` + exp + `, 1, 2) < '69' THEN '20' ELSE '19' END) || ` + exp + `
+    ELSE ` + exp + ` END`}
+	conds := []string{`LENGTH(` + exp + `) = 6`, `(DatExpiryDate <> '' AND TRIM(DatExpiryDate, '0 ') = '')`}
+	for _, c := range numericColumns {
+		norm := `CAST(CAST(TRIM(` + c + `) AS NUMERIC) AS TEXT)`
+		sets = append(sets, c+` = `+norm)
+		conds = append(conds, c+` <> `+norm)
+	}
+	res, err := db.Exec(`UPDATE datrecords SET ` + strings.Join(sets, ", ") +
+		` WHERE ` + strings.Join(conds, " OR "))
+	if err != nil {
+		return fmt.Errorf("migrate datrecords: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[SCHEMA] normalized %d legacy datrecords rows", n)
+	}
+	return nil
+}
+
+// datKey は datrecords の主キー列と値を返します。
+func datKey(rec model.DATRecord) importer.Row {
+	return importer.Row{
+		"CurrentOroshiCode": rec.CurrentOroshiCode,
+		"DatDeliveryFlag":   rec.DatFlag,
+		"DatDate":           rec.DatDate,
+		"DatReceiptNumber":  rec.DatRecNo,
+		"DatLineNumber":     rec.DatLineNo,
+		"DatJanCode":        rec.DatJan,
+	}
+}
+
+// ImportDATRecords は読み込み済みの DAT レコードを datrecords に登録し、
+// MA0 連携と MA2 登録を行います。変更内容は batch（nil 可）に記録します。
+// datrecords への書き込みに失敗した時点で中断し、エラーを返します。
+func ImportDATRecords(records []model.DATRecord, batch *importer.Batch) (ma0CreatedCount, duplicateCount int, err error) {
+	for _, rec := range records {
+		datJan := rec.DatJan
+		name := rec.DatProductName
 
 		// datrecords テーブル挿入＋organizedFlag 集計
 		flag, fgErr := getOrganizedFlag(datJan)
@@ -107,8 +167,14 @@ func ParseDATFile(
 			log.Printf("[DAT] OrganizedFlag error JAN=%q: %v", datJan, fgErr)
 			flag = 0
 		}
-		if err := ma0.InsertDATRecord(ma0.DB, rec, flag); err != nil {
+		key := datKey(rec)
+		old, _ := importer.SelectRow("datrecords", key)
+		if err = ma0.InsertDATRecord(ma0.DB, rec, flag); err != nil {
 			log.Printf("[DAT] InsertDATRecord error: %v", err)
+			return ma0CreatedCount, duplicateCount, fmt.Errorf("datrecords JAN=%s: %w", datJan, err)
+		}
+		if old == nil {
+			batch.RecordInsert("datrecords", key)
 		}
 		if flag == 1 {
 			// organized
@@ -117,38 +183,91 @@ func ParseDATFile(
 		}
 
 		// MA0 連携／MA2 登録
-		ma0Rec, created, err0 := ma0.CheckOrCreateMA0(datJan, name)
+		batch.TrackMasters(datJan, func() {
+			if registerMasters(datJan, name) {
+				ma0CreatedCount++
+			}
+		})
+	}
+	return
+}
 
-		if err0 != nil {
-			log.Printf("[DAT] MA0 lookup error JAN=%s: %v", datJan, err0)
-		}
-		if created {
-			ma0CreatedCount++
+// registerMasters は JAN の MA0 を確認・作成し、マスター未登録品は MA2 に登録します。
+// MA0 を新規作成したときは true を返します。
+func registerMasters(datJan, name string) bool {
+	ma0Rec, created, err0 := ma0.CheckOrCreateMA0(datJan, name)
+	if err0 != nil {
+		log.Printf("[DAT] MA0 lookup error JAN=%s: %v", datJan, err0)
+	}
+	// マスター未登録品は MA2 に登録
+	if !created && ma0Rec.MA018JC018ShouhinMei == "" {
+		hs, _ := strconv.Atoi(ma0Rec.MA044JC044HousouSouryouSuuchi)
+		jsn, _ := strconv.Atoi(ma0Rec.MA131JA006HousouSuuryouSuuchi)
+		jssn, _ := strconv.Atoi(ma0Rec.MA133JA008HousouSouryouSuuchi)
+		mrec := &ma0.MARecord{
+			JanCode:                datJan,
+			ProductName:            name,
+			HousouKeitai:           ma0Rec.MA037JC037HousouKeitai,
+			HousouTaniUnit:         ma0Rec.MA038JC038HousouTaniSuuchi,
+			HousouSouryouNumber:    hs,
+			JanHousouSuuryouNumber: jsn,
+			JanHousouSuuryouUnit:   ma0Rec.MA132JA007HousouSuuryouTaniCode,
+			JanHousouSouryouNumber: jssn,
 		}
-		// マスター未登録品は MA2 に登録
-		if !created && ma0Rec.MA018JC018ShouhinMei == "" {
-			hs, _ := strconv.Atoi(ma0Rec.MA044JC044HousouSouryouSuuchi)
-			jsn, _ := strconv.Atoi(ma0Rec.MA131JA006HousouSuuryouSuuchi)
-			jssn, _ := strconv.Atoi(ma0Rec.MA133JA008HousouSouryouSuuchi)
-			mrec := &ma0.MARecord{
-				JanCode:                datJan,
-				ProductName:            name,
-				HousouKeitai:           ma0Rec.MA037JC037HousouKeitai,
-				HousouTaniUnit:         ma0Rec.MA038JC038HousouTaniSuuchi,
-				HousouSouryouNumber:    hs,
-				JanHousouSuuryouNumber: jsn,
-				JanHousouSuuryouUnit:   ma0Rec.MA132JA007HousouSuuryouTaniCode,
-				JanHousouSouryouNumber: jssn,
-			}
-			_, _, err2 := ma0.RegisterMA(ma0.DB, mrec)
-			if err2 != nil {
-				log.Printf("[DAT] MA2 registration error JAN=%s: %v", datJan, err2)
-			}
+		_, _, err2 := ma0.RegisterMA(ma0.DB, mrec)
+		if err2 != nil {
+			log.Printf("[DAT] MA2 registration error JAN=%s: %v", datJan, err2)
 		}
 	}
+	return created
+}
 
-	if scanErr := scanner.Err(); scanErr != nil {
-		err = scanErr
+// ParseDATFile は DAT ファイルを読み込み、
+// model.DATRecord スライスと統計値、ファイル検証結果を返します。
+// MA0 未登録品はすべて MA2 テーブルに登録します。
+func ParseDATFile(
+	r io.Reader,
+) (
+	records []model.DATRecord,
+	totalCount, ma0CreatedCount, duplicateCount int,
+	validation Validation,
+	err error,
+) {
+	records, validation, err = ReadDATFile(r, "")
+	if err != nil {
+		return
 	}
+	totalCount = len(records)
+	ma0CreatedCount, duplicateCount, err = ImportDATRecords(records, nil)
 	return
 }
+
+// PreviewDATRecords は DB に書き込まずに各レコードの取込結果を判定します。
+func PreviewDATRecords(records []model.DATRecord) []importer.PreviewRow {
+	rows := make([]importer.PreviewRow, 0, len(records))
+	for i, rec := range records {
+		row := importer.PreviewRow{
+			Row:  i + 1,
+			Jan:  rec.DatJan,
+			Name: rec.DatProductName,
+			Key: strings.Join([]string{
+				rec.CurrentOroshiCode, rec.DatFlag, rec.DatDate,
+				rec.DatRecNo, rec.DatLineNo, rec.DatJan,
+			}, "/"),
+		}
+		if importer.Exists(`
+SELECT COUNT(*) FROM datrecords
+ WHERE CurrentOroshiCode = ? AND DatDeliveryFlag = ? AND DatDate = ?
+   AND DatReceiptNumber = ? AND DatLineNumber = ? AND DatJanCode = ?`,
+			rec.CurrentOroshiCode, rec.DatFlag, rec.DatDate,
+			rec.DatRecNo, rec.DatLineNo, rec.DatJan,
+		) {
+			row.Marks = append(row.Marks, importer.MarkDuplicate)
+		} else {
+			row.Marks = append(row.Marks, importer.MarkNew)
+		}
+		row.Marks = append(row.Marks, importer.JanState(rec.DatJan)...)
+		rows = append(rows, row)
+	}
+	return rows
+}
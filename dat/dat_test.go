@@ -0,0 +1,89 @@
+package dat
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"YAMATO/ma0"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+
+	// 旧形式: 固定長の項目をそのまま保存していた行
+	legacy := []struct {
+		recNo, qty, price, sub, pkg, exp string
+	}{
+		{"0000012345", "00002", "000001500", "000003000", "00001600", "271231"},
+		{"0000012346", "00001", "000000050", "000000050", "00000000", "000000"},
+		{"0000012347", "00010", "000000012.5", "000000125", "00000000", ""},
+	}
+	for _, l := range legacy {
+		if _, err := db.Exec(`
+INSERT INTO datrecords VALUES ('123456789', '20250401', '1', ?, '01', '4987123456789', 'テスト錠', ?, ?, ?, ?, ?, 'AB1234', 1)`,
+			l.recNo, l.qty, l.price, l.sub, l.pkg, l.exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	// ２回目は何も変えない
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][5]string{
+		"0000012345": {"2", "1500", "3000", "1600", "20271231"},
+		"0000012346": {"1", "50", "50", "0", ""},
+		"0000012347": {"10", "12.5", "125", "0", ""},
+	}
+	rows, err := db.Query(`SELECT DatReceiptNumber, DatQuantity, DatUnitPrice, DatSubtotal, DatPackagingDrugPrice, DatExpiryDate FROM datrecords`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var recNo string
+		var got [5]string
+		if err := rows.Scan(&recNo, &got[0], &got[1], &got[2], &got[3], &got[4]); err != nil {
+			t.Fatal(err)
+		}
+		if got != want[recNo] {
+			t.Errorf("%s = %v, want %v", recNo, got, want[recNo])
+		}
+	}
+	rows.Close()
+
+	// 同じ明細を現在の形式で再取込しても１行のまま
+	rec, errs := decodeDetail(DefaultLayout, "D20", detailFields(nil))
+	if len(errs) > 0 {
+		t.Fatalf("decodeDetail: %v", errs)
+	}
+	rec.CurrentOroshiCode = "123456789"
+	if err := ma0.InsertDATRecord(db, rec, 1); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM datrecords WHERE DatReceiptNumber = '0000012345'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("rows after re-import = %d, want 1", n)
+	}
+}
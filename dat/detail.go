@@ -0,0 +1,101 @@
+package dat
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"YAMATO/model"
+)
+
+// subtotalTolerance は 数量×単価 と小計の差として許容する端数（円）です。
+const subtotalTolerance = 1.0
+
+// LineError は取込を拒否した明細行とその理由です。
+type LineError struct {
+	Line   int    `json:"line"`
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// parseDATDate は YYYYMMDD または YYMMDD の日付を検証し YYYYMMDD で返します。
+// 空欄・ゼロ埋めは日付無しとして空文字を返します。
+func parseDATDate(s string) (string, error) {
+	if strings.Trim(s, "0 ") == "" {
+		return "", nil
+	}
+	layout := "20060102"
+	if len(s) == 6 {
+		layout = "060102"
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return "", err
+	}
+	return t.Format("20060102"), nil
+}
+
+// decodeDetail はレイアウトの明細レコード code の型定義に従って各項目を検証し、
+// model.DATRecord を組み立てます。不正な項目があれば LineError を返します。
+func decodeDetail(l Layout, code string, f map[string]string) (model.DATRecord, []LineError) {
+	var errs []LineError
+	reject := func(field, value, reason string) {
+		errs = append(errs, LineError{Field: field, Value: value, Reason: reason})
+	}
+
+	nums := make(map[string]float64)
+	dates := make(map[string]string)
+	for _, fd := range l.Records[code] {
+		raw := strings.TrimSpace(f[fd.Name])
+		switch fd.Type {
+		case TypeNumber:
+			if raw == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				reject(fd.Name, raw, "数値ではありません")
+				continue
+			}
+			nums[fd.Name] = v
+		case TypeDate:
+			d, err := parseDATDate(raw)
+			if err != nil {
+				reject(fd.Name, raw, "日付として正しくありません")
+				continue
+			}
+			dates[fd.Name] = d
+		}
+	}
+
+	if d, ok := dates[FieldDate]; ok && d == "" {
+		reject(FieldDate, strings.TrimSpace(f[FieldDate]), "伝票日付がありません")
+	}
+	if strings.TrimSpace(f[FieldJan]) == "" {
+		reject(FieldJan, "", "JANコードがありません")
+	}
+
+	qty, price, sub := nums[FieldQuantity], nums[FieldUnitPrice], nums[FieldSubtotal]
+	if len(errs) == 0 && math.Abs(qty*price-sub) > subtotalTolerance {
+		reject(FieldSubtotal, strings.TrimSpace(f[FieldSubtotal]),
+			"小計が 数量×単価 ("+strconv.FormatFloat(qty*price, 'f', -1, 64)+") と一致しません")
+	}
+
+	rec := model.DATRecord{
+		DatDate:        dates[FieldDate],
+		DatFlag:        f[FieldFlag],
+		DatRecNo:       f[FieldReceiptNumber],
+		DatLineNo:      f[FieldLineNumber],
+		DatJan:         f[FieldJan],
+		DatProductName: f[FieldProductName],
+		DatQty:         qty,
+		DatUnit:        price,
+		DatSub:         sub,
+		DatPkg:         nums[FieldPackagingPrice],
+		DatExp:         dates[FieldExpiryDate],
+		DatLot:         f[FieldLotNumber],
+	}
+	return rec, errs
+}
@@ -0,0 +1,64 @@
+package dat
+
+import "testing"
+
+func detailFields(mod func(f map[string]string)) map[string]string {
+	f := map[string]string{
+		FieldFlag:           "1",
+		FieldDate:           "20250401",
+		FieldReceiptNumber:  "0000012345",
+		FieldLineNumber:     "01",
+		FieldJan:            "4987123456789",
+		FieldProductName:    "テスト錠",
+		FieldQuantity:       "00002",
+		FieldUnitPrice:      "000001500",
+		FieldSubtotal:       "000003000",
+		FieldPackagingPrice: "00001600",
+		FieldExpiryDate:     "271231",
+		FieldLotNumber:      "AB1234",
+	}
+	if mod != nil {
+		mod(f)
+	}
+	return f
+}
+
+func TestDecodeDetail(t *testing.T) {
+	tests := []struct {
+		name   string
+		mod    func(f map[string]string)
+		field  string // 拒否される項目（空なら取込可）
+		expiry string
+	}{
+		{"正常", nil, "", "20271231"},
+		{"期限が YYYYMMDD", func(f map[string]string) { f[FieldExpiryDate] = "20271231" }, "", "20271231"},
+		{"期限なし（ゼロ埋め）", func(f map[string]string) { f[FieldExpiryDate] = "000000" }, "", ""},
+		{"数量が数値でない", func(f map[string]string) { f[FieldQuantity] = "0000A" }, FieldQuantity, ""},
+		{"あり得ない期限 YYMMDD", func(f map[string]string) { f[FieldExpiryDate] = "271341" }, FieldExpiryDate, ""},
+		{"2月30日", func(f map[string]string) { f[FieldExpiryDate] = "270230" }, FieldExpiryDate, ""},
+		{"伝票日付なし", func(f map[string]string) { f[FieldDate] = "00000000" }, FieldDate, ""},
+		{"JAN なし", func(f map[string]string) { f[FieldJan] = "             " }, FieldJan, ""},
+		{"小計が数量×単価と一致しない", func(f map[string]string) { f[FieldSubtotal] = "000003100" }, FieldSubtotal, ""},
+		{"1円以内の端数は許容", func(f map[string]string) { f[FieldSubtotal] = "000003001" }, "", "20271231"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, errs := decodeDetail(DefaultLayout, "D20", detailFields(tt.mod))
+			if tt.field == "" {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %+v", errs)
+				}
+				if rec.DatQty != 2 || rec.DatUnit != 1500 || rec.DatDate != "20250401" || rec.DatExp != tt.expiry {
+					t.Errorf("decoded %+v", rec)
+				}
+				return
+			}
+			if len(errs) == 0 {
+				t.Fatalf("line accepted, want rejection of %s", tt.field)
+			}
+			if errs[0].Field != tt.field || errs[0].Reason == "" {
+				t.Errorf("error = %+v, want field %s", errs[0], tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package dat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+// レイアウト項目の型
+const (
+	TypeText   = "text"   // Shift-JIS を UTF-8 に変換する文字列
+	TypeNumber = "number" // 数字（半角）
+	TypeDate   = "date"   // 日付（半角数字）
+)
+
+// レイアウトの項目名（ReadDATFile が参照するもの）
+const (
+	FieldOroshiCode     = "oroshiCode"
+	FieldFlag           = "flag"
+	FieldDate           = "date"
+	FieldReceiptNumber  = "receiptNumber"
+	FieldLineNumber     = "lineNumber"
+	FieldJan            = "jan"
+	FieldProductName    = "productName"
+	FieldQuantity       = "quantity"
+	FieldUnitPrice      = "unitPrice"
+	FieldSubtotal       = "subtotal"
+	FieldPackagingPrice = "packagingPrice"
+	FieldExpiryDate     = "expiryDate"
+	FieldLotNumber      = "lotNumber"
+	FieldDetailCount    = "detailCount"
+	FieldTotalAmount    = "totalAmount"
+)
+
+// LayoutField は固定長レコードの１項目（バイト位置は 0 始まり）です。
+type LayoutField struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	Type   string `json:"type"`
+}
+
+// Layout は卸ごとの DAT ファイル形式です。
+// Records は行頭のレコード種別コード（例: S20・D20）ごとの項目定義で、行には最長一致で当てはめます。
+// コードの先頭1文字が区分（S: ヘッダ、D: 明細、T: 合計、E: エンド）です。
+// 合計（T）レコードを定義したレイアウトでは、明細件数（detailCount）・金額合計（totalAmount）を照合します。
+type Layout struct {
+	Name        string                   `json:"name"`
+	Default     bool                     `json:"default"`
+	OroshiCodes []string                 `json:"oroshiCodes"`
+	Records     map[string][]LayoutField `json:"records"`
+}
+
+// DefaultLayout は MEDICODE 標準の DAT レイアウトです（S20・D20 は従来の固定位置の読み込みと同じ）。
+// config/dat_layouts.json の medicode と同じ定義にしてください。
+var DefaultLayout = Layout{
+	Name:    "medicode",
+	Default: true,
+	Records: map[string][]LayoutField{
+		recHeader + "20": {
+			{Name: FieldOroshiCode, Offset: 3, Length: 9, Type: TypeText},
+		},
+		recDetail + "20": {
+			{Name: FieldFlag, Offset: 3, Length: 1, Type: TypeNumber},
+			{Name: FieldDate, Offset: 4, Length: 8, Type: TypeDate},
+			{Name: FieldReceiptNumber, Offset: 12, Length: 10, Type: TypeText},
+			{Name: FieldLineNumber, Offset: 22, Length: 2, Type: TypeNumber},
+			{Name: FieldJan, Offset: 25, Length: 13, Type: TypeText},
+			{Name: FieldProductName, Offset: 38, Length: 40, Type: TypeText},
+			{Name: FieldQuantity, Offset: 78, Length: 5, Type: TypeNumber},
+			{Name: FieldUnitPrice, Offset: 83, Length: 9, Type: TypeNumber},
+			{Name: FieldSubtotal, Offset: 92, Length: 9, Type: TypeNumber},
+			{Name: FieldPackagingPrice, Offset: 101, Length: 8, Type: TypeNumber},
+			{Name: FieldExpiryDate, Offset: 109, Length: 6, Type: TypeDate},
+			{Name: FieldLotNumber, Offset: 115, Length: 6, Type: TypeText},
+		},
+		recTrailer + "20": {
+			{Name: FieldDetailCount, Offset: 3, Length: 6, Type: TypeNumber},
+			{Name: FieldTotalAmount, Offset: 9, Length: 12, Type: TypeNumber},
+		},
+		recEnd: {},
+	},
+}
+
+// requiredFields はレコード区分ごとに必須の項目です。
+var requiredFields = map[string][]string{
+	recHeader: {FieldOroshiCode},
+	recDetail: {
+		FieldDate, FieldFlag, FieldReceiptNumber, FieldLineNumber, FieldJan,
+		FieldProductName, FieldQuantity, FieldUnitPrice, FieldSubtotal,
+	},
+	recTrailer: {FieldDetailCount, FieldTotalAmount},
+	recEnd:     {},
+}
+
+// kindOf はレコード種別コードの区分（先頭1文字）を返します。
+func kindOf(code string) string {
+	if code == "" {
+		return ""
+	}
+	return code[:1]
+}
+
+var (
+	layoutMu sync.RWMutex
+	layouts  []Layout
+)
+
+// LayoutConfigPath は卸別レイアウト定義ファイルの既定パスです。
+const LayoutConfigPath = "config/dat_layouts.json"
+
+// check はレイアウト定義の整合性を確認します。
+func (l Layout) check() error {
+	if l.Name == "" {
+		return fmt.Errorf("レイアウト名がありません")
+	}
+	if !l.defines(recDetail) {
+		return fmt.Errorf("%s: 明細(D)レコードの定義がありません", l.Name)
+	}
+	for typ, fields := range l.Records {
+		required, ok := requiredFields[kindOf(typ)]
+		if !ok {
+			return fmt.Errorf("%s: レコード種別 %q は S・D・T・E のいずれかで始めてください", l.Name, typ)
+		}
+		for _, name := range required {
+			if _, ok := l.field(typ, name); !ok {
+				return fmt.Errorf("%s: %s レコードに %s がありません", l.Name, typ, name)
+			}
+		}
+		for _, f := range fields {
+			if f.Offset < 0 || f.Length <= 0 {
+				return fmt.Errorf("%s: %s.%s の位置・長さが不正です", l.Name, typ, f.Name)
+			}
+			switch f.Type {
+			case TypeText, TypeNumber, TypeDate:
+			default:
+				return fmt.Errorf("%s: %s.%s の型 %q は未対応です", l.Name, typ, f.Name, f.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// defines はレイアウトに区分 kind のレコードが定義されているかを返します。
+func (l Layout) defines(kind string) bool {
+	for code := range l.Records {
+		if kindOf(code) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// match は行頭に一致するレコード種別コードを最長一致で返します。
+func (l Layout) match(line []byte) (string, bool) {
+	best := ""
+	for code := range l.Records {
+		if len(code) > len(best) && len(line) >= len(code) && string(line[:len(code)]) == code {
+			best = code
+		}
+	}
+	return best, best != ""
+}
+
+// field はレコード種別 typ の項目 name を返します。
+func (l Layout) field(typ, name string) (LayoutField, bool) {
+	for _, f := range l.Records[typ] {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return LayoutField{}, false
+}
+
+// recordLen はレコード種別 typ の定義上の最小バイト長です。
+func (l Layout) recordLen(typ string) int {
+	n := 0
+	for _, f := range l.Records[typ] {
+		if end := f.Offset + f.Length; end > n {
+			n = end
+		}
+	}
+	return n
+}
+
+// Decode は生の Shift-JIS バイト列 line をレコード種別 typ の定義で項目に分解します。
+// バイト位置で切り出してから項目ごとに文字コードを変換するため、
+// 全角文字を含む項目があっても後続の項目はずれません。
+func (l Layout) Decode(typ string, line []byte) map[string]string {
+	out := make(map[string]string, len(l.Records[typ]))
+	for _, f := range l.Records[typ] {
+		raw := bytesOf(line, f.Offset, f.Offset+f.Length)
+		if f.Type == TypeText {
+			if s, err := japanese.ShiftJIS.NewDecoder().Bytes(raw); err == nil {
+				out[f.Name] = string(s)
+				continue
+			}
+		}
+		out[f.Name] = string(raw)
+	}
+	return out
+}
+
+// bytesOf は line から [start:end] を取り出します（短い行は可能な範囲）。
+func bytesOf(line []byte, start, end int) []byte {
+	if len(line) >= end {
+		return line[start:end]
+	} else if len(line) > start {
+		return line[start:]
+	}
+	return nil
+}
+
+// LoadLayouts は卸別レイアウト定義（JSON）を読み込みます。
+// ファイルが無い場合は組み込みの DefaultLayout のみを使います。
+func LoadLayouts(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("[DAT] layout file %s not found, using built-in layout", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Layouts []Layout `json:"layouts"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, l := range cfg.Layouts {
+		if err := l.check(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	layoutMu.Lock()
+	layouts = cfg.Layouts
+	layoutMu.Unlock()
+	log.Printf("[DAT] loaded %d layouts from %s", len(cfg.Layouts), path)
+	return nil
+}
+
+// LayoutFor は卸コードに対応するレイアウトを返します。
+// 該当が無ければ default 指定のレイアウト、それも無ければ DefaultLayout を返します。
+func LayoutFor(oroshiCode string) Layout {
+	layoutMu.RLock()
+	defer layoutMu.RUnlock()
+	code := strings.TrimSpace(oroshiCode)
+	var def *Layout
+	for i, l := range layouts {
+		if l.assigned(code) {
+			return l
+		}
+		if l.Default && def == nil {
+			def = &layouts[i]
+		}
+	}
+	if def != nil {
+		return *def
+	}
+	return DefaultLayout
+}
+
+// assigned は卸コードがレイアウトに割り当てられているかを返します。
+func (l Layout) assigned(oroshiCode string) bool {
+	for _, c := range l.OroshiCodes {
+		if c == oroshiCode {
+			return true
+		}
+	}
+	return false
+}
+
+// headerCode は line が l のヘッダ（S）レコードであれば、l の定義で読んだ卸コードを返します。
+func (l Layout) headerCode(line []byte) (string, bool) {
+	code, ok := l.match(line)
+	if !ok || kindOf(code) != recHeader {
+		return "", false
+	}
+	return strings.TrimSpace(l.Decode(code, line)[FieldOroshiCode]), true
+}
+
+// headerLayout はヘッダ行の生バイト列からその卸のレイアウトを選びます。
+// 卸コードの位置はレイアウトごとに異なるため、各レイアウト自身の S レコード定義で卸コードを読み、
+// そのレイアウトに割り当てられた卸コードであれば採用します。どれにも当たらなければ
+// 既定のレイアウトで読んだ卸コードを LayoutFor で引きます。
+// どのレイアウトでもヘッダとして読めない行は false を返します。
+func headerLayout(line []byte) (Layout, bool) {
+	layoutMu.RLock()
+	cands := append([]Layout(nil), layouts...)
+	layoutMu.RUnlock()
+	for _, l := range cands {
+		if code, ok := l.headerCode(line); ok && l.assigned(code) {
+			return l, true
+		}
+	}
+	if code, ok := LayoutFor("").headerCode(line); ok {
+		return LayoutFor(code), true
+	}
+	return Layout{}, false
+}
+
+// LayoutByName は名前でレイアウトを探します。
+func LayoutByName(name string) (Layout, bool) {
+	layoutMu.RLock()
+	defer layoutMu.RUnlock()
+	for _, l := range layouts {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	if name == DefaultLayout.Name {
+		return DefaultLayout, true
+	}
+	return Layout{}, false
+}
@@ -0,0 +1,197 @@
+package dat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MEDICODE DAT のレコード区分（レコード種別コードの先頭1文字）
+const (
+	recHeader  = "S" // ヘッダ（卸コード）
+	recDetail  = "D" // 明細
+	recTrailer = "T" // 合計（明細件数・金額合計）
+	recEnd     = "E" // エンド
+)
+
+// BlockCheck は S レコードから T レコードまでの１ブロック分の照合結果です。
+type BlockCheck struct {
+	OroshiCode         string `json:"oroshiCode"`
+	DetailCount        int    `json:"detailCount"`        // 実際に読んだ D レコード数
+	SubtotalSum        int64  `json:"subtotalSum"`        // D レコード小計の合計
+	TrailerFound       bool   `json:"trailerFound"`       // T レコードの有無
+	TrailerDetailCount int    `json:"trailerDetailCount"` // T レコード記載の件数
+	TrailerAmount      int64  `json:"trailerAmount"`      // T レコード記載の金額合計
+
+	trailerRequired bool // レイアウトに合計(T)レコードが定義されている
+}
+
+// Validation は DAT ファイル１本分の検証結果です。
+type Validation struct {
+	FileName    string         `json:"fileName"`
+	Valid       bool           `json:"valid"`
+	EndFound    bool           `json:"endFound"`
+	RecordTypes map[string]int `json:"recordTypes"` // レコード種別（先頭3文字）ごとの件数
+	Blocks      []BlockCheck   `json:"blocks"`
+	Errors      []string       `json:"errors"`
+	Warnings    []string       `json:"warnings"`
+	Rejected    int            `json:"rejected"`   // 取込を拒否した明細行数
+	LineErrors  []LineError    `json:"lineErrors"` // 拒否した明細行の項目ごとの理由
+}
+
+// validator は ParseDATFile の読み込みに合わせて検証結果を積み上げます。
+type validator struct {
+	v   Validation
+	cur *BlockCheck
+}
+
+func newValidator() *validator {
+	return &validator{v: Validation{RecordTypes: make(map[string]int)}}
+}
+
+// parseAmount は固定長の数値フィールドを整数に変換します。
+func parseAmount(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (vd *validator) errorf(format string, a ...interface{}) {
+	vd.v.Errors = append(vd.v.Errors, fmt.Sprintf(format, a...))
+}
+
+func (vd *validator) warnf(format string, a ...interface{}) {
+	vd.v.Warnings = append(vd.v.Warnings, fmt.Sprintf(format, a...))
+}
+
+// closeBlock は現在のブロックを確定させます。
+func (vd *validator) closeBlock() {
+	if vd.cur == nil {
+		return
+	}
+	vd.v.Blocks = append(vd.v.Blocks, *vd.cur)
+	vd.cur = nil
+}
+
+// header は S レコードを受け取り新しいブロックを開始します。
+// trailerRequired はブロックのレイアウトに合計(T)レコードが定義されているかです。
+func (vd *validator) header(lineNo int, oroshiCode string, trailerRequired bool) {
+	if vd.cur != nil && !vd.cur.TrailerFound {
+		vd.missingTrailer(fmt.Sprintf("%d行目: ", lineNo), "")
+	}
+	vd.closeBlock()
+	vd.cur = &BlockCheck{OroshiCode: oroshiCode, trailerRequired: trailerRequired}
+	if !trailerRequired {
+		vd.warnf("%d行目: 卸コード %s のレイアウトに合計(T)レコードの定義が無いため、明細件数・金額合計を照合していません",
+			lineNo, oroshiCode)
+	}
+}
+
+// missingTrailer は現在のブロックに合計(T)レコードが無いことを記録します。
+// レイアウトに合計レコードが定義されていなければ照合できないため何もしません。
+func (vd *validator) missingTrailer(prefix, suffix string) {
+	if vd.cur.trailerRequired {
+		vd.errorf("%s卸コード %s のブロックに合計(T)レコードがありません%s", prefix, vd.cur.OroshiCode, suffix)
+	}
+}
+
+// detail は D レコードを受け取り件数・小計を積み上げます。
+// minLen はレイアウト上の明細レコード長です。
+func (vd *validator) detail(lineNo, lineLen, minLen int, subtotal string) {
+	if vd.cur == nil {
+		vd.errorf("%d行目: ヘッダ(S)レコードより前に明細(D)レコードがあります", lineNo)
+		vd.cur = &BlockCheck{}
+	}
+	vd.cur.DetailCount++
+	if lineLen < minLen {
+		vd.errorf("%d行目: 明細レコードが短すぎます (%d/%dバイト)", lineNo, lineLen, minLen)
+	}
+	amt, err := parseAmount(subtotal)
+	if err != nil {
+		vd.errorf("%d行目: 小計が数値ではありません %q", lineNo, subtotal)
+		return
+	}
+	vd.cur.SubtotalSum += amt
+}
+
+// trailer は T レコードの明細件数・金額合計を受け取り現在のブロックと照合します。
+func (vd *validator) trailer(lineNo int, count, amount string) {
+	if vd.cur == nil {
+		vd.errorf("%d行目: 対応するヘッダ(S)の無い合計(T)レコードです", lineNo)
+		vd.cur = &BlockCheck{}
+	}
+	b := vd.cur
+	b.TrailerFound = true
+
+	cnt, err := parseAmount(count)
+	if err != nil {
+		vd.errorf("%d行目: 合計レコードの件数が数値ではありません", lineNo)
+	}
+	b.TrailerDetailCount = int(cnt)
+	if b.TrailerAmount, err = parseAmount(amount); err != nil {
+		vd.errorf("%d行目: 合計レコードの金額が数値ではありません", lineNo)
+	}
+
+	if b.TrailerDetailCount != b.DetailCount {
+		vd.errorf("卸コード %s: 明細件数が一致しません (合計レコード %d件 / 実際 %d件)",
+			b.OroshiCode, b.TrailerDetailCount, b.DetailCount)
+	}
+	if b.TrailerAmount != b.SubtotalSum {
+		vd.errorf("卸コード %s: 金額合計が一致しません (合計レコード %d / 明細合計 %d)",
+			b.OroshiCode, b.TrailerAmount, b.SubtotalSum)
+	}
+	vd.closeBlock()
+}
+
+// reject は取込を拒否した明細行の理由を記録します。
+func (vd *validator) reject(lineNo int, errs []LineError) {
+	vd.v.Rejected++
+	for _, e := range errs {
+		e.Line = lineNo
+		vd.v.LineErrors = append(vd.v.LineErrors, e)
+	}
+}
+
+// end は E レコードを受け取ります。
+func (vd *validator) end(lineNo int) {
+	if vd.v.EndFound {
+		vd.warnf("%d行目: エンド(E)レコードが複数あります", lineNo)
+	}
+	vd.v.EndFound = true
+}
+
+// unknown はレイアウトに定義の無いレコード種別を記録します。
+// 読み飛ばした行のあるファイルは取込内容が欠けている可能性があるため不正とします。
+func (vd *validator) unknown(lineNo int, line string) {
+	vd.errorf("%d行目: レイアウトに定義の無いレコード種別 %q を読み飛ばしました", lineNo, fieldOf(line, 0, 3))
+}
+
+// result は読み込み終了時の最終判定を行い結果を返します。
+func (vd *validator) result() Validation {
+	if vd.cur != nil {
+		if !vd.cur.TrailerFound {
+			vd.missingTrailer("", "（ファイルが途中で切れている可能性があります）")
+		}
+		vd.closeBlock()
+	}
+	if len(vd.v.Blocks) == 0 {
+		vd.errorf("ヘッダ(S)・明細(D)レコードがありません")
+	}
+	if vd.v.Rejected > 0 {
+		vd.errorf("取込を拒否した明細行が %d 行あります", vd.v.Rejected)
+	}
+	vd.v.Valid = len(vd.v.Errors) == 0
+	return vd.v
+}
+
+// fieldOf は固定長レコードから [start:end] を取り出します（短い行は可能な範囲）。
+func fieldOf(s string, start, end int) string {
+	if len(s) >= end {
+		return s[start:end]
+	} else if len(s) > start {
+		return s[start:]
+	}
+	return ""
+}
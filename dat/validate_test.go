@@ -0,0 +1,226 @@
+package dat
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	"YAMATO/oroshi"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// trailerLayout は合計(T)レコードを定義したテスト用レイアウトです。
+var trailerLayout = Layout{
+	Name: "test",
+	Records: map[string][]LayoutField{
+		"S20": DefaultLayout.Records["S20"],
+		"D20": DefaultLayout.Records["D20"],
+		"T20": {
+			{Name: FieldDetailCount, Offset: 3, Length: 6, Type: TypeNumber},
+			{Name: FieldTotalAmount, Offset: 9, Length: 12, Type: TypeNumber},
+		},
+		"E": {},
+	},
+}
+
+func TestLayoutMatch(t *testing.T) {
+	tests := []struct {
+		line string
+		code string
+		ok   bool
+	}{
+		{"S20123456789", "S20", true},
+		{"D201...", "D20", true},
+		{"T20000002", "T20", true},
+		{"E", "E", true},
+		{"D30abc", "", false}, // 先頭1文字だけでは明細とみなさない
+		{"S2", "", false},
+		{"X20", "", false},
+	}
+	for _, tt := range tests {
+		code, ok := trailerLayout.match([]byte(tt.line))
+		if code != tt.code || ok != tt.ok {
+			t.Errorf("match(%q) = %q, %v; want %q, %v", tt.line, code, ok, tt.code, tt.ok)
+		}
+	}
+	if err := trailerLayout.check(); err != nil {
+		t.Errorf("check: %v", err)
+	}
+	if err := (Layout{Name: "bad", Records: map[string][]LayoutField{"D20": DefaultLayout.Records["D20"], "X1": {}}}).check(); err == nil {
+		t.Error("check accepted record code X1")
+	}
+	if err := (Layout{Name: "bad", Records: map[string][]LayoutField{"D20": DefaultLayout.Records["D20"], "T20": {}}}).check(); err == nil {
+		t.Error("check accepted trailer without detailCount/totalAmount")
+	}
+}
+
+func TestHeaderLayout(t *testing.T) {
+	// 卸コードが既定と異なる位置にある卸のレイアウト
+	wide := Layout{
+		Name:        "wide",
+		OroshiCodes: []string{"987654321"},
+		Records: map[string][]LayoutField{
+			"S20": {{Name: FieldOroshiCode, Offset: 5, Length: 9, Type: TypeText}},
+			"D20": DefaultLayout.Records["D20"],
+		},
+	}
+	saved := layouts
+	layouts = []Layout{wide}
+	t.Cleanup(func() { layouts = saved })
+
+	tests := []struct {
+		line string
+		name string
+		ok   bool
+	}{
+		{"S20  987654321", "wide", true},   // 自身の定義で読んだ卸コードが割り当て済み
+		{"S20123456789", "medicode", true}, // 既定の位置で読んだ未割当の卸コード
+		{"S20987654321", "wide", true},     // 既定の位置で読んだ卸コードから LayoutFor で引く
+		{"D20120250401", "", false},        // 明細行
+		{"S2", "", false},
+	}
+	for _, tt := range tests {
+		l, ok := headerLayout([]byte(tt.line))
+		if ok != tt.ok || l.Name != tt.name {
+			t.Errorf("headerLayout(%q) = %q, %v; want %q, %v", tt.line, l.Name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+// step は validator に与える１行分の操作です。
+type step func(vd *validator, lineNo int)
+
+func header(trailer bool) step {
+	return func(vd *validator, n int) { vd.header(n, "123456789", trailer) }
+}
+
+func detail(subtotal string) step {
+	return func(vd *validator, n int) { vd.detail(n, 121, 121, subtotal) }
+}
+
+func trailer(count, amount string) step {
+	return func(vd *validator, n int) { vd.trailer(n, count, amount) }
+}
+
+func rejected() step {
+	return func(vd *validator, n int) {
+		vd.detail(n, 121, 121, "0")
+		vd.reject(n, []LineError{{Field: FieldQuantity, Value: "1x", Reason: "数値ではありません"}})
+	}
+}
+
+func unknownLine() step {
+	return func(vd *validator, n int) { vd.unknown(n, "D30xxxx") }
+}
+
+func TestValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []step
+		valid   bool
+		errPart string
+	}{
+		{"件数・金額が合計レコードと一致", []step{header(true), detail("100"), detail("250"), trailer("000002", "000000000350")}, true, ""},
+		{"明細件数の不一致", []step{header(true), detail("100"), trailer("000002", "000000000100")}, false, "明細件数が一致しません"},
+		{"金額合計の不一致", []step{header(true), detail("100"), detail("250"), trailer("000002", "000000000351")}, false, "金額合計が一致しません"},
+		{"合計レコードの件数が数値でない", []step{header(true), detail("100"), trailer("00000A", "000000000100")}, false, "件数が数値ではありません"},
+		{"途中で切れたファイル", []step{header(true), detail("100")}, false, "合計(T)レコードがありません"},
+		{"次のヘッダまでに合計レコードが無い", []step{header(true), detail("100"), header(true), detail("5"), trailer("1", "5")}, false, "合計(T)レコードがありません"},
+		{"拒否した明細行がある", []step{header(true), rejected(), detail("100"), trailer("2", "100")}, false, "拒否した明細行が 1 行"},
+		{"定義の無いレコード種別がある", []step{header(true), detail("100"), unknownLine(), trailer("1", "100")}, false, "定義の無いレコード種別"},
+		{"合計レコードの定義が無いレイアウトは照合しない", []step{header(false), detail("100")}, true, ""},
+		{"明細が無い", nil, false, "明細(D)レコードがありません"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vd := newValidator()
+			for i, s := range tt.steps {
+				s(vd, i+1)
+			}
+			v := vd.result()
+			if v.Valid != tt.valid {
+				t.Fatalf("Valid = %v, want %v (errors=%v)", v.Valid, tt.valid, v.Errors)
+			}
+			if tt.errPart != "" && !strings.Contains(strings.Join(v.Errors, "\n"), tt.errPart) {
+				t.Errorf("errors %v do not mention %q", v.Errors, tt.errPart)
+			}
+		})
+	}
+}
+
+// datLine は固定長の行を空白で埋めて作り、offset の位置に値を書き込みます。
+func datLine(n int, fields map[int]string) string {
+	b := bytes.Repeat([]byte(" "), n)
+	for off, v := range fields {
+		copy(b[off:], v)
+	}
+	return string(b)
+}
+
+func TestReadDATFileShippedLayout(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	oroshi.DB = db
+
+	d := func(line, qty, price, subtotal string) string {
+		return datLine(121, map[int]string{
+			0: "D20", 3: "1", 4: "20250401", 12: "0000012345", 22: line, 25: "4987123456784",
+			38: "TEST TABLET", 78: qty, 83: price, 92: subtotal, 101: "00001600", 109: "271231", 115: "AB1234",
+		})
+	}
+	file := func(trailerCount string) string {
+		return strings.Join([]string{
+			"S20123456789",
+			d("01", "00002", "000001500", "000003000"),
+			d("02", "00001", "000000050", "000000050"),
+			"T20" + trailerCount + "000000003050",
+			"E",
+		}, "\r\n") + "\r\n"
+	}
+
+	saved := layouts
+	t.Cleanup(func() { layouts = saved })
+	for _, src := range []string{"config/dat_layouts.json", "DefaultLayout"} {
+		t.Run(src, func(t *testing.T) {
+			layouts = nil
+			if src != "DefaultLayout" {
+				if err := LoadLayouts("../" + src); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			recs, v, err := ReadDATFile(strings.NewReader(file("000002")), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !v.Valid || len(recs) != 2 || !v.EndFound || len(v.Blocks) != 1 || !v.Blocks[0].TrailerFound {
+				t.Fatalf("valid file: records=%d validation=%+v", len(recs), v)
+			}
+			if len(v.Warnings) != 0 {
+				t.Errorf("warnings = %v", v.Warnings)
+			}
+
+			_, v, err = ReadDATFile(strings.NewReader(file("000003")), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Valid || !strings.Contains(strings.Join(v.Errors, "\n"), "明細件数が一致しません") {
+				t.Errorf("trailer mismatch: valid=%v errors=%v", v.Valid, v.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,620 @@
+package importer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 取込バッチ行の操作区分
+const (
+	ActionInsert  = "insert"  // 新規挿入（ロールバックで削除）
+	ActionReplace = "replace" // 既存行の置換（ロールバックで旧行を復元）
+	ActionDelete  = "delete"  // 既存行の削除（ロールバックで旧行を復元）
+)
+
+// バッチの状態
+const (
+	StatusImported   = "imported"
+	StatusFailed     = "failed" // 途中で失敗した取込（確定した変更だけを記録し、ロールバックできます）
+	StatusRolledBack = "rolledback"
+)
+
+// Row は SELECT * の１行分（列名→値）です。
+type Row map[string]interface{}
+
+// BatchFile は取込ファイル１本分の情報です。
+type BatchFile struct {
+	FileName string `json:"fileName"`
+	SHA256   string `json:"sha256"`
+}
+
+// LineError は取込を拒否した行とその理由です（バッチごとに保存し CSV で取得できます）。
+type LineError struct {
+	FileName string `json:"fileName"`
+	Line     int    `json:"line"`
+	Field    string `json:"field"`
+	Value    string `json:"value"`
+	Reason   string `json:"reason"`
+}
+
+type change struct {
+	table  string
+	action string
+	key    Row
+	old    Row
+}
+
+// Batch はアップロード１回分の取込バッチです。
+// 取込処理は Inserted/Replaced/Deleted で変更内容を記録し、最後に Save します。
+// nil の Batch に対する記録は何もしません。
+type Batch struct {
+	ID          int64       `json:"batchId"`
+	Type        string      `json:"importType"`
+	Files       []BatchFile `json:"files"`
+	ImportedAt  string      `json:"importedAt"`
+	RowCount    int         `json:"rowCount"`
+	Inserted    int         `json:"insertedCount"`
+	Replaced    int         `json:"replacedCount"`
+	Deleted     int         `json:"deletedCount"`
+	MasterCount int         `json:"masterCount"` // 自動作成・更新された MA0/MA2 行数
+	ErrorCount  int         `json:"errorCount"`  // 取込を拒否した行の理由の件数
+	Status      string      `json:"status"`
+
+	changes []change
+	errors  []LineError
+}
+
+// NewBatch は importType の新しいバッチを返します。
+func NewBatch(importType string) *Batch {
+	return &Batch{Type: importType, Status: StatusImported}
+}
+
+// FileHash はファイル内容の SHA-256 を16進文字列で返します。
+func FileHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AddFile は取込ファイル名と内容のハッシュを記録します。
+func (b *Batch) AddFile(name string, data []byte) {
+	if b == nil {
+		return
+	}
+	b.Files = append(b.Files, BatchFile{FileName: name, SHA256: FileHash(data)})
+}
+
+// AddError は取込を拒否した行の理由を記録します。
+func (b *Batch) AddError(e LineError) {
+	if b == nil {
+		return
+	}
+	b.errors = append(b.errors, e)
+	b.ErrorCount++
+}
+
+// masterTables は取込時に自動作成されうるマスターテーブルとその主キー列です。
+var masterTables = map[string]string{
+	"ma0": "MA000JC000JanCode",
+	"ma2": "MA2JanCode",
+}
+
+func (b *Batch) record(table, action string, key, old Row) {
+	if b == nil {
+		return
+	}
+	b.changes = append(b.changes, change{table: table, action: action, key: key, old: old})
+	b.count(table, action)
+}
+
+func (b *Batch) count(table, action string) {
+	if _, ok := masterTables[table]; ok {
+		b.MasterCount++
+		return
+	}
+	switch action {
+	case ActionInsert:
+		b.Inserted++
+	case ActionReplace:
+		b.Replaced++
+	case ActionDelete:
+		b.Deleted++
+	}
+}
+
+// Checkpoint は現在までに記録した変更の位置を返します。
+func (b *Batch) Checkpoint() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.changes)
+}
+
+// Discard は Checkpoint 以降に記録した変更を捨てます。
+// 記録した書き込みのトランザクションを巻き戻したときに使います。
+func (b *Batch) Discard(cp int) {
+	if b == nil || cp >= len(b.changes) {
+		return
+	}
+	b.changes = b.changes[:cp]
+	b.Inserted, b.Replaced, b.Deleted, b.MasterCount = 0, 0, 0, 0
+	for _, c := range b.changes {
+		b.count(c.table, c.action)
+	}
+}
+
+// RecordInsert は key の行を新規挿入したことを記録します。
+func (b *Batch) RecordInsert(table string, key Row) {
+	b.record(table, ActionInsert, key, nil)
+}
+
+// RecordReplace は key の行を置き換えたことを旧行とともに記録します。
+func (b *Batch) RecordReplace(table string, key, old Row) {
+	b.record(table, ActionReplace, key, old)
+}
+
+// RecordDelete は key の行を削除したことを旧行とともに記録します。
+func (b *Batch) RecordDelete(table string, key, old Row) {
+	b.record(table, ActionDelete, key, old)
+}
+
+// RecordUpsert は INSERT OR REPLACE の前に取得した旧行 old（無ければ nil）から
+// 挿入か置換かを判定して記録します。
+func (b *Batch) RecordUpsert(table string, key, old Row) {
+	if old == nil {
+		b.RecordInsert(table, key)
+	} else {
+		b.RecordReplace(table, key, old)
+	}
+}
+
+// TrackMasters は fn の実行前後で JAN の MA0/MA2 行を比較し、
+// 自動作成・置換された行をバッチに記録します。
+func (b *Batch) TrackMasters(jan string, fn func()) {
+	if b == nil || jan == "" {
+		fn()
+		return
+	}
+	tables := []string{"ma0", "ma2"}
+	before := make(map[string]Row, len(tables))
+	for _, t := range tables {
+		before[t], _ = SelectRow(t, Row{masterTables[t]: jan})
+	}
+	fn()
+	for _, t := range tables {
+		key := Row{masterTables[t]: jan}
+		after, _ := SelectRow(t, key)
+		switch {
+		case before[t] == nil && after != nil:
+			b.RecordInsert(t, key)
+		case before[t] != nil && after != nil && !reflect.DeepEqual(before[t], after):
+			b.RecordReplace(t, key, before[t])
+		}
+	}
+}
+
+// whereKey は key から "k1 = ? AND k2 = ?" と引数を組み立てます（列名順）。
+func whereKey(key Row) (string, []interface{}) {
+	cols := make([]string, 0, len(key))
+	for c := range key {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	conds := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	for i, c := range cols {
+		conds[i] = c + " = ?"
+		args[i] = key[c]
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// selectRows は任意の SELECT の結果を列名→値のマップで返します。
+func selectRows(q querier, query string, args ...interface{}) ([]Row, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var out []Row
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		r := make(Row, len(cols))
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				r[c] = string(b)
+			} else {
+				r[c] = vals[i]
+			}
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// SelectRows は table から where 句に一致する行を返します。
+func SelectRows(table, where string, args ...interface{}) ([]Row, error) {
+	return selectRows(DB, "SELECT * FROM "+table+" "+where, args...)
+}
+
+// SelectRowsTx は SelectRows をトランザクション tx の中で実行します。
+func SelectRowsTx(tx *sql.Tx, table, where string, args ...interface{}) ([]Row, error) {
+	return selectRows(tx, "SELECT * FROM "+table+" "+where, args...)
+}
+
+// SelectRow は主キー key に一致する行を返します（無ければ nil）。
+func SelectRow(table string, key Row) (Row, error) {
+	cond, args := whereKey(key)
+	rows, err := SelectRows(table, "WHERE "+cond, args...)
+	if err != nil {
+		log.Printf("[IMPORT] select %s error: %v", table, err)
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0], nil
+}
+
+// Save はバッチと変更行を保存し、b.ID を設定します。
+func (b *Batch) Save() error {
+	if b == nil {
+		return nil
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+	if err := b.SaveTx(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Fail は途中で失敗した取込を状態 failed で保存し、cause に結果を添えたエラーを返します。
+// それまでに確定した変更はバッチに残るため、ロールバックで取り消せます。
+func (b *Batch) Fail(cause error) error {
+	if b == nil {
+		return cause
+	}
+	b.Status = StatusFailed
+	if err := b.Save(); err != nil {
+		return fmt.Errorf("%w（取込バッチの保存にも失敗しました: %v）", cause, err)
+	}
+	log.Printf("[IMPORT] %s batch %d saved as failed: %v", b.Type, b.ID, cause)
+	return fmt.Errorf("%w（途中までの変更は取込バッチ %d に記録しました）", cause, b.ID)
+}
+
+// SaveTx はデータの書き込みと同じトランザクション tx でバッチを保存します。
+// コミットは呼び出し側が行います。
+func (b *Batch) SaveTx(tx *sql.Tx) error {
+	if b == nil {
+		return nil
+	}
+	b.ImportedAt = time.Now().Format("2006-01-02 15:04:05")
+
+	names := make([]string, len(b.Files))
+	for i, f := range b.Files {
+		names[i] = f.FileName
+	}
+	sha := ""
+	if len(b.Files) == 1 {
+		sha = b.Files[0].SHA256
+	}
+	res, err := tx.Exec(`
+INSERT INTO import_batches
+  (importType, fileName, sha256, importedAt, rowCount,
+   insertedCount, replacedCount, deletedCount, masterCount, status)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.Type, strings.Join(names, ", "), sha, b.ImportedAt, b.RowCount,
+		b.Inserted, b.Replaced, b.Deleted, b.MasterCount, b.Status,
+	)
+	if err != nil {
+		return fmt.Errorf("insert import_batches: %w", err)
+	}
+	if b.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+
+	for _, f := range b.Files {
+		if _, err := tx.Exec(
+			`INSERT INTO import_batch_files (batchId, fileName, sha256) VALUES (?, ?, ?)`,
+			b.ID, f.FileName, f.SHA256,
+		); err != nil {
+			return fmt.Errorf("insert import_batch_files: %w", err)
+		}
+	}
+
+	for _, e := range b.errors {
+		if _, err := tx.Exec(`
+INSERT INTO import_errors (batchId, fileName, lineNo, field, value, reason)
+VALUES (?, ?, ?, ?, ?, ?)`,
+			b.ID, e.FileName, e.Line, e.Field, e.Value, e.Reason,
+		); err != nil {
+			return fmt.Errorf("insert import_errors: %w", err)
+		}
+	}
+
+	stmt, err := tx.Prepare(`
+INSERT INTO import_batch_rows (batchId, seq, tableName, action, keyJson, oldJson)
+VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, c := range b.changes {
+		keyJSON, _ := json.Marshal(c.key)
+		var oldJSON interface{}
+		if c.old != nil {
+			bs, _ := json.Marshal(c.old)
+			oldJSON = string(bs)
+		}
+		if _, err := stmt.Exec(b.ID, i+1, c.table, c.action, string(keyJSON), oldJSON); err != nil {
+			return fmt.Errorf("insert import_batch_rows: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeRow は保存済み JSON を Row に戻します（数値は json.Number のまま）。
+func decodeRow(s string) (Row, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	var r Row
+	if err := dec.Decode(&r); err != nil {
+		return nil, err
+	}
+	for k, v := range r {
+		if n, ok := v.(json.Number); ok {
+			r[k] = n.String()
+		}
+	}
+	return r, nil
+}
+
+// ListBatches は取込バッチを新しい順に返します。
+func ListBatches(limit int) ([]Batch, error) {
+	rows, err := DB.Query(`
+SELECT batchId, importType, importedAt, rowCount,
+       insertedCount, replacedCount, deletedCount, masterCount,
+       (SELECT COUNT(*) FROM import_errors e WHERE e.batchId = import_batches.batchId),
+       status
+  FROM import_batches
+ ORDER BY batchId DESC
+ LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]Batch, 0)
+	for rows.Next() {
+		var b Batch
+		if err := rows.Scan(
+			&b.ID, &b.Type, &b.ImportedAt, &b.RowCount,
+			&b.Inserted, &b.Replaced, &b.Deleted, &b.MasterCount, &b.ErrorCount, &b.Status,
+		); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range out {
+		files, err := DB.Query(
+			`SELECT fileName, sha256 FROM import_batch_files WHERE batchId = ? ORDER BY rowid`, out[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for files.Next() {
+			var f BatchFile
+			if err := files.Scan(&f.FileName, &f.SHA256); err == nil {
+				out[i].Files = append(out[i].Files, f)
+			}
+		}
+		files.Close()
+	}
+	return out, nil
+}
+
+// laterConflicts は batchID より後の有効な（ロールバックしていない）バッチが
+// 同じ行を変更している件数を返します。
+func laterConflicts(batchID int64) (int, error) {
+	var n int
+	err := DB.QueryRow(`
+SELECT COUNT(*)
+  FROM import_batch_rows r
+  JOIN import_batch_rows l ON l.tableName = r.tableName AND l.keyJson = r.keyJson
+  JOIN import_batches lb   ON lb.batchId = l.batchId
+ WHERE r.batchId = ? AND l.batchId > ? AND lb.status <> ?`,
+		batchID, batchID, StatusRolledBack).Scan(&n)
+	return n, err
+}
+
+// Rollback はバッチの変更を新しい順に取り消し、状態を rolledback にします。
+// 後続バッチが同じ行を変更している場合は force が true のときだけ実行します。
+func Rollback(batchID int64, force bool) error {
+	var status string
+	if err := DB.QueryRow(
+		`SELECT status FROM import_batches WHERE batchId = ?`, batchID,
+	).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("バッチ %d が見つかりません", batchID)
+		}
+		return err
+	}
+	if status == StatusRolledBack {
+		return fmt.Errorf("バッチ %d はロールバック済みです", batchID)
+	}
+	if !force {
+		n, err := laterConflicts(batchID)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("後続の取込バッチが同じ行を %d 件変更しています（force=1 で強制実行）", n)
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	changes, err := selectRows(tx, `
+SELECT tableName, action, keyJson, COALESCE(oldJson, '') AS oldJson
+  FROM import_batch_rows WHERE batchId = ? ORDER BY seq DESC`, batchID)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		table := fmt.Sprint(c["tableName"])
+		key, err := decodeRow(fmt.Sprint(c["keyJson"]))
+		if err != nil {
+			return fmt.Errorf("keyJson decode: %w", err)
+		}
+		cond, args := whereKey(key)
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE "+cond, args...); err != nil {
+			return fmt.Errorf("rollback delete %s: %w", table, err)
+		}
+		if c["action"] == ActionInsert {
+			continue
+		}
+		old, err := decodeRow(fmt.Sprint(c["oldJson"]))
+		if err != nil {
+			return fmt.Errorf("oldJson decode: %w", err)
+		}
+		cols := make([]string, 0, len(old))
+		for col := range old {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		ph := make([]string, len(cols))
+		vals := make([]interface{}, len(cols))
+		for i, col := range cols {
+			ph[i] = "?"
+			vals[i] = old[col]
+		}
+		if _, err := tx.Exec(
+			"INSERT OR REPLACE INTO "+table+" ("+strings.Join(cols, ",")+") VALUES ("+strings.Join(ph, ",")+")",
+			vals...,
+		); err != nil {
+			return fmt.Errorf("rollback restore %s: %w", table, err)
+		}
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE import_batches SET status = ?, rolledBackAt = ? WHERE batchId = ?`,
+		StatusRolledBack, time.Now().Format("2006-01-02 15:04:05"), batchID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BatchesHandler は /api/import/batches の GET（一覧）を処理します
+func BatchesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	list, err := ListBatches(limit)
+	if err != nil {
+		log.Printf("[IMPORT] list batches error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
+
+// RollbackHandler は /api/import/rollback?id=N の POST を処理します
+func RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "id が不正です", http.StatusBadRequest)
+		return
+	}
+	force := r.URL.Query().Get("force") == "1"
+	if err := Rollback(id, force); err != nil {
+		log.Printf("[IMPORT] rollback %d error: %v", id, err)
+		http.Error(w, "ロールバックエラー: "+err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("[IMPORT] batch %d rolled back", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ErrorsCSVHandler は /api/import/errors.csv?batch=N の GET を処理し、
+// バッチで拒否した行の一覧を CSV（UTF-8 BOM 付き）で返します。
+func ErrorsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("batch"), 10, 64)
+	if err != nil {
+		http.Error(w, "batch が不正です", http.StatusBadRequest)
+		return
+	}
+	rows, err := DB.Query(`
+SELECT fileName, lineNo, field, value, reason
+  FROM import_errors WHERE batchId = ? ORDER BY rowid`, id)
+	if err != nil {
+		log.Printf("[IMPORT] errors query error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="import_errors_%d.csv"`, id))
+	w.Write([]byte("\xEF\xBB\xBF"))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ファイル名", "行番号", "項目", "値", "理由"})
+	for rows.Next() {
+		var e LineError
+		if err := rows.Scan(&e.FileName, &e.Line, &e.Field, &e.Value, &e.Reason); err != nil {
+			log.Printf("[IMPORT] errors scan error: %v", err)
+			continue
+		}
+		cw.Write([]string{e.FileName, strconv.Itoa(e.Line), e.Field, e.Value, e.Reason})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,254 @@
+package importer
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB はスキーマを適用したメモリ DB を DB に設定します。
+// テスト用に主キー k の items テーブルを追加します。
+func openTestDB(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE items (k TEXT PRIMARY KEY, v TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	DB = db
+}
+
+func exec(t *testing.T, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := DB.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+// upsert は items に v を書き込み、その変更を batch に記録します。
+func upsert(t *testing.T, b *Batch, k, v string) {
+	t.Helper()
+	key := Row{"k": k}
+	old, err := SelectRow("items", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, `INSERT OR REPLACE INTO items (k, v) VALUES (?, ?)`, k, v)
+	b.RecordUpsert("items", key, old)
+}
+
+func remove(t *testing.T, b *Batch, k string) {
+	t.Helper()
+	key := Row{"k": k}
+	old, err := SelectRow("items", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, `DELETE FROM items WHERE k = ?`, k)
+	b.RecordDelete("items", key, old)
+}
+
+func save(t *testing.T, b *Batch) int64 {
+	t.Helper()
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return b.ID
+}
+
+// items は items テーブルの内容を "k=v" の列で返します。
+func items(t *testing.T) string {
+	t.Helper()
+	rows, err := SelectRows("items", "ORDER BY k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, r := range rows {
+		out = append(out, r["k"].(string)+"="+r["v"].(string))
+	}
+	return strings.Join(out, ",")
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T) int64 // 取り消すバッチの ID を返す
+		force    bool
+		errPart  string
+		want     string
+		conflict int
+	}{
+		{
+			name: "挿入・置換・削除を取り消して元の行に戻す",
+			setup: func(t *testing.T) int64 {
+				exec(t, `INSERT INTO items VALUES ('a', '1'), ('b', '2')`)
+				b := NewBatch("test")
+				upsert(t, b, "a", "10")
+				upsert(t, b, "c", "30")
+				remove(t, b, "b")
+				return save(t, b)
+			},
+			want: "a=1,b=2",
+		},
+		{
+			name: "同じ行を後続バッチが変更していれば force なしでは拒否",
+			setup: func(t *testing.T) int64 {
+				b1 := NewBatch("test")
+				upsert(t, b1, "a", "1")
+				id := save(t, b1)
+				b2 := NewBatch("test")
+				upsert(t, b2, "a", "2")
+				save(t, b2)
+				return id
+			},
+			errPart:  "後続の取込バッチ",
+			want:     "a=2",
+			conflict: 1,
+		},
+		{
+			name: "force なら後続バッチがあっても取り消す",
+			setup: func(t *testing.T) int64 {
+				b1 := NewBatch("test")
+				upsert(t, b1, "a", "1")
+				id := save(t, b1)
+				b2 := NewBatch("test")
+				upsert(t, b2, "a", "2")
+				save(t, b2)
+				return id
+			},
+			force:    true,
+			conflict: 1,
+		},
+		{
+			name: "ロールバック済みの後続バッチは衝突に数えない",
+			setup: func(t *testing.T) int64 {
+				b1 := NewBatch("test")
+				upsert(t, b1, "a", "1")
+				id := save(t, b1)
+				b2 := NewBatch("test")
+				upsert(t, b2, "a", "2")
+				if err := Rollback(save(t, b2), false); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+		},
+		{
+			name: "別の行だけを変更した後続バッチは衝突しない",
+			setup: func(t *testing.T) int64 {
+				b1 := NewBatch("test")
+				upsert(t, b1, "a", "1")
+				id := save(t, b1)
+				b2 := NewBatch("test")
+				upsert(t, b2, "b", "2")
+				save(t, b2)
+				return id
+			},
+			want: "b=2",
+		},
+		{
+			name: "途中で失敗したバッチも記録済みの変更を取り消せる",
+			setup: func(t *testing.T) int64 {
+				exec(t, `INSERT INTO items VALUES ('a', '1')`)
+				b := NewBatch("test")
+				upsert(t, b, "a", "10")
+				upsert(t, b, "b", "20")
+				if err := b.Fail(sql.ErrConnDone); !strings.Contains(err.Error(), "取込バッチ") {
+					t.Fatalf("Fail error %q does not mention the batch", err)
+				}
+				if b.Status != StatusFailed {
+					t.Fatalf("status = %q, want %q", b.Status, StatusFailed)
+				}
+				return b.ID
+			},
+			want: "a=1",
+		},
+		{
+			name: "失敗した後続バッチも衝突に数える",
+			setup: func(t *testing.T) int64 {
+				b1 := NewBatch("test")
+				upsert(t, b1, "a", "1")
+				id := save(t, b1)
+				b2 := NewBatch("test")
+				upsert(t, b2, "a", "2")
+				b2.Fail(sql.ErrConnDone)
+				return id
+			},
+			errPart:  "後続の取込バッチ",
+			want:     "a=2",
+			conflict: 1,
+		},
+		{
+			name: "ロールバック済みのバッチは再実行できない",
+			setup: func(t *testing.T) int64 {
+				b := NewBatch("test")
+				upsert(t, b, "a", "1")
+				id := save(t, b)
+				if err := Rollback(id, false); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			errPart: "ロールバック済み",
+		},
+		{
+			name:    "存在しないバッチ",
+			setup:   func(t *testing.T) int64 { return 99 },
+			errPart: "見つかりません",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			id := tt.setup(t)
+
+			n, err := laterConflicts(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.conflict {
+				t.Errorf("laterConflicts = %d, want %d", n, tt.conflict)
+			}
+
+			err = Rollback(id, tt.force)
+			if tt.errPart != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errPart) {
+					t.Fatalf("Rollback error = %v, want %q", err, tt.errPart)
+				}
+			} else if err != nil {
+				t.Fatalf("Rollback: %v", err)
+			}
+			if got := items(t); got != tt.want {
+				t.Errorf("items = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	b := NewBatch("test")
+	b.RecordInsert("ma0", Row{"MA000JC000JanCode": "4987000000001"})
+	cp := b.Checkpoint()
+	b.RecordDelete("items", Row{"k": "a"}, Row{"k": "a", "v": "1"})
+	b.RecordInsert("items", Row{"k": "b"})
+	b.Discard(cp)
+	if len(b.changes) != 1 || b.MasterCount != 1 || b.Inserted != 0 || b.Deleted != 0 {
+		t.Errorf("after Discard: changes=%d master=%d inserted=%d deleted=%d, want 1/1/0/0",
+			len(b.changes), b.MasterCount, b.Inserted, b.Deleted)
+	}
+}
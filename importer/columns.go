@@ -0,0 +1,98 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/width"
+)
+
+// Column は取込プロファイルでの１項目の列の探し方です。
+// Headers のいずれかに一致する見出しの列を使い、見つからなければ Index（0 始まり）を使います。
+type Column struct {
+	Field   string   `json:"field"`
+	Headers []string `json:"headers"`
+	Index   *int     `json:"index,omitempty"`
+}
+
+// IntP は Column.Index などに使う int のポインタを返します。
+func IntP(i int) *int { return &i }
+
+// NormHeader は見出しの比較用に全角英数・前後空白・引用符・BOM を正規化します。
+func NormHeader(s string) string {
+	s = strings.TrimPrefix(s, "\ufeff")
+	s = strings.Trim(width.Fold.String(s), "\" ")
+	return strings.ToUpper(s)
+}
+
+// ColumnIndex は見出し行 header から各項目の列位置を求めます。
+// byHeader が false の場合は見出しに無い項目に Index を使います。見つからない項目は -1 です。
+func ColumnIndex(cols []Column, header []string, byHeader bool) map[string]int {
+	pos := make(map[string]int, len(header))
+	for i, h := range header {
+		if _, dup := pos[NormHeader(h)]; !dup {
+			pos[NormHeader(h)] = i
+		}
+	}
+	idx := make(map[string]int, len(cols))
+	for _, c := range cols {
+		idx[c.Field] = -1
+		for _, h := range c.Headers {
+			if i, ok := pos[NormHeader(h)]; ok {
+				idx[c.Field] = i
+				break
+			}
+		}
+		if idx[c.Field] < 0 && !byHeader && c.Index != nil {
+			idx[c.Field] = *c.Index
+		}
+	}
+	return idx
+}
+
+// ParseDate は layouts のいずれかで日付を解釈し YYYYMMDD で返します。
+func ParseDate(s string, layouts []string) (string, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format("20060102"), nil
+		}
+	}
+	return "", fmt.Errorf("日付 %q は %v のいずれの形式でもありません", s, layouts)
+}
+
+// CheckEncoding はプロファイルの encoding 指定を確認します。
+func CheckEncoding(enc string) error {
+	switch enc {
+	case "", "auto", "sjis", "utf8":
+		return nil
+	}
+	return fmt.Errorf("encoding %q は未対応です", enc)
+}
+
+// NewCSVReader は data を encoding（"sjis"・"utf8"、空または "auto" は BOM・UTF-8 妥当性で判定）に従って
+// UTF-8 で読む csv.Reader を返します。
+func NewCSVReader(data []byte, encoding string) *csv.Reader {
+	if encoding == "" || encoding == "auto" {
+		encoding = "sjis"
+		if bytes.HasPrefix(data, []byte("\xef\xbb\xbf")) || utf8.Valid(data) {
+			encoding = "utf8"
+		}
+	}
+	var src io.Reader = bytes.NewReader(data)
+	if encoding == "sjis" {
+		src = transform.NewReader(src, japanese.ShiftJIS.NewDecoder())
+	}
+	rd := csv.NewReader(src)
+	rd.LazyQuotes = true
+	rd.FieldsPerRecord = -1
+	rd.TrimLeadingSpace = true
+	return rd
+}
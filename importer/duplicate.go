@@ -0,0 +1,65 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ErrAlreadyImported は同じ内容のファイルが取込済みのときに返されます。
+var ErrAlreadyImported = errors.New("同じ内容のファイルが取込済みです")
+
+// DuplicateFile は取込済みのファイルと内容が一致したアップロードファイルです。
+type DuplicateFile struct {
+	FileName     string `json:"fileName"`
+	SHA256       string `json:"sha256"`
+	BatchID      int64  `json:"batchId"`      // 0 は同じアップロード内の重複
+	PrevFileName string `json:"prevFileName"` // 取込済み側のファイル名
+	ImportedAt   string `json:"importedAt"`
+}
+
+// Duplicates はバッチのファイルのうち、同じ取込種別でロールバックされていない
+// バッチに同じ SHA-256 のファイルがあるもの（または同一アップロード内の重複）を返します。
+// force が true の場合は常に nil を返します。
+func (b *Batch) Duplicates(force bool) []DuplicateFile {
+	if b == nil || force {
+		return nil
+	}
+	var out []DuplicateFile
+	seen := make(map[string]string, len(b.Files))
+	for _, f := range b.Files {
+		if prev, ok := seen[f.SHA256]; ok {
+			out = append(out, DuplicateFile{FileName: f.FileName, SHA256: f.SHA256, PrevFileName: prev})
+			continue
+		}
+		seen[f.SHA256] = f.FileName
+
+		d := DuplicateFile{FileName: f.FileName, SHA256: f.SHA256}
+		err := DB.QueryRow(`
+SELECT f.batchId, f.fileName, b.importedAt
+  FROM import_batch_files f
+  JOIN import_batches b ON b.batchId = f.batchId
+ WHERE f.sha256 = ? AND b.importType = ? AND b.status = ?
+ ORDER BY f.batchId DESC
+ LIMIT 1`, f.SHA256, b.Type, StatusImported).Scan(&d.BatchID, &d.PrevFileName, &d.ImportedAt)
+		if err == nil {
+			out = append(out, d)
+		} else if err != sql.ErrNoRows {
+			log.Printf("[IMPORT] duplicate lookup error %s: %v", f.FileName, err)
+		}
+	}
+	return out
+}
+
+// WriteDuplicates は取込済みファイルの一覧を 409 Conflict で返します。
+// クライアントは force=1 を付けて再送すると取り込めます。
+func WriteDuplicates(w http.ResponseWriter, dups []DuplicateFile) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      ErrAlreadyImported.Error(),
+		"duplicates": dups,
+	})
+}
@@ -0,0 +1,52 @@
+package importer
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// TableColumns は table の列名を返します（テーブルが無ければ空）。
+func TableColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			def              sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &def, &pk); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
+
+// AddColumns は schema.sql 適用後に呼び出し、既存の table に無い列を追加します。
+// defs は列名と列定義（例: "REAL NOT NULL DEFAULT 0"）の組です。
+func AddColumns(db *sql.DB, table string, defs [][2]string) error {
+	cols, err := TableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(cols))
+	for _, c := range cols {
+		have[c] = true
+	}
+	for _, d := range defs {
+		if have[d[0]] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + d[0] + ` ` + d[1]); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", table, d[0], err)
+		}
+		log.Printf("[SCHEMA] added column %s.%s", table, d[0])
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Package importer は DAT・USAGE・棚卸アップロードに共通する
+// 取込前プレビュー（ドライラン）と確定処理を扱います。
+package importer
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var DB *sql.DB
+
+// SetDB は main から DB を受け取ります
+func SetDB(db *sql.DB) {
+	DB = db
+}
+
+// プレビュー行の判定区分
+const (
+	MarkNew        = "new"        // 新規行
+	MarkDuplicate  = "duplicate"  // 既存の主キーと重複（置換または無視される）
+	MarkUnknownJan = "unknownJan" // JCSHMS/JANCODE マスターに無い JAN
+	MarkCreateMA2  = "createMa2"  // 取込時に MA2 が新規作成される
+)
+
+// PreviewRow はプレビュー対象の１行分の判定結果です。
+type PreviewRow struct {
+	Row   int      `json:"row"`
+	Jan   string   `json:"jan"`
+	Name  string   `json:"name"`
+	Key   string   `json:"key"`
+	Marks []string `json:"marks"`
+}
+
+// Preview はアップロード１回分のプレビュー結果です。
+type Preview struct {
+	Token  string         `json:"token"`
+	Type   string         `json:"type"`
+	Rows   []PreviewRow   `json:"rows"`
+	Counts map[string]int `json:"counts"`
+	Extra  interface{}    `json:"extra,omitempty"`
+}
+
+// NewPreview は Rows から Counts を集計した Preview を返します。
+func NewPreview(typ string, rows []PreviewRow, extra interface{}) *Preview {
+	p := &Preview{Type: typ, Rows: rows, Counts: make(map[string]int), Extra: extra}
+	for _, r := range rows {
+		for _, m := range r.Marks {
+			p.Counts[m]++
+		}
+	}
+	p.Counts["total"] = len(rows)
+	return p
+}
+
+// JanState は JAN のマスター登録状況を調べ、プレビュー用の区分を返します。
+// CheckOrCreateMA0 と同じ判定で、YJ が得られない JAN は MA2 作成対象になります。
+func JanState(jan string) []string {
+	var inMaster, inMA2 int
+	var ma0YJ sql.NullString
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM jcshms WHERE JC000JanCode = ?`, jan).Scan(&inMaster); err != nil {
+		log.Printf("[IMPORT] jcshms lookup error JAN=%s: %v", jan, err)
+	}
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM ma2 WHERE MA2JanCode = ?`, jan).Scan(&inMA2); err != nil {
+		log.Printf("[IMPORT] ma2 lookup error JAN=%s: %v", jan, err)
+	}
+	err := DB.QueryRow(`SELECT MA009JC009YJCode FROM ma0 WHERE MA000JC000JanCode = ?`, jan).Scan(&ma0YJ)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[IMPORT] ma0 lookup error JAN=%s: %v", jan, err)
+	}
+
+	var marks []string
+	if inMaster == 0 {
+		marks = append(marks, MarkUnknownJan)
+		if inMA2 == 0 && ma0YJ.String == "" {
+			marks = append(marks, MarkCreateMA2)
+		}
+	}
+	return marks
+}
+
+// Exists は query（COUNT(*) を返す SELECT）で既存行の有無を判定します。
+func Exists(query string, args ...interface{}) bool {
+	var n int
+	if err := DB.QueryRow(query, args...).Scan(&n); err != nil {
+		log.Printf("[IMPORT] exists query error: %v", err)
+		return false
+	}
+	return n > 0
+}
+
+// CommitFunc はプレビュー済みバッチを実際に取り込み、アップロード時と同じ形のレスポンスを返します。
+type CommitFunc func() (interface{}, error)
+
+type pending struct {
+	typ     string
+	created time.Time
+	commit  CommitFunc
+}
+
+// pendingTTL を過ぎたプレビューは確定できません。
+const pendingTTL = 30 * time.Minute
+
+var (
+	mu       sync.Mutex
+	pendings = make(map[string]pending)
+)
+
+// newToken はプレビュー識別用のランダムなトークンを返します。
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hold は p を確定待ちとして保持し、p.Token を設定します。
+func Hold(p *Preview, commit CommitFunc) error {
+	token, err := newToken()
+	if err != nil {
+		return fmt.Errorf("token error: %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	for k, v := range pendings {
+		if now.Sub(v.created) > pendingTTL {
+			delete(pendings, k)
+		}
+	}
+	pendings[token] = pending{typ: p.Type, created: now, commit: commit}
+	p.Token = token
+	return nil
+}
+
+// take は token のプレビューを取り出して保持リストから外します。
+func take(token string) (pending, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	p, ok := pendings[token]
+	if !ok {
+		return pending{}, false
+	}
+	delete(pendings, token)
+	if time.Since(p.created) > pendingTTL {
+		return pending{}, false
+	}
+	return p, true
+}
+
+// WritePreview はプレビュー結果を JSON で返します。
+func WritePreview(w http.ResponseWriter, p *Preview) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(p)
+}
+
+// CommitHandler は /api/import/commit を処理します。
+// POST でプレビュー済みバッチを取り込み、DELETE で破棄します。
+func CommitHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.FormValue("token")
+	}
+	if token == "" {
+		http.Error(w, "token は必須です", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		p, ok := take(token)
+		if !ok {
+			http.Error(w, "プレビューが見つからないか期限切れです", http.StatusNotFound)
+			return
+		}
+		log.Printf("[IMPORT] commit %s token=%s", p.typ, token)
+		resp, err := p.commit()
+		if errors.Is(err, ErrAlreadyImported) {
+			http.Error(w, "取込エラー: "+err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("[IMPORT] commit %s error: %v", p.typ, err)
+			http.Error(w, "取込エラー: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(resp)
+	case http.MethodDelete:
+		take(token)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,104 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Profile は取込プロファイル（USAGE・棚卸 CSV など出力元ごとの列対応）が備えるメソッドです。
+type Profile interface {
+	ProfileName() string
+	IsDefault() bool
+	Check() error // 設定ファイルの読込時に整合性を確認する
+}
+
+// Profiles は設定ファイルから読み込んだ取込プロファイルの一覧です。
+// 設定ファイルが無い、またはプロファイルが１つも無い場合は組み込みのプロファイルだけを使います。
+type Profiles[P Profile] struct {
+	tag     string // ログの接頭辞（例: USAGE）
+	builtin P
+	mu      sync.RWMutex
+	list    []P
+}
+
+// NewProfiles は組み込みのプロファイル builtin だけを持つ一覧を返します。
+func NewProfiles[P Profile](tag string, builtin P) *Profiles[P] {
+	return &Profiles[P]{tag: tag, builtin: builtin}
+}
+
+// Load は設定ファイル path（{"profiles": [...]}）を読み込み、一覧を置き換えます。
+// 整合性の確認に失敗したプロファイルがあれば一覧を変えずにエラーを返します。
+func (r *Profiles[P]) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("[%s] profile file %s not found, using built-in profile", r.tag, path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Profiles []P `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, p := range cfg.Profiles {
+		if err := p.Check(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	r.mu.Lock()
+	r.list = cfg.Profiles
+	r.mu.Unlock()
+	log.Printf("[%s] loaded %d profiles from %s", r.tag, len(cfg.Profiles), path)
+	return nil
+}
+
+// All は読込済みのプロファイル（無ければ組み込みのプロファイル）を返します。
+func (r *Profiles[P]) All() []P {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.list) == 0 {
+		return []P{r.builtin}
+	}
+	return append([]P(nil), r.list...)
+}
+
+// Default は default 指定のプロファイル、無ければ組み込みのプロファイルを返します。
+func (r *Profiles[P]) Default() P {
+	for _, p := range r.All() {
+		if p.IsDefault() {
+			return p
+		}
+	}
+	return r.builtin
+}
+
+// ByName は名前でプロファイルを探します。空の場合は Default です。
+// 組み込みのプロファイルは設定ファイルに無くても名前で使えます。
+func (r *Profiles[P]) ByName(name string) (P, bool) {
+	if name == "" {
+		return r.Default(), true
+	}
+	for _, p := range r.All() {
+		if p.ProfileName() == name {
+			return p, true
+		}
+	}
+	if name == r.builtin.ProfileName() {
+		return r.builtin, true
+	}
+	var zero P
+	return zero, false
+}
+
+// Handler はプロファイル一覧を JSON で返す GET ハンドラです。
+func (r *Profiles[P]) Handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(r.All())
+}
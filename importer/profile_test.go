@@ -0,0 +1,72 @@
+package importer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testProfile struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+}
+
+func (p testProfile) ProfileName() string { return p.Name }
+func (p testProfile) IsDefault() bool     { return p.Default }
+func (p testProfile) Check() error {
+	if p.Name == "" {
+		return errors.New("プロファイル名がありません")
+	}
+	return nil
+}
+
+func TestProfiles(t *testing.T) {
+	builtin := testProfile{Name: "standard", Default: true}
+	r := NewProfiles("TEST", builtin)
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// 設定ファイルが無ければ組み込みのプロファイルだけ
+	if err := r.Load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Fatal(err)
+	}
+	if all := r.All(); len(all) != 1 || all[0] != builtin {
+		t.Errorf("without file: %+v", all)
+	}
+
+	if err := r.Load(write("ok.json", `{"profiles": [{"name": "a"}, {"name": "b", "default": true}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a", "a", true},
+		{"", "b", true},                // 空は default 指定のプロファイル
+		{"standard", "standard", true}, // 組み込みは設定ファイルに無くても使える
+		{"x", "", false},
+	}
+	for _, tt := range tests {
+		p, ok := r.ByName(tt.name)
+		if ok != tt.ok || p.Name != tt.want {
+			t.Errorf("ByName(%q) = %q %v, want %q %v", tt.name, p.Name, ok, tt.want, tt.ok)
+		}
+	}
+
+	// 整合性の確認に失敗したら一覧を変えない
+	if err := r.Load(write("bad.json", `{"profiles": [{"name": ""}]}`)); err == nil {
+		t.Error("bad profile: want error")
+	}
+	if len(r.All()) != 2 {
+		t.Errorf("after bad file: %+v", r.All())
+	}
+}
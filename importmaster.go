@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"YAMATO/maker"
+	"YAMATO/master"
+)
+
+// runImportMaster は import-master コマンドを実行し、終了コードを返します。
+//
+//	YAMATO import-master [-force]                     JCSHMS・JANCODE を既定のファイルから読む
+//	YAMATO import-master [-force] JCSHMS [ファイル]   指定のマスターだけを読む（MAKER も可）
+func runImportMaster(args []string) int {
+	fs := flag.NewFlagSet("import-master", flag.ContinueOnError)
+	force := fs.Bool("force", false, "前回と同じファイルも読み直す")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	name, path := fs.Arg(0), fs.Arg(1)
+	switch {
+	case name == "":
+		st := master.LoadAll(*force)
+		enc.Encode(st)
+		if len(st.Errors) > 0 {
+			return 1
+		}
+		return 0
+	case strings.EqualFold(name, "MAKER"):
+		if path == "" {
+			path = maker.CSVPath
+		}
+		res, err := maker.LoadCSV(path, *force)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "load MAKER failed: %v\n", err)
+			return 1
+		}
+		enc.Encode(res)
+		return 0
+	}
+
+	spec, ok := master.SpecByName(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "master %s は未対応です（JCSHMS・JANCODE・MAKER）\n", name)
+		return 2
+	}
+	res, err := master.Load(spec, path, *force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load %s failed: %v\n", spec.Name, err)
+		return 1
+	}
+	master.SyncMA0(res)
+	enc.Encode(res)
+	return 0
+}
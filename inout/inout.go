@@ -6,8 +6,14 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"YAMATO/ma0"
+	"YAMATO/oroshi"
+	"YAMATO/search"
+	"YAMATO/usage"
+	"YAMATO/yakka"
 )
 
 var DB *sql.DB
@@ -17,6 +23,7 @@ type InoutRecord struct {
 	InoutCode  string `json:"inoutcode"`
 	Name       string `json:"name"`
 	OroshiCode string `json:"oroshicode"`
+	OroshiName string `json:"oroshiName"` // 卸マスターの名称
 }
 
 // ProductRec は /api/inout/search の結果レコードです
@@ -31,6 +38,8 @@ type ProductRec struct {
 	Coef            float64 `json:"coef"`
 	UnitName        string  `json:"unitName"`
 	UnitYaku        float64 `json:"unitYaku"`
+	MakerCode       string  `json:"makerCode"` // 販売元コード (JC029)
+	MakerName       string  `json:"makerName"`
 }
 
 // IODRecord は出庫・入庫明細DTOです
@@ -68,7 +77,13 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
 // listClients は得意先一覧を返却します
 func listClients(w http.ResponseWriter) {
-	rows, err := DB.Query(`SELECT inoutcode, name, oroshicode FROM inout ORDER BY inoutcode`)
+	rows, err := DB.Query(`
+      SELECT i.inoutcode, i.name, i.oroshicode,
+             COALESCE((SELECT o.name FROM oroshi o
+                        WHERE o.oroshiCode = i.oroshicode AND o.oroshiCode <> ''
+                        ORDER BY o.oroshiNo LIMIT 1), '')
+        FROM inout i
+       ORDER BY i.inoutcode`)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -78,7 +93,7 @@ func listClients(w http.ResponseWriter) {
 	var out []InoutRecord
 	for rows.Next() {
 		var rec InoutRecord
-		if err := rows.Scan(&rec.InoutCode, &rec.Name, &rec.OroshiCode); err != nil {
+		if err := rows.Scan(&rec.InoutCode, &rec.Name, &rec.OroshiCode, &rec.OroshiName); err != nil {
 			log.Println("inout scan error:", err)
 			continue
 		}
@@ -100,6 +115,13 @@ func saveClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 卸コードは卸マスターに登録済みのものに限る
+	req.OroshiCode = strings.TrimSpace(req.OroshiCode)
+	if req.OroshiCode != "" && !oroshi.Exists(req.OroshiCode) {
+		http.Error(w, "卸コード "+req.OroshiCode+" は卸マスターに登録されていません", http.StatusBadRequest)
+		return
+	}
+
 	// シーケンス発行
 	seq, err := ma0.NextSequence(DB, "INOUT")
 	if err != nil {
@@ -122,10 +144,49 @@ func saveClient(w http.ResponseWriter, r *http.Request) {
 }
 
 // ProductSearchHandler は /api/inout/search の GET リクエストを処理します。
+// 商品名・規格は search（全角／半角・ひらがな／カタカナを問わない）で探し、一致度の高い順に返します。
+// JCSHMS に無い MA2 の独自登録品も含みます（メーカー指定時を除く）。page で 100 件ずつ送ります。
 func ProductSearchHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
-	name := "%" + q.Get("name") + "%"
-	spec := "%" + q.Get("spec") + "%"
+	var args []interface{}
+
+	// メーカー（販売元・製造元）で絞り込み
+	makerCond := ""
+	mk := q.Get("maker")
+	if mk != "" {
+		makerCond = " AND (j.JC029HanbaiMotoCode = ? OR j.JC033SeizouMotoYunyuuMotoCode = ?)"
+		args = append(args, mk, mk)
+	}
+	// 伝票日付（YYYYMMDD）があればその日に適用されていた薬価を返す
+	unitYaku := "COALESCE(NULLIF(j.JC049GenTaniYakka, ''), '0')"
+	if date := strings.ReplaceAll(q.Get("date"), "-", ""); date != "" {
+		unitYaku = "COALESCE(" + yakka.TaniYakkaSQL("j.JC000JanCode", "?") + ", " + unitYaku + ")"
+		args = append([]interface{}{date}, args...)
+	}
+	// JAN（バーコード読取後の /api/barcode の結果）で絞り込み
+	var ranked []search.Product
+	if jan := q.Get("jan"); jan != "" {
+		makerCond += " AND j.JC000JanCode = ?"
+		args = append(args, jan)
+	} else {
+		page, _ := strconv.Atoi(q.Get("page"))
+		res, err := search.Search(search.Query{Text: q.Get("name"), Spec: q.Get("spec"), Page: page, Size: 100})
+		if err != nil {
+			log.Printf("▶ ProductSearch search error: %v", err)
+			http.Error(w, "DB Query Error", http.StatusInternalServerError)
+			return
+		}
+		ranked = res.Items
+		if len(ranked) == 0 {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode([]ProductRec{})
+			return
+		}
+		makerCond += " AND j.JC000JanCode IN (" + strings.TrimSuffix(strings.Repeat("?,", len(ranked)), ",") + ")"
+		for _, p := range ranked {
+			args = append(args, p.JanCode)
+		}
+	}
 
 	rows, err := DB.Query(`
       SELECT
@@ -133,22 +194,23 @@ func ProductSearchHandler(w http.ResponseWriter, r *http.Request) {
         j.JC000JanCode,
         j.JC018ShouhinMei,
         j.JC020KikakuYouryou AS spec,
-        m2.JA006HousouSuuryouSuuchi   AS packQtyNumber,
-        m2.JA007HousouSuuryouTaniCode AS packQtyUnitCode,
+        COALESCE(m2.JA006HousouSuuryouSuuchi, 0)   AS packQtyNumber,
+        COALESCE(m2.JA007HousouSuuryouTaniCode, 0) AS packQtyUnitCode,
         j.JC044HousouSouryouSuuchi    AS packTotal,
         COALESCE(NULLIF(j.JC048HousouYakkaKeisuu, ''), '0') AS coef,
         j.JC039HousouTaniTani         AS unitName,
-        COALESCE(NULLIF(j.JC049GenTaniYakka, ''), '0') AS unitYaku
+        `+unitYaku+` AS unitYaku,
+        COALESCE(j.JC029HanbaiMotoCode, '') AS makerCode,
+        COALESCE(mk.name, j.JC030HanbaiMotoMei, '') AS makerName
       FROM jcshms AS j
       LEFT JOIN jancode AS m2
         ON j.JC000JanCode = m2.JA001JanCode
-      WHERE (
-          j.JC018ShouhinMei           LIKE ?   -- 商品名
-       OR j.JC022ShouhinMeiKanaSortYou LIKE ?   -- かなソート用商品名
-      )
-        AND j.JC020KikakuYouryou LIKE ?        -- 規格
+      LEFT JOIN maker AS mk
+        ON j.JC029HanbaiMotoCode = mk.makerCode
+      WHERE 1 = 1
+      `+makerCond+`
       LIMIT 100
-    `, name, name, spec) // ← name を2回渡すのを忘れずに
+    `, args...)
 
 	if err != nil {
 		log.Printf("▶ ProductSearch SQL error: %v", err)
@@ -171,6 +233,8 @@ func ProductSearchHandler(w http.ResponseWriter, r *http.Request) {
 			&p.Coef,
 			&p.UnitName,
 			&p.UnitYaku,
+			&p.MakerCode,
+			&p.MakerName,
 		); err != nil {
 			log.Printf("▶ ProductSearch scan error: %v", err)
 			continue
@@ -183,11 +247,60 @@ func ProductSearchHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "DB Rows Error", http.StatusInternalServerError)
 		return
 	}
+	rows.Close()
+
+	// 検索の順位に並べ直し、JCSHMS に無いものは MA2 から補う
+	if jan := q.Get("jan"); jan != "" && len(out) == 0 && mk == "" {
+		if p, ok := ma2Product(jan); ok {
+			out = append(out, p)
+		}
+	}
+	if ranked != nil {
+		byJan := make(map[string]ProductRec, len(out))
+		for _, p := range out {
+			byJan[p.Jan] = p
+		}
+		out = out[:0]
+		for _, sp := range ranked {
+			if p, ok := byJan[sp.JanCode]; ok {
+				out = append(out, p)
+			} else if mk == "" {
+				if p, ok := ma2Product(sp.JanCode); ok {
+					out = append(out, p)
+				}
+			}
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(out)
 }
 
+// ma2Product は MA2 の独自登録品を検索結果の形にします（薬価は無し、包装総量が無ければ 1）。
+func ma2Product(jan string) (ProductRec, bool) {
+	var p ProductRec
+	var unit, janUnit string
+	var total, janQty sql.NullFloat64
+	err := DB.QueryRow(`
+SELECT COALESCE(MA2YjCode, ''), MA2JanCode, COALESCE(Shouhinmei, ''), COALESCE(HousouTaniUnit, ''),
+       HousouSouryouNumber, JanHousouSuuryouNumber, COALESCE(JanHousouSuuryouUnit, '')
+  FROM ma2 WHERE MA2JanCode = ?`, jan).Scan(&p.YJ, &p.Jan, &p.Name, &unit, &total, &janQty, &janUnit)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("▶ ProductSearch ma2 error JAN=%s: %v", jan, err)
+		}
+		return p, false
+	}
+	p.UnitName = usage.GetTaniName(unit)
+	p.PackTotal, p.Coef = total.Float64, 1
+	if p.PackTotal <= 0 {
+		p.PackTotal = 1
+	}
+	p.PackQtyNumber = janQty.Float64
+	p.PackQtyUnitCode, _ = strconv.Atoi(janUnit)
+	return p, true
+}
+
 // SaveIODHandler は /api/inout/save で明細を受け取り DB に登録します
 func SaveIODHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -2,7 +2,7 @@
 package inventory
 
 import (
-	"encoding/csv"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,14 +11,13 @@ import (
 	"strconv"
 	"strings"
 
+	"YAMATO/aggregate"
+	"YAMATO/importer"
 	"YAMATO/jcshms"
 	"YAMATO/ma0"
 	"YAMATO/ma2"
 	"YAMATO/tani"
 	"YAMATO/usage"
-
-	"golang.org/x/text/encoding/japanese"
-	"golang.org/x/text/transform"
 )
 
 // trimQS は前後のクォート・空白を削除
@@ -33,7 +32,9 @@ type InventoryRecord struct {
 	InvJanCode                string  // JANコード
 	InvProductName            string  // 商品名
 	InvJanHousouSuuryouNumber float64 // JAN包装数量
-	Qty                       float64 // 在庫数(包装単位)
+	PackCount                 float64 // 未開封の在庫数(JAN包装単位)
+	LooseQty                  float64 // 開封済みのバラ数(包装単位)
+	Qty                       float64 // 在庫数(包装単位) = PackCount × JAN包装数量 + LooseQty
 	HousouTaniUnit            string  // 包装単位(名称)
 	InvHousouTaniUnit         string  // 包装単位(コード)
 	JanQty                    float64 // 在庫数(JAN包装単位)
@@ -41,83 +42,183 @@ type InventoryRecord struct {
 	InvJanHousouSuuryouUnit   string  // JAN包装数量単位(コード)
 }
 
-// ParseInventoryCSV は Shift-JIS→UTF-8 変換しつつ CSV を読み込み、
-// 第17列（包装単位）・第24列（JAN包装単位）の
-// “'” を含む加工前後をログ出力します。
+// ParseInventoryCSV は既定のプロファイルで棚卸 CSV を読み込みます。
 func ParseInventoryCSV(r io.Reader) ([]InventoryRecord, error) {
-	rd := csv.NewReader(transform.NewReader(r, japanese.ShiftJIS.NewDecoder()))
-	rd.LazyQuotes = true
-	rd.FieldsPerRecord = -1
-
-	// ヘッダ行取得
-	hrow, err := rd.Read()
+	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("inventory: H行読み込みエラー: %w", err)
+		return nil, fmt.Errorf("inventory: 読み込みエラー: %w", err)
 	}
-	if len(hrow) <= 4 {
-		return nil, fmt.Errorf("inventory: H行の列不足")
+	res, err := ReadInventoryCSV(data, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Records, nil
+}
+
+// ReadResult は棚卸 CSV 読込の結果です。
+type ReadResult struct {
+	Profile string               `json:"profile"`
+	Records []InventoryRecord    `json:"records"`
+	Skipped []importer.LineError `json:"skipped"` // 読み飛ばした行と理由
+}
+
+// ReadInventoryCSV は棚卸 CSV を profileName のプロファイル（空は既定）で読み込みます。
+// 棚卸日は行の date 列、H 行の DateCell、引数 date（YYYYMMDD）の順に使います。
+func ReadInventoryCSV(data []byte, profileName, date string) (ReadResult, error) {
+	var res ReadResult
+	prof, ok := Profiles.ByName(profileName)
+	if !ok {
+		return res, fmt.Errorf("inventory: プロファイル %q がありません", profileName)
+	}
+	res.Profile = prof.Name
+	enc := prof.Encoding
+	if enc == "" {
+		enc = "sjis"
+	}
+	rd := importer.NewCSVReader(data, enc)
+
+	// H 行（ヘッダレコード）から棚卸日
+	if prof.DateCell != nil {
+		hrow, err := rd.Read()
+		if err != nil {
+			return res, fmt.Errorf("inventory: H行読み込みエラー: %w", err)
+		}
+		if len(hrow) <= *prof.DateCell {
+			return res, fmt.Errorf("inventory: H行の列不足")
+		}
+		d, err := importer.ParseDate(trimQS(hrow[*prof.DateCell]), prof.DateFormats)
+		if err != nil {
+			return res, fmt.Errorf("inventory: H行の棚卸日: %w", err)
+		}
+		date = d
+	}
+
+	// 見出し行
+	var header []string
+	if prof.HeaderRow {
+		h, err := rd.Read()
+		if err != nil {
+			return res, fmt.Errorf("inventory: 見出し行読み込みエラー: %w", err)
+		}
+		header = h
+	}
+	idx := importer.ColumnIndex(prof.Columns, header, false)
+	for _, f := range requiredFields {
+		if idx[f] < 0 {
+			return res, fmt.Errorf("inventory: プロファイル %s: 列 %s が見出しにありません", prof.Name, f)
+		}
+	}
+	if idx[FieldJanQty] < 0 && idx[FieldLooseQty] < 0 {
+		return res, fmt.Errorf("inventory: プロファイル %s: 数量の列が見出しにありません", prof.Name)
+	}
+	need := 0
+	for _, f := range append(requiredFields, FieldJanQty, FieldLooseQty) {
+		if idx[f]+1 > need {
+			need = idx[f] + 1
+		}
 	}
-	date := trimQS(hrow[4])
 
-	var recs []InventoryRecord
 	for {
 		parts, err := rd.Read()
 		if err == io.EOF {
 			break
 		}
+		line, _ := rd.FieldPos(0)
+		skip := func(field, value, reason string) {
+			log.Printf("[ParseInventoryCSV] skip line %d: %s %q: %s", line, field, value, reason)
+			res.Skipped = append(res.Skipped, importer.LineError{Line: line, Field: field, Value: value, Reason: reason})
+		}
 		if err != nil {
-			return nil, fmt.Errorf("inventory: CSV読み込みエラー: %w", err)
+			skip("", "", err.Error())
+			continue
+		}
+		if strings.TrimSpace(strings.Join(parts, "")) == "" {
+			continue
 		}
-		if len(parts) <= 45 {
+		if len(parts) < need {
+			skip("", strconv.Itoa(len(parts)), fmt.Sprintf("列が足りません（%d列、%d列必要）", len(parts), need))
 			continue
 		}
+		get := func(f string) string {
+			if i := idx[f]; i >= 0 && i < len(parts) {
+				return trimQS(strings.ReplaceAll(parts[i], "　", ""))
+			}
+			return ""
+		}
 
-		// 元データ（クォート含む）
-		origPackField := parts[16] // R17 包装単位
-		origJanField := parts[23]  // R24 JAN包装単位
-		log.Printf(
-			"[ParseInventoryCSV] origPackField=%q origJanField=%q",
-			origPackField, origJanField,
-		)
+		jan := get(FieldJanCode)
+		if jan == "" {
+			skip(FieldJanCode, "", "JANコードがありません")
+			continue
+		}
+		packs := 0.0 // 空欄は在庫 0
+		if v := get(FieldJanQty); v != "" {
+			if packs, err = strconv.ParseFloat(v, 64); err != nil {
+				skip(FieldJanQty, v, "在庫数が数値ではありません")
+				continue
+			}
+		}
+		loose := 0.0
+		if v := get(FieldLooseQty); v != "" {
+			if loose, err = strconv.ParseFloat(v, 64); err != nil {
+				skip(FieldLooseQty, v, "バラ数が数値ではありません")
+				continue
+			}
+		}
+		jps := 0.0
+		if v := get(FieldJanPackSize); v != "" {
+			if jps, err = strconv.ParseFloat(v, 64); err != nil {
+				skip(FieldJanPackSize, v, "JAN包装数量が数値ではありません")
+				continue
+			}
+		}
+		rowDate := date
+		if v := get(FieldDate); v != "" {
+			if rowDate, err = importer.ParseDate(v, prof.DateFormats); err != nil {
+				skip(FieldDate, v, "棚卸日として正しくありません")
+				continue
+			}
+		}
+		if rowDate == "" {
+			skip(FieldDate, "", "棚卸日がありません（アップロード時に指定してください）")
+			continue
+		}
 
-		// トリム前／後比較
-		rawPack := strings.ReplaceAll(origPackField, "　", "")
-		rawPack = trimQS(rawPack)
-		rawJan := strings.ReplaceAll(origJanField, "　", "")
-		rawJan = trimQS(rawJan)
-		log.Printf(
-			"[ParseInventoryCSV] trimmed HousouTaniUnit=%q JanHousouSuuryouUnit=%q",
-			rawPack, rawJan,
-		)
+		rawPack, rawJan := get(FieldPackUnit), get(FieldJanUnit)
+		log.Printf("[ParseInventoryCSV] JAN=%s HousouTaniUnit=%q JanHousouSuuryouUnit=%q", jan, rawPack, rawJan)
 
-		// 他フィールド読み取り（省略可）
-		jps, _ := strconv.ParseFloat(trimQS(parts[17]), 64)
-		baseQty, _ := strconv.ParseFloat(trimQS(parts[21]), 64)
-		qty := baseQty * jps
-		janQty, _ := strconv.ParseFloat(trimQS(parts[21]), 64)
-		yj := trimQS(parts[42])
-		jan := trimQS(parts[45])
-		name := trimQS(parts[12])
-
-		recs = append(recs, InventoryRecord{
-			InvDate:                   date,
-			InvYjCode:                 yj,
+		rec := InventoryRecord{
+			InvDate:                   rowDate,
+			InvYjCode:                 get(FieldYjCode),
 			InvJanCode:                jan,
-			InvProductName:            name,
+			InvProductName:            get(FieldProductName),
 			InvJanHousouSuuryouNumber: jps,
-			Qty:                       qty,
+			PackCount:                 packs,
+			LooseQty:                  loose,
 			HousouTaniUnit:            rawPack,
 			InvHousouTaniUnit:         rawPack,
-			JanQty:                    janQty,
 			JanHousouSuuryouUnit:      rawJan,
 			InvJanHousouSuuryouUnit:   rawJan,
-		})
+		}
+		rec.deriveTotals()
+		res.Records = append(res.Records, rec)
+	}
+	return res, nil
+}
+
+// deriveTotals は未開封の包装数とバラ数から、包装単位の在庫数 Qty と
+// JAN包装単位の在庫数 JanQty を求めます（JAN包装数量が不明ならバラのみ換算できます）。
+func (rec *InventoryRecord) deriveTotals() {
+	rec.Qty = rec.PackCount*rec.InvJanHousouSuuryouNumber + rec.LooseQty
+	rec.JanQty = rec.PackCount
+	if rec.InvJanHousouSuuryouNumber > 0 {
+		rec.JanQty += rec.LooseQty / rec.InvJanHousouSuuryouNumber
 	}
-	return recs, nil
 }
 
 // UploadInventoryHandler は棚卸CSVのアップロードを受け取り、
 // 単位マッピング前後をログ出力しつつDBにUPSERT、JSONを返します。
+// preview=1 の場合は DB に書き込まず判定結果を返し、/api/import/commit で確定します。
 func UploadInventoryHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("[UploadInventoryHandler] start")
 
@@ -125,31 +226,119 @@ func UploadInventoryHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	file, _, err := r.FormFile("inventoryFile")
+	file, fh, err := r.FormFile("inventoryFile")
 	if err != nil {
 		http.Error(w, "ファイルが指定されていません", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
+	preview := r.FormValue("preview") == "1"
 
-	// 1) CSV→構造体
-	recs, err := ParseInventoryCSV(file)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "ファイル読み込みエラー: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch := importer.NewBatch("inventory")
+	batch.AddFile(fh.Filename, data)
+
+	// 1) CSV→構造体（プロファイルは inventoryProfile、棚卸日は H 行に無ければ invDate）
+	res, err := ReadInventoryCSV(data, r.FormValue("inventoryProfile"),
+		strings.ReplaceAll(r.FormValue("invDate"), "-", ""))
 	if err != nil {
 		http.Error(w, "CSV読み込みエラー: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Printf("[UploadInventoryHandler] parsed %d records", len(recs))
+	recs := res.Records
+	for _, e := range res.Skipped {
+		e.FileName = fh.Filename
+		batch.AddError(e)
+	}
+	log.Printf("[UploadInventoryHandler] profile=%s parsed %d records, skipped %d rows",
+		res.Profile, len(recs), len(res.Skipped))
+
+	// 2) 単位名称→コード
+	MapInventoryUnits(recs)
 
-	// 2) 名称→コードマップ取得
+	// 取込済みファイルは force=1 が無ければ受け付けない
+	force := r.FormValue("force") == "1"
+	if dups := batch.Duplicates(force); len(dups) > 0 {
+		log.Printf("[UploadInventoryHandler] rejected already imported file: %v", dups)
+		importer.WriteDuplicates(w, dups)
+		return
+	}
+
+	// 取込処理（プレビュー時は確定まで保留）
+	commit := func() (interface{}, error) {
+		// プレビュー中に同じファイルが取り込まれていないか再確認
+		if len(batch.Duplicates(force)) > 0 {
+			return nil, importer.ErrAlreadyImported
+		}
+		batch.RowCount = len(recs)
+		if err := ImportInventoryRecords(recs, batch); err != nil {
+			return nil, batch.Fail(err)
+		}
+		if err := batch.Save(); err != nil {
+			log.Printf("[UploadInventoryHandler] save import batch error: %v", err)
+			return nil, fmt.Errorf("取込バッチの保存に失敗しました: %w", err)
+		}
+
+		// 理論在庫との差異レポート
+		var variance *aggregate.VarianceReport
+		if len(recs) > 0 {
+			rep, err := aggregate.BuildVariance(recs[0].InvDate)
+			if err != nil {
+				log.Printf("[UploadInventoryHandler] variance error: %v", err)
+			} else {
+				variance = &rep
+			}
+		}
+
+		// レスポンス直前ログ
+		log.Printf("[UploadInventoryHandler] returning %d records", len(recs))
+		return map[string]interface{}{
+			"batchId":     batch.ID,
+			"profile":     res.Profile,
+			"count":       len(recs),
+			"skipped":     res.Skipped,
+			"inventories": recs,
+			"variance":    variance,
+		}, nil
+	}
+
+	if preview {
+		p := importer.NewPreview("inventory", PreviewInventoryRecords(recs), map[string]interface{}{
+			"skipped": res.Skipped,
+		})
+		if err := importer.Hold(p, commit); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		importer.WritePreview(w, p)
+		return
+	}
+
+	resp, err := commit()
+	if err != nil {
+		http.Error(w, "取込エラー: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// MapInventoryUnits は包装単位・JAN包装単位の名称を TANI コードに置き換えます。
+func MapInventoryUnits(recs []InventoryRecord) {
+	// 名称→コードマップ取得
 	nameToCode := tani.BuildNameToCodeMap(usage.GetTaniMap())
-	// 2a) マップキー一覧ログ
+	// マップキー一覧ログ
 	var keys []string
 	for k := range nameToCode {
 		keys = append(keys, k)
 	}
 	log.Printf("[UploadInventoryHandler] nameToCode keys: %v", keys)
 
-	// 3) レコードごとにマッピング前後をログ出力
+	// レコードごとにマッピング前後をログ出力
 	for i := range recs {
 		rec := &recs[i]
 		log.Printf(
@@ -176,64 +365,125 @@ func UploadInventoryHandler(w http.ResponseWriter, r *http.Request) {
 			rec.InvJanHousouSuuryouUnit = ""
 			log.Printf("[UploadInventoryHandler] #%d no map for jan unit %q", i, rawJan)
 		}
+	}
+}
 
-		// 以下、MA0登録・DB UPSERT・MA2登録は既存ロジック
-		maRec, _, err := ma0.CheckOrCreateMA0(rec.InvJanCode, rec.InvProductName)
+// ImportInventoryRecords は単位マッピング済みの棚卸レコードを MA0 と連携し、
+// inventory テーブルに UPSERT、マスター未登録品を MA2 に登録します。
+// 変更内容は batch（nil 可）に記録します。
+// MA0 連携か inventory への書き込みに失敗した時点で中断し、エラーを返します。
+func ImportInventoryRecords(recs []InventoryRecord, batch *importer.Batch) error {
+	for i := range recs {
+		rec := &recs[i]
+		var err error
+		batch.TrackMasters(rec.InvJanCode, func() { err = importInventoryRecord(rec, batch) })
 		if err != nil {
-			log.Printf("[UploadInventoryHandler] MA0 error JAN=%s: %v", rec.InvJanCode, err)
-			continue
+			return err
 		}
-		rec.InvYjCode = maRec.MA009JC009YJCode
+	}
+	return nil
+}
+
+// importInventoryRecord は棚卸レコード１件を取り込みます。
+func importInventoryRecord(rec *InventoryRecord, batch *importer.Batch) error {
+	maRec, _, err := ma0.CheckOrCreateMA0(rec.InvJanCode, rec.InvProductName)
+	if err != nil {
+		log.Printf("[UploadInventoryHandler] MA0 error JAN=%s: %v", rec.InvJanCode, err)
+		return fmt.Errorf("MA0 JAN=%s: %w", rec.InvJanCode, err)
+	}
+	rec.InvYjCode = maRec.MA009JC009YJCode
 
-		prod := maRec.MA018JC018ShouhinMei
-		if prod == "" {
-			prod = rec.InvProductName
+	// JAN包装数量が CSV に無ければ MA0 の包装総量から在庫数を求める
+	if rec.InvJanHousouSuuryouNumber <= 0 {
+		if hs, err := strconv.ParseFloat(maRec.MA044JC044HousouSouryouSuuchi, 64); err == nil && hs > 0 {
+			rec.InvJanHousouSuuryouNumber = hs
+		} else if rec.PackCount > 0 {
+			log.Printf("[UploadInventoryHandler] unknown package size JAN=%s, counting loose units only", rec.InvJanCode)
+			batch.AddError(importer.LineError{
+				Field: FieldJanPackSize, Value: rec.InvJanCode,
+				Reason: "JAN包装数量が不明のため未開封分を在庫数に換算できません",
+			})
 		}
-		_, err = ma0.DB.Exec(
-			`INSERT OR REPLACE INTO inventory
+		rec.deriveTotals()
+	}
+
+	prod := maRec.MA018JC018ShouhinMei
+	if prod == "" {
+		prod = rec.InvProductName
+	}
+	key := importer.Row{"invDate": rec.InvDate, "invJanCode": rec.InvJanCode}
+	old, _ := importer.SelectRow("inventory", key)
+	_, err = ma0.DB.Exec(
+		`INSERT OR REPLACE INTO inventory
               (invDate, invYjCode, invJanCode, invProductName,
-               invJanHousouSuuryouNumber, qty,
+               invJanHousouSuuryouNumber, qty, packCount, looseQty,
                HousouTaniUnit, InvHousouTaniUnit,
                janqty, JanHousouSuuryouUnit, InvJanHousouSuuryouUnit)
-             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			rec.InvDate, rec.InvYjCode, rec.InvJanCode, prod,
-			rec.InvJanHousouSuuryouNumber, rec.Qty,
-			rec.HousouTaniUnit, rec.InvHousouTaniUnit,
-			rec.JanQty, rec.JanHousouSuuryouUnit, rec.InvJanHousouSuuryouUnit,
-		)
-		if err != nil {
-			log.Printf("[UploadInventoryHandler] upsert error JAN=%s: %v", rec.InvJanCode, err)
-			continue
-		}
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.InvDate, rec.InvYjCode, rec.InvJanCode, prod,
+		rec.InvJanHousouSuuryouNumber, rec.Qty, rec.PackCount, rec.LooseQty,
+		rec.HousouTaniUnit, rec.InvHousouTaniUnit,
+		rec.JanQty, rec.JanHousouSuuryouUnit, rec.InvJanHousouSuuryouUnit,
+	)
+	if err != nil {
+		log.Printf("[UploadInventoryHandler] upsert error JAN=%s: %v", rec.InvJanCode, err)
+		return fmt.Errorf("inventory JAN=%s: %w", rec.InvJanCode, err)
+	}
+	batch.RecordUpsert("inventory", key, old)
 
-		cs, err := jcshms.QueryByJan(ma0.DB, rec.InvJanCode)
-		if err != nil {
-			log.Printf("[UploadInventoryHandler] JCShms error JAN=%s: %v", rec.InvJanCode, err)
-			continue
+	cs, err := jcshms.QueryByJan(ma0.DB, rec.InvJanCode)
+	if err != nil {
+		log.Printf("[UploadInventoryHandler] JCShms error JAN=%s: %v", rec.InvJanCode, err)
+		return nil
+	}
+	if len(cs) == 0 {
+		m2 := &ma2.Record{
+			JanCode:                  rec.InvJanCode,
+			Shouhinmei:               rec.InvProductName,
+			HousouKeitai:             "",
+			HousouTaniUnitName:       rec.HousouTaniUnit,
+			HousouSouryouNumber:      0,
+			JanHousouSuuryouNumber:   int(rec.InvJanHousouSuuryouNumber),
+			JanHousouSuuryouUnitName: rec.JanHousouSuuryouUnit,
+			JanHousouSouryouNumber:   0,
 		}
-		if len(cs) == 0 {
-			m2 := &ma2.Record{
-				JanCode:                  rec.InvJanCode,
-				Shouhinmei:               rec.InvProductName,
-				HousouKeitai:             "",
-				HousouTaniUnitName:       rec.HousouTaniUnit,
-				HousouSouryouNumber:      0,
-				JanHousouSuuryouNumber:   int(rec.InvJanHousouSuuryouNumber),
-				JanHousouSuuryouUnitName: rec.JanHousouSuuryouUnit,
-				JanHousouSouryouNumber:   0,
-			}
-			if err := ma2.Upsert(ma0.DB, m2); err != nil {
-				log.Printf("[UploadInventoryHandler] MA2 Upsert error JAN=%s: %v", rec.InvJanCode, err)
-			}
+		if err := ma2.Upsert(ma0.DB, m2); err != nil {
+			log.Printf("[UploadInventoryHandler] MA2 Upsert error JAN=%s: %v", rec.InvJanCode, err)
 		}
 	}
+	return nil
+}
 
-	// 4) レスポンス直前ログ
-	log.Printf("[UploadInventoryHandler] returning %d records", len(recs))
-
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"count":       len(recs),
-		"inventories": recs,
+// Migrate は schema.sql 適用後に呼び出し、既存の inventory に未開封数・バラ数の列を追加します。
+// 追加前の行は qty のみを持ちます（packCount・looseQty は 0）。
+func Migrate(db *sql.DB) error {
+	return importer.AddColumns(db, "inventory", [][2]string{
+		{"packCount", "REAL NOT NULL DEFAULT 0"},
+		{"looseQty", "REAL NOT NULL DEFAULT 0"},
 	})
 }
+
+// PreviewInventoryRecords は DB に書き込まずに各行の取込結果を判定します。
+// 同じ棚卸日・JAN の既存行は置換対象として duplicate になります。
+func PreviewInventoryRecords(recs []InventoryRecord) []importer.PreviewRow {
+	rows := make([]importer.PreviewRow, 0, len(recs))
+	for i, rec := range recs {
+		row := importer.PreviewRow{
+			Row:  i + 1,
+			Jan:  rec.InvJanCode,
+			Name: rec.InvProductName,
+			Key:  rec.InvDate + "/" + rec.InvJanCode,
+		}
+		if importer.Exists(
+			`SELECT COUNT(*) FROM inventory WHERE invDate = ? AND invJanCode = ?`,
+			rec.InvDate, rec.InvJanCode,
+		) {
+			row.Marks = append(row.Marks, importer.MarkDuplicate)
+		} else {
+			row.Marks = append(row.Marks, importer.MarkNew)
+		}
+		row.Marks = append(row.Marks, importer.JanState(rec.InvJanCode)...)
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,101 @@
+package inventory
+
+import (
+	"fmt"
+
+	"YAMATO/importer"
+)
+
+// 棚卸 CSV の項目名（プロファイルの columns で指定するもの）
+const (
+	FieldDate        = "date"        // 棚卸日（行ごと。無ければ H 行・アップロード時の指定）
+	FieldYjCode      = "yjCode"      // YJコード
+	FieldJanCode     = "janCode"     // JANコード
+	FieldProductName = "productName" // 商品名
+	FieldPackUnit    = "packUnit"    // 包装単位（名称）
+	FieldJanPackSize = "janPackSize" // JAN包装数量（JAN包装１つあたりの包装単位数）
+	FieldJanQty      = "janQty"      // 未開封の在庫数（JAN包装単位）
+	FieldLooseQty    = "looseQty"    // 開封済みのバラ数（包装単位）
+	FieldJanUnit     = "janUnit"     // JAN包装単位（名称）
+)
+
+// requiredFields は必ず特定できなければならない項目です。
+// 数量は janQty・looseQty の少なくとも一方が必要です。
+var requiredFields = []string{FieldJanCode}
+
+// Profile は棚卸データの出力元ごとの CSV 形式です。
+//
+//   - DateCell を指定すると 1行目を H 行（ヘッダレコード）とし、その列から棚卸日を読みます。
+//   - HeaderRow が true の場合は（H 行の次の）行を見出し行とし、Headers で列を探します。
+//     false の場合は Index の列位置のみを使います。
+type Profile struct {
+	Name        string            `json:"name"`
+	Default     bool              `json:"default"`
+	Encoding    string            `json:"encoding"` // "sjis"（既定）・"utf8"・"auto"
+	DateCell    *int              `json:"dateCell,omitempty"`
+	HeaderRow   bool              `json:"headerRow"`
+	Columns     []importer.Column `json:"columns"`
+	DateFormats []string          `json:"dateFormats"`
+}
+
+// DefaultProfile は従来の固定列の棚卸 CSV（H 行の5列目が棚卸日）です。
+var DefaultProfile = Profile{
+	Name:     "standard",
+	Default:  true,
+	Encoding: "sjis",
+	DateCell: importer.IntP(4),
+	Columns: []importer.Column{
+		{Field: FieldProductName, Index: importer.IntP(12)},
+		{Field: FieldPackUnit, Index: importer.IntP(16)},
+		{Field: FieldJanPackSize, Index: importer.IntP(17)},
+		{Field: FieldJanQty, Index: importer.IntP(21)},
+		{Field: FieldJanUnit, Index: importer.IntP(23)},
+		{Field: FieldYjCode, Index: importer.IntP(42)},
+		{Field: FieldJanCode, Index: importer.IntP(45)},
+	},
+	DateFormats: []string{"20060102", "2006/01/02", "2006/1/2", "2006-01-02"},
+}
+
+// ProfileConfigPath は棚卸 CSV プロファイルの既定パスです。
+const ProfileConfigPath = "config/inventory_profiles.json"
+
+// Profiles は読込済みの棚卸 CSV プロファイルです（設定ファイルが無ければ DefaultProfile のみ）。
+var Profiles = importer.NewProfiles("INVENTORY", DefaultProfile)
+
+func (p Profile) ProfileName() string { return p.Name }
+func (p Profile) IsDefault() bool     { return p.Default }
+
+// Check はプロファイルの整合性を確認します。
+func (p Profile) Check() error {
+	if p.Name == "" {
+		return fmt.Errorf("プロファイル名がありません")
+	}
+	if err := importer.CheckEncoding(p.Encoding); err != nil {
+		return fmt.Errorf("%s: %w", p.Name, err)
+	}
+	have := make(map[string]bool)
+	for _, c := range p.Columns {
+		switch c.Field {
+		case FieldDate, FieldYjCode, FieldJanCode, FieldProductName,
+			FieldPackUnit, FieldJanPackSize, FieldJanQty, FieldLooseQty, FieldJanUnit:
+		default:
+			return fmt.Errorf("%s: 項目 %q は未対応です", p.Name, c.Field)
+		}
+		if c.Index == nil && (len(c.Headers) == 0 || !p.HeaderRow) {
+			return fmt.Errorf("%s: %s の列を特定できません（index か headerRow+headers が必要です）", p.Name, c.Field)
+		}
+		have[c.Field] = true
+	}
+	for _, f := range requiredFields {
+		if !have[f] {
+			return fmt.Errorf("%s: 必須項目 %s の定義がありません", p.Name, f)
+		}
+	}
+	if !have[FieldJanQty] && !have[FieldLooseQty] {
+		return fmt.Errorf("%s: 数量（%s または %s）の定義がありません", p.Name, FieldJanQty, FieldLooseQty)
+	}
+	if len(p.DateFormats) == 0 {
+		return fmt.Errorf("%s: dateFormats がありません", p.Name)
+	}
+	return nil
+}
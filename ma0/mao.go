@@ -177,6 +177,16 @@ type MA0Record struct {
 // DB は、ma0 連携用に参照するグローバルなデータベース接続です。
 var DB *sql.DB
 
+// OnChange は MA0・MA2 の行を追加・更新した後に呼ばれます（検索索引の破棄など）。main で設定します。
+var OnChange func()
+
+// changed は OnChange が設定されていれば呼び出します。
+func changed() {
+	if OnChange != nil {
+		OnChange()
+	}
+}
+
 // Migrate は、MA0Record の全フィールドを TEXT 型として、
 // 最初のフィールドを PRIMARY KEY としたテーブル "ma0" を作成します。
 func Migrate(db *sql.DB) error {
@@ -303,33 +313,7 @@ func CheckOrCreateMA0(jan, fallbackName string) (MA0Record, bool, error) {
 	// 2) New MA0 record: copy from masters
 	cs, _ := jcshms.QueryByJan(DB, jan)
 	ja, _ := jancode.QueryByJan(DB, jan)
-	rv = reflect.ValueOf(&rec).Elem()
-	// Copy JC fields
-	if len(cs) > 0 {
-		jcVal := reflect.ValueOf(cs[0])
-		for i := 0; i < rv.NumField(); i++ {
-			f := rv.Type().Field(i)
-			if strings.Contains(f.Name, "JC") {
-				idx := strings.Index(f.Name, "JC")
-				if mf := jcVal.FieldByName(f.Name[idx:]); mf.IsValid() {
-					rv.Field(i).SetString(mf.String())
-				}
-			}
-		}
-	}
-	// Copy JA fields
-	if len(ja) > 0 {
-		jaVal := reflect.ValueOf(ja[0])
-		for i := 0; i < rv.NumField(); i++ {
-			f := rv.Type().Field(i)
-			if strings.Contains(f.Name, "JA") {
-				idx := strings.Index(f.Name, "JA")
-				if mf := jaVal.FieldByName(f.Name[idx:]); mf.IsValid() {
-					rv.Field(i).SetString(mf.String())
-				}
-			}
-		}
-	}
+	copyFromMasters(&rec, cs, ja)
 	rec.MA000JC000JanCode = jan
 
 	// If no master product name, use fallbackName
@@ -359,16 +343,54 @@ func CheckOrCreateMA0(jan, fallbackName string) (MA0Record, bool, error) {
 	if err := InsertIgnore(DB, []MA0Record{rec}); err != nil {
 		return MA0Record{}, true, fmt.Errorf("ma0 insert error: %w", err)
 	}
+	changed()
 
 	return rec, true, nil
 }
 
+// copyFromMasters は JCSHMS・JANCODE の値を、フィールド名の "JCxxx"・"JAxxx" 部分が一致する
+// MA0 のフィールドへコピーします。マスターに行が無い側のフィールドは変更しません。
+func copyFromMasters(rec *MA0Record, cs []jcshms.JCFields, ja []jancode.JANCODERecord) {
+	rv := reflect.ValueOf(rec).Elem()
+	// Copy JC fields
+	if len(cs) > 0 {
+		jcVal := reflect.ValueOf(cs[0])
+		for i := 0; i < rv.NumField(); i++ {
+			f := rv.Type().Field(i)
+			if strings.Contains(f.Name, "JC") {
+				idx := strings.Index(f.Name, "JC")
+				if mf := jcVal.FieldByName(f.Name[idx:]); mf.IsValid() {
+					rv.Field(i).SetString(mf.String())
+				}
+			}
+		}
+	}
+	// Copy JA fields
+	if len(ja) > 0 {
+		jaVal := reflect.ValueOf(ja[0])
+		for i := 0; i < rv.NumField(); i++ {
+			f := rv.Type().Field(i)
+			if strings.Contains(f.Name, "JA") {
+				idx := strings.Index(f.Name, "JA")
+				if mf := jaVal.FieldByName(f.Name[idx:]); mf.IsValid() {
+					rv.Field(i).SetString(mf.String())
+				}
+			}
+		}
+	}
+}
+
 // atoi is a helper to convert string→int, ignoring errors.
 func atoi(s string) int {
 	v, _ := strconv.Atoi(s)
 	return v
 }
 
+// formatNum は数値を TEXT 列用に最短表記の文字列へ変換します（10.0 → "10"）。
+func formatNum(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
 // InsertDATRecord は、与えられた model.DATRecord を datrecords テーブルに挿入します。
 // organizedFlag には、1 (organized) または 0 (disorganized) を指定します。
 func InsertDATRecord(db *sql.DB, rec model.DATRecord, organizedFlag int) error {
@@ -391,19 +413,19 @@ func InsertDATRecord(db *sql.DB, rec model.DATRecord, organizedFlag int) error {
 		)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 	_, err := db.Exec(stmt,
-		rec.CurrentOroshiCode, // DatOroshiCode 列へ
-		rec.DatDate,           // DatDate 列へ
-		rec.DatFlag,           // DatDeliveryFlag 列へ（旧：DatDeliveryFlag → DatFlag）
-		rec.DatRecNo,          // DatReceiptNumber 列へ
-		rec.DatLineNo,         // DatLineNumber 列へ
-		rec.DatJan,            // DatJanCode 列へ
-		rec.DatProductName,    // DatProductName 列へ
-		rec.DatQty,            // DatQuantity 列へ
-		rec.DatUnit,           // DatUnitPrice 列へ
-		rec.DatSub,            // DatSubtotal 列へ
-		rec.DatPkg,            // DatPackagingDrugPrice 列へ
-		rec.DatExp,            // DatExpiryDate 列へ
-		rec.DatLot,            // DatLotNumber 列へ
+		rec.CurrentOroshiCode,  // DatOroshiCode 列へ
+		rec.DatDate,            // DatDate 列へ
+		rec.DatFlag,            // DatDeliveryFlag 列へ（旧：DatDeliveryFlag → DatFlag）
+		rec.DatRecNo,           // DatReceiptNumber 列へ
+		rec.DatLineNo,          // DatLineNumber 列へ
+		rec.DatJan,             // DatJanCode 列へ
+		rec.DatProductName,     // DatProductName 列へ
+		formatNum(rec.DatQty),  // DatQuantity 列へ
+		formatNum(rec.DatUnit), // DatUnitPrice 列へ
+		formatNum(rec.DatSub),  // DatSubtotal 列へ
+		formatNum(rec.DatPkg),  // DatPackagingDrugPrice 列へ
+		rec.DatExp,             // DatExpiryDate 列へ
+		rec.DatLot,             // DatLotNumber 列へ
 		organizedFlag,
 	)
 	if err != nil {
@@ -67,6 +67,7 @@ func RegisterMA(db *sql.DB, maRec *MARecord) (janSeq, yjSeq string, err error) {
 	if execErr != nil {
 		return "", "", fmt.Errorf("MA2 insert error: %w", execErr)
 	}
+	changed()
 
 	return janSeq, yjSeq, nil
 }
@@ -0,0 +1,503 @@
+package ma0
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"YAMATO/jancode"
+	"YAMATO/jcshms"
+)
+
+// 同期を起動した契機
+const (
+	TriggerMaster = "master" // マスター読込の後
+	TriggerManual = "manual" // /api/ma0/sync
+)
+
+// ErrNotFound は MA0 に JAN が無いことを表します。
+var ErrNotFound = errors.New("ma0: JAN が登録されていません")
+
+// keepLocal は、マスター側が空のとき MA0 の値を残すフィールドです。
+// YJ コードは MA2 発番、商品名は取込ファイルの商品名で埋めているためです。
+// 初回の同期では、マスター側に値があってもこれらのフィールドは変更しません（SyncReport.Conflicts）。
+var keepLocal = map[string]bool{
+	"MA009JC009YJCode":     true,
+	"MA018JC018ShouhinMei": true,
+}
+
+// FieldChange は同期で変わった１フィールドです。
+type FieldChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+}
+
+// JanSync は同期で更新した１JAN 分の変更です。
+type JanSync struct {
+	JanCode     string        `json:"janCode"`
+	ProductName string        `json:"productName"`
+	Changes     []FieldChange `json:"changes"`
+}
+
+// SyncReport は１回の同期の結果です。
+type SyncReport struct {
+	SyncID      int64     `json:"syncId"`
+	SyncedAt    string    `json:"syncedAt"`
+	Trigger     string    `json:"trigger"`
+	Checked     int       `json:"checked"`     // 照合した MA0 行数
+	Updated     int       `json:"updated"`     // 更新した行数
+	Fields      int       `json:"fields"`      // 更新したフィールド数
+	Overridden  int       `json:"overridden"`  // 上書き指定のためマスターと違うまま残したフィールド数
+	NotInMaster int       `json:"notInMaster"` // JCSHMS・JANCODE のどちらにも無い行数
+	Jans        []JanSync `json:"jans"`
+	// Conflicts は初回の同期で見つかった、YJ コード・商品名の MA0 とマスターの違いです（OldValue が MA0 の値）。
+	// MA2 発番や取込時の商品名などローカルの値の可能性があるため上書き指定として残し、変更しません。
+	Conflicts []JanSync `json:"conflicts,omitempty"`
+}
+
+// Override は MA0 のフィールドの上書き指定です。同期はこのフィールドを変更しません。
+type Override struct {
+	JanCode   string `json:"janCode"`
+	Field     string `json:"field"`
+	Value     string `json:"value"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// isField は MA0 の主キー以外の列名かどうかを返します。
+func isField(name string) bool {
+	for i, c := range columns() {
+		if c == name {
+			return i > 0
+		}
+	}
+	return false
+}
+
+// syncRow は MA0 の１行と、同じ JAN のマスター行です。マスターに行が無い側は nil です。
+type syncRow struct {
+	rec MA0Record
+	jc  *jcshms.JCFields
+	ja  *jancode.JANCODERecord
+}
+
+// fieldNames は構造体のフィールド名を、テーブル別名を付けた列名として返します。
+func fieldNames(t reflect.Type, alias string) []string {
+	out := make([]string, t.NumField())
+	for i := range out {
+		out[i] = alias + "." + t.Field(i).Name
+	}
+	return out
+}
+
+// loadAll は MA0 の全行を、JCSHMS・JANCODE の同じ JAN の行と合わせて１回のクエリで読み込みます。
+func loadAll() ([]syncRow, error) {
+	jcType := reflect.TypeOf(jcshms.JCFields{})
+	jaType := reflect.TypeOf(jancode.JANCODERecord{})
+	cols := append(fieldNames(reflect.TypeOf(MA0Record{}), "m"), fieldNames(jcType, "c")...)
+	cols = append(cols, fieldNames(jaType, "j")...)
+	rows, err := DB.Query(fmt.Sprintf(`
+SELECT %s
+  FROM ma0 m
+  LEFT JOIN jcshms c ON c.JC000JanCode = m.MA000JC000JanCode
+  LEFT JOIN jancode j ON j.JA001JanCode = m.MA000JC000JanCode
+ ORDER BY m.MA000JC000JanCode`, strings.Join(cols, ",")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []syncRow
+	for rows.Next() {
+		// 古い行は NULL の列を持つことがあり、マスターに無い側はすべて NULL になる
+		nulls := make([]sql.NullString, len(cols))
+		addrs := make([]interface{}, len(nulls))
+		for i := range addrs {
+			addrs[i] = &nulls[i]
+		}
+		if err := rows.Scan(addrs...); err != nil {
+			return nil, err
+		}
+		var r syncRow
+		rest := fill(reflect.ValueOf(&r.rec).Elem(), nulls)
+		jc, ja := rest[:jcType.NumField()], rest[jcType.NumField():]
+		// 結合先の JAN が NULL ならマスターに行が無い
+		if jc[0].Valid {
+			r.jc = &jcshms.JCFields{}
+			fill(reflect.ValueOf(r.jc).Elem(), jc)
+		}
+		if ja[1].Valid {
+			r.ja = &jancode.JANCODERecord{}
+			fill(reflect.ValueOf(r.ja).Elem(), ja)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// fill は構造体の各フィールドに先頭から値を設定し、残りの値を返します。
+func fill(rv reflect.Value, vals []sql.NullString) []sql.NullString {
+	for i := 0; i < rv.NumField(); i++ {
+		rv.Field(i).SetString(vals[i].String)
+	}
+	return vals[rv.NumField():]
+}
+
+// overrideSet は JAN ごとの上書き指定フィールドを返します。
+func overrideSet() (map[string]map[string]bool, error) {
+	rows, err := DB.Query(`SELECT janCode, field FROM ma0_overrides`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]map[string]bool)
+	for rows.Next() {
+		var jan, field string
+		if err := rows.Scan(&jan, &field); err != nil {
+			return nil, err
+		}
+		if out[jan] == nil {
+			out[jan] = make(map[string]bool)
+		}
+		out[jan][field] = true
+	}
+	return out, rows.Err()
+}
+
+// Sync は MA0 の各行を現在の JCSHMS・JANCODE と照合し、違うフィールドを更新して結果を記録します。
+// 上書き指定のフィールドと、マスター側が空の YJ コード・商品名は変更しません。
+// マスターに行が無い側（JC・JA）のフィールドもそのまま残します。
+// 同期の記録が無い初回は、YJ コード・商品名の違いだけを Conflicts に挙げて上書き指定にし、
+// 薬価・包装・販売中止日などその他のフィールドは通常どおり更新します。
+// マスターの値に合わせるものは DeleteOverride で解除すると次の同期で更新されます。
+func Sync(trigger string) (SyncReport, error) {
+	rep := SyncReport{
+		SyncedAt: time.Now().Format("2006-01-02 15:04:05"),
+		Trigger:  trigger,
+		Jans:     make([]JanSync, 0),
+	}
+	var synced int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM ma0_syncs`).Scan(&synced); err != nil {
+		return rep, fmt.Errorf("ma0_syncs select error: %w", err)
+	}
+	first := synced == 0
+	recs, err := loadAll()
+	if err != nil {
+		return rep, fmt.Errorf("ma0 select error: %w", err)
+	}
+	overrides, err := overrideSet()
+	if err != nil {
+		return rep, fmt.Errorf("ma0_overrides select error: %w", err)
+	}
+
+	cols := columns()
+	for _, r := range recs {
+		rep.Checked++
+		rec, jan := r.rec, r.rec.MA000JC000JanCode
+		if r.jc == nil && r.ja == nil {
+			rep.NotInMaster++
+			continue
+		}
+		var cs []jcshms.JCFields
+		var ja []jancode.JANCODERecord
+		if r.jc != nil {
+			cs = append(cs, *r.jc)
+		}
+		if r.ja != nil {
+			ja = append(ja, *r.ja)
+		}
+		fresh := rec
+		copyFromMasters(&fresh, cs, ja)
+
+		oldV, newV := reflect.ValueOf(rec), reflect.ValueOf(fresh)
+		js := JanSync{JanCode: jan, ProductName: rec.MA018JC018ShouhinMei}
+		conflict := JanSync{JanCode: jan, ProductName: rec.MA018JC018ShouhinMei}
+		for i := 1; i < len(cols); i++ {
+			o, n := oldV.Field(i).String(), newV.Field(i).String()
+			if o == n || (n == "" && keepLocal[cols[i]]) {
+				continue
+			}
+			if overrides[jan][cols[i]] {
+				rep.Overridden++
+				continue
+			}
+			c := FieldChange{Field: cols[i], OldValue: o, NewValue: n}
+			if first && keepLocal[cols[i]] {
+				conflict.Changes = append(conflict.Changes, c)
+				rep.Overridden++
+				continue
+			}
+			js.Changes = append(js.Changes, c)
+		}
+		if len(conflict.Changes) > 0 {
+			rep.Conflicts = append(rep.Conflicts, conflict)
+		}
+		if len(js.Changes) == 0 {
+			continue
+		}
+		if n := fresh.MA018JC018ShouhinMei; n != "" && !overrides[jan]["MA018JC018ShouhinMei"] && !first {
+			js.ProductName = n
+		}
+		rep.Jans = append(rep.Jans, js)
+		rep.Updated++
+		rep.Fields += len(js.Changes)
+	}
+
+	if err := saveSync(&rep); err != nil {
+		return rep, err
+	}
+	changed()
+	log.Printf("[MA0] sync #%d (%s): checked=%d updated=%d fields=%d overridden=%d notInMaster=%d conflicts=%d",
+		rep.SyncID, trigger, rep.Checked, rep.Updated, rep.Fields, rep.Overridden, rep.NotInMaster, len(rep.Conflicts))
+	return rep, nil
+}
+
+// saveSync は変更を MA0 に反映し、ma0_syncs・ma0_sync_changes に記録します。
+// 初回の同期で見つかった違いは ma0_overrides に登録します。
+func saveSync(rep *SyncReport) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+INSERT INTO ma0_syncs (syncedAt, trigger, checked, updated, fields, overridden, notInMaster)
+VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rep.SyncedAt, rep.Trigger, rep.Checked, rep.Updated, rep.Fields, rep.Overridden, rep.NotInMaster)
+	if err != nil {
+		return fmt.Errorf("ma0_syncs insert error: %w", err)
+	}
+	if rep.SyncID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	logStmt, err := tx.Prepare(`
+INSERT INTO ma0_sync_changes (syncId, janCode, productName, field, oldValue, newValue)
+VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer logStmt.Close()
+
+	for _, js := range rep.Conflicts {
+		for _, c := range js.Changes {
+			if _, err := tx.Exec(`
+INSERT OR IGNORE INTO ma0_overrides (janCode, field, value, updatedAt) VALUES (?, ?, ?, ?)`,
+				js.JanCode, c.Field, c.OldValue, rep.SyncedAt); err != nil {
+				return fmt.Errorf("ma0_overrides insert error: %w", err)
+			}
+		}
+	}
+	for _, js := range rep.Jans {
+		sets := make([]string, len(js.Changes))
+		args := make([]interface{}, 0, len(js.Changes)+1)
+		for i, c := range js.Changes {
+			sets[i] = c.Field + " = ?"
+			args = append(args, c.NewValue)
+			if _, err := logStmt.Exec(rep.SyncID, js.JanCode, js.ProductName, c.Field, c.OldValue, c.NewValue); err != nil {
+				return fmt.Errorf("ma0_sync_changes insert error: %w", err)
+			}
+		}
+		args = append(args, js.JanCode)
+		if _, err := tx.Exec("UPDATE ma0 SET "+strings.Join(sets, ", ")+" WHERE MA000JC000JanCode = ?", args...); err != nil {
+			return fmt.Errorf("ma0 update error JAN=%s: %w", js.JanCode, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SyncReportByID は記録済みの同期結果を返します。syncID が 0 なら最新の同期です。
+func SyncReportByID(syncID int64) (SyncReport, error) {
+	rep := SyncReport{Jans: make([]JanSync, 0)}
+	query, args := `
+SELECT syncId, syncedAt, trigger, checked, updated, fields, overridden, notInMaster
+  FROM ma0_syncs`, []interface{}{}
+	if syncID > 0 {
+		query += ` WHERE syncId = ?`
+		args = append(args, syncID)
+	}
+	query += ` ORDER BY syncId DESC LIMIT 1`
+	err := DB.QueryRow(query, args...).Scan(&rep.SyncID, &rep.SyncedAt, &rep.Trigger,
+		&rep.Checked, &rep.Updated, &rep.Fields, &rep.Overridden, &rep.NotInMaster)
+	if err != nil {
+		return rep, err
+	}
+
+	rows, err := DB.Query(`
+SELECT janCode, productName, field, oldValue, newValue
+  FROM ma0_sync_changes
+ WHERE syncId = ?
+ ORDER BY rowid`, rep.SyncID)
+	if err != nil {
+		return rep, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jan, name string
+		var c FieldChange
+		if err := rows.Scan(&jan, &name, &c.Field, &c.OldValue, &c.NewValue); err != nil {
+			return rep, err
+		}
+		if n := len(rep.Jans); n == 0 || rep.Jans[n-1].JanCode != jan {
+			rep.Jans = append(rep.Jans, JanSync{JanCode: jan, ProductName: name})
+		}
+		last := &rep.Jans[len(rep.Jans)-1]
+		last.Changes = append(last.Changes, c)
+	}
+	return rep, rows.Err()
+}
+
+// SetOverride は MA0 のフィールドに値を設定し、以後の同期で変更しないようにします。
+func SetOverride(jan, field, value string) error {
+	if !isField(field) {
+		return fmt.Errorf("ma0: フィールド %q はありません", field)
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE ma0 SET "+field+" = ? WHERE MA000JC000JanCode = ?", value, jan)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(`
+INSERT OR REPLACE INTO ma0_overrides (janCode, field, value, updatedAt) VALUES (?, ?, ?, ?)`,
+		jan, field, value, time.Now().Format("2006-01-02 15:04:05")); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	changed()
+	return nil
+}
+
+// DeleteOverride は上書き指定を解除します。値は次の同期でマスターの値に戻ります。
+func DeleteOverride(jan, field string) error {
+	_, err := DB.Exec(`DELETE FROM ma0_overrides WHERE janCode = ? AND field = ?`, jan, field)
+	return err
+}
+
+// Overrides は上書き指定の一覧を返します。jan を指定するとその JAN のみです。
+func Overrides(jan string) ([]Override, error) {
+	query, args := `SELECT janCode, field, value, updatedAt FROM ma0_overrides`, []interface{}{}
+	if jan != "" {
+		query += ` WHERE janCode = ?`
+		args = append(args, jan)
+	}
+	rows, err := DB.Query(query+` ORDER BY janCode, field`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Override, 0)
+	for rows.Next() {
+		var o Override
+		if err := rows.Scan(&o.JanCode, &o.Field, &o.Value, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// SyncHandler は /api/ma0/sync を処理します。
+//   - GET ?id=  : 記録済みの同期結果（省略時は最新）
+//   - POST      : 同期を実行して結果を返す
+func SyncHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var id int64
+		if s := r.URL.Query().Get("id"); s != "" {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, "id が不正です", http.StatusBadRequest)
+				return
+			}
+			id = v
+		}
+		rep, err := SyncReportByID(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "同期の記録がありません", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("[MA0] sync report error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, rep)
+	case http.MethodPost:
+		rep, err := Sync(TriggerManual)
+		if err != nil {
+			log.Printf("[MA0] sync error: %v", err)
+			http.Error(w, "同期エラー: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, rep)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// OverridesHandler は /api/ma0/overrides を処理します。
+//   - GET ?jan=                              : 上書き指定の一覧
+//   - POST {"janCode","field","value"}       : 値を設定して上書き指定
+//   - DELETE ?jan=&field=                    : 上書き指定を解除
+func OverridesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := Overrides(r.URL.Query().Get("jan"))
+		if err != nil {
+			log.Printf("[MA0] overrides error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		var o Override
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			http.Error(w, "JSON の形式が不正です", http.StatusBadRequest)
+			return
+		}
+		switch err := SetOverride(o.JanCode, o.Field, o.Value); {
+		case err == ErrNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil && !isField(o.Field):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("[MA0] set override error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		q := r.URL.Query()
+		if err := DeleteOverride(q.Get("jan"), q.Get("field")); err != nil {
+			log.Printf("[MA0] delete override error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
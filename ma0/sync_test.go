@@ -0,0 +1,104 @@
+package ma0
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSync(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	DB = db
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	field := func(jan, col string) string {
+		t.Helper()
+		var v sql.NullString
+		if err := db.QueryRow("SELECT "+col+" FROM ma0 WHERE MA000JC000JanCode = ?", jan).Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v.String
+	}
+	sync := func() SyncReport {
+		t.Helper()
+		rep, err := Sync(TriggerManual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+
+	const jan, other, jaOnly = "4987123456784", "4987000000001", "4987000000002"
+	exec(`INSERT INTO jcshms (JC000JanCode, JC018ShouhinMei, JC050GenHousouYakka) VALUES (?, 'テスト錠', '100')`, jan)
+	exec(`INSERT INTO ma0 (MA000JC000JanCode, MA018JC018ShouhinMei, MA050JC050GenHousouYakka) VALUES (?, 'テスト錠（院内名）', '110')`, jan)
+	exec(`INSERT INTO ma0 (MA000JC000JanCode, MA018JC018ShouhinMei) VALUES (?, 'マスターに無い薬')`, other)
+
+	// 初回は商品名の違いだけを上書き指定として残し、古い薬価は更新する
+	rep := sync()
+	if rep.Updated != 1 || rep.Fields != 1 || rep.Overridden != 1 || rep.NotInMaster != 1 || len(rep.Conflicts) != 1 {
+		t.Fatalf("first sync: %+v", rep)
+	}
+	if got := field(jan, "MA050JC050GenHousouYakka"); got != "100" {
+		t.Errorf("first sync left the stale price: %q", got)
+	}
+	if c := rep.Jans[0]; c.ProductName != "テスト錠（院内名）" || c.Changes[0].OldValue != "110" {
+		t.Errorf("first sync changes = %+v", rep.Jans)
+	}
+	if c := rep.Conflicts[0].Changes; len(c) != 1 || c[0].Field != "MA018JC018ShouhinMei" || c[0].OldValue != "テスト錠（院内名）" || c[0].NewValue != "テスト錠" {
+		t.Errorf("conflicts = %+v", rep.Conflicts)
+	}
+	if got := field(jan, "MA018JC018ShouhinMei"); got != "テスト錠（院内名）" {
+		t.Errorf("first sync changed the local name: %q", got)
+	}
+	if o, _ := Overrides(jan); len(o) != 1 || o[0].Value != "テスト錠（院内名）" {
+		t.Errorf("overrides = %+v", o)
+	}
+
+	// ２回目以降はマスターの変更を反映し、上書き指定のフィールドは残す
+	exec(`UPDATE jcshms SET JC050GenHousouYakka = '90' WHERE JC000JanCode = ?`, jan)
+	exec(`INSERT INTO jancode (JA001JanCode, JA006HousouSuuryouSuuchi) VALUES (?, '100')`, jaOnly)
+	exec(`INSERT INTO ma0 (MA000JC000JanCode, MA018JC018ShouhinMei) VALUES (?, 'JANCODE のみの薬')`, jaOnly)
+	rep = sync()
+	if rep.Updated != 2 || rep.Fields != 3 || rep.Overridden != 1 || len(rep.Conflicts) != 0 {
+		t.Fatalf("second sync: %+v", rep)
+	}
+	if got := field(jan, "MA050JC050GenHousouYakka"); got != "90" {
+		t.Errorf("price = %q, want 90", got)
+	}
+	if got := field(jaOnly, "MA131JA006HousouSuuryouSuuchi"); got != "100" {
+		t.Errorf("JANCODE field = %q, want 100", got)
+	}
+	if got := field(jaOnly, "MA018JC018ShouhinMei"); got != "JANCODE のみの薬" {
+		t.Errorf("name without JCSHMS row = %q", got)
+	}
+
+	// 上書き指定を解除するとマスターの値に合わせる
+	if err := DeleteOverride(jan, "MA018JC018ShouhinMei"); err != nil {
+		t.Fatal(err)
+	}
+	if rep = sync(); rep.Updated != 1 || field(jan, "MA018JC018ShouhinMei") != "テスト錠" {
+		t.Errorf("after delete override: %+v name=%q", rep, field(jan, "MA018JC018ShouhinMei"))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"YAMATO/ma0"
+	"YAMATO/search"
 	"YAMATO/tani"
 	"YAMATO/usage"
 )
@@ -84,6 +85,7 @@ VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
 	); err != nil {
 		return fmt.Errorf("ma2 UPSERT エラー: %w", err)
 	}
+	search.Invalidate()
 
 	return nil
 }
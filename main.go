@@ -2,9 +2,10 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"mime"
@@ -12,19 +13,23 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
-	"strings"
-
-	"golang.org/x/text/encoding/japanese"
-	"golang.org/x/text/transform"
 
 	"YAMATO/aggregate"
+	"YAMATO/barcode"
 	"YAMATO/dat"
+	"YAMATO/importer"
 	"YAMATO/inout"
 	"YAMATO/inventory"
 	"YAMATO/ma0"
 	"YAMATO/ma2"
+	"YAMATO/maker"
+	"YAMATO/master"
 	"YAMATO/model"
+	"YAMATO/oroshi"
+	"YAMATO/search"
+	"YAMATO/stocktake"
 	"YAMATO/usage"
+	"YAMATO/yakka"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -46,64 +51,6 @@ func autoLaunchBrowser(url string) {
 	exec.Command(cmd, args...).Start()
 }
 
-// loadCSV は Shift-JIS エンコードの CSV を指定テーブルにロードするユーティリティ
-func loadCSV(db *sql.DB, filePath, table string, cols int, skipHeader bool) error {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	rd := csv.NewReader(transform.NewReader(f, japanese.ShiftJIS.NewDecoder()))
-	rd.LazyQuotes = true
-	rd.FieldsPerRecord = -1
-	if skipHeader {
-		if _, err := rd.Read(); err != nil {
-			return err
-		}
-	}
-
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-
-	ph := make([]string, cols)
-	for i := range ph {
-		ph[i] = "?"
-	}
-	stmt, err := tx.Prepare(
-		"INSERT OR REPLACE INTO " + table + " VALUES(" + strings.Join(ph, ",") + ")",
-	)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	for {
-		rec, err := rd.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		args := make([]interface{}, len(rec))
-		for i, v := range rec {
-			args[i] = v
-		}
-		if _, err := stmt.Exec(args...); err != nil {
-			return err
-		}
-	}
-	return tx.Commit()
-}
-
 // uploadDatHandler は DAT ファイルのアップロードを処理
 func uploadDatHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -120,31 +67,99 @@ func uploadDatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	preview := r.FormValue("preview") == "1"
+	layoutName := r.FormValue("datLayout") // 省略時はヘッダの卸コードから選択
+
 	var all []model.DATRecord
-	var total, created, dup int
+	validations := make([]dat.Validation, 0, len(files))
+	invalid := make([]string, 0)
+	batch := importer.NewBatch("dat")
 	for _, fh := range files {
 		file, err := fh.Open()
 		if err != nil {
 			log.Println("open DAT error:", err)
 			continue
 		}
-		recs, tc, mc, dc, err := dat.ParseDATFile(file)
+		data, err := io.ReadAll(file)
 		file.Close()
+		if err != nil {
+			log.Println("read DAT error:", err)
+			continue
+		}
+		recs, v, err := dat.ReadDATFile(bytes.NewReader(data), layoutName)
 		if err != nil {
 			log.Println("parse DAT error:", err)
 			continue
 		}
-		total += tc
-		created += mc
-		dup += dc
+		v.FileName = fh.Filename
+		for _, e := range v.LineErrors {
+			batch.AddError(importer.LineError{
+				FileName: fh.Filename, Line: e.Line, Field: e.Field, Value: e.Value, Reason: e.Reason,
+			})
+		}
+		validations = append(validations, v)
+		// 件数・金額が合わない・途中で切れたファイルは一部だけ取り込まないよう、ファイルごと除外する
+		if !v.Valid {
+			log.Printf("[DAT] excluded invalid file %s: %v", fh.Filename, v.Errors)
+			invalid = append(invalid, fh.Filename)
+			continue
+		}
+		batch.AddFile(fh.Filename, data)
 		all = append(all, recs...)
 	}
 
-	resp := map[string]interface{}{
-		"DATReadCount":    total,
-		"MA0CreatedCount": created,
-		"DuplicateCount":  dup,
-		"DATRecords":      all,
+	// 取込済みファイルは force=1 が無ければ受け付けない
+	force := r.FormValue("force") == "1"
+	if dups := batch.Duplicates(force); len(dups) > 0 {
+		log.Printf("[DAT] rejected already imported files: %v", dups)
+		importer.WriteDuplicates(w, dups)
+		return
+	}
+
+	// 取込処理（プレビュー時は確定まで保留）
+	commit := func() (interface{}, error) {
+		// プレビュー中に同じファイルが取り込まれていないか再確認
+		if len(batch.Duplicates(force)) > 0 {
+			return nil, importer.ErrAlreadyImported
+		}
+		batch.RowCount = len(all)
+		created, dup, err := dat.ImportDATRecords(all, batch)
+		if err != nil {
+			return nil, batch.Fail(err)
+		}
+		if err := batch.Save(); err != nil {
+			log.Printf("[DAT] save import batch error: %v", err)
+			return nil, fmt.Errorf("取込バッチの保存に失敗しました: %w", err)
+		}
+		return map[string]interface{}{
+			"BatchID":         batch.ID,
+			"DATReadCount":    len(all),
+			"MA0CreatedCount": created,
+			"DuplicateCount":  dup,
+			"ErrorCount":      batch.ErrorCount,
+			"DATRecords":      all,
+			"Validations":     validations,
+			"InvalidFiles":    invalid,
+		}, nil
+	}
+
+	if preview {
+		p := importer.NewPreview("dat", dat.PreviewDATRecords(all), map[string]interface{}{
+			"Validations":  validations,
+			"InvalidFiles": invalid,
+		})
+		if err := importer.Hold(p, commit); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		importer.WritePreview(w, p)
+		return
+	}
+
+	resp, err := commit()
+	if err != nil {
+		http.Error(w, "取込エラー: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
@@ -197,8 +212,8 @@ func main() {
 	mime.AddExtensionType(".css", "text/css")
 	mime.AddExtensionType(".js", "application/javascript")
 
-	// Open SQLite database
-	db, err := sql.Open("sqlite3", "yamato.db")
+	// Open SQLite database（バックグラウンドのマスター読込中も書き込みを待てるようにする）
+	db, err := sql.Open("sqlite3", "yamato.db?_busy_timeout=10000")
 	if err != nil {
 		log.Fatalf("DB open error: %v", err)
 	}
@@ -207,9 +222,23 @@ func main() {
 	// Provide DB to other packages
 	ma0.DB = db
 	inout.DB = db
+	oroshi.DB = db
+	maker.DB = db
+	stocktake.DB = db
+	barcode.DB = db
+	master.DB = db
+	yakka.DB = db
+	search.DB = db
+	ma0.OnChange = search.Invalidate
 	aggregate.SetDB(db)
+	importer.SetDB(db)
 	usage.LoadTaniMap()
 
+	// 旧形式の usagerecords は退避して schema.sql 適用後に移し替える
+	if _, err := usage.StashLegacyTable(db); err != nil {
+		log.Fatalf("migrate usagerecords error: %v", err)
+	}
+
 	// Apply schema.sql
 	schema, err := os.ReadFile("schema.sql")
 	if err != nil {
@@ -218,15 +247,62 @@ func main() {
 	if _, err := db.Exec(string(schema)); err != nil {
 		log.Fatalf("exec schema.sql error: %v", err)
 	}
+	if err := usage.MoveLegacyRows(db, usage.LegacySource(usage.ProfileConfigPath)); err != nil {
+		log.Fatalf("migrate usagerecords error: %v", err)
+	}
+	if err := dat.Migrate(db); err != nil {
+		log.Fatalf("migrate datrecords error: %v", err)
+	}
+	if err := inventory.Migrate(db); err != nil {
+		log.Fatalf("migrate inventory error: %v", err)
+	}
+	if err := master.Migrate(db); err != nil {
+		log.Fatalf("migrate master_updates error: %v", err)
+	}
+	if err := yakka.Migrate(db); err != nil {
+		log.Fatalf("migrate yakka_history error: %v", err)
+	}
 
-	// Load master CSVs
-	if err := loadCSV(db, "SOU/JCSHMS.CSV", "jcshms", 125, false); err != nil {
-		log.Fatalf("load JCSHMS failed: %v", err)
+	// コマンド: YAMATO import-master [-force] [マスター名 [ファイル]]
+	if len(os.Args) > 1 && os.Args[1] == "import-master" {
+		code := runImportMaster(os.Args[2:])
+		db.Close()
+		os.Exit(code)
 	}
-	if err := loadCSV(db, "SOU/JANCODE.CSV", "jancode", 30, true); err != nil {
-		log.Fatalf("load JANCODE failed: %v", err)
+
+	// 卸マスター（保守 API での変更は上書きしない）
+	if n, err := oroshi.LoadCSV(oroshi.CSVPath, false); err != nil {
+		log.Printf("load IOALIST failed: %v", err)
+	} else {
+		log.Printf("IOALIST: %d rows added", n)
+	}
+
+	// メーカーマスター（同じ版は読み直さない）
+	if res, err := maker.LoadCSV(maker.CSVPath, false); err != nil {
+		log.Printf("load MAKER failed: %v", err)
+	} else {
+		log.Printf("MAKER %s: %d rows (skipped=%v)", res.Version, res.Count, res.Skipped)
+	}
+
+	// USAGE 列対応プロファイル（調剤システム別）
+	if err := usage.Profiles.Load(usage.ProfileConfigPath); err != nil {
+		log.Fatalf("load USAGE profiles error: %v", err)
+	}
+
+	// 棚卸 CSV プロファイル（棚卸データの出力元別）
+	if err := inventory.Profiles.Load(inventory.ProfileConfigPath); err != nil {
+		log.Fatalf("load inventory profiles error: %v", err)
+	}
+
+	// DAT レイアウト定義（卸別）
+	if err := dat.LoadLayouts(dat.LayoutConfigPath); err != nil {
+		log.Fatalf("load DAT layouts failed: %v", err)
 	}
 
+	// Load master CSVs（起動を待たせないようバックグラウンドで読み込む。
+	// 前回と同じファイルは読み飛ばし、差分を master_changes に記録）
+	master.Start(false)
+
 	// Static file server
 	fs := http.FileServer(http.Dir("./static"))
 	http.Handle("/", fs)
@@ -236,15 +312,56 @@ func main() {
 	// API endpoints
 	http.HandleFunc("/uploadDat", uploadDatHandler)
 	http.HandleFunc("/uploadUsage", usage.UploadUsageHandler)
+	http.HandleFunc("/api/usage/profiles", usage.Profiles.Handler)
+	http.HandleFunc("/api/usage/conversion", aggregate.UsageConversionHandler)
 
 	http.HandleFunc("/uploadInventory", inventory.UploadInventoryHandler)
+	http.HandleFunc("/api/inventory/profiles", inventory.Profiles.Handler)
+	http.HandleFunc("/api/import/commit", importer.CommitHandler)
+	http.HandleFunc("/api/import/batches", importer.BatchesHandler)
+	http.HandleFunc("/api/import/rollback", importer.RollbackHandler)
+	http.HandleFunc("/api/import/errors.csv", importer.ErrorsCSVHandler)
+	http.HandleFunc("/api/inventory/variance", aggregate.VarianceHandler)
+	http.HandleFunc("/api/inventory/valuation", aggregate.ValuationHandler)
 	http.HandleFunc("/aggregate", aggregate.AggregateHandler)
 
 	// Inout (出庫・入庫)
 	http.HandleFunc("/api/inout", inout.Handler)
 	http.HandleFunc("/api/inout/search", inout.ProductSearchHandler)
+	http.HandleFunc("/api/products/search", search.Handler)
 	http.HandleFunc("/api/inout/save", inout.SaveIODHandler)
 
+	// 卸マスター
+	http.HandleFunc("/api/oroshi", oroshi.Handler)
+	http.HandleFunc("/api/oroshi/import", oroshi.ImportHandler)
+
+	// メーカーマスター
+	http.HandleFunc("/api/maker", maker.Handler)
+	http.HandleFunc("/api/maker/import", maker.ImportHandler)
+	http.HandleFunc("/api/maker/totals", maker.TotalsHandler)
+
+	// バーコード（JAN・GS1）の解釈
+	http.HandleFunc("/api/barcode", barcode.Handler)
+
+	// マスター読込履歴・差分
+	http.HandleFunc("/api/master/import", master.ImportHandler)
+	http.HandleFunc("/api/master/updates", master.UpdatesHandler)
+	http.HandleFunc("/api/master/changes", master.ChangesHandler)
+
+	// 薬価の履歴
+	http.HandleFunc("/api/yakka/history", yakka.HistoryHandler)
+
+	// MA0 とマスターの再同期・上書き指定
+	http.HandleFunc("/api/ma0/sync", ma0.SyncHandler)
+	http.HandleFunc("/api/ma0/overrides", ma0.OverridesHandler)
+
+	// 棚卸セッション（ハンディスキャナー）
+	http.HandleFunc("/api/stocktake/sessions", stocktake.SessionsHandler)
+	http.HandleFunc("/api/stocktake/session", stocktake.SessionHandler)
+	http.HandleFunc("/api/stocktake/scans", stocktake.ScansHandler)
+	http.HandleFunc("/api/stocktake/close", stocktake.CloseHandler)
+	http.HandleFunc("/api/stocktake/unknown", stocktake.QueueHandler)
+
 	// MA2 endpoints
 	http.HandleFunc("/api/ma2", listMa2Handler)
 	http.HandleFunc("/api/ma2/upsert", ma2.UpsertHandler)
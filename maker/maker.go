@@ -0,0 +1,197 @@
+// Package maker はメーカー（販売元・製造元）マスターを扱います。
+// SOU/MAKER.CSV の MK レコードを読み込み、JCSHMS の販売元コード（JC029）・
+// 製造元／輸入元コード（JC033）と結び付けます。
+package maker
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+var DB *sql.DB
+
+// CSVPath はメーカーマスターの既定ファイルです。
+const CSVPath = "SOU/MAKER.CSV"
+
+// masterName は master_versions に記録する名前です。
+const masterName = "MAKER"
+
+// Record はメーカーマスターの１行です。
+type Record struct {
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	KanaShort string `json:"kanaShort"` // 半角カナ略称
+	FullName  string `json:"fullName"`
+	Kana      string `json:"kana"`
+}
+
+// LoadResult は MAKER.CSV 読込の結果です。
+type LoadResult struct {
+	Version string `json:"version"`
+	Count   int    `json:"count"`
+	Skipped bool   `json:"skipped"` // 同じ版が読込済みのため読み飛ばした
+}
+
+// LoadCSV は Shift-JIS の MAKER.CSV を maker テーブルに読み込みます。
+// 1行目（コード 0）は版情報として master_versions に記録し、
+// 同じ版が読込済みの場合は force が true のときだけ読み直します。
+func LoadCSV(path string, force bool) (LoadResult, error) {
+	var res LoadResult
+	f, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	rd := csv.NewReader(transform.NewReader(f, japanese.ShiftJIS.NewDecoder()))
+	rd.LazyQuotes = true
+	rd.FieldsPerRecord = -1
+
+	var recs []Record
+	for {
+		row, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		if len(row) < 4 || strings.TrimSpace(row[0]) != "MK" {
+			continue
+		}
+		code := strings.TrimSpace(row[1])
+		if strings.Trim(code, "0") == "" {
+			res.Version = strings.TrimSpace(row[3])
+			continue
+		}
+		r := Record{Code: code, Name: strings.TrimSpace(row[3])}
+		if len(row) > 4 {
+			r.KanaShort = strings.TrimSpace(row[4])
+		}
+		if len(row) > 5 {
+			r.FullName = strings.TrimSpace(row[5])
+		}
+		if len(row) > 6 {
+			r.Kana = strings.TrimSpace(row[6])
+		}
+		recs = append(recs, r)
+	}
+	res.Count = len(recs)
+
+	if !force && res.Version != "" && res.Version == Version() {
+		res.Skipped = true
+		return res, nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM maker`); err != nil {
+		return res, err
+	}
+	stmt, err := tx.Prepare(`
+INSERT OR REPLACE INTO maker (makerCode, name, kanaShort, fullName, kana)
+VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return res, err
+	}
+	defer stmt.Close()
+	for _, r := range recs {
+		if _, err := stmt.Exec(r.Code, r.Name, r.KanaShort, r.FullName, r.Kana); err != nil {
+			return res, fmt.Errorf("insert maker %s: %w", r.Code, err)
+		}
+	}
+	if _, err := tx.Exec(`
+INSERT OR REPLACE INTO master_versions (masterName, version, loadedAt, rowCount)
+VALUES (?, ?, ?, ?)`,
+		masterName, res.Version, time.Now().Format("2006-01-02 15:04:05"), len(recs),
+	); err != nil {
+		return res, err
+	}
+	return res, tx.Commit()
+}
+
+// Version は読込済みの MAKER.CSV の版を返します（未読込は空文字）。
+func Version() string {
+	var v string
+	err := DB.QueryRow(`SELECT version FROM master_versions WHERE masterName = ?`, masterName).Scan(&v)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[MAKER] version lookup error: %v", err)
+	}
+	return v
+}
+
+// List はメーカーをコード順に返します。q を指定すると名称・カナで絞り込みます。
+func List(q string) ([]Record, error) {
+	query := `SELECT makerCode, name, kanaShort, fullName, kana FROM maker`
+	var args []interface{}
+	if q != "" {
+		query += ` WHERE name LIKE ? OR fullName LIKE ? OR kana LIKE ? OR kanaShort LIKE ?`
+		like := "%" + q + "%"
+		args = append(args, like, like, like, like)
+	}
+	rows, err := DB.Query(query+` ORDER BY makerCode`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]Record, 0)
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.Code, &r.Name, &r.KanaShort, &r.FullName, &r.Kana); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Handler は /api/maker の GET（?q= で絞り込み）を処理します
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := List(strings.TrimSpace(r.URL.Query().Get("q")))
+	if err != nil {
+		log.Printf("[MAKER] list error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": Version(),
+		"makers":  list,
+	})
+}
+
+// ImportHandler は /api/maker/import の POST で MAKER.CSV を再読込します（force=1 で同版も再読込）
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := LoadCSV(CSVPath, r.URL.Query().Get("force") == "1")
+	if err != nil {
+		log.Printf("[MAKER] import error: %v", err)
+		http.Error(w, "取込エラー: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
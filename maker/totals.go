@@ -0,0 +1,190 @@
+package maker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"YAMATO/yakka"
+)
+
+// makerColumns は集計の基準にする MA0 のメーカーコード列です。
+var makerColumns = map[string]string{
+	"hanbai": "MA029JC029HanbaiMotoCode",           // 販売元
+	"seizou": "MA033JC033SeizouMotoYunyuuMotoCode", // 製造元／輸入元
+}
+
+// Total はメーカー別の仕入・消費の合計です。
+type Total struct {
+	MakerCode         string  `json:"makerCode"`
+	MakerName         string  `json:"makerName"`
+	ProductCount      int     `json:"productCount"`      // 仕入・消費のあった JAN 数
+	PurchaseAmount    float64 `json:"purchaseAmount"`    // 納品の小計合計
+	ReturnAmount      float64 `json:"returnAmount"`      // 返品の小計合計
+	NetPurchaseAmount float64 `json:"netPurchaseAmount"` // 納品 − 返品
+	ConsumptionLines  int     `json:"consumptionLines"`  // USAGE の行数
+	ConsumptionYakka  float64 `json:"consumptionYakka"`  // 消費数量 × 消費日の単位薬価
+}
+
+// Totals は from〜to のメーカー別合計を純仕入額の大きい順に返します。
+// by は "hanbai"（販売元、既定）または "seizou"（製造元／輸入元）、
+// makerCode を指定するとそのメーカーのみを返します。
+func Totals(from, to, by, makerCode string) ([]Total, error) {
+	col, ok := makerColumns[by]
+	if !ok {
+		return nil, fmt.Errorf("by は hanbai または seizou を指定してください")
+	}
+	mk := "COALESCE(m." + col + ", '')"
+	makerCond := ""
+	var makerArgs []interface{}
+	if makerCode != "" {
+		makerCond = " AND " + mk + " = ?"
+		makerArgs = append(makerArgs, makerCode)
+	}
+
+	byCode := make(map[string]*Total)
+	get := func(code string) *Total {
+		t, ok := byCode[code]
+		if !ok {
+			t = &Total{MakerCode: code}
+			byCode[code] = t
+		}
+		return t
+	}
+
+	// 仕入（DAT）
+	args := append([]interface{}{from, to}, makerArgs...)
+	rows, err := DB.Query(`
+SELECT `+mk+`, d.DatDeliveryFlag, COALESCE(SUM(CAST(d.DatSubtotal AS REAL)), 0)
+  FROM datrecords d
+  LEFT JOIN ma0 m ON d.DatJanCode = m.MA000JC000JanCode
+ WHERE d.DatDate BETWEEN ? AND ?`+makerCond+`
+ GROUP BY 1, 2`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("purchase totals: %w", err)
+	}
+	for rows.Next() {
+		var code, flag string
+		var amt float64
+		if err := rows.Scan(&code, &flag, &amt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t := get(code)
+		if flag == "2" {
+			t.ReturnAmount += amt
+		} else {
+			t.PurchaseAmount += amt
+		}
+	}
+	rows.Close()
+
+	// 消費（USAGE）
+	rows, err = DB.Query(`
+SELECT `+mk+`, COUNT(*),
+       COALESCE(SUM(CAST(u.usageAmount AS REAL) * COALESCE(`+yakka.TaniYakkaSQL("u.usageJanCode", "u.usageDate")+`,
+                CAST(COALESCE(NULLIF(m.MA049JC049GenTaniYakka, ''), '0') AS REAL))), 0)
+  FROM usagerecords u
+  LEFT JOIN ma0 m ON u.usageJanCode = m.MA000JC000JanCode
+ WHERE u.usageDate BETWEEN ? AND ?`+makerCond+`
+ GROUP BY 1`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("consumption totals: %w", err)
+	}
+	for rows.Next() {
+		var code string
+		var n int
+		var yakka float64
+		if err := rows.Scan(&code, &n, &yakka); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t := get(code)
+		t.ConsumptionLines += n
+		t.ConsumptionYakka += yakka
+	}
+	rows.Close()
+
+	// 品目数（仕入・消費のいずれかがあった JAN）
+	rows, err = DB.Query(`
+SELECT mk, COUNT(DISTINCT jan) FROM (
+  SELECT `+mk+` AS mk, d.DatJanCode AS jan
+    FROM datrecords d LEFT JOIN ma0 m ON d.DatJanCode = m.MA000JC000JanCode
+   WHERE d.DatDate BETWEEN ? AND ?`+makerCond+`
+  UNION
+  SELECT `+mk+`, u.usageJanCode
+    FROM usagerecords u LEFT JOIN ma0 m ON u.usageJanCode = m.MA000JC000JanCode
+   WHERE u.usageDate BETWEEN ? AND ?`+makerCond+`
+) GROUP BY mk`, append(append([]interface{}{}, args...), args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("product counts: %w", err)
+	}
+	for rows.Next() {
+		var code string
+		var n int
+		if err := rows.Scan(&code, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		get(code).ProductCount = n
+	}
+	rows.Close()
+
+	names := make(map[string]string)
+	if list, err := List(""); err == nil {
+		for _, r := range list {
+			names[r.Code] = r.Name
+		}
+	} else {
+		log.Printf("[MAKER] name lookup error: %v", err)
+	}
+
+	out := make([]Total, 0, len(byCode))
+	for code, t := range byCode {
+		t.MakerName = names[code]
+		if t.MakerName == "" {
+			if code == "" {
+				t.MakerName = "（メーカー不明）"
+			} else {
+				t.MakerName = "（未登録 " + code + "）"
+			}
+		}
+		t.NetPurchaseAmount = math.Round((t.PurchaseAmount-t.ReturnAmount)*100) / 100
+		t.ConsumptionYakka = math.Round(t.ConsumptionYakka*100) / 100
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].NetPurchaseAmount != out[j].NetPurchaseAmount {
+			return out[i].NetPurchaseAmount > out[j].NetPurchaseAmount
+		}
+		return out[i].MakerCode < out[j].MakerCode
+	})
+	return out, nil
+}
+
+// TotalsHandler は /api/maker/totals?from=&to=&by=&maker= の GET を処理します
+func TotalsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from := strings.ReplaceAll(q.Get("from"), "-", "")
+	to := strings.ReplaceAll(q.Get("to"), "-", "")
+	if from == "" || to == "" {
+		http.Error(w, "from/to は必須です", http.StatusBadRequest)
+		return
+	}
+	by := q.Get("by")
+	if by == "" {
+		by = "hanbai"
+	}
+	list, err := Totals(from, to, by, q.Get("maker"))
+	if err != nil {
+		log.Printf("[MAKER] totals error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
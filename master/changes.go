@@ -0,0 +1,171 @@
+package master
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Update は master_updates の１行（マスター読込１回分）です。
+type Update struct {
+	UpdateID int64  `json:"updateId"`
+	Master   string `json:"master"`
+	FileName string `json:"fileName"`
+	SHA256   string `json:"sha256"`
+	Version  string `json:"version"`
+	LoadedAt string `json:"loadedAt"`
+	Rows     int    `json:"rows"`
+	Added    int    `json:"added"`
+	Removed  int    `json:"removed"`
+	Changed  int    `json:"changed"`
+	Initial  bool   `json:"initial"`
+	Status   string `json:"status"` // loading は書き込み途中で中断した読込
+}
+
+// Updates は新しい順にマスター読込の履歴を返します。master を指定するとそのマスターのみです。
+func Updates(master string, limit int) ([]Update, error) {
+	query, args := `
+SELECT updateId, masterName, fileName, sha256, version, loadedAt, rowCount, added, removed, changed, initial, status
+  FROM master_updates`, []interface{}{}
+	if master != "" {
+		query += ` WHERE masterName = ?`
+		args = append(args, master)
+	}
+	query += ` ORDER BY updateId DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Update, 0)
+	for rows.Next() {
+		var u Update
+		if err := rows.Scan(&u.UpdateID, &u.Master, &u.FileName, &u.SHA256, &u.Version, &u.LoadedAt,
+			&u.Rows, &u.Added, &u.Removed, &u.Changed, &u.Initial, &u.Status); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// ChangeFilter は変更履歴の絞り込み条件です。
+type ChangeFilter struct {
+	UpdateID   int64    // 0 ならマスターごとの最新の読込
+	Master     string   // JCSHMS・JANCODE
+	JanCode    string   // 指定すると全読込の履歴
+	Categories []string // price・packaging・regulatory・supply・other
+	All        bool     // false なら取扱品（MA0 に登録のある JAN）のみ
+}
+
+// Changes は条件に合う変更を返します。
+func Changes(f ChangeFilter) ([]Change, error) {
+	sb := &strings.Builder{}
+	sb.WriteString(`
+SELECT c.updateId, c.masterName, c.janCode,
+       COALESCE(NULLIF(c.productName, ''), j.JC018ShouhinMei, m.MA018JC018ShouhinMei, ''),
+       c.changeType, c.category, c.field, c.oldValue, c.newValue, u.loadedAt
+  FROM master_changes c
+  JOIN master_updates u ON u.updateId = c.updateId
+  LEFT JOIN jcshms j ON j.JC000JanCode = c.janCode
+  LEFT JOIN ma0 m    ON m.MA000JC000JanCode = c.janCode
+ WHERE 1 = 1`)
+	var args []interface{}
+	switch {
+	case f.UpdateID > 0:
+		sb.WriteString(` AND c.updateId = ?`)
+		args = append(args, f.UpdateID)
+	case f.JanCode == "":
+		sb.WriteString(` AND c.updateId IN (SELECT MAX(updateId) FROM master_updates WHERE initial = 0 GROUP BY masterName)`)
+	}
+	if f.Master != "" {
+		sb.WriteString(` AND c.masterName = ?`)
+		args = append(args, f.Master)
+	}
+	if f.JanCode != "" {
+		sb.WriteString(` AND c.janCode = ?`)
+		args = append(args, f.JanCode)
+	}
+	if len(f.Categories) > 0 {
+		// 追加・削除は分類を持たないため常に含める
+		sb.WriteString(` AND (c.category = '' OR c.category IN (` +
+			strings.TrimSuffix(strings.Repeat("?,", len(f.Categories)), ",") + `))`)
+		for _, c := range f.Categories {
+			args = append(args, c)
+		}
+	}
+	if !f.All {
+		sb.WriteString(` AND m.MA000JC000JanCode IS NOT NULL`)
+	}
+	sb.WriteString(` ORDER BY c.updateId DESC, c.janCode, c.field`)
+
+	rows, err := DB.Query(sb.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Change, 0)
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.UpdateID, &c.Master, &c.JanCode, &c.ProductName,
+			&c.ChangeType, &c.Category, &c.Field, &c.OldValue, &c.NewValue, &c.LoadedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// UpdatesHandler は /api/master/updates?master=&limit= の GET でマスター読込の履歴を返します。
+func UpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	list, err := Updates(q.Get("master"), limit)
+	if err != nil {
+		log.Printf("[MASTER] updates error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
+
+// ChangesHandler は /api/master/changes の GET で変更履歴を返します。
+//   - update=ID  : その読込の変更（省略時はマスターごとの最新の読込）
+//   - master     : JCSHMS・JANCODE
+//   - jan        : その JAN の全履歴
+//   - category   : price,packaging,regulatory,supply,other（カンマ区切り）
+//   - all=1      : 取扱品（MA0 登録済み）以外も含める
+func ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := ChangeFilter{
+		Master:  q.Get("master"),
+		JanCode: q.Get("jan"),
+		All:     q.Get("all") == "1",
+	}
+	if s := q.Get("update"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "update が不正です", http.StatusBadRequest)
+			return
+		}
+		f.UpdateID = id
+	}
+	if s := q.Get("category"); s != "" {
+		f.Categories = strings.Split(s, ",")
+	}
+	list, err := Changes(f)
+	if err != nil {
+		log.Printf("[MASTER] changes error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,179 @@
+package master
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"YAMATO/importer"
+	"YAMATO/ma0"
+)
+
+// Status はマスター一括読込の状態です。
+type Status struct {
+	Running    bool              `json:"running"`
+	StartedAt  string            `json:"startedAt,omitempty"`
+	FinishedAt string            `json:"finishedAt,omitempty"`
+	Results    []LoadResult      `json:"results"`
+	Errors     map[string]string `json:"errors,omitempty"` // マスター名→エラー（ファイルが無いなど）
+	Versions   map[string]string `json:"versions"`         // 読込済みの版
+}
+
+var (
+	loadMu   sync.Mutex // 読込は同時に１つだけ
+	statusMu sync.Mutex
+	status   Status
+)
+
+// Migrate は schema.sql 適用後に呼び出し、既存の master_updates に版と状態の列を追加します。
+// master_removed が空なら、マスターごとの最新の読込で削除と記録した行から印を付けます。
+func Migrate(db *sql.DB) error {
+	if err := importer.AddColumns(db, "master_updates", [][2]string{
+		{"version", "TEXT NOT NULL DEFAULT ''"},
+		{"status", "TEXT NOT NULL DEFAULT 'done'"},
+	}); err != nil {
+		return err
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM master_removed`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	_, err := db.Exec(`
+INSERT OR IGNORE INTO master_removed (masterName, janCode, updateId)
+SELECT masterName, janCode, updateId FROM master_changes
+ WHERE changeType = 'removed'
+   AND updateId IN (SELECT MAX(updateId) FROM master_updates GROUP BY masterName)`)
+	return err
+}
+
+// LoadAll は Specs を順に既定のファイルから読み込みます。
+// ファイルが無いなどのエラーは記録して次のマスターに進みます。
+func LoadAll(force bool) Status {
+	st := Status{Running: true, StartedAt: time.Now().Format("2006-01-02 15:04:05"), Errors: map[string]string{}}
+	setStatus(st)
+	for _, spec := range Specs {
+		res, err := Load(spec, "", force)
+		if err != nil {
+			log.Printf("[MASTER] load %s failed: %v", spec.Name, err)
+			st.Errors[spec.Name] = err.Error()
+			continue
+		}
+		st.Results = append(st.Results, res)
+		setStatus(st)
+	}
+	SyncMA0(st.Results...)
+	st.Running = false
+	st.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	setStatus(st)
+	return CurrentStatus()
+}
+
+// SyncMA0 は読込でマスターの内容が変わっていれば MA0 を再同期します。
+func SyncMA0(results ...LoadResult) {
+	for _, res := range results {
+		if res.Skipped {
+			continue
+		}
+		if _, err := ma0.Sync(ma0.TriggerMaster); err != nil {
+			log.Printf("[MASTER] ma0 sync failed: %v", err)
+		}
+		return
+	}
+}
+
+// Start は LoadAll をバックグラウンドで開始します。実行中なら false を返します。
+func Start(force bool) bool {
+	statusMu.Lock()
+	if status.Running {
+		statusMu.Unlock()
+		return false
+	}
+	status.Running = true
+	statusMu.Unlock()
+	go LoadAll(force)
+	return true
+}
+
+func setStatus(st Status) {
+	statusMu.Lock()
+	status = st
+	statusMu.Unlock()
+}
+
+// CurrentStatus は一括読込の状態と読込済みの版を返します。
+func CurrentStatus() Status {
+	statusMu.Lock()
+	st := status
+	statusMu.Unlock()
+	st.Versions = map[string]string{}
+	for _, spec := range Specs {
+		st.Versions[spec.Name] = LoadedVersion(spec.Name)
+	}
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ImportHandler は /api/master/import を処理します。
+//   - GET                         : 一括読込の状態と読込済みの版
+//   - POST ?master=JCSHMS (+file) : そのマスターを読み込み結果を返す（file が無ければ既定のファイル）
+//   - POST（master 無し）         : 全マスターの読込をバックグラウンドで開始（202）
+//
+// force=1 で前回と同じファイルも読み直します。
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, CurrentStatus())
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	force := r.FormValue("force") == "1"
+	name := r.FormValue("master")
+	if name == "" {
+		if !Start(force) {
+			http.Error(w, "マスター読込を実行中です", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, CurrentStatus())
+		return
+	}
+	spec, ok := SpecByName(name)
+	if !ok {
+		http.Error(w, "master "+name+" は未対応です", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		res LoadResult
+		err error
+	)
+	if file, fh, ferr := r.FormFile("file"); ferr == nil {
+		defer file.Close()
+		data, rerr := io.ReadAll(file)
+		if rerr != nil {
+			http.Error(w, "ファイル読み込みエラー: "+rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err = LoadData(spec, fh.Filename, data, force)
+	} else {
+		res, err = Load(spec, "", force)
+	}
+	if err != nil {
+		log.Printf("[MASTER] import %s error: %v", spec.Name, err)
+		http.Error(w, "マスター読込エラー: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	SyncMA0(res)
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,642 @@
+// Package master は医薬品マスター（SOU/JCSHMS.CSV・SOU/JANCODE.CSV）の読込を扱います。
+// 読込のたびに既存の行と比較し、追加・削除（ファイルから消えた行）・項目の変更を
+// master_updates／master_changes に記録します。消えた行はテーブルに残し、master_removed に
+// 印を付けて次回以降の読込では削除として記録し直しません。
+package master
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+
+	"YAMATO/importer"
+	"YAMATO/search"
+	"YAMATO/yakka"
+)
+
+var DB *sql.DB
+
+// Spec はマスターファイル１種類の読込方法です。
+type Spec struct {
+	Name       string // master_updates に記録する名前
+	Path       string // 既定のファイル
+	Table      string
+	Cols       int // 想定する列数（テーブルの列数）
+	KeyCol     int // 主キー（JAN）の列位置
+	NameCol    int // 商品名の列位置（無ければ -1）
+	VersionCol int // 版とする列（全行の最大値。無ければ -1 で見出し行の日付）
+	SkipHeader bool
+	// Editions は列数がテーブルと異なる版の列対応です。ファイルの列数ごとに、テーブルの各列へ入れる
+	// ファイルの列位置（-1 は空）を並べます。途中に列が挿入された版を位置のまま詰め替えると
+	// 以降の項目がずれるため、列数が異なり対応の無いファイルは読み込みません。
+	Editions map[int][]int
+}
+
+// 読み込むマスター
+var (
+	JCSHMS  = Spec{Name: "JCSHMS", Path: "SOU/JCSHMS.CSV", Table: "jcshms", Cols: 125, KeyCol: 0, NameCol: 18, VersionCol: 120}
+	JANCODE = Spec{Name: "JANCODE", Path: "SOU/JANCODE.CSV", Table: "jancode", Cols: 30, KeyCol: 1, NameCol: -1, VersionCol: -1, SkipHeader: true}
+)
+
+// SpecByName は名前（大文字小文字を区別しない）でマスターを探します。
+func SpecByName(name string) (Spec, bool) {
+	for _, s := range Specs {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+	}
+	return Spec{}, false
+}
+
+// Specs は起動時に読み込む順のマスターです。
+var Specs = []Spec{JCSHMS, JANCODE}
+
+// 変更の種類
+const (
+	ChangeAdded        = "added"        // 新規収載
+	ChangeRemoved      = "removed"      // ファイルから削除（テーブルの行は残す）
+	ChangeChanged      = "changed"      // 項目の変更
+	ChangeDiscontinued = "discontinued" // 発売中止日・製造中止日が新たに入った
+)
+
+// 変更項目の分類
+const (
+	CategoryPrice      = "price"      // 薬価
+	CategoryPackaging  = "packaging"  // 包装
+	CategoryRegulatory = "regulatory" // 毒劇麻向・規制区分
+	CategorySupply     = "supply"     // 販売開始・中止
+	CategoryOther      = "other"
+)
+
+// categories は列番号（JC/JA の後の３桁）ごとの分類です。無い列は other です。
+var categories = map[string]map[int]string{
+	"JC": func() map[int]string {
+		m := map[int]string{121: CategoryPackaging, 122: CategoryPackaging, 124: CategoryPrice,
+			77: CategoryRegulatory, 79: CategoryRegulatory, 86: CategoryRegulatory, 80: CategorySupply}
+		for n := 37; n <= 47; n++ {
+			m[n] = CategoryPackaging
+		}
+		for n := 48; n <= 56; n++ {
+			m[n] = CategoryPrice
+		}
+		for n := 57; n <= 60; n++ {
+			m[n] = CategorySupply
+		}
+		for n := 61; n <= 70; n++ {
+			m[n] = CategoryRegulatory
+		}
+		return m
+	}(),
+	"JA": {6: CategoryPackaging, 7: CategoryPackaging, 8: CategoryPackaging},
+}
+
+// ignored は毎回変わるため比較しない列です（更新区分・登録日・更新日）。
+var ignored = map[string]bool{
+	"JC118KoushinKubun": true, "JC119TourokuNengappi": true, "JC120KoushinNengappi": true,
+}
+
+// discontinuedCols は値が新たに入ったとき discontinued とする列です。
+var discontinuedCols = map[string]bool{
+	"JC059HatsubaiChuushiNengappi": true, "JC060SeizouChuushiNengappi": true,
+}
+
+// CategoryOf は列名の分類を返します。
+func CategoryOf(col string) string {
+	if len(col) < 5 {
+		return CategoryOther
+	}
+	n, err := strconv.Atoi(col[2:5])
+	if err != nil {
+		return CategoryOther
+	}
+	if c, ok := categories[col[:2]][n]; ok {
+		return c
+	}
+	return CategoryOther
+}
+
+// LoadResult はマスター読込の結果です。
+type LoadResult struct {
+	UpdateID int64  `json:"updateId"`
+	Master   string `json:"master"`
+	FileName string `json:"fileName"`
+	SHA256   string `json:"sha256"`
+	LoadedAt string `json:"loadedAt"`
+	Rows     int    `json:"rows"`
+	Added    int    `json:"added"`
+	Removed  int    `json:"removed"`
+	Changed  int    `json:"changed"`
+	Version  string `json:"version"`  // 検出した版（検出できなければファイルのハッシュ先頭）
+	Initial  bool   `json:"initial"`  // 空のテーブルへの初回読込（行ごとの変更は記録しない）
+	Skipped  bool   `json:"skipped"`  // 前回と同じファイルのため読み飛ばした
+	FileCols int    `json:"fileCols"` // ファイルの最大列数
+	Mapped   int    `json:"mapped"`   // Editions の列対応で読み替えた行数
+	Resumed  bool   `json:"resumed"`  // 中断した同じファイルの読込の続きとして記録した
+}
+
+// 読込の状態（master_updates.status）
+const (
+	StatusLoading = "loading" // 書き込み中（中断した読込もこのまま残る）
+	StatusDone    = "done"
+)
+
+// write は書き込む１行と、その行の差分です。
+type write struct {
+	row      []string
+	changes  []Change
+	added    bool
+	changed  bool
+	relisted bool // 削除済みから再びファイルに載った
+}
+
+// chunkRows は１トランザクションで書き込む行数です。
+// 書き込み中は他の取込が待たされるため、長いトランザクションにしないよう分けてコミットします。
+// 各行の差分（master_changes）は行と同じトランザクションで記録します。
+var chunkRows = 2000
+
+// mapRow はファイルの１行をテーブルの列順に並べます。
+// 列数がテーブルと同じならそのまま、異なれば Editions の列対応で読み替えます。
+func (s Spec) mapRow(rec []string, cols int) ([]string, bool, error) {
+	if len(rec) == cols {
+		return rec, false, nil
+	}
+	idx, ok := s.Editions[len(rec)]
+	if !ok {
+		return nil, false, fmt.Errorf("列数 %d がテーブル %s の列数 %d と異なり、列の対応が定義されていません",
+			len(rec), s.Table, cols)
+	}
+	if len(idx) != cols {
+		return nil, false, fmt.Errorf("列数 %d の版の列対応が %d 列ではありません（テーブルは %d 列）", len(rec), len(idx), cols)
+	}
+	row := make([]string, cols)
+	for i, j := range idx {
+		if j >= 0 && j < len(rec) {
+			row[i] = rec[j]
+		}
+	}
+	return row, true, nil
+}
+
+func blank(rec []string) bool {
+	for _, v := range rec {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Change は１商品の１項目の変更です（追加・削除は Field が空）。
+type Change struct {
+	UpdateID    int64  `json:"updateId"`
+	Master      string `json:"master"`
+	JanCode     string `json:"janCode"`
+	ProductName string `json:"productName"`
+	ChangeType  string `json:"changeType"`
+	Category    string `json:"category"`
+	Field       string `json:"field"`
+	OldValue    string `json:"oldValue"`
+	NewValue    string `json:"newValue"`
+	LoadedAt    string `json:"loadedAt,omitempty"`
+}
+
+// lastHash は前回最後まで読み込んだファイルのハッシュを返します。
+func lastHash(name string) string {
+	var sha string
+	err := DB.QueryRow(
+		`SELECT sha256 FROM master_updates WHERE masterName = ? AND status = ? ORDER BY updateId DESC LIMIT 1`, name, StatusDone,
+	).Scan(&sha)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[MASTER] last update lookup error %s: %v", name, err)
+	}
+	return sha
+}
+
+// interrupted は前回の読込が同じファイル sha の書き込み途中で中断していれば、その updateId と初回読込かを返します。
+func interrupted(name, sha string) (id int64, initial, ok bool) {
+	var prevSHA, st string
+	err := DB.QueryRow(
+		`SELECT updateId, initial, sha256, status FROM master_updates WHERE masterName = ? ORDER BY updateId DESC LIMIT 1`, name,
+	).Scan(&id, &initial, &prevSHA, &st)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[MASTER] last update lookup error %s: %v", name, err)
+		}
+		return 0, false, false
+	}
+	return id, initial, st == StatusLoading && prevSHA == sha
+}
+
+// removedKeys はファイルから消えたと記録済みの主キーを返します。
+func removedKeys(name string) (map[string]bool, error) {
+	rows, err := DB.Query(`SELECT janCode FROM master_removed WHERE masterName = ?`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		out[key] = true
+	}
+	return out, rows.Err()
+}
+
+// readTable は既存の行を主キーごとに返します。
+func readTable(spec Spec, cols int) (map[string][]string, error) {
+	rows, err := DB.Query(`SELECT * FROM ` + spec.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]string)
+	vals := make([]sql.NullString, cols)
+	ptrs := make([]interface{}, cols)
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]string, cols)
+		for i, v := range vals {
+			row[i] = v.String
+		}
+		out[row[spec.KeyCol]] = row
+	}
+	return out, rows.Err()
+}
+
+// Load は spec のマスターファイル path（空なら spec.Path）を読み込みます。
+// 前回と同じ内容のファイルは force が true のときだけ読み直します。
+// 既存の行と比べて追加・変更のあった行だけを書き込み、差分を記録します。
+func Load(spec Spec, path string, force bool) (LoadResult, error) {
+	if path == "" {
+		path = spec.Path
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return LoadResult{Master: spec.Name}, err
+	}
+	return LoadData(spec, filepath.Base(path), data, force)
+}
+
+// LoadData は読込済みのファイル内容 data を取り込みます（Load を参照）。
+// 列数を確かめてから書き込み、書き込みは chunkRows 行ごとに差分の記録と一緒にコミットします。
+// 途中で失敗した読込は master_updates に loading のまま残るため、書き込み済みの行の差分も失われません。
+// 次回同じファイルを読み込むと、同じ読込の続きとして残りの行を書き込み・記録します。
+func LoadData(spec Spec, fileName string, data []byte, force bool) (LoadResult, error) {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+
+	res := LoadResult{
+		Master:   spec.Name,
+		FileName: fileName,
+		SHA256:   importer.FileHash(data),
+		LoadedAt: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if !force && lastHash(spec.Name) == res.SHA256 {
+		res.Skipped = true
+		res.Version = LoadedVersion(spec.Name)
+		return res, nil
+	}
+
+	cols, err := importer.TableColumns(DB, spec.Table)
+	if err != nil {
+		return res, err
+	}
+	if len(cols) <= spec.KeyCol {
+		return res, fmt.Errorf("%s: テーブルがありません", spec.Table)
+	}
+	old, err := readTable(spec, len(cols))
+	if err != nil {
+		return res, err
+	}
+	res.Initial = len(old) == 0
+	if id, initial, ok := interrupted(spec.Name, res.SHA256); ok {
+		// 書き込み済みの行は差分が無くなるため、残りの行だけが書き込まれる
+		res.UpdateID, res.Initial, res.Resumed = id, initial, true
+	}
+	removed, err := removedKeys(spec.Name)
+	if err != nil {
+		return res, err
+	}
+
+	rd := csv.NewReader(transform.NewReader(bytes.NewReader(data), japanese.ShiftJIS.NewDecoder()))
+	rd.LazyQuotes = true
+	rd.FieldsPerRecord = -1
+	var header []string
+	if spec.SkipHeader {
+		if header, err = rd.Read(); err != nil {
+			return res, err
+		}
+	}
+	var maxVersion string
+
+	// 書き込む前に全行の列数を確かめる
+	var rows [][]string
+	for {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		if blank(rec) {
+			continue
+		}
+		line, _ := rd.FieldPos(0)
+		row, mapped, err := spec.mapRow(rec, len(cols))
+		if err != nil {
+			return res, fmt.Errorf("%s %d 行目: %w", fileName, line, err)
+		}
+		res.FileCols = max(res.FileCols, len(rec))
+		if mapped {
+			res.Mapped++
+		}
+		if spec.VersionCol >= 0 && spec.VersionCol < len(row) {
+			maxVersion = max(maxVersion, strings.TrimSpace(row[spec.VersionCol]))
+		}
+		rows = append(rows, row)
+	}
+
+	var writes []write
+	var gone []Change
+	seen := make(map[string]bool, len(old))
+	for _, row := range rows {
+		key := row[spec.KeyCol]
+		if key == "" {
+			continue
+		}
+		res.Rows++
+		seen[key] = true
+
+		w := write{row: row}
+		prev, ok := old[key]
+		if ok && removed[key] {
+			// 削除済みの行が再びファイルに載ったときは追加とする
+			removed[key] = false
+			w.added, w.relisted = true, true
+			w.changes = []Change{{JanCode: key, ChangeType: ChangeAdded, ProductName: nameOf(spec, row)}}
+		} else if ok {
+			diff := diffRow(spec, cols, prev, row)
+			if len(diff) == 0 && slices.Equal(prev, row) {
+				continue
+			}
+			// 比較しない列（更新日など）だけの変更は書き込むが記録しない
+			w.changed = len(diff) > 0
+			w.changes = diff
+		} else {
+			w.added = true
+			if !res.Initial {
+				w.changes = []Change{{JanCode: key, ChangeType: ChangeAdded, ProductName: nameOf(spec, row)}}
+			}
+		}
+		// 同じキーが後に出てきた場合に比較元を揃える
+		old[key] = row
+		writes = append(writes, w)
+	}
+	for key, row := range old {
+		// 前回までに消えた行は記録済み
+		if !seen[key] && !removed[key] {
+			gone = append(gone, Change{JanCode: key, ChangeType: ChangeRemoved, ProductName: nameOf(spec, row)})
+		}
+	}
+
+	res.Version = detectVersion(maxVersion, header, res.SHA256)
+	if res.Mapped > 0 {
+		log.Printf("[MASTER] %s: file has %d columns, table has %d (%d rows mapped by edition)",
+			spec.Name, res.FileCols, len(cols), res.Mapped)
+	}
+	if err := beginUpdate(&res, gone); err != nil {
+		return res, err
+	}
+	// 途中のチャンクで失敗しても、書き込んだ分を次の検索に反映する
+	defer search.Invalidate()
+	for start := 0; start < len(writes); start += chunkRows {
+		if err := writeChunk(spec, res.UpdateID, writes[start:min(start+chunkRows, len(writes))]); err != nil {
+			return res, fmt.Errorf("%s: %d 行目以降の書き込みエラー: %w", spec.Table, start+1, err)
+		}
+	}
+	if err := finishUpdate(&res); err != nil {
+		return res, err
+	}
+	log.Printf("[MASTER] %s %s (version %s): rows=%d added=%d removed=%d changed=%d initial=%v",
+		spec.Name, fileName, res.Version, res.Rows, res.Added, res.Removed, res.Changed, res.Initial)
+	if spec.Name == JCSHMS.Name {
+		// 薬価の履歴は読込の成否に影響させない
+		if n, err := yakka.Record(res.UpdateID, time.Now().Format("20060102")); err != nil {
+			log.Printf("[MASTER] yakka history error: %v", err)
+		} else if n > 0 {
+			log.Printf("[MASTER] yakka history: %d prices recorded", n)
+		}
+	}
+	return res, nil
+}
+
+// writeChunk は ws の行と差分を１トランザクションで書き込み、読込の件数に加えます。
+func writeChunk(spec Spec, updateID int64, ws []write) error {
+	if len(ws) == 0 {
+		return nil
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ph := strings.TrimSuffix(strings.Repeat("?,", len(ws[0].row)), ",")
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO " + spec.Table + " VALUES(" + ph + ")")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	changes, err := prepareChanges(tx)
+	if err != nil {
+		return err
+	}
+	defer changes.Close()
+	var added, changed int
+	args := make([]interface{}, len(ws[0].row))
+	for _, w := range ws {
+		for i, v := range w.row {
+			args[i] = v
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return err
+		}
+		if err := insertChanges(changes, updateID, spec.Name, w.changes); err != nil {
+			return err
+		}
+		if w.relisted {
+			if _, err := tx.Exec(`DELETE FROM master_removed WHERE masterName = ? AND janCode = ?`, spec.Name, w.row[spec.KeyCol]); err != nil {
+				return err
+			}
+		}
+		if w.added {
+			added++
+		}
+		if w.changed {
+			changed++
+		}
+	}
+	if _, err := tx.Exec(`UPDATE master_updates SET added = added + ?, changed = changed + ? WHERE updateId = ?`,
+		added, changed, updateID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// datePattern は見出し行の版表記（2025.05.27・2025/5/27・20250527 など）です。
+var datePattern = regexp.MustCompile(`(20\d\d)[./-]?(\d{1,2})[./-]?(\d{1,2})`)
+
+// detectVersion は版を決めます。版の列の最大値、見出し行の日付、ファイルのハッシュ先頭の順です。
+func detectVersion(maxVersion string, header []string, sha string) string {
+	if maxVersion != "" {
+		return maxVersion
+	}
+	if m := datePattern.FindStringSubmatch(strings.Join(header, " ")); m != nil {
+		mo, _ := strconv.Atoi(m[2])
+		d, _ := strconv.Atoi(m[3])
+		return fmt.Sprintf("%s%02d%02d", m[1], mo, d)
+	}
+	return "sha:" + sha[:12]
+}
+
+// LoadedVersion は読込済みの版を返します（未読込は空）。
+func LoadedVersion(name string) string {
+	var v string
+	if err := DB.QueryRow(`SELECT version FROM master_versions WHERE masterName = ?`, name).Scan(&v); err != nil && err != sql.ErrNoRows {
+		log.Printf("[MASTER] version lookup error %s: %v", name, err)
+	}
+	return v
+}
+
+// nameOf は行の商品名を返します。
+func nameOf(spec Spec, row []string) string {
+	if spec.NameCol < 0 || spec.NameCol >= len(row) {
+		return ""
+	}
+	return row[spec.NameCol]
+}
+
+// diffRow は比較対象の列のうち値が変わったものを返します。
+func diffRow(spec Spec, cols []string, prev, row []string) []Change {
+	var out []Change
+	for i, col := range cols {
+		if ignored[col] || prev[i] == row[i] {
+			continue
+		}
+		c := Change{
+			JanCode:     row[spec.KeyCol],
+			ProductName: nameOf(spec, row),
+			ChangeType:  ChangeChanged,
+			Category:    CategoryOf(col),
+			Field:       col,
+			OldValue:    prev[i],
+			NewValue:    row[i],
+		}
+		if discontinuedCols[col] && strings.TrimSpace(prev[i]) == "" {
+			c.ChangeType = ChangeDiscontinued
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// beginUpdate は読込を loading として記録し（中断した読込の続きなら既存の記録を使う）、
+// ファイルから消えた行 gone の差分と印を書き込みます。
+func beginUpdate(res *LoadResult, gone []Change) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if !res.Resumed {
+		r, err := tx.Exec(`
+INSERT INTO master_updates (masterName, fileName, sha256, version, loadedAt, initial, status)
+VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			res.Master, res.FileName, res.SHA256, res.Version, res.LoadedAt, res.Initial, StatusLoading,
+		)
+		if err != nil {
+			return err
+		}
+		res.UpdateID, _ = r.LastInsertId()
+	}
+	stmt, err := prepareChanges(tx)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if err := insertChanges(stmt, res.UpdateID, res.Master, gone); err != nil {
+		return err
+	}
+	for _, c := range gone {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO master_removed (masterName, janCode, updateId) VALUES (?, ?, ?)`,
+			res.Master, c.JanCode, res.UpdateID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE master_updates SET removed = removed + ? WHERE updateId = ?`, len(gone), res.UpdateID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// finishUpdate は読込を done にして版を記録し、件数（中断前の分を含む）を res に読み直します。
+func finishUpdate(res *LoadResult) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE master_updates SET rowCount = ?, version = ?, status = ? WHERE updateId = ?`,
+		res.Rows, res.Version, StatusDone, res.UpdateID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT OR REPLACE INTO master_versions (masterName, version, loadedAt, rowCount) VALUES (?, ?, ?, ?)`,
+		res.Master, res.Version, res.LoadedAt, res.Rows,
+	); err != nil {
+		return err
+	}
+	if err := tx.QueryRow(`SELECT added, removed, changed FROM master_updates WHERE updateId = ?`, res.UpdateID).
+		Scan(&res.Added, &res.Removed, &res.Changed); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func prepareChanges(tx *sql.Tx) (*sql.Stmt, error) {
+	return tx.Prepare(`
+INSERT INTO master_changes (updateId, masterName, janCode, productName, changeType, category, field, oldValue, newValue)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+}
+
+func insertChanges(stmt *sql.Stmt, updateID int64, master string, changes []Change) error {
+	for _, c := range changes {
+		if _, err := stmt.Exec(updateID, master, c.JanCode, c.ProductName,
+			c.ChangeType, c.Category, c.Field, c.OldValue, c.NewValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
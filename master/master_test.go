@@ -0,0 +1,298 @@
+package master
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestDiffRow(t *testing.T) {
+	spec := Spec{Name: "TEST", KeyCol: 0, NameCol: 1}
+	cols := []string{
+		"JC000JanCode", "JC018ShouhinMei", "JC050YakkaKijunSaishouTaniYakka",
+		"JC044HousouSouryouSuuchi", "JC059HatsubaiChuushiNengappi", "JC120KoushinNengappi",
+	}
+	prev := []string{"4987123456784", "テスト錠", "10.1", "100", "", "20250401"}
+	with := func(i int, v string) []string {
+		row := append([]string{}, prev...)
+		row[i] = v
+		return row
+	}
+
+	tests := []struct {
+		name string
+		row  []string
+		want []Change // JanCode・ProductName 以外を比較
+	}{
+		{"変更なし", with(0, prev[0]), nil},
+		{"更新日だけの変更は記録しない", with(5, "20250501"), nil},
+		{"薬価の変更", with(2, "9.8"), []Change{
+			{ChangeType: ChangeChanged, Category: CategoryPrice, Field: cols[2], OldValue: "10.1", NewValue: "9.8"},
+		}},
+		{"包装の変更", with(3, "500"), []Change{
+			{ChangeType: ChangeChanged, Category: CategoryPackaging, Field: cols[3], OldValue: "100", NewValue: "500"},
+		}},
+		{"発売中止日が新たに入ったら discontinued", with(4, "20251001"), []Change{
+			{ChangeType: ChangeDiscontinued, Category: CategorySupply, Field: cols[4], OldValue: "", NewValue: "20251001"},
+		}},
+		{"商品名の変更は other", with(1, "テスト錠10mg"), []Change{
+			{ChangeType: ChangeChanged, Category: CategoryOther, Field: cols[1], OldValue: "テスト錠", NewValue: "テスト錠10mg"},
+		}},
+		{"複数列の変更は列順", func() []string { r := with(2, "9.8"); r[3] = "500"; return r }(), []Change{
+			{ChangeType: ChangeChanged, Category: CategoryPrice, Field: cols[2], OldValue: "10.1", NewValue: "9.8"},
+			{ChangeType: ChangeChanged, Category: CategoryPackaging, Field: cols[3], OldValue: "100", NewValue: "500"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffRow(spec, cols, prev, tt.row)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d changes %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i, w := range tt.want {
+				w.JanCode, w.ProductName = tt.row[0], tt.row[1]
+				if got[i] != w {
+					t.Errorf("change %d = %+v, want %+v", i, got[i], w)
+				}
+			}
+		})
+	}
+
+	// 発売中止日が別の日付に変わったのは通常の変更
+	prev[4] = "20251001"
+	if got := diffRow(spec, cols, prev, with(4, "20251101")); len(got) != 1 || got[0].ChangeType != ChangeChanged {
+		t.Errorf("changed discontinuation date: %+v", got)
+	}
+}
+
+func TestCategoryOf(t *testing.T) {
+	tests := map[string]string{
+		"JC050YakkaKijunSaishouTaniYakka": CategoryPrice,
+		"JC124Yakka":                      CategoryPrice,
+		"JC037HousouKeitai":               CategoryPackaging,
+		"JA006HousouSuuryouSuuchi":        CategoryPackaging,
+		"JC061Doku":                       CategoryRegulatory,
+		"JC080HanbaiKubun":                CategorySupply,
+		"JC018ShouhinMei":                 CategoryOther,
+		"JA001JanCode":                    CategoryOther,
+		"XX":                              CategoryOther,
+		"JCabcName":                       CategoryOther,
+	}
+	for col, want := range tests {
+		if got := CategoryOf(col); got != want {
+			t.Errorf("CategoryOf(%s) = %s, want %s", col, got, want)
+		}
+	}
+}
+
+// openTestDB は schema.sql と３列のテスト用マスター tmaster を持つ DB を DB に設定し、
+// ２行ごとにコミットするようにします。
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE tmaster (JA000JanCode TEXT PRIMARY KEY, JA001Name TEXT, JA002Price TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	DB = db
+	saved := chunkRows
+	chunkRows = 2
+	t.Cleanup(func() { chunkRows = saved })
+	return db
+}
+
+func TestLoadData(t *testing.T) {
+	db := openTestDB(t)
+	spec := Spec{
+		Name: "TEST", Table: "tmaster", Cols: 3, KeyCol: 0, NameCol: 1, VersionCol: -1,
+		// 名称の後に列が挿入された４列の版
+		Editions: map[int][]int{4: {0, 1, 3}},
+	}
+	table := func() string {
+		rows, err := db.Query(`SELECT JA000JanCode || ':' || JA001Name || ':' || JA002Price FROM tmaster ORDER BY 1`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var out []string
+		for rows.Next() {
+			var s string
+			rows.Scan(&s)
+			out = append(out, s)
+		}
+		return strings.Join(out, " ")
+	}
+
+	// 複数のトランザクションに分けて書き込む
+	res, err := LoadData(spec, "v1.csv", []byte("A,a,10\nB,b,20\nC,c,30\n\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rows != 3 || !res.Initial || table() != "A:a:10 B:b:20 C:c:30" {
+		t.Fatalf("v1: rows=%d initial=%v table=%q", res.Rows, res.Initial, table())
+	}
+
+	// 列数が違い対応の無い版は、列をずらして取り込まずに拒否する
+	_, err = LoadData(spec, "v2.csv", []byte("A,a,10\nB,b,x,20,extra\n"), false)
+	if err == nil || !strings.Contains(err.Error(), "2 行目") {
+		t.Fatalf("v2: err = %v, want column count error at line 2", err)
+	}
+	if table() != "A:a:10 B:b:20 C:c:30" {
+		t.Errorf("v2 changed the table: %q", table())
+	}
+
+	// 列対応のある版は挿入された列を飛ばして読む
+	res, err = LoadData(spec, "v3.csv", []byte("A,a,new,10\nB,b,new,25\nC,c,new,30\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Mapped != 3 || res.Changed != 1 || table() != "A:a:10 B:b:25 C:c:30" {
+		t.Errorf("v3: mapped=%d changed=%d table=%q", res.Mapped, res.Changed, table())
+	}
+
+	// ファイルから消えた行は一度だけ削除として記録し、テーブルには残す
+	changes := func(key, changeType string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM master_changes WHERE masterName = 'TEST' AND janCode = ? AND changeType = ?`,
+			key, changeType).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	steps := []struct {
+		file                    string
+		data                    string
+		added, removed, changed int
+	}{
+		{"v4.csv", "A,a,10\nB,b,25\n", 0, 1, 0},
+		{"v5.csv", "A,a,10\nB,b,26\n", 0, 0, 1},
+		{"v6.csv", "A,a,10\nB,b,26\nC,c,30\n", 1, 0, 0}, // 再び載った行は追加
+		{"v7.csv", "A,a,10\nB,b,26\n", 0, 1, 0},
+	}
+	for _, s := range steps {
+		res, err := LoadData(spec, s.file, []byte(s.data), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Added != s.added || res.Removed != s.removed || res.Changed != s.changed {
+			t.Errorf("%s: added=%d removed=%d changed=%d, want %d %d %d",
+				s.file, res.Added, res.Removed, res.Changed, s.added, s.removed, s.changed)
+		}
+	}
+	if n := changes("C", ChangeRemoved); n != 2 {
+		t.Errorf("C removed recorded %d times, want 2", n)
+	}
+	if n := changes("C", ChangeAdded); n != 1 {
+		t.Errorf("C added recorded %d times, want 1", n)
+	}
+	if table() != "A:a:10 B:b:26 C:c:30" {
+		t.Errorf("removed row was deleted: %q", table())
+	}
+}
+
+func TestLoadDataResumesAfterFailure(t *testing.T) {
+	db := openTestDB(t)
+	spec := Spec{Name: "TEST", Table: "tmaster", Cols: 3, KeyCol: 0, NameCol: 1, VersionCol: -1}
+	exec := func(query string) {
+		t.Helper()
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type update struct {
+		id                      int64
+		added, removed, changed int
+		status                  string
+	}
+	updates := func() []update {
+		t.Helper()
+		rows, err := db.Query(`SELECT updateId, added, removed, changed, status FROM master_updates ORDER BY updateId`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var out []update
+		for rows.Next() {
+			var u update
+			if err := rows.Scan(&u.id, &u.added, &u.removed, &u.changed, &u.status); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, u)
+		}
+		return out
+	}
+	changes := func(updateID int64) string {
+		t.Helper()
+		rows, err := db.Query(`SELECT janCode || ':' || changeType FROM master_changes WHERE updateId = ? ORDER BY 1`, updateID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var out []string
+		for rows.Next() {
+			var s string
+			rows.Scan(&s)
+			out = append(out, s)
+		}
+		return strings.Join(out, " ")
+	}
+
+	if _, err := LoadData(spec, "v1.csv", []byte("A,a,10\nB,b,20\nC,c,30\nX,x,1\n"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// ２つ目のまとまり（D・E）の書き込みで失敗させる
+	exec(`CREATE TRIGGER fail_d BEFORE INSERT ON tmaster WHEN NEW.JA000JanCode = 'D' BEGIN SELECT RAISE(ABORT, 'fail'); END`)
+	v2 := []byte("A,a,11\nB,b,21\nC,c,30\nD,d,40\nE,e,50\n")
+	if _, err := LoadData(spec, "v2.csv", v2, false); err == nil {
+		t.Fatal("v2: want write error")
+	}
+	u := updates()
+	if len(u) != 2 || u[1] != (update{u[1].id, 0, 1, 2, StatusLoading}) {
+		t.Fatalf("after failure: updates = %+v", u)
+	}
+	// コミット済みの行の差分は行と一緒に残る
+	if got := changes(u[1].id); got != "A:changed B:changed X:removed" {
+		t.Errorf("after failure: changes = %q", got)
+	}
+
+	// 同じファイルの読込は読み飛ばさず、同じ読込の続きとして記録する
+	exec(`DROP TRIGGER fail_d`)
+	res, err := LoadData(spec, "v2.csv", v2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Skipped || !res.Resumed || res.UpdateID != u[1].id || res.Added != 2 || res.Removed != 1 || res.Changed != 2 {
+		t.Errorf("retry: %+v", res)
+	}
+	u = updates()
+	if len(u) != 2 || u[1] != (update{res.UpdateID, 2, 1, 2, StatusDone}) {
+		t.Errorf("after retry: updates = %+v", u)
+	}
+	if got := changes(res.UpdateID); got != "A:changed B:changed D:added E:added X:removed" {
+		t.Errorf("after retry: changes = %q", got)
+	}
+
+	// 最後まで読み込んだファイルは次回読み飛ばす
+	if res, err := LoadData(spec, "v2.csv", v2, false); err != nil || !res.Skipped {
+		t.Errorf("reload: skipped=%v err=%v", res.Skipped, err)
+	}
+}
@@ -6,19 +6,20 @@ package model
 // "Name" フィールドに読み込まれますが、Shift‑JIS から UTF‑8 への変換後は
 // この値を "DatProductName" にセットします。
 type DATRecord struct {
-	CurrentOroshiCode string `json:"DatOroshiCode"`         // 卸コード
-	DatDate           string `json:"DatDate"`               // 日付
-	DatFlag           string `json:"DatDeliveryFlag"`       // 納品／返品フラグ
-	DatRecNo          string `json:"DatReceiptNumber"`      // 伝票番号
-	DatJan            string `json:"DatJanCode"`            // JANコード
-	DatLineNo         string `json:"DatLineNumber"`         // 行番号
-	DatProductName    string `json:"DatProductName"`        // 商品名（変換後の値）
-	DatQty            string `json:"DatQuantity"`           // 数量
-	DatUnit           string `json:"DatUnitPrice"`          // 単価または単位
-	DatSub            string `json:"DatSubtotal"`           // 小計
-	DatPkg            string `json:"DatPackagingDrugPrice"` // 包装薬価
-	DatExp            string `json:"DatExpiryDate"`         // 賞味期限
-	DatLot            string `json:"DatLotNumber"`          // ロット番号
+	CurrentOroshiCode string  `json:"DatOroshiCode"`         // 卸コード
+	CurrentOroshiName string  `json:"DatOroshiName"`         // 卸名（卸マスター）
+	DatDate           string  `json:"DatDate"`               // 日付
+	DatFlag           string  `json:"DatDeliveryFlag"`       // 納品／返品フラグ
+	DatRecNo          string  `json:"DatReceiptNumber"`      // 伝票番号
+	DatJan            string  `json:"DatJanCode"`            // JANコード
+	DatLineNo         string  `json:"DatLineNumber"`         // 行番号
+	DatProductName    string  `json:"DatProductName"`        // 商品名（変換後の値）
+	DatQty            float64 `json:"DatQuantity"`           // 数量
+	DatUnit           float64 `json:"DatUnitPrice"`          // 単価
+	DatSub            float64 `json:"DatSubtotal"`           // 小計
+	DatPkg            float64 `json:"DatPackagingDrugPrice"` // 包装薬価
+	DatExp            string  `json:"DatExpiryDate"`         // 有効期限（YYYYMMDD、無しは空）
+	DatLot            string  `json:"DatLotNumber"`          // ロット番号
 }
 
 // USAGERecord は、USAGE CSV の1行分の情報を表します。
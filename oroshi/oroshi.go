@@ -0,0 +1,222 @@
+// Package oroshi は卸（取引先）マスターを扱います。
+// SOU/IOALIST.CSV（番号,名称,卸コード）から読み込み、/api/oroshi で保守します。
+package oroshi
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+var DB *sql.DB
+
+// CSVPath は卸マスターの既定ファイルです。
+const CSVPath = "SOU/IOALIST.CSV"
+
+// Record は卸マスターの１行です。卸コードの無い行は取引先（薬局など）です。
+type Record struct {
+	No         int    `json:"no"`
+	Name       string `json:"name"`
+	OroshiCode string `json:"oroshiCode"`
+}
+
+// LoadCSV は Shift-JIS の IOALIST.CSV を oroshi テーブルに読み込みます。
+// overwrite が false の場合、既存の番号は保守 API での変更を優先して上書きしません。
+func LoadCSV(path string, overwrite bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rd := csv.NewReader(transform.NewReader(f, japanese.ShiftJIS.NewDecoder()))
+	rd.LazyQuotes = true
+	rd.FieldsPerRecord = -1
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	verb := "INSERT OR IGNORE"
+	if overwrite {
+		verb = "INSERT OR REPLACE"
+	}
+	stmt, err := tx.Prepare(verb + ` INTO oroshi (oroshiNo, name, oroshiCode) VALUES (?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	n := 0
+	for {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if len(rec) < 2 {
+			continue
+		}
+		no, err := strconv.Atoi(strings.TrimSpace(rec[0]))
+		if err != nil {
+			continue // 見出し行など
+		}
+		code := ""
+		if len(rec) > 2 {
+			code = strings.TrimSpace(rec[2])
+		}
+		res, err := stmt.Exec(no, strings.TrimSpace(rec[1]), code)
+		if err != nil {
+			return n, err
+		}
+		if c, _ := res.RowsAffected(); c > 0 {
+			n++
+		}
+	}
+	return n, tx.Commit()
+}
+
+// List は卸マスターを番号順に返します。all が false の場合は卸コードのある行（卸）のみです。
+func List(all bool) ([]Record, error) {
+	query := `SELECT oroshiNo, name, oroshiCode FROM oroshi`
+	if !all {
+		query += ` WHERE oroshiCode <> ''`
+	}
+	rows, err := DB.Query(query + ` ORDER BY oroshiNo`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]Record, 0)
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.No, &r.Name, &r.OroshiCode); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Exists は卸コードが卸マスターに登録されているかを返します。
+func Exists(code string) bool {
+	var n int
+	if err := DB.QueryRow(
+		`SELECT COUNT(*) FROM oroshi WHERE oroshiCode = ? AND oroshiCode <> ''`, code,
+	).Scan(&n); err != nil {
+		log.Printf("[OROSHI] exists error code=%s: %v", code, err)
+		return false
+	}
+	return n > 0
+}
+
+// NameOf は卸コードの名称を返します（未登録は空文字）。
+func NameOf(code string) string {
+	var name string
+	err := DB.QueryRow(
+		`SELECT name FROM oroshi WHERE oroshiCode = ? AND oroshiCode <> '' ORDER BY oroshiNo LIMIT 1`, code,
+	).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[OROSHI] name lookup error code=%s: %v", code, err)
+	}
+	return name
+}
+
+// Handler は /api/oroshi を処理します。
+// GET: 一覧（all=1 で取引先も含む） / POST: 登録・更新 / DELETE: ?no=N を削除
+func Handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := List(r.URL.Query().Get("all") == "1")
+		if err != nil {
+			log.Printf("[OROSHI] list error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost:
+		var rec Record
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		rec.Name = strings.TrimSpace(rec.Name)
+		rec.OroshiCode = strings.TrimSpace(rec.OroshiCode)
+		if rec.Name == "" {
+			http.Error(w, "名称は必須です", http.StatusBadRequest)
+			return
+		}
+		if rec.OroshiCode != "" {
+			if _, err := strconv.Atoi(rec.OroshiCode); err != nil || len(rec.OroshiCode) != 9 {
+				http.Error(w, "卸コードは9桁の数字で入力してください", http.StatusBadRequest)
+				return
+			}
+		}
+		if rec.No == 0 {
+			if err := DB.QueryRow(`SELECT COALESCE(MAX(oroshiNo), 0) + 1 FROM oroshi`).Scan(&rec.No); err != nil {
+				http.Error(w, "DB Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if _, err := DB.Exec(
+			`INSERT OR REPLACE INTO oroshi (oroshiNo, name, oroshiCode) VALUES (?, ?, ?)`,
+			rec.No, rec.Name, rec.OroshiCode,
+		); err != nil {
+			log.Printf("[OROSHI] upsert error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(rec)
+
+	case http.MethodDelete:
+		no, err := strconv.Atoi(r.URL.Query().Get("no"))
+		if err != nil {
+			http.Error(w, "no が不正です", http.StatusBadRequest)
+			return
+		}
+		if _, err := DB.Exec(`DELETE FROM oroshi WHERE oroshiNo = ?`, no); err != nil {
+			log.Printf("[OROSHI] delete error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ImportHandler は /api/oroshi/import の POST で IOALIST.CSV を再読込します。
+// overwrite=1 の場合はファイルの内容で既存の番号を上書きします。
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := LoadCSV(CSVPath, r.URL.Query().Get("overwrite") == "1")
+	if err != nil {
+		log.Printf("[OROSHI] import error: %v", err)
+		http.Error(w, fmt.Sprintf("取込エラー: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]int{"count": n})
+}
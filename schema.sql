@@ -350,6 +350,7 @@ CREATE TABLE IF NOT EXISTS datrecords (
 
 
 CREATE TABLE IF NOT EXISTS usagerecords (
+    usageSource       TEXT NOT NULL DEFAULT '', -- 取込元（店舗・調剤システム）。置換はこの単位
     usageDate         TEXT,
     usageYjCode       TEXT,
     usageJanCode      TEXT,
@@ -358,7 +359,8 @@ CREATE TABLE IF NOT EXISTS usagerecords (
     usageUnit         TEXT,
     usageUnitName     TEXT,
     organizedFlag     INTEGER NOT NULL DEFAULT 0, -- 1: organized, 0: disorganized
-    PRIMARY KEY (usageDate, usageYjCode, usageJanCode)
+    usageLineNo       INTEGER NOT NULL DEFAULT 1, -- 同じ日・同じ品目の何行目か（1 始まり）
+    PRIMARY KEY (usageSource, usageDate, usageYjCode, usageJanCode, usageLineNo)
 );
 
 CREATE TABLE IF NOT EXISTS inventory (
@@ -367,7 +369,9 @@ CREATE TABLE IF NOT EXISTS inventory (
   invJanCode                  TEXT    NOT NULL,  -- JANコード
   invProductName              TEXT    NOT NULL,  -- 商品名
   invJanHousouSuuryouNumber   REAL    NOT NULL,  -- JAN包装数量（数字）
-  qty                         REAL    NOT NULL,  -- 在庫数（包装単位）
+  qty                         REAL    NOT NULL,  -- 在庫数（包装単位）= packCount × JAN包装数量 + looseQty
+  packCount                   REAL    NOT NULL DEFAULT 0, -- 未開封の在庫数（JAN包装単位）
+  looseQty                    REAL    NOT NULL DEFAULT 0, -- 開封済みのバラ数（包装単位）
   HousouTaniUnit              TEXT    NOT NULL,  -- 包装単位（単位）
   InvHousouTaniUnit           TEXT    NOT NULL,  -- 包装単位（単位）逆マッピング
   janqty                      REAL    NOT NULL,  -- 在庫数（JAN包装単位）
@@ -439,5 +443,188 @@ CREATE TABLE IF NOT EXISTS iod (
   PRIMARY KEY(iodReceiptNumber, iodLineNumber)
 );
 
+-- 卸（取引先）マスター（SOU/IOALIST.CSV）
+CREATE TABLE IF NOT EXISTS oroshi (
+  oroshiNo    INTEGER PRIMARY KEY,       -- IOALIST の番号
+  name        TEXT    NOT NULL,
+  oroshiCode  TEXT    NOT NULL DEFAULT '' -- 卸コード（9桁、取引先のみの行は空）
+);
+CREATE INDEX IF NOT EXISTS idx_oroshi_code ON oroshi(oroshiCode);
 
+-- メーカーマスター（SOU/MAKER.CSV の MK レコード）
+CREATE TABLE IF NOT EXISTS maker (
+  makerCode  TEXT PRIMARY KEY,  -- JC029 販売元コード／JC033 製造元・輸入元コードと対応
+  name       TEXT NOT NULL,
+  kanaShort  TEXT,              -- 半角カナ略称
+  fullName   TEXT,
+  kana       TEXT
+);
 
+-- マスターファイルの版（ヘッダ行などに記載されたもの）
+CREATE TABLE IF NOT EXISTS master_versions (
+  masterName  TEXT PRIMARY KEY,   -- 'MAKER'・'JCSHMS'・'JANCODE'
+  version     TEXT NOT NULL,      -- 版を検出できないファイルは 'sha:' とハッシュ先頭
+  loadedAt    TEXT NOT NULL,
+  rowCount    INTEGER NOT NULL DEFAULT 0
+);
+
+-- 医薬品マスター（JCSHMS・JANCODE）の読込履歴と差分
+CREATE TABLE IF NOT EXISTS master_updates (
+  updateId    INTEGER PRIMARY KEY AUTOINCREMENT,
+  masterName  TEXT    NOT NULL,               -- 'JCSHMS' / 'JANCODE'
+  fileName    TEXT    NOT NULL,
+  sha256      TEXT    NOT NULL,
+  version     TEXT    NOT NULL DEFAULT '',    -- 検出した版
+  loadedAt    TEXT    NOT NULL,
+  rowCount    INTEGER NOT NULL DEFAULT 0,
+  added       INTEGER NOT NULL DEFAULT 0,
+  removed     INTEGER NOT NULL DEFAULT 0,
+  changed     INTEGER NOT NULL DEFAULT 0,
+  initial     INTEGER NOT NULL DEFAULT 0,     -- 空のテーブルへの初回読込（行ごとの差分なし）
+  status      TEXT    NOT NULL DEFAULT 'done' -- 'loading'（書き込み中・中断）/ 'done'
+);
+
+CREATE TABLE IF NOT EXISTS master_changes (
+  updateId     INTEGER NOT NULL,
+  masterName   TEXT    NOT NULL,
+  janCode      TEXT    NOT NULL,
+  productName  TEXT    NOT NULL DEFAULT '',
+  changeType   TEXT    NOT NULL,               -- 'added' / 'removed' / 'changed' / 'discontinued'
+  category     TEXT    NOT NULL DEFAULT '',    -- 'price' / 'packaging' / 'regulatory' / 'supply' / 'other'
+  field        TEXT    NOT NULL DEFAULT '',
+  oldValue     TEXT    NOT NULL DEFAULT '',
+  newValue     TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_master_changes_update ON master_changes(updateId);
+CREATE INDEX IF NOT EXISTS idx_master_changes_jan ON master_changes(janCode);
+
+-- マスターファイルから消えた行（テーブルの行は残すため、次回以降の読込で削除を繰り返し記録しない）
+CREATE TABLE IF NOT EXISTS master_removed (
+  masterName  TEXT    NOT NULL,
+  janCode     TEXT    NOT NULL,
+  updateId    INTEGER NOT NULL,               -- 削除を記録した master_updates.updateId
+  PRIMARY KEY(masterName, janCode)
+);
+
+-- 薬価の履歴（JCSHMS の読込ごとに現薬価の変化を適用開始日つきで記録）
+CREATE TABLE IF NOT EXISTS yakka_history (
+  janCode        TEXT    NOT NULL,
+  yjCode         TEXT    NOT NULL DEFAULT '',
+  effectiveFrom  TEXT    NOT NULL,               -- 適用開始日 YYYYMMDD（'00000000' は最初の読込以前から）
+  taniYakka      REAL    NOT NULL DEFAULT 0,     -- 単位薬価 (JC049、旧薬価は JC051)
+  housouYakka    REAL    NOT NULL DEFAULT 0,     -- 包装薬価 (JC050、旧薬価は JC052)
+  source         TEXT    NOT NULL,               -- 'current' / 'previous'
+  updateId       INTEGER NOT NULL DEFAULT 0,     -- master_updates.updateId（初期移行は 0）
+  PRIMARY KEY(janCode, effectiveFrom)
+);
+CREATE INDEX IF NOT EXISTS idx_yakka_history_yj ON yakka_history(yjCode, effectiveFrom);
+
+-- MA0 の上書き指定（マスターとの再同期で変更しないフィールド）
+CREATE TABLE IF NOT EXISTS ma0_overrides (
+  janCode    TEXT NOT NULL,
+  field      TEXT NOT NULL,   -- MA0 の列名（例: MA018JC018ShouhinMei）
+  value      TEXT NOT NULL,
+  updatedAt  TEXT NOT NULL,
+  PRIMARY KEY(janCode, field)
+);
+
+-- MA0 とマスターの再同期の履歴と変更
+CREATE TABLE IF NOT EXISTS ma0_syncs (
+  syncId       INTEGER PRIMARY KEY AUTOINCREMENT,
+  syncedAt     TEXT    NOT NULL,
+  trigger      TEXT    NOT NULL,               -- 'master' / 'manual'
+  checked      INTEGER NOT NULL DEFAULT 0,
+  updated      INTEGER NOT NULL DEFAULT 0,     -- 更新した MA0 行数
+  fields       INTEGER NOT NULL DEFAULT 0,
+  overridden   INTEGER NOT NULL DEFAULT 0,     -- 上書き指定のため残したフィールド数
+  notInMaster  INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS ma0_sync_changes (
+  syncId       INTEGER NOT NULL,
+  janCode      TEXT    NOT NULL,
+  productName  TEXT    NOT NULL DEFAULT '',
+  field        TEXT    NOT NULL,
+  oldValue     TEXT    NOT NULL DEFAULT '',
+  newValue     TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_ma0_sync_changes_sync ON ma0_sync_changes(syncId);
+
+-- 棚卸セッション（ハンディスキャナーでの読取を棚卸日ごとにまとめる）
+CREATE TABLE IF NOT EXISTS stocktake_sessions (
+  sessionId  INTEGER PRIMARY KEY AUTOINCREMENT,
+  invDate    TEXT    NOT NULL,               -- YYYYMMDD
+  note       TEXT    NOT NULL DEFAULT '',
+  status     TEXT    NOT NULL DEFAULT 'open', -- 'open' / 'closed'
+  openedAt   TEXT    NOT NULL,
+  closedAt   TEXT,
+  batchId    INTEGER                          -- 締めたときの取込バッチ
+);
+
+CREATE TABLE IF NOT EXISTS stocktake_scans (
+  scanId     INTEGER PRIMARY KEY AUTOINCREMENT,
+  sessionId  INTEGER NOT NULL,
+  counter    TEXT    NOT NULL DEFAULT '',    -- 担当者・端末名
+  barcode    TEXT    NOT NULL,               -- 読み取ったままの値
+  janCode    TEXT    NOT NULL,
+  packCount  REAL    NOT NULL DEFAULT 0,     -- 未開封の包装数
+  looseQty   REAL    NOT NULL DEFAULT 0,     -- バラ数（包装単位）
+  scannedAt  TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_stocktake_scans_session ON stocktake_scans(sessionId);
+
+-- マスターに無い JAN の MA2 登録待ち
+CREATE TABLE IF NOT EXISTS ma2_queue (
+  janCode      TEXT PRIMARY KEY,
+  barcode      TEXT    NOT NULL,
+  sessionId    INTEGER NOT NULL,
+  counter      TEXT    NOT NULL DEFAULT '',
+  firstSeenAt  TEXT    NOT NULL,
+  status       TEXT    NOT NULL DEFAULT 'pending' -- 'pending' / 'registered'
+);
+
+-- ======================================================
+-- ④ 取込バッチ（アップロード履歴・ロールバック用）
+-- ======================================================
+CREATE TABLE IF NOT EXISTS import_batches (
+  batchId        INTEGER PRIMARY KEY AUTOINCREMENT,
+  importType     TEXT    NOT NULL,              -- 'dat' / 'usage' / 'inventory'
+  fileName       TEXT    NOT NULL,              -- 取込ファイル名（複数はカンマ区切り）
+  sha256         TEXT    NOT NULL DEFAULT '',   -- 単一ファイル時の SHA-256
+  importedAt     TEXT    NOT NULL,
+  rowCount       INTEGER NOT NULL DEFAULT 0,    -- 読み込んだ行数
+  insertedCount  INTEGER NOT NULL DEFAULT 0,
+  replacedCount  INTEGER NOT NULL DEFAULT 0,
+  deletedCount   INTEGER NOT NULL DEFAULT 0,
+  masterCount    INTEGER NOT NULL DEFAULT 0,    -- 自動作成・更新された MA0/MA2 行数
+  status         TEXT    NOT NULL DEFAULT 'imported', -- 'imported' / 'failed' / 'rolledback'
+  rolledBackAt   TEXT
+);
+
+CREATE TABLE IF NOT EXISTS import_batch_files (
+  batchId   INTEGER NOT NULL,
+  fileName  TEXT    NOT NULL,
+  sha256    TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_import_batch_files_sha ON import_batch_files(sha256);
+
+CREATE TABLE IF NOT EXISTS import_batch_rows (
+  batchId    INTEGER NOT NULL,
+  seq        INTEGER NOT NULL,
+  tableName  TEXT    NOT NULL,
+  action     TEXT    NOT NULL,  -- 'insert' / 'replace' / 'delete'
+  keyJson    TEXT    NOT NULL,  -- 主キー列と値
+  oldJson    TEXT,              -- replace/delete 前の行
+  PRIMARY KEY(batchId, seq)
+);
+CREATE INDEX IF NOT EXISTS idx_import_batch_rows_key ON import_batch_rows(tableName, keyJson);
+
+CREATE TABLE IF NOT EXISTS import_errors (
+  batchId   INTEGER NOT NULL,
+  fileName  TEXT    NOT NULL,
+  lineNo    INTEGER NOT NULL,  -- ファイル内の行番号（1 始まり）
+  field     TEXT    NOT NULL,
+  value     TEXT    NOT NULL,
+  reason    TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_import_errors_batch ON import_errors(batchId);
@@ -0,0 +1,366 @@
+// Package search は JCSHMS・MA0・MA2 を横断する商品検索です。
+// 商品名・カナ（JC022）・一般名（JC024・JC123）・規格を NFKC 正規化し、
+// カタカナをひらがなに揃えてから照合するため、全角／半角やひらがな／カタカナの違いを問いません。
+// JAN・YJ コードは完全一致と前方一致で照合します。
+package search
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"YAMATO/usage"
+)
+
+// DB は検索対象のマスターを読むデータベース接続です。
+var DB *sql.DB
+
+// 検索結果の出所
+const (
+	SourceJCSHMS = "jcshms"
+	SourceMA0    = "ma0"
+	SourceMA2    = "ma2"
+)
+
+// 既定・最大の１ページの件数
+const (
+	DefaultSize = 50
+	MaxSize     = 200
+)
+
+// Product は検索結果の１商品（JAN）です。
+type Product struct {
+	JanCode   string   `json:"janCode"`
+	YjCode    string   `json:"yjCode"`
+	Name      string   `json:"name"`
+	Kana      string   `json:"kana"`
+	Generic   string   `json:"generic"` // 一般名 (JC024)
+	Spec      string   `json:"spec"`    // 規格容量 (JC020)
+	MakerName string   `json:"makerName"`
+	PackUnit  string   `json:"packUnit"` // 包装単位（名称）
+	Sources   []string `json:"sources"`  // jcshms・ma0・ma2
+	Stocked   bool     `json:"stocked"`  // MA0 に登録済み（取扱品）
+	Score     int      `json:"score"`
+}
+
+// Query は検索条件です。Text は空白区切りの各語をすべて含むものを返します。
+type Query struct {
+	Text    string
+	Spec    string // 規格の部分一致
+	Stocked bool   // MA0 登録済みのみ
+	Page    int    // 1 始まり
+	Size    int
+}
+
+// Result は１ページ分の検索結果です。
+type Result struct {
+	Total int       `json:"total"`
+	Page  int       `json:"page"`
+	Size  int       `json:"size"`
+	Items []Product `json:"items"`
+}
+
+// entry は索引の１件です。照合用の項目は Normalize 済みです。
+type entry struct {
+	Product
+	names   []string // 商品名（MA0 と JCSHMS で異なれば両方）
+	kana    string
+	generic []string
+	spec    string
+}
+
+// index は作成済みの索引です。nil なら次の検索で作り直します。
+var (
+	mu    sync.Mutex
+	index []*entry
+)
+
+// Normalize は照合用に文字列を揃えます（NFKC、英字は小文字、カタカナはひらがな、空白は除去）。
+func Normalize(s string) string {
+	s = norm.NFKC.String(s)
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			continue
+		case r >= 'ァ' && r <= 'ヶ':
+			r -= 'ァ' - 'ぁ'
+		default:
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Invalidate は次の検索で索引を作り直させます。
+// マスターの読込、MA0 の同期・上書き指定、MA0・MA2 の行の追加の後に呼び出します。
+func Invalidate() {
+	mu.Lock()
+	index = nil
+	mu.Unlock()
+}
+
+// entries は索引を返します。破棄されていれば作り直します。
+func entries() ([]*entry, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if index != nil {
+		return index, nil
+	}
+	list, err := build()
+	if err != nil {
+		return nil, err
+	}
+	index = list
+	log.Printf("[SEARCH] index rebuilt: %d products", len(list))
+	return index, nil
+}
+
+// build は JCSHMS・MA0・MA2 から索引を作ります。
+func build() ([]*entry, error) {
+	byJan := make(map[string]*entry)
+	var order []string
+	get := func(jan string) *entry {
+		e, ok := byJan[jan]
+		if !ok {
+			e = &entry{Product: Product{JanCode: jan}}
+			byJan[jan] = e
+			order = append(order, jan)
+		}
+		return e
+	}
+	merge := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+
+	// JCSHMS
+	rows, err := DB.Query(`
+SELECT JC000JanCode, COALESCE(JC009YJCode, ''), COALESCE(JC018ShouhinMei, ''), COALESCE(JC022ShouhinMeiKanaSortYou, ''),
+       COALESCE(JC024IppanMeishou, ''), COALESCE(JC123IppanMeiKana, ''), COALESCE(JC020KikakuYouryou, ''),
+       COALESCE(JC030HanbaiMotoMei, ''), COALESCE(JC039HousouTaniTani, '')
+  FROM jcshms`)
+	if err != nil {
+		return nil, fmt.Errorf("jcshms: %w", err)
+	}
+	for rows.Next() {
+		var jan, yj, name, kana, generic, genericKana, spec, maker, unit string
+		if err := rows.Scan(&jan, &yj, &name, &kana, &generic, &genericKana, &spec, &maker, &unit); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e := get(jan)
+		e.Sources = append(e.Sources, SourceJCSHMS)
+		e.YjCode, e.Name, e.Kana, e.Generic, e.Spec, e.MakerName, e.PackUnit = yj, name, kana, generic, spec, maker, unit
+		e.generic = append(e.generic, Normalize(generic), Normalize(genericKana))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// MA0（取扱品。上書き指定の商品名を優先）
+	rows, err = DB.Query(`
+SELECT MA000JC000JanCode, COALESCE(MA009JC009YJCode, ''), COALESCE(MA018JC018ShouhinMei, ''),
+       COALESCE(MA022JC022ShouhinMeiKanaSortYou, ''), COALESCE(MA024JC024IppanMeishou, ''),
+       COALESCE(MA020JC020KikakuYouryou, ''), COALESCE(MA030JC030HanbaiMotoMei, ''), COALESCE(MA039JC039HousouTaniTani, '')
+  FROM ma0`)
+	if err != nil {
+		return nil, fmt.Errorf("ma0: %w", err)
+	}
+	for rows.Next() {
+		var jan, yj, name, kana, generic, spec, maker, unit string
+		if err := rows.Scan(&jan, &yj, &name, &kana, &generic, &spec, &maker, &unit); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e := get(jan)
+		e.Sources = append(e.Sources, SourceMA0)
+		e.Stocked = true
+		if name != "" && name != e.Name {
+			if e.Name != "" {
+				e.names = append(e.names, Normalize(e.Name))
+			}
+			e.Name = name
+		}
+		if yj != "" {
+			e.YjCode = yj
+		}
+		merge(&e.Kana, kana)
+		merge(&e.Generic, generic)
+		merge(&e.Spec, spec)
+		merge(&e.MakerName, maker)
+		merge(&e.PackUnit, unit)
+		if len(e.generic) == 0 {
+			e.generic = append(e.generic, Normalize(generic))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// MA2（JCSHMS に無い独自登録品）
+	rows, err = DB.Query(`
+SELECT MA2JanCode, COALESCE(MA2YjCode, ''), COALESCE(Shouhinmei, ''), COALESCE(HousouTaniUnit, '') FROM ma2`)
+	if err != nil {
+		return nil, fmt.Errorf("ma2: %w", err)
+	}
+	for rows.Next() {
+		var jan, yj, name, unit string
+		if err := rows.Scan(&jan, &yj, &name, &unit); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e := get(jan)
+		e.Sources = append(e.Sources, SourceMA2)
+		merge(&e.YjCode, yj)
+		merge(&e.Name, name)
+		merge(&e.PackUnit, usage.GetTaniName(unit))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*entry, 0, len(order))
+	for _, jan := range order {
+		e := byJan[jan]
+		e.names = append([]string{Normalize(e.Name)}, e.names...)
+		e.kana = Normalize(e.Kana)
+		e.spec = Normalize(e.Spec)
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// score は１語の一致度です（0 は不一致）。JAN・YJ、前方一致、部分一致の順に高くなります。
+func (e *entry) score(t string) int {
+	jan, yj := strings.ToLower(e.JanCode), strings.ToLower(e.YjCode)
+	switch {
+	case t == jan || t == yj:
+		return 100
+	case len(t) >= 4 && (strings.HasPrefix(jan, t) || strings.HasPrefix(yj, t)):
+		return 85
+	}
+	best := 0
+	try := func(s string, prefix, contains int) {
+		switch {
+		case s == "":
+		case strings.HasPrefix(s, t):
+			best = max(best, prefix)
+		case strings.Contains(s, t):
+			best = max(best, contains)
+		}
+	}
+	for _, n := range e.names {
+		try(n, 80, 50)
+	}
+	try(e.kana, 70, 40)
+	for _, g := range e.generic {
+		try(g, 60, 30)
+	}
+	try(e.spec, 20, 20)
+	return best
+}
+
+// Search は条件に合う商品を一致度の高い順に返します。
+// 同じ一致度なら取扱品（MA0 登録済み）、カナ、JAN の順です。
+func Search(q Query) (Result, error) {
+	if q.Size <= 0 {
+		q.Size = DefaultSize
+	}
+	q.Size = min(q.Size, MaxSize)
+	q.Page = max(q.Page, 1)
+	res := Result{Page: q.Page, Size: q.Size, Items: make([]Product, 0)}
+
+	list, err := entries()
+	if err != nil {
+		return res, err
+	}
+	terms := strings.Fields(norm.NFKC.String(q.Text))
+	for i := range terms {
+		terms[i] = Normalize(terms[i])
+	}
+	spec := Normalize(q.Spec)
+
+	var hits []Product
+	for _, e := range list {
+		if q.Stocked && !e.Stocked {
+			continue
+		}
+		if spec != "" && !strings.Contains(e.spec, spec) {
+			continue
+		}
+		total := 0
+		for _, t := range terms {
+			s := e.score(t)
+			if s == 0 {
+				total = 0
+				break
+			}
+			total += s
+		}
+		if len(terms) > 0 && total == 0 {
+			continue
+		}
+		p := e.Product
+		p.Score = total
+		hits = append(hits, p)
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		switch {
+		case a.Score != b.Score:
+			return a.Score > b.Score
+		case a.Stocked != b.Stocked:
+			return a.Stocked
+		case a.Kana != b.Kana:
+			return a.Kana < b.Kana
+		}
+		return a.JanCode < b.JanCode
+	})
+
+	res.Total = len(hits)
+	if from := (q.Page - 1) * q.Size; from < len(hits) {
+		res.Items = hits[from:min(from+q.Size, len(hits))]
+	}
+	return res, nil
+}
+
+// Handler は /api/products/search の GET を処理します。
+//   - q        : 商品名・カナ・一般名・JAN・YJ（空白区切りで AND）
+//   - spec     : 規格
+//   - stocked=1: 取扱品（MA0 登録済み）のみ
+//   - page, size（既定 50、最大 200）
+func Handler(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	page, _ := strconv.Atoi(v.Get("page"))
+	size, _ := strconv.Atoi(v.Get("size"))
+	res, err := Search(Query{
+		Text:    v.Get("q"),
+		Spec:    v.Get("spec"),
+		Stocked: v.Get("stocked") == "1",
+		Page:    page,
+		Size:    size,
+	})
+	if err != nil {
+		log.Printf("[SEARCH] search error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,153 @@
+package search
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"YAMATO/ma0"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"アムロジピン", "あむろじぴん"},
+		{"ｱﾑﾛｼﾞﾋﾟﾝ", "あむろじぴん"}, // 半角カナは濁点・半濁点を合成してからひらがなに
+		{"あむろじぴん", "あむろじぴん"},
+		{"ヴァイアル", "ゔぁいある"},
+		{"ＡＢＣ錠　５ｍｇ", "abc錠5mg"},
+		{" Loxo Nin ", "loxonin"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	e := &entry{
+		Product: Product{JanCode: "4987123456784", YjCode: "2171022F1011"},
+		names:   []string{Normalize("アムロジピン錠5mg「テスト」")},
+		kana:    Normalize("ｱﾑﾛｼﾞﾋﾟﾝｼﾞｮｳ"),
+		generic: []string{Normalize("アムロジピンベシル酸塩")},
+		spec:    Normalize("５ｍｇ１錠"),
+	}
+	tests := []struct {
+		term string
+		want int
+	}{
+		{"4987123456784", 100}, // JAN 完全一致
+		{"2171022f1011", 100},  // YJ 完全一致（英字は小文字で照合）
+		{"49871234", 85},       // JAN 前方一致
+		{"2171022", 85},        // YJ 前方一致
+		{"498", 0},             // ３文字以下のコードは前方一致にしない
+		{"3456784", 0},         // コードの途中は一致にしない
+		{"あむろ", 80},            // 商品名の前方一致
+		{"てすと", 50},            // 商品名の部分一致
+		{"じょう", 40},            // カナの部分一致
+		{"べしる", 30},            // 一般名の部分一致
+		{"1錠", 20},             // 規格
+		{"ろきそ", 0},
+	}
+	for _, tt := range tests {
+		if got := e.score(tt.term); got != tt.want {
+			t.Errorf("score(%q) = %d, want %d", tt.term, got, tt.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if err := ma0.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	DB = db
+	Invalidate()
+	defer Invalidate()
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const (
+		amlo   = "4987000000011"
+		amloOD = "4987000000028"
+		other  = "4987000000035"
+	)
+	exec(`
+INSERT INTO jcshms (JC000JanCode, JC009YJCode, JC018ShouhinMei, JC022ShouhinMeiKanaSortYou, JC024IppanMeishou)
+VALUES (?, '2171022F1011', 'アムロジピン錠5mg', 'ｱﾑﾛｼﾞﾋﾟﾝｼﾞｮｳ5MG', 'アムロジピンベシル酸塩'),
+       (?, '2171022F2018', 'アムロジピンOD錠5mg', 'ｱﾑﾛｼﾞﾋﾟﾝODｼﾞｮｳ5MG', 'アムロジピンベシル酸塩'),
+       (?, '1149019F1013', 'ロキソプロフェン錠', 'ﾛｷｿﾌﾟﾛﾌｪﾝｼﾞｮｳ', 'ロキソプロフェンナトリウム水和物')`,
+		amlo, amloOD, other)
+	// OD 錠だけ取扱品
+	exec(`INSERT INTO ma0 (MA000JC000JanCode, MA009JC009YJCode, MA018JC018ShouhinMei) VALUES (?, '2171022F2018', 'アムロジピンOD錠5mg')`, amloOD)
+
+	jans := func(q Query) []string {
+		t.Helper()
+		res, err := Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]string, len(res.Items))
+		for i, p := range res.Items {
+			out[i] = p.JanCode
+		}
+		return out
+	}
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"半角カナで全角の商品名を探す", Query{Text: "ｱﾑﾛｼﾞﾋﾟﾝ"}, []string{amloOD, amlo}},
+		{"ひらがなでカタカナの商品名を探す", Query{Text: "ろきそ"}, []string{other}},
+		{"JAN 完全一致", Query{Text: amlo}, []string{amlo}},
+		{"YJ 前方一致は同点なら取扱品が先", Query{Text: "2171022"}, []string{amloOD, amlo}},
+		{"一般名の部分一致", Query{Text: "ナトリウム"}, []string{other}},
+		{"取扱品のみ", Query{Text: "アムロ", Stocked: true}, []string{amloOD}},
+	}
+	for _, tt := range tests {
+		got := jans(tt.q)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+
+	// コード完全一致と前方一致が混ざる場合は完全一致が先
+	exec(`INSERT INTO ma2 (MA2JanCode, MA2YjCode, Shouhinmei) VALUES ('2171022F10', 'MA2Y0001', '院内製剤')`)
+	// 索引は Invalidate されるまで作り直さない
+	if got := jans(Query{Text: "2171022F10"}); len(got) != 1 {
+		t.Errorf("before Invalidate: %v", got)
+	}
+	Invalidate()
+	if got := jans(Query{Text: "2171022F10"}); len(got) != 2 || got[0] != "2171022F10" || got[1] != amlo {
+		t.Errorf("after Invalidate: %v", got)
+	}
+}
@@ -28,6 +28,20 @@ document.addEventListener("DOMContentLoaded", () => {
     toInput.value   = fmt(endOfMonth);
   })();
 
+  // ── メーカー選択肢 ──
+  const makerSel = formFilter.querySelector('select[name="maker"]');
+  fetch("/api/maker")
+    .then(res => res.json())
+    .then(({makers}) => {
+      (makers || []).forEach(m => {
+        const opt = document.createElement("option");
+        opt.value = m.code;
+        opt.textContent = `${m.name} (${m.code})`;
+        makerSel.appendChild(opt);
+      });
+    })
+    .catch(err => console.error("メーカー一覧取得失敗:", err));
+
   // 初期化
   thead.innerHTML = "";
   tbody.innerHTML = "";
@@ -62,6 +76,21 @@ document.addEventListener("DOMContentLoaded", () => {
     // クエリ生成
     const params = new URLSearchParams({ from, to });
     if (filter) params.append("filter", filter);
+    if (makerSel.value) params.append("maker", makerSel.value);
+
+    // メーカー別合計
+    const makerTotalsCb = formFilter.querySelector('input[name="makerTotals"]');
+    if (makerTotalsCb && makerTotalsCb.checked) {
+      indicator.textContent = `集計中… (${from} ～ ${to})`;
+      const res = await fetch(`/api/maker/totals?${params.toString()}`);
+      if (!res.ok) {
+        indicator.textContent = "集計失敗: " + await res.text();
+        return;
+      }
+      renderMakerTotals(await res.json());
+      indicator.textContent = `集計完了 (${from} ～ ${to})`;
+      return;
+    }
     ["doyaku","gekiyaku","mayaku","kakuseizai","kakuseizaiGenryou"]
       .forEach(name => {
         const cb = formFilter.querySelector(`input[name="${name}"]`);
@@ -73,6 +102,15 @@ document.addEventListener("DOMContentLoaded", () => {
     if (kousei.length) {
       params.append("kouseishinyaku", kousei.join(","));
     }
+    const ledgerCb = formFilter.querySelector('input[name="mode"]');
+    const ledger   = ledgerCb && ledgerCb.checked;
+    const groupSel = formFilter.querySelector('select[name="group"]');
+    const generic  = !ledger && groupSel && groupSel.value;
+    if (ledger) params.append("mode", "ledger");
+    if (generic) {
+      params.append("mode", "generic");
+      params.append("group", groupSel.value);
+    }
 
     indicator.textContent = `集計中… (${from} ～ ${to})`;
 
@@ -89,6 +127,20 @@ try {
 }
 
 
+    // 同一成分まとめ: 一般名／YJ先頭9桁 → 先発・AG・後発と欠品時の代替候補
+    if (generic) {
+      renderGeneric(data);
+      indicator.textContent = `集計完了 (${from} ～ ${to})`;
+      return;
+    }
+
+    // 台帳モード: YJ → 包装分類キー → 期首残高・明細・期末残高
+    if (ledger) {
+      renderLedger(data);
+      indicator.textContent = `集計完了 (${from} ～ ${to})`;
+      return;
+    }
+
     // 描画: YJ → 包装分類キー → 明細
     Object.entries(data).forEach(([yj, {productName, groups}]) => {
       // YJヘッダ
@@ -111,7 +163,7 @@ try {
           <th>日付</th><th>種類</th><th>数量</th>
           <th>単位</th><th>包装</th><th>個数</th>
           <th>単価</th><th>金額</th><th>期限</th>
-          <th>ロット</th><th>卸コード</th>
+          <th>ロット</th><th>卸</th>
           <th>伝票番号</th><th>行番号</th>`;
         tbody.appendChild(trCols);
 
@@ -120,10 +172,10 @@ try {
           const tr = document.createElement("tr");
           tr.innerHTML = `
             <td>${d.date}</td><td>${d.type}</td>
-            <td>${d.quantity}</td><td>${d.unit}</td><td>${d.packaging}</td>
-            <td>${d.count}</td><td>${d.unitPrice}</td><td>${d.subtotal}</td>
+            ${quantityCell(d)}<td>${d.unit}</td><td>${d.packaging}</td>
+            <td>${countText(d)}</td><td>${d.unitPrice}</td><td>${d.subtotal}</td>
             <td>${d.expiryDate}</td><td>${d.lotNumber}</td>
-            <td>${d.oroshiCode}</td><td>${d.receiptNumber}</td><td>${d.lineNumber}</td>`;
+            <td title="${d.oroshiCode}">${d.oroshiName || d.oroshiCode}</td><td>${d.receiptNumber}</td><td>${d.lineNumber}</td>`;
           tbody.appendChild(tr);
         });
       });
@@ -131,4 +183,116 @@ try {
 
     indicator.textContent = `集計完了 (${from} ～ ${to})`;
   });
+
+  // 数量セル: USAGE は換算前の数量を title に、換算できない行は ⚠ を付ける
+  function quantityCell(d) {
+    if (d.conversion) {
+      return `<td class="warn" title="${d.conversion}">⚠${d.quantity}</td>`;
+    }
+    if (d.rawQuantity) {
+      return `<td title="元: ${d.rawQuantity}${d.rawUnit}">${d.quantity}</td>`;
+    }
+    return `<td>${d.quantity}</td>`;
+  }
+
+  // 個数セル: 棚卸は「未開封数+バラ数」
+  function countText(d) {
+    return d.loose && d.loose !== "0" ? `${d.count}+バラ${d.loose}` : d.count;
+  }
+
+  // メーカー別合計の描画
+  function renderMakerTotals(list) {
+    thead.innerHTML = `<tr>
+      <th>メーカー</th><th>品目数</th><th>仕入額</th><th>返品額</th>
+      <th>純仕入額</th><th>消費行数</th><th>消費薬価額</th></tr>`;
+    list.forEach(t => {
+      const tr = document.createElement("tr");
+      tr.innerHTML = `
+        <td title="${t.makerCode}">${t.makerName}</td><td>${t.productCount}</td>
+        <td>${t.purchaseAmount}</td><td>${t.returnAmount}</td>
+        <td>${t.netPurchaseAmount}</td><td>${t.consumptionLines}</td>
+        <td>${t.consumptionYakka}</td>`;
+      tbody.appendChild(tr);
+    });
+  }
+
+  // 同一成分まとめの描画
+  function renderGeneric(groups) {
+    thead.innerHTML = `<tr>
+      <th>YJコード</th><th>商品名</th><th>規格</th><th>区分</th>
+      <th>在庫</th><th>処方量</th><th>単位</th><th>代替候補</th></tr>`;
+    groups.forEach(g => {
+      const totals = g.totals.map(t => `${t.stock}${t.baseUnit}（処方 ${t.usage}${t.baseUnit}）`).join("、");
+      const trG = document.createElement("tr");
+      trG.innerHTML = `<td colspan="8">${g.name} ／ 合計在庫: ${totals}</td>`;
+      tbody.appendChild(trG);
+      g.members.forEach(m => {
+        const subs = (m.substitutes || [])
+          .map(s => `${s.productName}（${s.stock}${s.baseUnit}${s.sameStrength ? "" : "・規格違い"}）`)
+          .join("<br>");
+        const tr = document.createElement("tr");
+        if (m.outOfStock) tr.classList.add("out-of-stock");
+        tr.innerHTML = `
+          <td>${m.yj}</td><td>${m.productName}</td><td>${m.spec}</td><td>${m.kind}</td>
+          <td>${m.inLedger ? m.stock : "―"}</td><td>${m.inLedger ? m.usage : "―"}</td><td>${m.baseUnit}</td><td>${subs}</td>`;
+        tbody.appendChild(tr);
+      });
+    });
+  }
+
+  // 台帳モードの描画
+  function renderLedger(data) {
+    Object.entries(data).forEach(([yj, {productName, groups}]) => {
+      const trYJ = document.createElement("tr");
+      trYJ.innerHTML = `<td colspan="14">
+        YJコード: ${yj}${productName ? " " + productName : ""}
+      </td>`;
+      tbody.appendChild(trYJ);
+
+      Object.entries(groups).forEach(([pk, g]) => {
+        const trPK = document.createElement("tr");
+        trPK.innerHTML = `<td colspan="14">包装分類: ${pk}
+          ／ 起点棚卸: ${g.openingDate || "なし"}
+          ／ 期首残高: ${g.opening}${g.baseUnit}</td>`;
+        tbody.appendChild(trPK);
+
+        const trCols = document.createElement("tr");
+        trCols.innerHTML = `
+          <th>日付</th><th>種類</th><th>数量</th>
+          <th>単位</th><th>包装</th><th>増減</th><th>残高</th>
+          <th>単価</th><th>金額</th><th>期限</th>
+          <th>ロット</th><th>卸</th>
+          <th>伝票番号</th><th>行番号</th>`;
+        tbody.appendChild(trCols);
+
+        (g.rows || []).forEach(d => {
+          const tr = document.createElement("tr");
+          tr.innerHTML = `
+            <td>${d.date}</td><td>${d.type}</td>
+            ${quantityCell(d)}<td>${d.unit}</td><td>${d.packaging}</td>
+            <td>${d.delta}</td><td>${d.balance}</td>
+            <td>${d.unitPrice}</td><td>${d.subtotal}</td>
+            <td>${d.expiryDate}</td><td>${d.lotNumber}</td>
+            <td title="${d.oroshiCode}">${d.oroshiName || d.oroshiCode}</td><td>${d.receiptNumber}</td><td>${d.lineNumber}</td>`;
+          tbody.appendChild(tr);
+        });
+
+        const trEnd = document.createElement("tr");
+        trEnd.innerHTML = `<td colspan="14" style="text-align:right;">
+          期末残高: ${g.closing}${g.baseUnit}</td>`;
+        tbody.appendChild(trEnd);
+
+        // 基本単位に換算できず残高に含めなかった明細
+        (g.excluded || []).forEach(d => {
+          const tr = document.createElement("tr");
+          tr.className = "unconverted";
+          tr.innerHTML = `
+            <td>${d.date}</td><td>${d.type}</td>
+            <td>${d.rawQuantity || d.count || d.quantity}</td><td>${d.rawUnit || d.unit}</td><td>${d.packaging}</td>
+            <td colspan="9">残高に含めていません: ${d.conversion}</td>`;
+          tbody.appendChild(tr);
+        });
+      });
+    });
+  }
 });
\ No newline at end of file
@@ -26,6 +26,80 @@ document.addEventListener("DOMContentLoaded", () => {
     debug.textContent         = "";
   }
 
+  // 取込前プレビュー（DAT/USAGE/棚卸 共通）
+  const MARK_LABELS = {
+    new:        "新規",
+    duplicate:  "重複",
+    unknownJan: "マスター未登録",
+    createMa2:  "MA2作成"
+  };
+
+  window.isPreviewMode = () => document.getElementById("previewMode").checked;
+
+  // showPreview はプレビュー結果を表示し、確定時に onCommitted(取込結果) を呼びます
+  window.showPreview = (preview, onCommitted) => {
+    thead.innerHTML = `
+      <tr><th>行</th><th>JANコード</th><th>商品名</th><th>キー</th><th>判定</th></tr>`;
+    tbody.innerHTML = "";
+    (preview.rows || []).forEach(r => {
+      const tr = document.createElement("tr");
+      tr.innerHTML = `
+        <td>${r.row}</td><td>${r.jan}</td><td>${r.name}</td><td>${r.key}</td>
+        <td>${(r.marks || []).map(m => MARK_LABELS[m] || m).join(" / ")}</td>`;
+      tbody.appendChild(tr);
+    });
+
+    const counts = Object.entries(preview.counts || {})
+      .map(([k, v]) => `${MARK_LABELS[k] || k} ${v}件`).join(" | ");
+    indicator.textContent = `プレビュー(${preview.type}): ${counts} `;
+    if (preview.extra) {
+      debug.textContent = JSON.stringify(preview.extra, null, 2);
+    }
+
+    const commitBtn  = document.createElement("button");
+    commitBtn.className = "btn";
+    commitBtn.textContent = "確定";
+    const discardBtn = document.createElement("button");
+    discardBtn.className = "btn";
+    discardBtn.textContent = "破棄";
+    indicator.appendChild(commitBtn);
+    indicator.appendChild(discardBtn);
+
+    const url = `/api/import/commit?token=${encodeURIComponent(preview.token)}`;
+    commitBtn.addEventListener("click", async () => {
+      const res = await fetch(url, { method: "POST" });
+      if (!res.ok) {
+        indicator.textContent = "確定エラー: " + await res.text();
+        return;
+      }
+      thead.innerHTML = "";
+      tbody.innerHTML = "";
+      debug.textContent = "";
+      onCommitted(await res.json());
+    });
+    discardBtn.addEventListener("click", async () => {
+      await fetch(url, { method: "DELETE" });
+      indicator.textContent = "プレビューを破棄しました";
+      tbody.innerHTML = "";
+      debug.textContent = "";
+    });
+  };
+
+  // uploadForm はアップロードを送信し、取込済みファイル(409)なら確認のうえ force=1 で再送します
+  window.uploadForm = async (url, form) => {
+    const res = await fetch(url, { method: "POST", body: form });
+    if (res.status !== 409) return res;
+    const info = await res.json();
+    const list = (info.duplicates || []).map(d => d.batchId
+      ? `${d.fileName}（${d.importedAt} に ${d.prevFileName} として取込済み）`
+      : `${d.fileName}（${d.prevFileName} と同じ内容）`).join("\n");
+    if (!confirm(`${info.error}\n${list}\n\nそれでも取り込みますか？`)) {
+      throw new Error("取込済みのため中止しました");
+    }
+    form.append("force", "1");
+    return fetch(url, { method: "POST", body: form });
+  };
+
   // NAV の全ボタンで resetUI を実行（出庫・入庫ボタンも含む）
   document
     .querySelectorAll("header nav .btn")
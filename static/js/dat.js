@@ -3,6 +3,7 @@ document.addEventListener("DOMContentLoaded", () => {
   const btn       = document.getElementById("datBtn");
   const input     = document.getElementById("datInput");
   const indicator = document.getElementById("indicator");
+  const debug     = document.getElementById("debug");
   const table     = document.getElementById("outputTable");
   const thead     = table.querySelector("thead");
   const tbody     = table.querySelector("tbody");
@@ -19,7 +20,7 @@ document.addEventListener("DOMContentLoaded", () => {
     // テーブル初期化＋DATヘッダーセット
     thead.innerHTML = `
       <tr>
-        <th>卸コード</th><th>日付</th><th>納品／返品</th>
+        <th>卸</th><th>日付</th><th>納品／返品</th>
         <th>伝票番号</th><th>行番号</th><th>JANコード</th>
         <th>商品名</th><th>数量</th><th>単価</th>
         <th>小計</th><th>包装薬価</th><th>有効期限</th><th>ロット番号</th>
@@ -32,34 +33,35 @@ document.addEventListener("DOMContentLoaded", () => {
   input.addEventListener("change", async () => {
     if (!input.files.length) return;
     indicator.textContent = "DATアップロード中…";
+    const headerHTML = thead.innerHTML;
+
+    // プレビュー時は選択ファイルをまとめて判定し、確定後に表示
+    if (window.isPreviewMode()) {
+      const form = new FormData();
+      for (let file of input.files) form.append("datFileInput[]", file);
+      form.append("preview", "1");
+      try {
+        const res = await window.uploadForm("/uploadDat", form);
+        const preview = await res.json();
+        window.showPreview(preview, result => {
+          thead.innerHTML = headerHTML;
+          renderResult("プレビュー確定", result);
+        });
+      } catch (err) {
+        console.error(err);
+        indicator.textContent = "DATプレビューエラー: " + err.message;
+      }
+      input.value = "";
+      return;
+    }
 
     for (let file of input.files) {
       const form = new FormData();
       form.append("datFileInput[]", file);
       try {
-        const res = await fetch("/uploadDat", { method: "POST", body: form });
+        const res = await window.uploadForm("/uploadDat", form);
         const result = await res.json();
-        indicator.textContent = `${file.name}: DAT読み込み ${result.DATReadCount}件 | MA0作成 ${result.MA0CreatedCount}件 | 重複 ${result.DuplicateCount}件`;
-        // テーブル行追加
-        result.DATRecords.forEach(rec => {
-          const tr = document.createElement("tr");
-          tr.innerHTML = `
-            <td>${rec.DatOroshiCode}</td>
-            <td>${rec.DatDate}</td>
-            <td>${rec.DatDeliveryFlag}</td>
-            <td>${rec.DatReceiptNumber}</td>
-            <td>${rec.DatLineNumber}</td>
-            <td>${rec.DatJanCode}</td>
-            <td>${rec.DatProductName}</td>
-            <td>${rec.DatQuantity}</td>
-            <td>${rec.DatUnitPrice}</td>
-            <td>${rec.DatSubtotal}</td>
-            <td>${rec.DatPackagingDrugPrice}</td>
-            <td>${rec.DatExpiryDate}</td>
-            <td>${rec.DatLotNumber}</td>
-          `;
-          tbody.appendChild(tr);
-        });
+        renderResult(file.name, result);
       } catch (err) {
         console.error(err);
         indicator.textContent = "DATアップロードエラー: " + err.message;
@@ -68,4 +70,48 @@ document.addEventListener("DOMContentLoaded", () => {
     indicator.textContent += " 完了";
     input.value = "";
   });
+
+  // 取込結果の表示
+  function renderResult(fileName, result) {
+    indicator.textContent = `${fileName}: DAT読み込み ${result.DATReadCount}件 | MA0作成 ${result.MA0CreatedCount}件 | 重複 ${result.DuplicateCount}件`;
+    // ファイル検証結果（件数・金額の不一致、途中切れなど）
+    (result.Validations || []).forEach(v => {
+      if (!v.valid) {
+        indicator.textContent += ` | ⚠ ${v.fileName} は検証エラーのため取り込みませんでした: ${v.errors.join(" / ")}`;
+      }
+      if (v.rejected) {
+        indicator.textContent += ` | 取込拒否 ${v.rejected}行`;
+        debug.textContent += (v.lineErrors || [])
+          .map(e => `${v.fileName} ${e.line}行目 ${e.field}=${e.value}: ${e.reason}`)
+          .join("\n") + "\n";
+      }
+    });
+    // 行エラーの CSV ダウンロード
+    if (result.ErrorCount && result.BatchID) {
+      const a = document.createElement("a");
+      a.href = `/api/import/errors.csv?batch=${result.BatchID}`;
+      a.textContent = " 行エラーCSV";
+      indicator.appendChild(a);
+    }
+    // テーブル行追加
+    (result.DATRecords || []).forEach(rec => {
+      const tr = document.createElement("tr");
+      tr.innerHTML = `
+        <td title="${rec.DatOroshiCode}">${rec.DatOroshiName || rec.DatOroshiCode}</td>
+        <td>${rec.DatDate}</td>
+        <td>${rec.DatDeliveryFlag}</td>
+        <td>${rec.DatReceiptNumber}</td>
+        <td>${rec.DatLineNumber}</td>
+        <td>${rec.DatJanCode}</td>
+        <td>${rec.DatProductName}</td>
+        <td>${rec.DatQuantity}</td>
+        <td>${rec.DatUnitPrice}</td>
+        <td>${rec.DatSubtotal}</td>
+        <td>${rec.DatPackagingDrugPrice}</td>
+        <td>${rec.DatExpiryDate}</td>
+        <td>${rec.DatLotNumber}</td>
+      `;
+      tbody.appendChild(tr);
+    });
+  }
 });
\ No newline at end of file
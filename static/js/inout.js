@@ -51,13 +51,34 @@ document.addEventListener("DOMContentLoaded", () => {
   async function loadClients() {
     existingNames.innerHTML = `<option value="">── 選択 ──</option>`;
     const list = await (await fetch("/api/inout")).json();
-    list.forEach(r => {
+    (list || []).forEach(r => {
       const o = document.createElement("option");
-      o.value = r.name; o.textContent = r.name;
+      o.value = r.name;
+      o.textContent = r.oroshiName ? `${r.name}（${r.oroshiName}）` : r.name;
+      o.dataset.oroshi = r.oroshicode;
       existingNames.appendChild(o);
     });
   }
 
+  // 卸マスター（卸コードのある行）ロード
+  async function loadOroshi() {
+    oroshiInput.innerHTML = `<option value="">── 卸なし ──</option>`;
+    const list = await (await fetch("/api/oroshi")).json();
+    list.forEach(r => {
+      const o = document.createElement("option");
+      o.value = r.oroshiCode;
+      o.textContent = `${r.name} (${r.oroshiCode})`;
+      oroshiInput.appendChild(o);
+    });
+  }
+  loadOroshi().catch(console.error);
+
+  // 既存得意先を選んだら登録済みの卸を選択
+  existingNames.addEventListener("change", () => {
+    const opt = existingNames.selectedOptions[0];
+    oroshiInput.value = (opt && opt.dataset.oroshi) || "";
+  });
+
   // 明細行初期化
   function initRows() {
     body.innerHTML = "";
@@ -86,6 +107,16 @@ document.addEventListener("DOMContentLoaded", () => {
         modal.classList.remove("hidden");
       });
 
+      // バーコード読取（スキャナーの Enter で確定）
+      const janInput = tr.querySelector(".jan");
+      janInput.addEventListener("change", () => applyBarcode(tr).catch(console.error));
+      janInput.addEventListener("keydown", e => {
+        if (e.key === "Enter") {
+          e.preventDefault();
+          janInput.blur();
+        }
+      });
+
       // 数量・期限入力で再計算
       tr.querySelector(".qty").addEventListener("input", recalcAll);
       tr.querySelector(".expiryDate").addEventListener("change", recalcAll);
@@ -141,7 +172,7 @@ document.addEventListener("DOMContentLoaded", () => {
 
     // 3) 成否アラート
     if (!res.ok) {
-      return alert("得意先登録に失敗しました");
+      return alert("得意先登録に失敗しました: " + await res.text());
     }
     alert("得意先を登録しました");
 
@@ -164,24 +195,57 @@ document.addEventListener("DOMContentLoaded", () => {
   // モーダル閉じる
   closeModalBtn.addEventListener("click", () => modal.classList.add("hidden"));
 
+  // 検索結果の１件から１JANあたり薬価と包装表記を求める
+  function productInfo(item) {
+    const baseY  = item.unitYaku / (item.packTotal / item.coef);
+    const mapped = taniMap[item.packQtyUnitCode] || item.unitName;
+    const suffix = item.packQtyUnitCode === 0 ? "" : `/${mapped}`;
+    return { baseY, pkgStr: `${item.packQtyNumber}${item.unitName}${suffix}` };
+  }
+
+  // 明細行に商品をセット
+  function applyProduct(row, item) {
+    const { baseY, pkgStr } = productInfo(item);
+    row.querySelector(".yj-code").textContent   = item.yj;
+    row.querySelector(".jan").value             = item.jan;
+    row.querySelector(".item-name").textContent = item.name;
+    row.querySelector(".packaging").value       = pkgStr;
+    row.dataset.baseY = baseY.toFixed(6);
+    row.dataset.num   = item.packQtyNumber;
+    row.dataset.code  = item.packQtyUnitCode;
+    row.dataset.unit  = item.unitName;
+  }
+
+  // JAN 欄にバーコード（JAN・GS1）を読み取ったら商品・期限・ロットをセット
+  async function applyBarcode(row) {
+    const input = row.querySelector(".jan");
+    const code  = input.value.trim();
+    if (!code) return;
+    const res = await fetch(`/api/barcode?code=${encodeURIComponent(code)}`);
+    if (!res.ok) return alert(await res.text());
+    const bc = await res.json();
+    input.value = bc.jan;
+    if (bc.expiry) row.querySelector(".expiryDate").value = bc.expiry;
+    if (bc.lot)    row.querySelector(".lotNumber").value  = bc.lot;
+    const list = await (await fetch(`/api/inout/search?jan=${encodeURIComponent(bc.jan)}&date=${dateInput.value}`)).json();
+    if (list && list.length) {
+      applyProduct(row, list[0]);
+    } else {
+      row.querySelector(".item-name").textContent = bc.found ? bc.name : "（マスター未登録）";
+    }
+    recalcAll();
+  }
+
   // 薬品検索
   searchBtn.addEventListener("click", async () => {
     const name = encodeURIComponent(searchName.value.trim());
     const spec = encodeURIComponent(searchSpec.value.trim());
-    const list = await (await fetch(`/api/inout/search?name=${name}&spec=${spec}`)).json();
+    const list = await (await fetch(`/api/inout/search?name=${name}&spec=${spec}&date=${dateInput.value}`)).json();
     resultsTbody.innerHTML = "";
 
     list.forEach(item => {
       const tr = document.createElement("tr");
-      const baseY = item.unitYaku / (item.packTotal / item.coef);
-      tr.dataset.baseY = baseY.toFixed(6);
-      tr.dataset.num   = item.packQtyNumber;
-      tr.dataset.code  = item.packQtyUnitCode;
-      tr.dataset.unit  = item.unitName;
-
-      const mapped = taniMap[item.packQtyUnitCode] || item.unitName;
-      const suffix = item.packQtyUnitCode === 0 ? "" : `/${mapped}`;
-      const pkgStr = `${item.packQtyNumber}${item.unitName}${suffix}`;
+      const { baseY, pkgStr } = productInfo(item);
 
       tr.innerHTML = `
         <td>${item.yj}</td>
@@ -193,14 +257,7 @@ document.addEventListener("DOMContentLoaded", () => {
       `;
 
       tr.addEventListener("click", () => {
-        currentRow.querySelector(".yj-code").textContent   = item.yj;
-        currentRow.querySelector(".jan").value             = item.jan;
-        currentRow.querySelector(".item-name").textContent = item.name;
-        currentRow.querySelector(".packaging").value       = pkgStr;
-        currentRow.dataset.baseY = tr.dataset.baseY;
-        currentRow.dataset.num   = tr.dataset.num;
-        currentRow.dataset.code  = tr.dataset.code;
-        currentRow.dataset.unit  = tr.dataset.unit;
+        applyProduct(currentRow, item);
         modal.classList.add("hidden");
         recalcAll();
       });
@@ -7,6 +7,22 @@ document.addEventListener("DOMContentLoaded", () => {
   const thead     = table.querySelector("thead");
   const tbody     = table.querySelector("tbody");
   const debug     = document.getElementById("debug");
+  const profileSel = document.getElementById("inventoryProfile");
+  const dateInput  = document.getElementById("inventoryDate");
+
+  // 棚卸CSVの形式（プロファイル）一覧
+  fetch("/api/inventory/profiles")
+    .then(res => res.json())
+    .then(list => {
+      list.forEach(p => {
+        const opt = document.createElement("option");
+        opt.value = p.name;
+        opt.textContent = p.name;
+        if (p.default) opt.selected = true;
+        profileSel.appendChild(opt);
+      });
+    })
+    .catch(err => console.error("棚卸プロファイル取得失敗:", err));
 
   btn.addEventListener("click", () => {
     const filterDiv = document.getElementById("aggregateFilter");
@@ -19,6 +35,8 @@ document.addEventListener("DOMContentLoaded", () => {
          <th>JANコード</th>
          <th>商品名</th>
          <th>JAN包装数量</th>
+         <th>未開封</th>
+         <th>バラ</th>
          <th>在庫数(包装単位)</th>
          <th>包装単位</th>
          <th>包装単位コード</th>
@@ -39,59 +57,132 @@ document.addEventListener("DOMContentLoaded", () => {
 
     const form = new FormData();
     form.append("inventoryFile", input.files[0]);
+    form.append("inventoryProfile", profileSel.value);
+    form.append("invDate", dateInput.value);
+    const headerHTML = thead.innerHTML;
+
+    // プレビュー時は判定のみ行い、確定後に表示
+    if (window.isPreviewMode()) {
+      form.append("preview", "1");
+      try {
+        const res = await window.uploadForm("/uploadInventory", form);
+        if (!res.ok) throw new Error(res.statusText);
+        const preview = await res.json();
+        window.showPreview(preview, data => {
+          thead.innerHTML = headerHTML;
+          renderResult(data);
+        });
+      } catch (err) {
+        console.error(err);
+        indicator.textContent = "棚卸プレビュー失敗: " + err.message;
+      }
+      return;
+    }
 
     try {
-      const res = await fetch("/uploadInventory", { method: "POST", body: form });
+      const res = await window.uploadForm("/uploadInventory", form);
       debug.textContent = `HTTP status: ${res.status}\n`;
       if (!res.ok) throw new Error(res.statusText);
 
       const data = await res.json();
       debug.textContent += JSON.stringify(data, null, 2);
+      renderResult(data);
+    }
+    catch (err) {
+      console.error(err);
+      debug.textContent += `\nError: ${err.message}`;
+      indicator.textContent = "棚卸アップロード失敗: " + err.message;
+    }
+  });
+
+  // 取込結果の表示
+  function renderResult(data) {
+    // CSV → Go → DB → Go → JS 経路で受け取ったフィールドをログ
+    data.inventories.forEach((rec, idx) => {
+    console.log(
+      `[inventory.js] #${idx} HousouTaniUnit="${rec.HousouTaniUnit}"`
+      + ` InvHousouTaniUnit="${rec.InvHousouTaniUnit}"`
+      + ` JanHousouSuuryouUnit="${rec.JanHousouSuuryouUnit}"`
+      + ` InvJanHousouSuuryouUnit="${rec.InvJanHousouSuuryouUnit}"`
+    );
+
 
-      // CSV → Go → DB → Go → JS 経路で受け取ったフィールドをログ
-      data.inventories.forEach((rec, idx) => {
+
+      // ' を取り除いたあとの文字列
+      const trimmedUnit = rec.HousouTaniUnit.replace(/'/g, "");
+      const trimmedJan  = rec.JanHousouSuuryouUnit.replace(/'/g, "");
       console.log(
-        `[inventory.js] #${idx} HousouTaniUnit="${rec.HousouTaniUnit}"`
-        + ` InvHousouTaniUnit="${rec.InvHousouTaniUnit}"`
-        + ` JanHousouSuuryouUnit="${rec.JanHousouSuuryouUnit}"`
-        + ` InvJanHousouSuuryouUnit="${rec.InvJanHousouSuuryouUnit}"`
+        `[inventory.js] #${idx} trimmed HousouTaniUnit:`, trimmedUnit,
+        ` trimmed JanHousouSuuryouUnit:`, trimmedJan
       );
+    });
 
+    tbody.innerHTML = "";
+    data.inventories.forEach(rec => {
+      const tr = document.createElement("tr");
+      tr.innerHTML =
+        `<td>${rec.InvDate}</td>
+         <td>${rec.InvYjCode}</td>
+         <td>${rec.InvJanCode}</td>
+         <td>${rec.InvProductName}</td>
+         <td>${rec.InvJanHousouSuuryouNumber}</td>
+         <td>${rec.PackCount}</td>
+         <td>${rec.LooseQty}</td>
+         <td>${rec.Qty}</td>
+         <td>${rec.HousouTaniUnit}</td>
+         <td>${rec.InvHousouTaniUnit}</td>
+         <td>${rec.JanQty}</td>
+         <td>${rec.JanHousouSuuryouUnit}</td>
+         <td>${rec.InvJanHousouSuuryouUnit}</td>`;
+      tbody.appendChild(tr);
+    });
 
+    // 差異の備考（棚卸なし・前回棚卸なし・換算できない明細）
+    function varianceNote(v) {
+      const notes = [];
+      if (v.notCounted) notes.push("棚卸なし");
+      if (v.noBaseline) notes.push("前回棚卸なし（履歴の始めから計算）");
+      if (v.excluded) notes.push(`換算できない明細 ${v.excluded} 件を除外`);
+      return notes.join("／");
+    }
 
-        // ' を取り除いたあとの文字列
-        const trimmedUnit = rec.HousouTaniUnit.replace(/'/g, "");
-        const trimmedJan  = rec.JanHousouSuuryouUnit.replace(/'/g, "");
-        console.log(
-          `[inventory.js] #${idx} trimmed HousouTaniUnit:`, trimmedUnit,
-          ` trimmed JanHousouSuuryouUnit:`, trimmedJan
-        );
-      });
-
-      tbody.innerHTML = "";
-      data.inventories.forEach(rec => {
+    // 理論在庫との差異
+    if (data.variance && data.variance.rows && data.variance.rows.length) {
+      const trTitle = document.createElement("tr");
+      trTitle.innerHTML = `<td colspan="13">理論在庫との差異 (${data.variance.date})
+        合計差異金額: ${data.variance.totalDiffValue}</td>`;
+      tbody.appendChild(trTitle);
+      const trCols = document.createElement("tr");
+      trCols.innerHTML =
+        `<th>YJコード</th><th>商品名</th><th>包装分類</th><th>前回棚卸日</th>
+         <th>理論在庫</th><th>実棚</th><th>差異</th><th>単位</th>
+         <th>単位薬価</th><th>差異金額</th><th>備考</th>`;
+      tbody.appendChild(trCols);
+      data.variance.rows.forEach(v => {
         const tr = document.createElement("tr");
         tr.innerHTML =
-          `<td>${rec.InvDate}</td>
-           <td>${rec.InvYjCode}</td>
-           <td>${rec.InvJanCode}</td>
-           <td>${rec.InvProductName}</td>
-           <td>${rec.InvJanHousouSuuryouNumber}</td>
-           <td>${rec.Qty}</td>
-           <td>${rec.HousouTaniUnit}</td>
-           <td>${rec.InvHousouTaniUnit}</td>
-           <td>${rec.JanQty}</td>
-           <td>${rec.JanHousouSuuryouUnit}</td>
-           <td>${rec.InvJanHousouSuuryouUnit}</td>`;
+          `<td>${v.yj}</td><td>${v.productName}</td><td>${v.packagingKey}</td>
+           <td>${v.prevDate}</td><td>${v.theoretical}</td><td>${v.counted}</td>
+           <td>${v.diff}</td><td>${v.baseUnit}</td><td>${v.unitYakka}</td>
+           <td>${v.diffValue}</td><td>${varianceNote(v)}</td>`;
         tbody.appendChild(tr);
       });
-
-      indicator.textContent = `棚卸 ${data.count} 件を取り込みました。`;
     }
-    catch (err) {
-      console.error(err);
-      debug.textContent += `\nError: ${err.message}`;
-      indicator.textContent = "棚卸アップロード失敗: " + err.message;
+
+    indicator.textContent = `棚卸 ${data.count} 件を取り込みました。`;
+    // 読み飛ばした行と理由
+    const skipped = data.skipped || [];
+    if (skipped.length) {
+      indicator.textContent += ` 読み飛ばし ${skipped.length} 行`;
+      if (data.batchId) {
+        const a = document.createElement("a");
+        a.href = `/api/import/errors.csv?batch=${data.batchId}`;
+        a.textContent = " 行エラーCSV";
+        indicator.appendChild(a);
+      }
+      debug.textContent += "\n読み飛ばした行:\n" + skipped
+        .map(e => `${e.line}行目 ${e.field} "${e.value}": ${e.reason}`)
+        .join("\n");
     }
-  });
+  }
 });
\ No newline at end of file
@@ -2,6 +2,7 @@
 document.addEventListener("DOMContentLoaded", () => {
   const btn       = document.getElementById("usageBtn");
   const input     = document.getElementById("usageInput");
+  const sourceInput = document.getElementById("usageSource");
   const indicator = document.getElementById("indicator");
   const table     = document.getElementById("outputTable");
   const thead     = table.querySelector("thead");
@@ -12,6 +13,13 @@ document.addEventListener("DOMContentLoaded", () => {
   tbody.innerHTML = "";
 
   btn.addEventListener("click", () => {
+    // 取込元ごとに期間の行を置き換えるため、取込元は必須
+    if (!sourceInput.value.trim()) {
+      indicator.textContent = "USAGEの取込元（店舗名など）を入力してください";
+      sourceInput.focus();
+      return;
+    }
+
     // フィルタ部を隠す
     const filterDiv = document.getElementById("aggregateFilter");
     filterDiv.style.display = "none";
@@ -19,8 +27,8 @@ document.addEventListener("DOMContentLoaded", () => {
     // テーブル初期化＋USAGEヘッダーセット
     thead.innerHTML = `
       <tr>
-        <th>日付</th><th>YJコード</th><th>JANコード</th>
-        <th>商品名</th><th>数量</th><th>単位コード</th><th>単位名称</th>
+        <th>取込元</th><th>日付</th><th>YJコード</th><th>JANコード</th>
+        <th>商品名</th><th>数量</th><th>単位コード</th><th>単位名称</th><th>行</th>
       </tr>`;
     tbody.innerHTML = "";
 
@@ -30,28 +38,39 @@ document.addEventListener("DOMContentLoaded", () => {
   input.addEventListener("change", async () => {
     if (!input.files.length) return;
     indicator.textContent = "USAGEアップロード中…";
+    const headerHTML = thead.innerHTML;
+
+    // プレビュー時は削除予定の既存レコードも含めて判定し、確定後に表示
+    if (window.isPreviewMode()) {
+      const form = new FormData();
+      for (let file of input.files) form.append("usageFileInput[]", file);
+      form.append("usageSource", sourceInput.value.trim());
+      form.append("preview", "1");
+      try {
+        const res = await window.uploadForm("/uploadUsage", form);
+        const preview = await res.json();
+        window.showPreview(preview, result => {
+          thead.innerHTML = headerHTML;
+          renderResult("プレビュー確定", result);
+        });
+        const warning = overlapText((preview.extra || {}).Overlaps);
+        if (warning) indicator.prepend(warning + " ");
+      } catch (err) {
+        console.error(err);
+        indicator.textContent = "USAGEプレビューエラー: " + err.message;
+      }
+      input.value = "";
+      return;
+    }
 
     for (let file of input.files) {
       const form = new FormData();
       form.append("usageFileInput[]", file);
+      form.append("usageSource", sourceInput.value.trim());
       try {
-        const res = await fetch("/uploadUsage", { method: "POST", body: form });
+        const res = await window.uploadForm("/uploadUsage", form);
         const result = await res.json();
-        indicator.textContent = `${file.name}: USAGE読み込み ${result.TotalRecords}件`;
-        // テーブル行追加
-        result.USAGERecords.forEach(rec => {
-          const tr = document.createElement("tr");
-          tr.innerHTML = `
-            <td>${rec.usageDate}</td>
-            <td>${rec.usageYjCode}</td>
-            <td>${rec.usageJanCode}</td>
-            <td>${rec.usageProductName}</td>
-            <td>${rec.usageAmount}</td>
-            <td>${rec.usageUnit}</td>
-            <td>${rec.usageUnitName}</td>
-          `;
-          tbody.appendChild(tr);
-        });
+        renderResult(file.name, result);
       } catch (err) {
         console.error(err);
         indicator.textContent = "USAGEアップロードエラー: " + err.message;
@@ -60,4 +79,47 @@ document.addEventListener("DOMContentLoaded", () => {
     indicator.textContent += " 完了";
     input.value = "";
   });
+
+  // 同じ期間・JAN に別の取込元の行が残る場合の警告（二重計上のおそれ）
+  function overlapText(overlaps) {
+    return (overlaps || []).map(o =>
+      `⚠ ${o.start}～${o.end} に別の取込元「${o.other}」の行が ${o.jans}品目 ${o.rows}件あります（二重計上のおそれ）`
+    ).join(" ");
+  }
+
+  // 取込結果の表示
+  function renderResult(fileName, result) {
+    indicator.textContent = `${fileName}: USAGE読み込み ${result.TotalRecords}件`;
+    const profiles = [...new Set(Object.values(result.Profiles || {}))];
+    if (profiles.length) indicator.textContent += ` (形式: ${profiles.join(", ")})`;
+    if (result.DeletedCount !== undefined) {
+      indicator.textContent += ` 削除 ${result.DeletedCount}件 / 登録 ${result.InsertedCount}件`;
+    }
+    if (result.ErrorCount) indicator.textContent += ` 読み飛ばし ${result.ErrorCount}行`;
+    const warning = overlapText(result.Overlaps);
+    if (warning) indicator.textContent += " " + warning;
+    // 読み飛ばした行の CSV ダウンロード
+    if (result.ErrorCount && result.BatchID) {
+      const a = document.createElement("a");
+      a.href = `/api/import/errors.csv?batch=${result.BatchID}`;
+      a.textContent = " 行エラーCSV";
+      indicator.appendChild(a);
+    }
+    // テーブル行追加
+    result.USAGERecords.forEach(rec => {
+      const tr = document.createElement("tr");
+      tr.innerHTML = `
+        <td>${rec.usageSource}</td>
+        <td>${rec.usageDate}</td>
+        <td>${rec.usageYjCode}</td>
+        <td>${rec.usageJanCode}</td>
+        <td>${rec.usageProductName}</td>
+        <td>${rec.usageAmount}</td>
+        <td>${rec.usageUnit}</td>
+        <td>${rec.usageUnitName}</td>
+        <td>${rec.usageLineNo || ""}</td>
+      `;
+      tbody.appendChild(tr);
+    });
+  }
 });
\ No newline at end of file
@@ -0,0 +1,72 @@
+// static/js/valuation.js
+document.addEventListener("DOMContentLoaded", () => {
+  const btn       = document.getElementById("valuationBtn");
+  const methodSel = document.getElementById("valuationMethod");
+  const dateInput = document.getElementById("inventoryDate");
+  const indicator = document.getElementById("indicator");
+  const table     = document.getElementById("outputTable");
+  const thead     = table.querySelector("thead");
+  const tbody     = table.querySelector("tbody");
+
+  const yen = v => Number(v).toLocaleString("ja-JP", { maximumFractionDigits: 2 });
+
+  btn.addEventListener("click", async () => {
+    const filterDiv = document.getElementById("aggregateFilter");
+    if (filterDiv) filterDiv.style.display = "none";
+    if (!dateInput.value) {
+      alert("棚卸日を指定してください");
+      return;
+    }
+    const params = new URLSearchParams({ date: dateInput.value, method: methodSel.value });
+    indicator.textContent = "在庫評価を計算中…";
+    thead.innerHTML = "";
+    tbody.innerHTML = "";
+
+    let rep;
+    try {
+      const res = await fetch(`/api/inventory/valuation?${params}`);
+      if (!res.ok) throw new Error(await res.text());
+      rep = await res.json();
+    } catch (err) {
+      indicator.textContent = "在庫評価に失敗しました: " + err.message;
+      return;
+    }
+    params.set("format", "csv");
+    indicator.innerHTML =
+      `在庫評価 ${rep.date}（${methodSel.selectedOptions[0].textContent}）
+       薬価金額: ${yen(rep.yakkaValue)} / 仕入金額: ${yen(rep.costValue)}
+       ${rep.noCost ? `（仕入単価なし ${rep.noCost}件）` : ""}
+       <a href="/api/inventory/valuation?${params}">CSV</a>`;
+
+    thead.innerHTML =
+      `<tr>
+         <th>JANコード</th><th>商品名</th><th>薬効分類</th><th>卸</th>
+         <th>在庫数</th><th>包装単位</th><th>単位薬価</th><th>薬価金額</th>
+         <th>仕入単価</th><th>仕入金額</th>
+       </tr>`;
+    rep.rows.forEach(r => {
+      const tr = document.createElement("tr");
+      tr.innerHTML = `
+        <td>${r.jan}</td><td>${r.productName}</td><td>${r.yakkouCode}</td><td>${r.oroshiName || r.oroshiCode}</td>
+        <td>${r.qty}</td><td>${r.baseUnit}</td>
+        <td class="${r.noYakka ? "warn" : ""}">${r.noYakka ? "⚠" : yen(r.unitYakka)}</td><td>${yen(r.yakkaValue)}</td>
+        <td class="${r.noCost ? "warn" : ""}">${r.noCost ? "⚠" : yen(r.unitCost)}</td><td>${yen(r.costValue)}</td>`;
+      tbody.appendChild(tr);
+    });
+
+    const section = (title, list) => {
+      const trTitle = document.createElement("tr");
+      trTitle.innerHTML = `<td colspan="10"><strong>${title}</strong></td>`;
+      tbody.appendChild(trTitle);
+      list.forEach(t => {
+        const tr = document.createElement("tr");
+        tr.innerHTML = `
+          <td>${t.key}</td><td colspan="3">${t.name}</td><td>${t.items}品目</td><td></td>
+          <td></td><td>${yen(t.yakkaValue)}</td><td></td><td>${yen(t.costValue)}</td>`;
+        tbody.appendChild(tr);
+      });
+    };
+    section("薬効分類別", rep.byYakkou);
+    section("卸別", rep.byOroshi);
+  });
+});
@@ -0,0 +1,147 @@
+package stocktake
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"YAMATO/barcode"
+	"YAMATO/usage"
+)
+
+// product は読取った JAN のマスター情報です。
+type product struct {
+	Name     string // 商品名（JCSHMS → MA2 → MA0）
+	PackUnit string // 包装単位（名称）
+	Known    bool   // JCSHMS か MA2 に登録済み
+}
+
+// janOf はバーコード（JAN・GTIN-14・GS1-128・GS1 データバー）を JAN に変換します。
+func janOf(code string) (string, error) {
+	d, err := barcode.Parse(code)
+	if err != nil {
+		return "", inputError{err.Error()}
+	}
+	jan := barcode.JAN(d.GTIN)
+	if jan == "" {
+		return "", invalid("バーコード %q を JAN に変換できません", code)
+	}
+	return jan, nil
+}
+
+// lookupProduct は JAN の商品名・包装単位とマスター登録の有無を返します。
+func lookupProduct(jan string) product {
+	var p product
+	err := DB.QueryRow(
+		`SELECT JC018ShouhinMei, JC039HousouTaniTani FROM jcshms WHERE JC000JanCode = ? LIMIT 1`, jan,
+	).Scan(&p.Name, &p.PackUnit)
+	if err == nil {
+		p.Known = true
+		return p
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("[STOCKTAKE] jcshms lookup error JAN=%s: %v", jan, err)
+	}
+	var unitCode string
+	err = DB.QueryRow(
+		`SELECT COALESCE(Shouhinmei, ''), COALESCE(HousouTaniUnit, '') FROM ma2 WHERE MA2JanCode = ?`, jan,
+	).Scan(&p.Name, &unitCode)
+	if err == nil {
+		p.Known = true
+		p.PackUnit = usage.GetTaniName(unitCode)
+		return p
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("[STOCKTAKE] ma2 lookup error JAN=%s: %v", jan, err)
+	}
+	DB.QueryRow(
+		`SELECT COALESCE(MA018JC018ShouhinMei, '') FROM ma0 WHERE MA000JC000JanCode = ?`, jan,
+	).Scan(&p.Name)
+	return p
+}
+
+// queueUnknown はマスターに無い JAN を MA2 登録待ちに追加します（登録済みの待ちは最初の読取を残します）。
+func queueUnknown(sc Scan) {
+	_, err := DB.Exec(`
+INSERT OR IGNORE INTO ma2_queue (janCode, barcode, sessionId, counter, firstSeenAt, status)
+VALUES (?, ?, ?, ?, ?, ?)`,
+		sc.JanCode, sc.Barcode, sc.SessionID, sc.Counter, sc.ScannedAt, QueuePending,
+	)
+	if err != nil {
+		log.Printf("[STOCKTAKE] queue unknown JAN=%s error: %v", sc.JanCode, err)
+	}
+}
+
+// MA2 登録待ちの状態
+const (
+	QueuePending    = "pending"
+	QueueRegistered = "registered"
+)
+
+// QueueItem は MA2 登録待ちの１件です。
+type QueueItem struct {
+	JanCode     string `json:"janCode"`
+	Barcode     string `json:"barcode"`
+	SessionID   int64  `json:"sessionId"`
+	Counter     string `json:"counter"`
+	FirstSeenAt string `json:"firstSeenAt"`
+	Status      string `json:"status"`
+	ProductName string `json:"productName"`
+}
+
+// refreshQueue はその後 JCSHMS・MA2 に登録された（商品名が入った）JAN を登録済みにします。
+func refreshQueue() error {
+	_, err := DB.Exec(`
+UPDATE ma2_queue SET status = ?
+ WHERE status = ?
+   AND (EXISTS (SELECT 1 FROM jcshms WHERE JC000JanCode = ma2_queue.janCode)
+     OR EXISTS (SELECT 1 FROM ma2 WHERE MA2JanCode = ma2_queue.janCode AND COALESCE(Shouhinmei, '') <> ''))`,
+		QueueRegistered, QueuePending,
+	)
+	return err
+}
+
+// Queue は MA2 登録待ちを返します。all が false なら未登録のみです。
+func Queue(all bool) ([]QueueItem, error) {
+	if err := refreshQueue(); err != nil {
+		return nil, err
+	}
+	query, args := `
+SELECT janCode, barcode, sessionId, counter, firstSeenAt, status FROM ma2_queue`, []interface{}{}
+	if !all {
+		query += ` WHERE status = ?`
+		args = append(args, QueuePending)
+	}
+	rows, err := DB.Query(query+` ORDER BY firstSeenAt, janCode`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]QueueItem, 0)
+	for rows.Next() {
+		var q QueueItem
+		if err := rows.Scan(&q.JanCode, &q.Barcode, &q.SessionID, &q.Counter, &q.FirstSeenAt, &q.Status); err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range out {
+		out[i].ProductName = lookupProduct(out[i].JanCode).Name
+	}
+	return out, nil
+}
+
+// QueueHandler は /api/stocktake/unknown の GET で MA2 登録待ちを返します（all=1 で登録済みも含む）。
+// 登録は /api/ma2/upsert で行い、登録後は自動的に registered になります。
+func QueueHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := Queue(r.URL.Query().Get("all") == "1")
+	if err != nil {
+		log.Printf("[STOCKTAKE] queue error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, items)
+}
@@ -0,0 +1,498 @@
+// Package stocktake はハンディスキャナーによる棚卸（セッション単位の読取）を扱います。
+// セッションを棚卸日ごとに開き、複数の担当者が並行してバーコードと数量を登録し、
+// 締めたときに JAN ごとに合算して inventory テーブルへ書き込みます。
+package stocktake
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"YAMATO/importer"
+	"YAMATO/inventory"
+)
+
+var DB *sql.DB
+
+// セッションの状態
+const (
+	StatusOpen   = "open"
+	StatusClosed = "closed"
+)
+
+var (
+	ErrNotFound     = errors.New("棚卸セッションがありません")
+	ErrScanNotFound = errors.New("読取がありません")
+	ErrClosed       = errors.New("棚卸セッションは締め済みです")
+)
+
+// inputError は入力の誤りです（writeError は 400 で返します）。
+type inputError struct{ msg string }
+
+func (e inputError) Error() string { return e.msg }
+
+func invalid(format string, args ...interface{}) error {
+	return inputError{fmt.Sprintf(format, args...)}
+}
+
+// Session は棚卸セッションです。
+type Session struct {
+	ID        int64  `json:"id"`
+	InvDate   string `json:"invDate"` // YYYYMMDD
+	Note      string `json:"note"`
+	Status    string `json:"status"`
+	OpenedAt  string `json:"openedAt"`
+	ClosedAt  string `json:"closedAt,omitempty"`
+	BatchID   int64  `json:"batchId,omitempty"` // 締めたときの取込バッチ
+	ScanCount int    `json:"scanCount"`
+}
+
+// Scan は１回の読取です。PackCount は未開封の包装数、LooseQty は開封済みのバラ数です。
+type Scan struct {
+	ID          int64   `json:"id"`
+	SessionID   int64   `json:"sessionId"`
+	Counter     string  `json:"counter"` // 担当者・端末名
+	Barcode     string  `json:"barcode"`
+	JanCode     string  `json:"janCode"`
+	ProductName string  `json:"productName"`
+	PackCount   float64 `json:"packCount"`
+	LooseQty    float64 `json:"looseQty"`
+	Unknown     bool    `json:"unknown"` // マスターに無い JAN（MA2 登録待ち）
+	ScannedAt   string  `json:"scannedAt"`
+}
+
+func now() string { return time.Now().Format("2006-01-02 15:04:05") }
+
+// Open は棚卸日 invDate（YYYYMMDD）のセッションを開きます。
+func Open(invDate, note string) (Session, error) {
+	s := Session{InvDate: invDate, Note: note, Status: StatusOpen, OpenedAt: now()}
+	if _, err := time.Parse("20060102", invDate); err != nil {
+		return s, invalid("棚卸日 %q が正しくありません", invDate)
+	}
+	res, err := DB.Exec(
+		`INSERT INTO stocktake_sessions (invDate, note, status, openedAt) VALUES (?, ?, ?, ?)`,
+		s.InvDate, s.Note, s.Status, s.OpenedAt,
+	)
+	if err != nil {
+		return s, err
+	}
+	s.ID, _ = res.LastInsertId()
+	return s, nil
+}
+
+const sessionColumns = `
+SELECT s.sessionId, s.invDate, s.note, s.status, s.openedAt,
+       COALESCE(s.closedAt, ''), COALESCE(s.batchId, 0),
+       (SELECT COUNT(*) FROM stocktake_scans c WHERE c.sessionId = s.sessionId)
+  FROM stocktake_sessions s`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+	var s Session
+	err := row.Scan(&s.ID, &s.InvDate, &s.Note, &s.Status, &s.OpenedAt, &s.ClosedAt, &s.BatchID, &s.ScanCount)
+	return s, err
+}
+
+// Get はセッションを返します。
+func Get(id int64) (Session, error) {
+	s, err := scanSession(DB.QueryRow(sessionColumns+` WHERE s.sessionId = ?`, id))
+	if err == sql.ErrNoRows {
+		return s, ErrNotFound
+	}
+	return s, err
+}
+
+// List はセッションを新しい順に返します。status を指定するとその状態のみです。
+func List(status string) ([]Session, error) {
+	query, args := sessionColumns, []interface{}{}
+	if status != "" {
+		query += ` WHERE s.status = ?`
+		args = append(args, status)
+	}
+	rows, err := DB.Query(query+` ORDER BY s.sessionId DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Session, 0)
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// openSession は読取を受け付けられるセッションかを確認します。
+func openSession(id int64) (Session, error) {
+	s, err := Get(id)
+	if err != nil {
+		return s, err
+	}
+	if s.Status != StatusOpen {
+		return s, ErrClosed
+	}
+	return s, nil
+}
+
+// AddScan は読取を１件登録します。バーコードは JAN に解決し、
+// マスターに無い JAN は MA2 登録待ちに追加します。
+func AddScan(sc Scan) (Scan, error) {
+	if _, err := openSession(sc.SessionID); err != nil {
+		return sc, err
+	}
+	jan, err := janOf(sc.Barcode)
+	if err != nil {
+		return sc, err
+	}
+	if sc.PackCount < 0 || sc.LooseQty < 0 {
+		return sc, invalid("数量が負です")
+	}
+	sc.JanCode = jan
+	prod := lookupProduct(jan)
+	sc.ProductName, sc.Unknown = prod.Name, !prod.Known
+	sc.Counter = strings.TrimSpace(sc.Counter)
+	sc.ScannedAt = now()
+
+	res, err := DB.Exec(`
+INSERT INTO stocktake_scans (sessionId, counter, barcode, janCode, packCount, looseQty, scannedAt)
+VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sc.SessionID, sc.Counter, sc.Barcode, sc.JanCode, sc.PackCount, sc.LooseQty, sc.ScannedAt,
+	)
+	if err != nil {
+		return sc, err
+	}
+	sc.ID, _ = res.LastInsertId()
+	if sc.Unknown {
+		queueUnknown(sc)
+	}
+	return sc, nil
+}
+
+// UpdateScan は読取の数量を訂正します。
+func UpdateScan(id int64, packCount, looseQty float64) (Scan, error) {
+	sc, err := getScan(id)
+	if err != nil {
+		return sc, err
+	}
+	if _, err := openSession(sc.SessionID); err != nil {
+		return sc, err
+	}
+	if packCount < 0 || looseQty < 0 {
+		return sc, invalid("数量が負です")
+	}
+	if _, err := DB.Exec(
+		`UPDATE stocktake_scans SET packCount = ?, looseQty = ? WHERE scanId = ?`,
+		packCount, looseQty, id,
+	); err != nil {
+		return sc, err
+	}
+	sc.PackCount, sc.LooseQty = packCount, looseQty
+	return sc, nil
+}
+
+// DeleteScan は読取を取り消します。
+func DeleteScan(id int64) error {
+	sc, err := getScan(id)
+	if err != nil {
+		return err
+	}
+	if _, err := openSession(sc.SessionID); err != nil {
+		return err
+	}
+	_, err = DB.Exec(`DELETE FROM stocktake_scans WHERE scanId = ?`, id)
+	return err
+}
+
+const scanColumns = `
+SELECT scanId, sessionId, counter, barcode, janCode, packCount, looseQty, scannedAt
+  FROM stocktake_scans`
+
+func getScan(id int64) (Scan, error) {
+	var sc Scan
+	err := DB.QueryRow(scanColumns+` WHERE scanId = ?`, id).Scan(
+		&sc.ID, &sc.SessionID, &sc.Counter, &sc.Barcode, &sc.JanCode,
+		&sc.PackCount, &sc.LooseQty, &sc.ScannedAt,
+	)
+	if err == sql.ErrNoRows {
+		return sc, fmt.Errorf("%w: %d", ErrScanNotFound, id)
+	}
+	return sc, err
+}
+
+// Scans はセッションの読取を登録順に返します。counter を指定するとその担当者のみです。
+func Scans(sessionID int64, counter string) ([]Scan, error) {
+	query, args := scanColumns+` WHERE sessionId = ?`, []interface{}{sessionID}
+	if counter != "" {
+		query += ` AND counter = ?`
+		args = append(args, counter)
+	}
+	rows, err := DB.Query(query+` ORDER BY scanId`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Scan, 0)
+	for rows.Next() {
+		var sc Scan
+		if err := rows.Scan(
+			&sc.ID, &sc.SessionID, &sc.Counter, &sc.Barcode, &sc.JanCode,
+			&sc.PackCount, &sc.LooseQty, &sc.ScannedAt,
+		); err != nil {
+			return nil, err
+		}
+		out = append(out, sc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range out {
+		prod := lookupProduct(out[i].JanCode)
+		out[i].ProductName, out[i].Unknown = prod.Name, !prod.Known
+	}
+	return out, nil
+}
+
+// Merge はセッションの読取を JAN ごとに合算した棚卸レコードを返します。
+func Merge(s Session) ([]inventory.InventoryRecord, error) {
+	scans, err := Scans(s.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	at := make(map[string]int)
+	var recs []inventory.InventoryRecord
+	for _, sc := range scans {
+		i, ok := at[sc.JanCode]
+		if !ok {
+			at[sc.JanCode] = len(recs)
+			recs = append(recs, inventory.InventoryRecord{
+				InvDate:        s.InvDate,
+				InvJanCode:     sc.JanCode,
+				InvProductName: sc.ProductName,
+				HousouTaniUnit: lookupProduct(sc.JanCode).PackUnit,
+			})
+			i = len(recs) - 1
+		}
+		recs[i].PackCount += sc.PackCount
+		recs[i].LooseQty += sc.LooseQty
+	}
+	return recs, nil
+}
+
+// Close はセッションを締め、合算結果を棚卸 CSV 取込と同じ手順（MA0/MA2 解決）で
+// inventory テーブルに書き込みます。書き込みは取込バッチとして記録し取消できます。
+// 書き込みに失敗した場合はセッションを開いた状態に戻すので、原因を直して締め直せます
+// （inventory は棚卸日・JAN ごとの置換なので、締め直しても重複しません）。
+func Close(id int64) (Session, []inventory.InventoryRecord, error) {
+	s, err := openSession(id)
+	if err != nil {
+		return s, nil, err
+	}
+	// 締め処理中の読取を受け付けないよう先に状態を変える
+	res, err := DB.Exec(
+		`UPDATE stocktake_sessions SET status = ?, closedAt = ? WHERE sessionId = ? AND status = ?`,
+		StatusClosed, now(), id, StatusOpen,
+	)
+	if err != nil {
+		return s, nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return s, nil, ErrClosed
+	}
+
+	batch, recs, err := closeInto(s)
+	if err != nil {
+		if _, rerr := DB.Exec(
+			`UPDATE stocktake_sessions SET status = ?, closedAt = NULL WHERE sessionId = ? AND status = ?`,
+			StatusOpen, id, StatusClosed,
+		); rerr != nil {
+			log.Printf("[STOCKTAKE] reopen error session=%d: %v", id, rerr)
+			return s, nil, fmt.Errorf("%w（セッションを開いた状態に戻せませんでした: %v）", err, rerr)
+		}
+		return s, nil, err
+	}
+	if _, err := DB.Exec(`UPDATE stocktake_sessions SET batchId = ? WHERE sessionId = ?`, batch.ID, id); err != nil {
+		log.Printf("[STOCKTAKE] batch link error session=%d: %v", id, err)
+	}
+	s, err = Get(id)
+	return s, recs, err
+}
+
+// closeInto はセッションの合算結果を inventory に書き込み、取込バッチを保存します。
+func closeInto(s Session) (*importer.Batch, []inventory.InventoryRecord, error) {
+	recs, err := Merge(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	batch := importer.NewBatch("stocktake")
+	batch.Files = append(batch.Files, importer.BatchFile{FileName: fmt.Sprintf("stocktake-%d.%s", s.ID, s.InvDate)})
+	inventory.MapInventoryUnits(recs)
+	batch.RowCount = len(recs)
+	if err := inventory.ImportInventoryRecords(recs, batch); err != nil {
+		return nil, nil, batch.Fail(err)
+	}
+	if err := batch.Save(); err != nil {
+		log.Printf("[STOCKTAKE] save import batch error: %v", err)
+		return nil, nil, fmt.Errorf("取込バッチの保存に失敗しました: %w", err)
+	}
+	return batch, recs, nil
+}
+
+// writeError はエラーを HTTP ステータスに対応づけて返します。
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrScanNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrClosed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, new(inputError)):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("[STOCKTAKE] error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func idParam(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return 0, invalid("id が不正です")
+	}
+	return id, nil
+}
+
+// SessionsHandler は /api/stocktake/sessions を処理します。
+// GET: 一覧（?status=open） / POST: {"invDate":"YYYY-MM-DD","note":""} でセッションを開く
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := List(r.URL.Query().Get("status"))
+		if err != nil {
+			log.Printf("[STOCKTAKE] list error: %v", err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		var req struct {
+			InvDate string `json:"invDate"`
+			Note    string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		s, err := Open(strings.ReplaceAll(req.InvDate, "-", ""), req.Note)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, s)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SessionHandler は /api/stocktake/session?id= の GET でセッションと読取・合算結果を返します。
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := idParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s, err := Get(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	scans, err := Scans(id, r.URL.Query().Get("counter"))
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	merged, err := Merge(s)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"session": s, "scans": scans, "merged": merged})
+}
+
+// ScansHandler は /api/stocktake/scans を処理します。
+// POST: 読取の登録 / PUT: {"id":N,"packCount":..,"looseQty":..} で訂正 / DELETE: ?id=N で取消
+func ScansHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var sc Scan
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		sc, err := AddScan(sc)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, sc)
+	case http.MethodPut:
+		var req struct {
+			ID        int64   `json:"id"`
+			PackCount float64 `json:"packCount"`
+			LooseQty  float64 `json:"looseQty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		sc, err := UpdateScan(req.ID, req.PackCount, req.LooseQty)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, sc)
+	case http.MethodDelete:
+		id, err := idParam(r)
+		if err == nil {
+			err = DeleteScan(id)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CloseHandler は /api/stocktake/close?id= の POST でセッションを締めます。
+func CloseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := idParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s, recs, err := Close(id)
+	if err != nil {
+		log.Printf("[STOCKTAKE] close error session=%d: %v", id, err)
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"session": s, "count": len(recs), "inventories": recs})
+}
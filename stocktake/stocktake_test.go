@@ -0,0 +1,201 @@
+package stocktake
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"YAMATO/importer"
+	"YAMATO/ma0"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	tablet  = "4987123456784" // JCSHMS にある 100錠包装の錠剤
+	powder  = "4987000000017" // JCSHMS にある散剤
+	unknown = "4987999999996" // マスターに無い JAN
+)
+
+// openTestDB はスキーマを適用したメモリ DB を各パッケージの DB に設定し、JCSHMS に２品目を登録します。
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if err := ma0.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	DB, ma0.DB = db, db
+	importer.SetDB(db)
+
+	// マスターの読込と同じく全列を空文字で埋める
+	cols, err := importer.TableColumns(db, "jcshms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range [][]string{
+		{tablet, "2171022F1011", "テスト錠", "錠", "100"},
+		{powder, "1124001B1011", "テスト散", "g", "500"},
+	} {
+		args := make([]interface{}, len(cols))
+		for i := range args {
+			args[i] = ""
+		}
+		if _, err := db.Exec(`INSERT INTO jcshms VALUES (?`+strings.Repeat(", ?", len(cols)-1)+`)`, args...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`
+UPDATE jcshms SET JC000JanCode = ?, JC009YJCode = ?, JC018ShouhinMei = ?, JC039HousouTaniTani = ?, JC044HousouSouryouSuuchi = ?
+ WHERE JC000JanCode = ''`, item[0], item[1], item[2], item[3], item[4]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func mustOpen(t *testing.T) Session {
+	t.Helper()
+	s, err := Open("20250401", "月末棚卸")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustScan(t *testing.T, sc Scan) Scan {
+	t.Helper()
+	sc, err := AddScan(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+func TestMerge(t *testing.T) {
+	openTestDB(t)
+	s := mustOpen(t)
+
+	// 複数の担当者が同じ JAN を別々の棚で数える
+	mustScan(t, Scan{SessionID: s.ID, Counter: "A", Barcode: tablet, PackCount: 2})
+	mustScan(t, Scan{SessionID: s.ID, Counter: "B", Barcode: " " + tablet + " ", PackCount: 1, LooseQty: 30})
+	mustScan(t, Scan{SessionID: s.ID, Counter: "A", Barcode: powder, LooseQty: 120})
+	mustScan(t, Scan{SessionID: s.ID, Counter: "B", Barcode: tablet, LooseQty: 5})
+
+	if scans, err := Scans(s.ID, "B"); err != nil || len(scans) != 2 || scans[0].ProductName != "テスト錠" {
+		t.Errorf("scans of B = %+v err=%v", scans, err)
+	}
+	recs, err := Merge(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type merged struct {
+		jan, name, unit string
+		pack, loose     float64
+	}
+	want := []merged{
+		{tablet, "テスト錠", "錠", 3, 35},
+		{powder, "テスト散", "g", 0, 120},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("merged = %+v", recs)
+	}
+	for i, w := range want {
+		r := recs[i]
+		got := merged{r.InvJanCode, r.InvProductName, r.HousouTaniUnit, r.PackCount, r.LooseQty}
+		if got != w || r.InvDate != s.InvDate {
+			t.Errorf("record %d = %+v (date %s), want %+v", i, got, r.InvDate, w)
+		}
+	}
+}
+
+func TestAddScanInput(t *testing.T) {
+	openTestDB(t)
+	s := mustOpen(t)
+	var ie inputError
+	if _, err := AddScan(Scan{SessionID: s.ID, Barcode: "12345"}); !errors.As(err, &ie) {
+		t.Errorf("bad barcode: err = %v, want input error", err)
+	}
+	if _, err := AddScan(Scan{SessionID: s.ID, Barcode: tablet, PackCount: -1}); !errors.As(err, &ie) {
+		t.Errorf("negative quantity: err = %v, want input error", err)
+	}
+	if _, err := AddScan(Scan{SessionID: s.ID + 1, Barcode: tablet}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing session: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	db := openTestDB(t)
+	s := mustOpen(t)
+	mustScan(t, Scan{SessionID: s.ID, Counter: "A", Barcode: tablet, PackCount: 2, LooseQty: 10})
+	sc := mustScan(t, Scan{SessionID: s.ID, Counter: "B", Barcode: tablet, PackCount: 1})
+
+	closed, recs, err := Close(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed.Status != StatusClosed || closed.ClosedAt == "" || closed.BatchID == 0 || len(recs) != 1 {
+		t.Errorf("closed = %+v records=%d", closed, len(recs))
+	}
+
+	// 未開封数・バラ数と、包装総量から求めた在庫数を書き込む
+	var pack, loose, qty, janQty, perPack float64
+	if err := db.QueryRow(`
+SELECT packCount, looseQty, qty, janqty, invJanHousouSuuryouNumber FROM inventory WHERE invDate = ? AND invJanCode = ?`,
+		s.InvDate, tablet).Scan(&pack, &loose, &qty, &janQty, &perPack); err != nil {
+		t.Fatal(err)
+	}
+	if pack != 3 || loose != 10 || perPack != 100 || qty != 310 || janQty != 3.1 {
+		t.Errorf("inventory pack=%v loose=%v qty=%v janqty=%v perPack=%v", pack, loose, qty, janQty, perPack)
+	}
+
+	// 締めた後は読取の追加・訂正・取消を受け付けない
+	if _, err := AddScan(Scan{SessionID: s.ID, Barcode: tablet, PackCount: 1}); !errors.Is(err, ErrClosed) {
+		t.Errorf("AddScan after close: err = %v", err)
+	}
+	if _, err := UpdateScan(sc.ID, 5, 0); !errors.Is(err, ErrClosed) {
+		t.Errorf("UpdateScan after close: err = %v", err)
+	}
+	if err := DeleteScan(sc.ID); !errors.Is(err, ErrClosed) {
+		t.Errorf("DeleteScan after close: err = %v", err)
+	}
+	if _, _, err := Close(s.ID); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close: err = %v", err)
+	}
+	if scans, _ := Scans(s.ID, ""); len(scans) != 2 || scans[1].PackCount != 1 {
+		t.Errorf("scans changed after close: %+v", scans)
+	}
+}
+
+func TestUnknownJanQueued(t *testing.T) {
+	openTestDB(t)
+	s := mustOpen(t)
+	sc := mustScan(t, Scan{SessionID: s.ID, Counter: "A", Barcode: unknown, PackCount: 1})
+	if !sc.Unknown {
+		t.Errorf("scan = %+v, want unknown", sc)
+	}
+	// 同じ JAN の２回目の読取は最初の読取を残す
+	mustScan(t, Scan{SessionID: s.ID, Counter: "B", Barcode: unknown, PackCount: 1})
+	mustScan(t, Scan{SessionID: s.ID, Counter: "A", Barcode: tablet, PackCount: 1})
+
+	items, err := Queue(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].JanCode != unknown || items[0].Counter != "A" ||
+		items[0].SessionID != s.ID || items[0].Status != QueuePending {
+		t.Errorf("queue = %+v", items)
+	}
+}
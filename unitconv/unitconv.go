@@ -0,0 +1,113 @@
+// Package unitconv は USAGE の数量（TANI 単位）を製品の包装に合わせて
+// 基本単位（JC039 包装単位）と包装数に換算します。
+//
+// 包装の表記「HK HS HU (JSN HU × JSSN JSU)」（例: PTP 100錠 (10錠×10シート)）に合わせ、
+//   - 基本単位 HU            : JC039 包装単位
+//   - 1包装の基本単位数 HS   : JC044 包装総量数値
+//   - 中間単位 JSU           : JA007 包装数量単位コード（例: シート）
+//   - 中間単位あたりの数 JSN : JA006 包装数量数値
+//   - 1包装の中間単位数 JSSN : JA008 包装総量数値
+//
+// として扱います。
+package unitconv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UnitPackage は数量が包装数（DAT の納品数など）であることを表す単位コードです。
+const UnitPackage = "package"
+
+// Packaging は換算に使う製品の包装情報です（単位は名称で持ちます）。
+type Packaging struct {
+	BaseUnit       string  // HU: 基本単位の名称
+	BaseUnitCode   string  // HU: 基本単位の TANI コード（名称が引けない場合の照合用）
+	BasePerPackage float64 // HS: 1包装あたりの基本単位数
+	SubUnitCode    string  // JSU: 中間単位の TANI コード
+	SubUnit        string  // 中間単位の名称
+	BasePerSub     float64 // JSN: 中間単位あたりの基本単位数
+	SubPerPackage  float64 // JSSN: 1包装あたりの中間単位数
+}
+
+// Result は換算結果です。OK が false の場合 Reason に理由が入ります。
+type Result struct {
+	BaseAmount float64 `json:"baseAmount"`
+	BaseUnit   string  `json:"baseUnit"`
+	Packages   float64 `json:"packages"`
+	OK         bool    `json:"ok"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// ParseNum は数値文字列を float64 に変換します（空・不正値は 0）。
+func ParseNum(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// Format は数値を表示用の文字列にします。
+func Format(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// perPackage は1包装あたりの基本単位数を返します（HS が無ければ JSN×JSSN）。
+func (p Packaging) perPackage() float64 {
+	if p.BasePerPackage > 0 {
+		return p.BasePerPackage
+	}
+	return p.BasePerSub * p.SubPerPackage
+}
+
+// Convert は amount（単位コード unitCode、名称 unitName）を包装 p の基本単位と包装数に換算します。
+// unitCode が UnitPackage の場合、amount は包装数です。
+func Convert(amount float64, unitCode, unitName string, p Packaging) Result {
+	res := Result{BaseUnit: p.BaseUnit}
+	if p.BaseUnit == "" {
+		res.Reason = "製品の包装単位が登録されていません"
+		return res
+	}
+	unitName = strings.TrimSpace(unitName)
+	switch {
+	case unitCode == UnitPackage:
+		res.BaseAmount = amount * p.perPackage()
+	case unitName == p.BaseUnit || (unitCode != "" && unitCode == p.BaseUnitCode):
+		res.BaseAmount = amount
+	case p.SubUnitCode != "" && p.SubUnitCode != "0" &&
+		(unitCode == p.SubUnitCode || (unitName != "" && unitName == p.SubUnit)):
+		if p.BasePerSub <= 0 {
+			res.Reason = fmt.Sprintf("%s あたりの%s数が登録されていません", p.SubUnit, p.BaseUnit)
+			return res
+		}
+		res.BaseAmount = amount * p.BasePerSub
+	default:
+		res.Reason = fmt.Sprintf("単位 %s を包装単位 %s に換算できません", unitLabel(unitCode, unitName), p.BaseUnit)
+		return res
+	}
+	per := p.perPackage()
+	if per <= 0 {
+		res.Reason = "1包装あたりの数量が登録されていません"
+		return res
+	}
+	res.Packages = round(res.BaseAmount / per)
+	res.BaseAmount = round(res.BaseAmount)
+	res.OK = true
+	return res
+}
+
+func unitLabel(code, name string) string {
+	if name != "" {
+		return name
+	}
+	return "コード" + code
+}
+
+// round は小数第3位で丸めます。
+func round(v float64) float64 {
+	s := strconv.FormatFloat(v, 'f', 3, 64)
+	r, _ := strconv.ParseFloat(s, 64)
+	return r
+}
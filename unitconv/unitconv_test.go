@@ -0,0 +1,73 @@
+package unitconv
+
+import (
+	"strings"
+	"testing"
+)
+
+// PTP 100錠 (10錠×10シート)
+var ptp = Packaging{
+	BaseUnit:       "錠",
+	BaseUnitCode:   "1",
+	BasePerPackage: 100,
+	SubUnitCode:    "50",
+	SubUnit:        "シート",
+	BasePerSub:     10,
+	SubPerPackage:  10,
+}
+
+func TestConvert(t *testing.T) {
+	noHS := ptp
+	noHS.BasePerPackage = 0
+	noJSN := ptp
+	noJSN.BasePerSub = 0
+	noSize := Packaging{BaseUnit: "mL", BaseUnitCode: "7"}
+
+	tests := []struct {
+		name      string
+		amount    float64
+		code      string
+		unit      string
+		p         Packaging
+		base      float64
+		packages  float64
+		ok        bool
+		reasonHas string
+	}{
+		{"基本単位の名称", 30, "", "錠", ptp, 30, 0.3, true, ""},
+		{"基本単位のコード（名称が引けない場合）", 30, "1", "", ptp, 30, 0.3, true, ""},
+		{"中間単位のコード", 3, "50", "", ptp, 30, 0.3, true, ""},
+		{"中間単位の名称", 2, "", "シート", ptp, 20, 0.2, true, ""},
+		{"包装数", 2, UnitPackage, "", ptp, 200, 2, true, ""},
+		{"HS が無ければ JSN×JSSN を1包装とする", 1, UnitPackage, "", noHS, 100, 1, true, ""},
+		{"端数は小数第3位で丸める", 1, "", "錠", Packaging{BaseUnit: "錠", BasePerPackage: 3}, 1, 0.333, true, ""},
+		{"前後の空白は無視", 5, "", " 錠 ", ptp, 5, 0.05, true, ""},
+		{"別の単位", 3, "7", "mL", ptp, 0, 0, false, "単位 mL"},
+		{"名称の無い別の単位はコードで示す", 3, "7", "", ptp, 0, 0, false, "コード7"},
+		{"中間単位あたりの数が無い", 2, "50", "", noJSN, 0, 0, false, "シート あたりの錠数"},
+		{"包装の基本単位が無い", 2, "", "錠", Packaging{}, 0, 0, false, "包装単位が登録されていません"},
+		{"1包装の数量が無い", 5, "", "mL", noSize, 0, 0, false, "1包装あたりの数量"},
+		{"包装数で1包装の数量が無い", 1, UnitPackage, "", noSize, 0, 0, false, "1包装あたりの数量"},
+		{"未設定の中間単位コード 0 は一致させない", 1, "0", "", Packaging{BaseUnit: "錠", BasePerPackage: 10, SubUnitCode: "0", BasePerSub: 5}, 0, 0, false, "コード0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Convert(tt.amount, tt.code, tt.unit, tt.p)
+			if got.OK != tt.ok {
+				t.Fatalf("OK = %v, want %v (reason %q)", got.OK, tt.ok, got.Reason)
+			}
+			if !tt.ok {
+				if !strings.Contains(got.Reason, tt.reasonHas) {
+					t.Errorf("Reason = %q, want it to mention %q", got.Reason, tt.reasonHas)
+				}
+				return
+			}
+			if got.BaseAmount != tt.base || got.Packages != tt.packages {
+				t.Errorf("got %v %s / %v packages, want %v / %v", got.BaseAmount, got.BaseUnit, got.Packages, tt.base, tt.packages)
+			}
+			if got.BaseUnit != tt.p.BaseUnit {
+				t.Errorf("BaseUnit = %q, want %q", got.BaseUnit, tt.p.BaseUnit)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package usage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"YAMATO/importer"
+)
+
+// legacyTable は旧形式の usagerecords を schema.sql 適用前に退避する名前です。
+const legacyTable = "usagerecords_legacy"
+
+// requiredColumns は現行の usagerecords に必要な列です（主キーに関わるもの）。
+var requiredColumns = []string{"usageSource", "usageLineNo"}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StashLegacyTable は schema.sql の適用前に呼び出します。
+// usagerecords が旧形式（主キーの列が足りない）なら usagerecords_legacy に改名し、
+// schema.sql で新形式のテーブルを作成できるようにします。
+func StashLegacyTable(db *sql.DB) (bool, error) {
+	cols, err := importer.TableColumns(db, "usagerecords")
+	if err != nil || len(cols) == 0 {
+		return false, err
+	}
+	for _, c := range requiredColumns {
+		if !contains(cols, c) {
+			if _, err := db.Exec(`ALTER TABLE usagerecords RENAME TO ` + legacyTable); err != nil {
+				return false, fmt.Errorf("rename usagerecords: %w", err)
+			}
+			log.Printf("[USAGE] usagerecords is missing %s, migrating", c)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LegacySource は取込元の無い旧データに付ける取込元を、プロファイルの設定ファイル path の
+// legacySource から返します。指定が無ければ DefaultProfile の名前です。
+// 旧データと同じ処方を店舗名などの取込元で取り込み直すと二重に数えるため、
+// 移行前に旧データを取り込んだ店舗名を設定してください。
+func LegacySource(path string) string {
+	var cfg struct {
+		LegacySource string `json:"legacySource"`
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[USAGE] legacySource lookup error %s: %v", path, err)
+	}
+	if s := strings.TrimSpace(cfg.LegacySource); s != "" {
+		return s
+	}
+	return DefaultProfile.Name
+}
+
+// MoveLegacyRows は schema.sql の適用後に呼び出し、退避した旧形式の行を
+// 新しい usagerecords に移して退避テーブルを削除します。
+// 取込元の無い旧データは source（LegacySource を参照）の取込元にします。
+func MoveLegacyRows(db *sql.DB, source string) error {
+	oldCols, err := importer.TableColumns(db, legacyTable)
+	if err != nil || len(oldCols) == 0 {
+		return err
+	}
+	newCols, err := importer.TableColumns(db, "usagerecords")
+	if err != nil {
+		return err
+	}
+	var common []string
+	for _, c := range oldCols {
+		if contains(newCols, c) {
+			common = append(common, c)
+		}
+	}
+	list := strings.Join(common, ", ")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO usagerecords (` + list + `) SELECT ` + list + ` FROM ` + legacyTable)
+	if err != nil {
+		return fmt.Errorf("copy legacy usagerecords: %w", err)
+	}
+	if !contains(oldCols, "usageSource") {
+		if _, err := tx.Exec(`UPDATE usagerecords SET usageSource = ? WHERE usageSource = ''`, source); err != nil {
+			return err
+		}
+		log.Printf("[USAGE] legacy usagerecords have no source, stored as %q (legacySource in %s)", source, ProfileConfigPath)
+	}
+	if _, err := tx.Exec(`DROP TABLE ` + legacyTable); err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	log.Printf("[USAGE] migrated %d legacy usagerecords rows", n)
+	return tx.Commit()
+}
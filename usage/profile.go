@@ -0,0 +1,123 @@
+package usage
+
+import (
+	"fmt"
+
+	"YAMATO/importer"
+)
+
+// USAGE の項目名（プロファイルの columns で指定するもの）
+const (
+	FieldDate        = "date"
+	FieldYjCode      = "yjCode"
+	FieldJanCode     = "janCode"
+	FieldProductName = "productName"
+	FieldAmount      = "amount"
+	FieldUnit        = "unit"
+)
+
+// requiredFields は見出しから必ず特定できなければならない項目です。
+var requiredFields = []string{FieldDate, FieldJanCode, FieldAmount}
+
+// ProfileColumn は１項目の列の探し方です（importer.Column を参照）。
+type ProfileColumn = importer.Column
+
+// Profile は調剤システムごとの USAGE CSV の形式です。
+type Profile struct {
+	Name        string          `json:"name"`
+	Default     bool            `json:"default"`
+	Encoding    string          `json:"encoding"` // "sjis"（既定）または "utf8"
+	Columns     []ProfileColumn `json:"columns"`
+	DateFormats []string        `json:"dateFormats"` // Go の日付レイアウト（例: "2006/01/02"）
+	Extra       []ProfileColumn `json:"extra"`       // 取込結果に添える任意の列
+}
+
+// DefaultProfile は従来の固定列（日付,YJ,JAN,商品名,数量,単位）の形式です。
+var DefaultProfile = Profile{
+	Name:     "standard",
+	Default:  true,
+	Encoding: "sjis",
+	Columns: []ProfileColumn{
+		{Field: FieldDate, Headers: []string{"日付", "使用日"}, Index: intp(0)},
+		{Field: FieldYjCode, Headers: []string{"YJコード", "YJ"}, Index: intp(1)},
+		{Field: FieldJanCode, Headers: []string{"JANコード", "JAN"}, Index: intp(2)},
+		{Field: FieldProductName, Headers: []string{"商品名", "薬品名"}, Index: intp(3)},
+		{Field: FieldAmount, Headers: []string{"数量", "使用量"}, Index: intp(4)},
+		{Field: FieldUnit, Headers: []string{"単位", "単位コード"}, Index: intp(5)},
+	},
+	DateFormats: []string{"20060102", "2006/01/02", "2006/1/2", "2006-01-02"},
+}
+
+func intp(i int) *int { return importer.IntP(i) }
+
+// ProfileConfigPath は USAGE 列対応プロファイルの既定パスです。
+const ProfileConfigPath = "config/usage_profiles.json"
+
+// Profiles は読込済みの USAGE 列対応プロファイルです（設定ファイルが無ければ DefaultProfile のみ）。
+var Profiles = importer.NewProfiles("USAGE", DefaultProfile)
+
+func (p Profile) ProfileName() string { return p.Name }
+func (p Profile) IsDefault() bool     { return p.Default }
+
+// Check はプロファイルの整合性を確認します。
+func (p Profile) Check() error {
+	if p.Name == "" {
+		return fmt.Errorf("プロファイル名がありません")
+	}
+	if err := importer.CheckEncoding(p.Encoding); err != nil {
+		return fmt.Errorf("%s: %w", p.Name, err)
+	}
+	have := make(map[string]bool)
+	for _, c := range p.Columns {
+		switch c.Field {
+		case FieldDate, FieldYjCode, FieldJanCode, FieldProductName, FieldAmount, FieldUnit:
+		default:
+			return fmt.Errorf("%s: 項目 %q は未対応です", p.Name, c.Field)
+		}
+		if len(c.Headers) == 0 && c.Index == nil {
+			return fmt.Errorf("%s: %s に headers も index もありません", p.Name, c.Field)
+		}
+		have[c.Field] = true
+	}
+	for _, f := range requiredFields {
+		if !have[f] {
+			return fmt.Errorf("%s: 必須項目 %s の定義がありません", p.Name, f)
+		}
+	}
+	for _, c := range p.Extra {
+		if c.Field == "" {
+			return fmt.Errorf("%s: extra に項目名の無い列があります", p.Name)
+		}
+	}
+	if len(p.DateFormats) == 0 {
+		return fmt.Errorf("%s: dateFormats がありません", p.Name)
+	}
+	return nil
+}
+
+// matches は見出し行だけで必須項目をすべて特定できるかを返します。
+func (p Profile) matches(header []string) bool {
+	idx := importer.ColumnIndex(p.Columns, header, true)
+	for _, f := range requiredFields {
+		if idx[f] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDate は DateFormats のいずれかで日付を解釈し YYYYMMDD で返します。
+func (p Profile) parseDate(s string) (string, error) {
+	return importer.ParseDate(s, p.DateFormats)
+}
+
+// detectProfile は見出し行で必須項目を特定できる最初のプロファイルを返します。
+// 該当が無ければ default 指定のプロファイル、それも無ければ DefaultProfile を返します。
+func detectProfile(header []string) Profile {
+	for _, p := range Profiles.All() {
+		if p.matches(header) {
+			return p
+		}
+	}
+	return Profiles.Default()
+}
@@ -2,9 +2,10 @@
 package usage
 
 import (
-	"bufio"
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,16 +14,15 @@ import (
 	"strconv"
 	"strings"
 
+	"YAMATO/importer"
 	"YAMATO/jcshms"
 	"YAMATO/ma0"
 	"YAMATO/tani"
-
-	"golang.org/x/text/encoding/japanese"
-	"golang.org/x/text/transform"
 )
 
 // UsageRecord は USAGE CSV の１行分を表します。
 type UsageRecord struct {
+	UsageSource      string `json:"usageSource"` // 取込元（店舗・調剤システム）
 	UsageDate        string `json:"usageDate"`
 	UsageYjCode      string `json:"usageYjCode"`
 	UsageJanCode     string `json:"usageJanCode"`
@@ -31,6 +31,9 @@ type UsageRecord struct {
 	UsageUnit        string `json:"usageUnit"`
 	UsageUnitName    string `json:"usageUnitName"`
 	OrganizedFlag    int    `json:"organizedFlag"`
+	UsageLineNo      int    `json:"usageLineNo"` // 同じ取込元・日付・YJ・JAN の何行目か
+	// Extra はプロファイルの extra 列の値です（取込結果の確認用で DB には保存しません）。
+	Extra map[string]string `json:"extra,omitempty"`
 }
 
 var taniMap map[string]string
@@ -81,37 +84,133 @@ func getOrganizedFlag(jan string) int {
 	return 0
 }
 
-// ParseUsageFile は SHIFT-JIS USAGE CSV を読み込み、UsageRecord スライスを返します。
+// ParseUsageFile は USAGE CSV を読み込み、UsageRecord スライスを返します。
 // MA0 未登録品は MA2 テーブルに登録します。
 func ParseUsageFile(r io.Reader) ([]UsageRecord, error) {
+	records, err := ReadUsageFile(r)
+	if err != nil {
+		return nil, err
+	}
+	RegisterUsageMasters(records, nil)
+	return records, nil
+}
+
+// ReadUsageFile は USAGE CSV を見出し行から判定したプロファイルで読み込み、
+// DB へは書き込まずに UsageRecord スライスを返します。
+func ReadUsageFile(r io.Reader) ([]UsageRecord, error) {
+	res, err := ReadUsageCSV(r, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Records, nil
+}
+
+// ReadResult は USAGE CSV １ファイルの読込結果です。
+type ReadResult struct {
+	Profile string               `json:"profile"`
+	Source  string               `json:"source"`
+	Records []UsageRecord        `json:"records"`
+	Skipped []importer.LineError `json:"skipped"` // 読み飛ばした行と理由
+}
+
+// ReadUsageCSV は USAGE CSV を profileName のプロファイルで読み込みます。
+// profileName が空の場合は見出し行から必須列を特定できるプロファイルを選びます。
+// 各行の取込元は source です。同じプロファイルを使う店舗が複数あるため、プロファイルからは補いません。
+func ReadUsageCSV(r io.Reader, profileName, source string) (ReadResult, error) {
+	var res ReadResult
 	loadTaniMap()
-	scanner := bufio.NewScanner(transform.NewReader(r, japanese.ShiftJIS.NewDecoder()))
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return res, fmt.Errorf("USAGE read error: %w", err)
+	}
 
-	var records []UsageRecord
-	headerSkipped := false
+	var prof Profile
+	if profileName != "" {
+		p, ok := Profiles.ByName(profileName)
+		if !ok {
+			return res, fmt.Errorf("USAGE プロファイル %q がありません", profileName)
+		}
+		prof = p
+	}
+	// プロファイル未指定時は文字コードを判定して見出しを読む
+	enc := prof.Encoding
+	if profileName != "" && enc == "" {
+		enc = "sjis"
+	}
+	rd := importer.NewCSVReader(data, enc)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !headerSkipped {
-			headerSkipped = true
+	header, err := rd.Read()
+	if err == io.EOF {
+		return res, nil
+	}
+	if err != nil {
+		return res, fmt.Errorf("USAGE header error: %w", err)
+	}
+	if profileName == "" {
+		prof = detectProfile(header)
+	}
+	res.Profile = prof.Name
+	res.Source = source
+	idx := importer.ColumnIndex(prof.Columns, header, false)
+	extra := importer.ColumnIndex(prof.Extra, header, false)
+	for _, f := range requiredFields {
+		if idx[f] < 0 {
+			return res, fmt.Errorf("USAGE プロファイル %s: 列 %s が見出しにありません", prof.Name, f)
+		}
+	}
+
+	for {
+		fields, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := rd.FieldPos(0)
+		skip := func(field, value, reason string) {
+			log.Printf("[USAGE] skip line %d: %s %q: %s", line, field, value, reason)
+			res.Skipped = append(res.Skipped, importer.LineError{Line: line, Field: field, Value: value, Reason: reason})
+		}
+		if err != nil {
+			skip("", "", err.Error())
 			continue
 		}
-		fields := strings.Split(line, ",")
-		if len(fields) < 6 {
-			log.Printf("[USAGE] skip short row: %v", fields)
+		if strings.TrimSpace(strings.Join(fields, "")) == "" {
 			continue
 		}
-		for i := range fields {
-			fields[i] = strings.Trim(fields[i], "\" ")
+		get := func(m map[string]int, f string) string {
+			if i := m[f]; i >= 0 && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
 		}
 
 		ur := UsageRecord{
-			UsageDate:        fields[0],
-			UsageYjCode:      fields[1],
-			UsageJanCode:     fields[2],
-			UsageProductName: fields[3],
-			UsageAmount:      fields[4],
-			UsageUnit:        fields[5],
+			UsageSource:      source,
+			UsageYjCode:      get(idx, FieldYjCode),
+			UsageJanCode:     get(idx, FieldJanCode),
+			UsageProductName: get(idx, FieldProductName),
+			UsageAmount:      strings.ReplaceAll(get(idx, FieldAmount), ",", ""),
+			UsageUnit:        get(idx, FieldUnit),
+		}
+		rawDate := get(idx, FieldDate)
+		if ur.UsageDate, err = prof.parseDate(rawDate); err != nil {
+			skip(FieldDate, rawDate, "日付として正しくありません")
+			continue
+		}
+		if ur.UsageJanCode == "" {
+			skip(FieldJanCode, "", "JANコードがありません")
+			continue
+		}
+		if _, err := strconv.ParseFloat(ur.UsageAmount, 64); err != nil {
+			skip(FieldAmount, ur.UsageAmount, "数量が数値ではありません")
+			continue
+		}
+		for _, c := range prof.Extra {
+			if v := get(extra, c.Field); v != "" {
+				if ur.Extra == nil {
+					ur.Extra = make(map[string]string)
+				}
+				ur.Extra[c.Field] = v
+			}
 		}
 		// 単位名称を解決
 		if nm := GetTaniName(ur.UsageUnit); nm != "" {
@@ -122,41 +221,49 @@ func ParseUsageFile(r io.Reader) ([]UsageRecord, error) {
 		// organizedFlag
 		ur.OrganizedFlag = getOrganizedFlag(ur.UsageJanCode)
 
-		// MA0 連携／MA2 登録
-		ma0Rec, created, err0 := ma0.CheckOrCreateMA0(ur.UsageJanCode, ur.UsageProductName)
-		if err0 != nil {
-			log.Printf("[USAGE] MA0 lookup error JAN=%s: %v", ur.UsageJanCode, err0)
-		}
-
-		// マスター名未設定の既存品のみ MA2 登録
-		if !created && ma0Rec.MA018JC018ShouhinMei == "" {
-			hs, _ := strconv.Atoi(ma0Rec.MA044JC044HousouSouryouSuuchi)
-			jsn, _ := strconv.Atoi(ma0Rec.MA131JA006HousouSuuryouSuuchi)
-			jssn, _ := strconv.Atoi(ma0Rec.MA133JA008HousouSouryouSuuchi)
-
-			mrec := &ma0.MARecord{
-				JanCode:                ur.UsageJanCode,
-				ProductName:            ur.UsageProductName,
-				HousouKeitai:           ma0Rec.MA037JC037HousouKeitai,
-				HousouTaniUnit:         ur.UsageUnit,
-				HousouSouryouNumber:    hs,
-				JanHousouSuuryouNumber: jsn,
-				JanHousouSuuryouUnit:   ma0Rec.MA132JA007HousouSuuryouTaniCode,
-				JanHousouSouryouNumber: jssn,
-			}
-			// シーケンスを受け取りつつ登録（戻り値は破棄）
-			_, _, err2 := ma0.RegisterMA(ma0.DB, mrec)
-			if err2 != nil {
-				log.Printf("[USAGE] MA2 registration error JAN=%s: %v", ur.UsageJanCode, err2)
-			}
-		}
+		res.Records = append(res.Records, ur)
+	}
+	return res, nil
+}
 
-		records = append(records, ur)
+// RegisterUsageMasters は USAGE レコードの JAN を MA0 と連携し、
+// マスター名未設定の既存品を MA2 に登録します。作成した行は batch（nil 可）に記録します。
+func RegisterUsageMasters(records []UsageRecord, batch *importer.Batch) {
+	for _, ur := range records {
+		ur := ur
+		batch.TrackMasters(ur.UsageJanCode, func() { registerMasters(ur) })
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("USAGE scan error: %w", err)
+}
+
+// registerMasters は１レコード分の MA0 連携／MA2 登録を行います。
+func registerMasters(ur UsageRecord) {
+	ma0Rec, created, err0 := ma0.CheckOrCreateMA0(ur.UsageJanCode, ur.UsageProductName)
+	if err0 != nil {
+		log.Printf("[USAGE] MA0 lookup error JAN=%s: %v", ur.UsageJanCode, err0)
+	}
+
+	// マスター名未設定の既存品のみ MA2 登録
+	if !created && ma0Rec.MA018JC018ShouhinMei == "" {
+		hs, _ := strconv.Atoi(ma0Rec.MA044JC044HousouSouryouSuuchi)
+		jsn, _ := strconv.Atoi(ma0Rec.MA131JA006HousouSuuryouSuuchi)
+		jssn, _ := strconv.Atoi(ma0Rec.MA133JA008HousouSouryouSuuchi)
+
+		mrec := &ma0.MARecord{
+			JanCode:                ur.UsageJanCode,
+			ProductName:            ur.UsageProductName,
+			HousouKeitai:           ma0Rec.MA037JC037HousouKeitai,
+			HousouTaniUnit:         ur.UsageUnit,
+			HousouSouryouNumber:    hs,
+			JanHousouSuuryouNumber: jsn,
+			JanHousouSuuryouUnit:   ma0Rec.MA132JA007HousouSuuryouTaniCode,
+			JanHousouSouryouNumber: jssn,
+		}
+		// シーケンスを受け取りつつ登録（戻り値は破棄）
+		_, _, err2 := ma0.RegisterMA(ma0.DB, mrec)
+		if err2 != nil {
+			log.Printf("[USAGE] MA2 registration error JAN=%s: %v", ur.UsageJanCode, err2)
+		}
 	}
-	return records, nil
 }
 
 // LoadTaniMap は main.go から呼ばれる公開版です。
@@ -164,43 +271,214 @@ func LoadTaniMap() {
 	loadTaniMap()
 }
 
-// ReplaceUsageRecordsWithPeriod は main.go から呼ばれる公開版です。
-// 指定期間の USAGE レコードを削除し、再挿入します。
-func ReplaceUsageRecordsWithPeriod(db *sql.DB, recs []UsageRecord) error {
-	if len(recs) == 0 {
-		return nil
+// sourcePeriod は取込元ごとの最小・最大日付です。
+type sourcePeriod struct {
+	Source, Start, End string
+}
+
+// usagePeriods は USAGE レコードの取込元ごとの最小・最大日付を返します。
+func usagePeriods(recs []UsageRecord) []sourcePeriod {
+	var out []sourcePeriod
+	at := make(map[string]int)
+	for _, r := range recs {
+		i, ok := at[r.UsageSource]
+		if !ok {
+			at[r.UsageSource] = len(out)
+			out = append(out, sourcePeriod{r.UsageSource, r.UsageDate, r.UsageDate})
+			continue
+		}
+		if r.UsageDate < out[i].Start {
+			out[i].Start = r.UsageDate
+		}
+		if r.UsageDate > out[i].End {
+			out[i].End = r.UsageDate
+		}
+	}
+	return out
+}
+
+// lineKey は行番号を除いた主キーです。
+func lineKey(r UsageRecord) string {
+	return r.UsageSource + "/" + r.UsageDate + "/" + r.UsageYjCode + "/" + r.UsageJanCode
+}
+
+// numberLines は同じ取込元・日付・YJ・JAN の行に出現順で 1 からの行番号を振ります。
+// 調剤システムが同じ日の同じ薬を複数行で出力しても、すべての行を別々に保存するためです。
+func numberLines(recs []UsageRecord) {
+	seq := make(map[string]int)
+	for i := range recs {
+		k := lineKey(recs[i])
+		seq[k]++
+		recs[i].UsageLineNo = seq[k]
+	}
+}
+
+// usageKey は usagerecords の主キー列と値を返します。
+func usageKey(r UsageRecord) importer.Row {
+	return importer.Row{
+		"usageSource":  r.UsageSource,
+		"usageDate":    r.UsageDate,
+		"usageYjCode":  r.UsageYjCode,
+		"usageJanCode": r.UsageJanCode,
+		"usageLineNo":  r.UsageLineNo,
 	}
-	start, end := recs[0].UsageDate, recs[0].UsageDate
+}
+
+// SourceOverlap は取り込む期間・JAN に別の取込元の行があることを表します。
+// 取込元ごとに置き換えるため別の取込元の行は残り、同じ処方を別の取込元名
+// （旧データの移行時の取込元など）で取り込んでいると二重に数えます。
+type SourceOverlap struct {
+	Source string `json:"source"` // 今回の取込元
+	Other  string `json:"other"`  // 行の残る別の取込元
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Jans   int    `json:"jans"` // 重なる JAN の数
+	Rows   int    `json:"rows"` // 重なる別の取込元の行数
+}
+
+// queryer は *sql.DB と *sql.Tx の共通部分です。
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// OverlappingSources は recs の取込元ごとの期間に、同じ JAN の別の取込元の行があれば返します。
+func OverlappingSources(db *sql.DB, recs []UsageRecord) ([]SourceOverlap, error) {
+	return overlappingSources(db, recs)
+}
+
+func overlappingSources(q queryer, recs []UsageRecord) ([]SourceOverlap, error) {
+	jans := make(map[string]map[string]bool)
 	for _, r := range recs {
-		if r.UsageDate < start {
-			start = r.UsageDate
+		if jans[r.UsageSource] == nil {
+			jans[r.UsageSource] = make(map[string]bool)
 		}
-		if r.UsageDate > end {
-			end = r.UsageDate
+		jans[r.UsageSource][r.UsageJanCode] = true
+	}
+	out := make([]SourceOverlap, 0)
+	for _, p := range usagePeriods(recs) {
+		rows, err := q.Query(`
+SELECT usageSource, usageJanCode, COUNT(*) FROM usagerecords
+ WHERE usageSource <> ? AND usageDate BETWEEN ? AND ?
+ GROUP BY usageSource, usageJanCode ORDER BY usageSource`, p.Source, p.Start, p.End)
+		if err != nil {
+			return nil, fmt.Errorf("select overlapping USAGE error: %w", err)
+		}
+		for rows.Next() {
+			var other, jan string
+			var n int
+			if err := rows.Scan(&other, &jan, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !jans[p.Source][jan] {
+				continue
+			}
+			if len(out) == 0 || out[len(out)-1].Source != p.Source || out[len(out)-1].Other != other {
+				out = append(out, SourceOverlap{Source: p.Source, Other: other, Start: p.Start, End: p.End})
+			}
+			out[len(out)-1].Jans++
+			out[len(out)-1].Rows += n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// ErrNoSource は取込元の無い USAGE レコードを登録しようとしたときに返されます。
+// 取込元ごとに期間の行を置き換えるため、取込元が無いと他の店舗の行を消してしまいます。
+var ErrNoSource = errors.New("USAGE の取込元（店舗名など）を指定してください")
+
+// ReplaceUsageRecordsWithPeriod は main.go から呼ばれる公開版です。
+// 取込元ごとに、その期間の同じ取込元の USAGE レコードだけを削除して再挿入し、
+// 削除件数と挿入件数を返します。削除・挿入した行は batch（nil 可）に記録し、
+// 削除・挿入とバッチの保存を１つのトランザクションで行います。
+// 失敗した場合は何も書き込まず、このトランザクションで記録した変更を batch から捨てます。
+// recs の UsageLineNo はここで振り直します。同じ期間・JAN に別の取込元の行が残る場合は警告を記録します。
+func ReplaceUsageRecordsWithPeriod(db *sql.DB, recs []UsageRecord, batch *importer.Batch) (deleted, inserted int, err error) {
+	for _, r := range recs {
+		if r.UsageSource == "" {
+			return 0, 0, ErrNoSource
 		}
 	}
-	if _, err := db.Exec(
-		`DELETE FROM usagerecords WHERE usageDate BETWEEN ? AND ?`,
-		start, end,
-	); err != nil {
-		return fmt.Errorf("delete existing USAGE error: %w", err)
+	numberLines(recs)
+	cp := batch.Checkpoint()
+	defer func() {
+		if err != nil {
+			batch.Discard(cp)
+			deleted, inserted = 0, 0
+		}
+	}()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	overlaps, err := overlappingSources(tx, recs)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, o := range overlaps {
+		log.Printf("[USAGE] warning: source=%s %s-%s overlaps %d rows (%d JANs) of source=%s",
+			o.Source, o.Start, o.End, o.Rows, o.Jans, o.Other)
+	}
+
+	for _, p := range usagePeriods(recs) {
+		if batch != nil {
+			olds, err := importer.SelectRowsTx(tx, "usagerecords",
+				`WHERE usageSource = ? AND usageDate BETWEEN ? AND ?`, p.Source, p.Start, p.End)
+			if err != nil {
+				return deleted, inserted, fmt.Errorf("select existing USAGE error: %w", err)
+			}
+			for _, o := range olds {
+				batch.RecordDelete("usagerecords", importer.Row{
+					"usageSource":  o["usageSource"],
+					"usageDate":    o["usageDate"],
+					"usageYjCode":  o["usageYjCode"],
+					"usageJanCode": o["usageJanCode"],
+					"usageLineNo":  o["usageLineNo"],
+				}, o)
+			}
+		}
+		res, err := tx.Exec(
+			`DELETE FROM usagerecords WHERE usageSource = ? AND usageDate BETWEEN ? AND ?`,
+			p.Source, p.Start, p.End,
+		)
+		if err != nil {
+			return deleted, inserted, fmt.Errorf("delete existing USAGE error: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += int(n)
+		log.Printf("[USAGE] source=%s %s-%s: deleted %d rows", p.Source, p.Start, p.End, n)
 	}
 	stmt := `
-        INSERT OR REPLACE INTO usagerecords (
-          usageDate, usageYjCode, usageJanCode,
+        INSERT INTO usagerecords (
+          usageSource, usageDate, usageYjCode, usageJanCode, usageLineNo,
           usageProductName, usageAmount, usageUnit,
           usageUnitName, organizedFlag
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	for _, r := range recs {
-		if _, err := db.Exec(stmt,
-			r.UsageDate, r.UsageYjCode, r.UsageJanCode,
+		if _, err := tx.Exec(stmt,
+			r.UsageSource, r.UsageDate, r.UsageYjCode, r.UsageJanCode, r.UsageLineNo,
 			r.UsageProductName, r.UsageAmount, r.UsageUnit,
 			r.UsageUnitName, r.OrganizedFlag,
 		); err != nil {
-			return fmt.Errorf("insert USAGE record error: %w", err)
+			return deleted, inserted, fmt.Errorf("insert USAGE record error: %w", err)
 		}
+		inserted++
+		batch.RecordInsert("usagerecords", usageKey(r))
+	}
+	if err := batch.SaveTx(tx); err != nil {
+		return deleted, inserted, fmt.Errorf("save import batch error: %w", err)
 	}
-	return nil
+	if err := tx.Commit(); err != nil {
+		return deleted, inserted, fmt.Errorf("commit USAGE error: %w", err)
+	}
+	return deleted, inserted, nil
 }
 
 // GetTaniMap は main.go から呼ばれる公開版です。
@@ -227,32 +505,177 @@ func UploadUsageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	preview := r.FormValue("preview") == "1"
+	profileName := r.FormValue("usageProfile") // 省略時は見出し行から判定
+	source := strings.TrimSpace(r.FormValue("usageSource"))
+	if source == "" {
+		http.Error(w, ErrNoSource.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var allRecords []UsageRecord
+	profilesUsed := make(map[string]string)
+	batch := importer.NewBatch("usage")
 	for _, fh := range files {
 		file, err := fh.Open()
 		if err != nil {
 			log.Printf("[UploadUsageHandler] open error: %v", err)
 			continue
 		}
-		recs, err := ParseUsageFile(file)
+		data, err := io.ReadAll(file)
 		file.Close()
 		if err != nil {
-			log.Printf("[UploadUsageHandler] parse error: %v", err)
+			log.Printf("[UploadUsageHandler] read error: %v", err)
 			continue
 		}
-		allRecords = append(allRecords, recs...)
+		batch.AddFile(fh.Filename, data)
+		res, err := ReadUsageCSV(bytes.NewReader(data), profileName, source)
+		if err != nil {
+			log.Printf("[UploadUsageHandler] parse error %s: %v", fh.Filename, err)
+			http.Error(w, fh.Filename+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[UploadUsageHandler] %s: profile=%s source=%s records=%d skipped=%d",
+			fh.Filename, res.Profile, res.Source, len(res.Records), len(res.Skipped))
+		for _, e := range res.Skipped {
+			e.FileName = fh.Filename
+			batch.AddError(e)
+		}
+		profilesUsed[fh.Filename] = res.Profile
+		allRecords = append(allRecords, res.Records...)
+	}
+
+	// 取込済みファイルは force=1 が無ければ受け付けない
+	force := r.FormValue("force") == "1"
+	if dups := batch.Duplicates(force); len(dups) > 0 {
+		log.Printf("[UploadUsageHandler] rejected already imported files: %v", dups)
+		importer.WriteDuplicates(w, dups)
+		return
+	}
+
+	// 取込処理（プレビュー時は確定まで保留）
+	commit := func() (interface{}, error) {
+		// プレビュー中に同じファイルが取り込まれていないか再確認
+		if len(batch.Duplicates(force)) > 0 {
+			return nil, importer.ErrAlreadyImported
+		}
+		batch.RowCount = len(allRecords)
+		RegisterUsageMasters(allRecords, batch)
+		// USAGE の削除・挿入とバッチは同じトランザクションで保存する。
+		// 失敗時は USAGE を変更していないので、自動作成したマスターだけを failed で記録する
+		deleted, inserted, err := ReplaceUsageRecordsWithPeriod(ma0.DB, allRecords, batch)
+		if err != nil {
+			log.Printf("[UploadUsageHandler] replace error: %v", err)
+			return nil, batch.Fail(err)
+		}
+		overlaps, err := OverlappingSources(ma0.DB, allRecords)
+		if err != nil {
+			log.Printf("[UploadUsageHandler] overlap check error: %v", err)
+		}
+		return map[string]interface{}{
+			"Overlaps":      overlaps,
+			"BatchID":       batch.ID,
+			"Profiles":      profilesUsed,
+			"ErrorCount":    batch.ErrorCount,
+			"DeletedCount":  deleted,
+			"InsertedCount": inserted,
+			"TotalRecords":  len(allRecords),
+			"USAGERecords":  allRecords,
+		}, nil
 	}
 
-	if err := ReplaceUsageRecordsWithPeriod(ma0.DB, allRecords); err != nil {
-		log.Printf("[UploadUsageHandler] replace error: %v", err)
-		http.Error(w, "Failed to update USAGE records", http.StatusInternalServerError)
+	if preview {
+		rows, deletions, err := PreviewUsageRecords(ma0.DB, allRecords)
+		if err != nil {
+			log.Printf("[UploadUsageHandler] preview error: %v", err)
+			http.Error(w, "Failed to preview USAGE records", http.StatusInternalServerError)
+			return
+		}
+		overlaps, err := OverlappingSources(ma0.DB, allRecords)
+		if err != nil {
+			log.Printf("[UploadUsageHandler] overlap check error: %v", err)
+			http.Error(w, "Failed to preview USAGE records", http.StatusInternalServerError)
+			return
+		}
+		p := importer.NewPreview("usage", rows, map[string]interface{}{
+			"DeleteCount":   len(deletions),
+			"DeleteRecords": deletions,
+			"Overlaps":      overlaps,
+		})
+		if err := importer.Hold(p, commit); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		importer.WritePreview(w, p)
 		return
 	}
 
-	resp := map[string]interface{}{
-		"TotalRecords": len(allRecords),
-		"USAGERecords": allRecords,
+	resp, err := commit()
+	if err != nil {
+		http.Error(w, "Failed to update USAGE records: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// PreviewUsageRecords は DB に書き込まずに各行の取込結果を判定し、
+// 置換対象期間で削除される既存レコードを返します。
+func PreviewUsageRecords(db *sql.DB, recs []UsageRecord) ([]importer.PreviewRow, []UsageRecord, error) {
+	rows := make([]importer.PreviewRow, 0, len(recs))
+	numberLines(recs)
+	var existing []UsageRecord
+	for _, p := range usagePeriods(recs) {
+		olds, err := queryUsageRecords(db,
+			`WHERE usageSource = ? AND usageDate BETWEEN ? AND ? ORDER BY usageDate, usageJanCode, usageLineNo`,
+			p.Source, p.Start, p.End)
+		if err != nil {
+			return nil, nil, err
+		}
+		existing = append(existing, olds...)
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, e := range existing {
+		exists[lineKey(e)+"/"+strconv.Itoa(e.UsageLineNo)] = true
+	}
+
+	for i, rec := range recs {
+		key := lineKey(rec) + "/" + strconv.Itoa(rec.UsageLineNo)
+		row := importer.PreviewRow{Row: i + 1, Jan: rec.UsageJanCode, Name: rec.UsageProductName, Key: key}
+		if exists[key] {
+			row.Marks = append(row.Marks, importer.MarkDuplicate)
+		} else {
+			row.Marks = append(row.Marks, importer.MarkNew)
+		}
+		row.Marks = append(row.Marks, importer.JanState(rec.UsageJanCode)...)
+		rows = append(rows, row)
+	}
+	return rows, existing, nil
+}
+
+// queryUsageRecords は usagerecords を where 句で絞り込んで返します。
+func queryUsageRecords(db *sql.DB, where string, args ...interface{}) ([]UsageRecord, error) {
+	rows, err := db.Query(`
+        SELECT usageSource, usageDate, usageYjCode, usageJanCode, usageLineNo,
+               usageProductName, usageAmount, usageUnit,
+               usageUnitName, organizedFlag
+          FROM usagerecords `+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select USAGE error: %w", err)
+	}
+	defer rows.Close()
+
+	var out []UsageRecord
+	for rows.Next() {
+		var u UsageRecord
+		if err := rows.Scan(
+			&u.UsageSource, &u.UsageDate, &u.UsageYjCode, &u.UsageJanCode, &u.UsageLineNo,
+			&u.UsageProductName, &u.UsageAmount, &u.UsageUnit,
+			&u.UsageUnitName, &u.OrganizedFlag,
+		); err != nil {
+			return nil, fmt.Errorf("scan USAGE error: %w", err)
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,188 @@
+package usage
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"YAMATO/importer"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func rec(source, date, yj, jan, amount string) UsageRecord {
+	return UsageRecord{UsageSource: source, UsageDate: date, UsageYjCode: yj, UsageJanCode: jan, UsageAmount: amount}
+}
+
+func TestNumberLines(t *testing.T) {
+	tests := []struct {
+		name string
+		recs []UsageRecord
+		want []int
+	}{
+		{
+			name: "同じ日の同じ薬は出現順に 1, 2, 3",
+			recs: []UsageRecord{
+				rec("A", "20250401", "1111", "4987000000001", "10"),
+				rec("A", "20250401", "1111", "4987000000001", "10"),
+				rec("A", "20250401", "1111", "4987000000001", "5"),
+			},
+			want: []int{1, 2, 3},
+		},
+		{
+			name: "間に別の薬・別の日が挟まっても同じ組み合わせで通し番号",
+			recs: []UsageRecord{
+				rec("A", "20250401", "1111", "4987000000001", "10"),
+				rec("A", "20250401", "2222", "4987000000002", "3"),
+				rec("A", "20250402", "1111", "4987000000001", "10"),
+				rec("A", "20250401", "1111", "4987000000001", "7"),
+				rec("A", "20250401", "2222", "4987000000002", "3"),
+			},
+			want: []int{1, 1, 1, 2, 2},
+		},
+		{
+			name: "取込元が違えば別の番号",
+			recs: []UsageRecord{
+				rec("A", "20250401", "1111", "4987000000001", "10"),
+				rec("B", "20250401", "1111", "4987000000001", "10"),
+				rec("A", "20250401", "1111", "4987000000001", "10"),
+			},
+			want: []int{1, 1, 2},
+		},
+		{
+			name: "読み込み時の行番号は振り直す",
+			recs: func() []UsageRecord {
+				r := rec("A", "20250401", "1111", "4987000000001", "10")
+				r.UsageLineNo = 9
+				return []UsageRecord{r, r}
+			}(),
+			want: []int{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			numberLines(tt.recs)
+			for i, want := range tt.want {
+				if tt.recs[i].UsageLineNo != want {
+					t.Errorf("row %d line = %d, want %d", i, tt.recs[i].UsageLineNo, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplaceUsageRecordsWithPeriod(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	importer.DB = db
+
+	count := func(source string) int {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM usagerecords WHERE usageSource = ?`, source).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// 同じ日の同じ薬の３行はすべて別の行として保存する
+	same := func(source string) []UsageRecord {
+		return []UsageRecord{
+			rec(source, "20250401", "1111", "4987000000001", "10"),
+			rec(source, "20250401", "1111", "4987000000001", "10"),
+			rec(source, "20250401", "1111", "4987000000001", "5"),
+		}
+	}
+	if _, ins, err := ReplaceUsageRecordsWithPeriod(db, same("A"), importer.NewBatch("usage")); err != nil || ins != 3 {
+		t.Fatalf("store A: inserted=%d err=%v, want 3", ins, err)
+	}
+	if _, _, err := ReplaceUsageRecordsWithPeriod(db, same("B"), importer.NewBatch("usage")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じ期間を再取込すると同じ取込元の行だけを置き換える
+	del, ins, err := ReplaceUsageRecordsWithPeriod(db, same("A")[:2], importer.NewBatch("usage"))
+	if err != nil || del != 3 || ins != 2 {
+		t.Fatalf("re-import A: deleted=%d inserted=%d err=%v, want 3/2", del, ins, err)
+	}
+	if a, b := count("A"), count("B"); a != 2 || b != 3 {
+		t.Errorf("rows A=%d B=%d, want 2/3", a, b)
+	}
+
+	// 同じ期間・JAN に残る別の取込元の行は警告する
+	overlaps, err := OverlappingSources(db, same("A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlaps) != 1 || overlaps[0] != (SourceOverlap{Source: "A", Other: "B", Start: "20250401", End: "20250401", Jans: 1, Rows: 3}) {
+		t.Errorf("overlaps = %+v", overlaps)
+	}
+	other := []UsageRecord{rec("A", "20250401", "2222", "4987000000002", "1")}
+	if overlaps, err := OverlappingSources(db, other); err != nil || len(overlaps) != 0 {
+		t.Errorf("other JAN: overlaps = %+v err=%v", overlaps, err)
+	}
+
+	// 取込元の無い行は他の店舗の行を消しうるため受け付けない
+	if _, _, err := ReplaceUsageRecordsWithPeriod(db, same(""), nil); !errors.Is(err, ErrNoSource) {
+		t.Errorf("empty source: err = %v, want ErrNoSource", err)
+	}
+}
+
+func TestMoveLegacyRows(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	// 取込元・行番号の列が無い旧形式
+	if _, err := db.Exec(`
+CREATE TABLE usagerecords (usageDate TEXT, usageYjCode TEXT, usageJanCode TEXT, usageProductName TEXT,
+                           usageAmount TEXT, usageUnit TEXT, usageUnitName TEXT, organizedFlag INTEGER,
+                           PRIMARY KEY (usageDate, usageYjCode, usageJanCode));
+INSERT INTO usagerecords VALUES ('20250401', '1111', '4987000000001', 'テスト錠', '10', '', '錠', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	if stashed, err := StashLegacyTable(db); err != nil || !stashed {
+		t.Fatalf("stash: %v %v", stashed, err)
+	}
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+
+	// 設定ファイルの legacySource を取込元にする
+	path := filepath.Join(t.TempDir(), "usage_profiles.json")
+	if got := LegacySource(path); got != DefaultProfile.Name {
+		t.Errorf("LegacySource without file = %q", got)
+	}
+	if err := os.WriteFile(path, []byte(`{"legacySource": "本店", "profiles": []}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveLegacyRows(db, LegacySource(path)); err != nil {
+		t.Fatal(err)
+	}
+	var source string
+	var line int
+	if err := db.QueryRow(`SELECT usageSource, usageLineNo FROM usagerecords`).Scan(&source, &line); err != nil {
+		t.Fatal(err)
+	}
+	if source != "本店" || line != 1 {
+		t.Errorf("migrated row source=%q line=%d", source, line)
+	}
+}
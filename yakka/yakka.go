@@ -0,0 +1,264 @@
+// Package yakka は薬価の履歴（適用開始日ごとの単位薬価・包装薬価）を扱います。
+// JCSHMS の読込のたびに JC049・JC050（現薬価）の変化を記録し、
+// 取引や棚卸の評価はその日に適用されていた薬価で行います。
+package yakka
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DB は yakka_history の参照・記録に使うデータベース接続です。
+var DB *sql.DB
+
+// Origin は最初の読込以前から適用されている薬価の適用開始日です。
+const Origin = "00000000"
+
+// 記録の出所
+const (
+	SourceCurrent  = "current"  // JC049・JC050 現薬価
+	SourcePrevious = "previous" // JC051・JC052 旧薬価（最初の読込で改定前の期間を補う）
+)
+
+// Price は１期間の薬価です。
+type Price struct {
+	JanCode       string  `json:"janCode"`
+	YjCode        string  `json:"yjCode"`
+	EffectiveFrom string  `json:"effectiveFrom"` // YYYYMMDD（00000000 は最初の読込以前から）
+	TaniYakka     float64 `json:"taniYakka"`     // 単位薬価
+	HousouYakka   float64 `json:"housouYakka"`   // 包装薬価
+	Source        string  `json:"source"`
+	UpdateID      int64   `json:"updateId"` // master_updates.updateId（初期移行は 0）
+}
+
+// Unit は単位薬価を返します。単位薬価が無ければ包装薬価÷包装総量 hs です。
+func (p Price) Unit(hs float64) float64 {
+	if p.TaniYakka > 0 || hs <= 0 {
+		return p.TaniYakka
+	}
+	return p.HousouYakka / hs
+}
+
+func parseNum(s string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return v
+}
+
+// dateOf は JCSHMS の年月日を YYYYMMDD にします。読めなければ "" です。
+func dateOf(s string) string {
+	d := strings.NewReplacer("/", "", "-", "", ".", "").Replace(strings.TrimSpace(s))
+	if len(d) != 8 {
+		return ""
+	}
+	if _, err := strconv.Atoi(d); err != nil {
+		return ""
+	}
+	return d
+}
+
+// Migrate は薬価の履歴が空で JCSHMS が読込済みなら、現在の JCSHMS から初期の履歴を作ります。
+func Migrate(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM yakka_history`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	added, err := record(db, 0, time.Now().Format("20060102"))
+	if added > 0 {
+		log.Printf("[YAKKA] initial history: %d prices", added)
+	}
+	return err
+}
+
+// Record は JCSHMS の現薬価を履歴と照合し、変わった JAN の薬価を記録して件数を返します。
+// 適用開始日は JC055 薬価改定年月日（前回の記録より前なら読込日 loadDate）です。
+func Record(updateID int64, loadDate string) (int, error) {
+	return record(DB, updateID, loadDate)
+}
+
+func record(db *sql.DB, updateID int64, loadDate string) (int, error) {
+	latest := make(map[string]Price)
+	rows, err := db.Query(`
+SELECT janCode, effectiveFrom, taniYakka, housouYakka FROM yakka_history ORDER BY janCode, effectiveFrom`)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var p Price
+		if err := rows.Scan(&p.JanCode, &p.EffectiveFrom, &p.TaniYakka, &p.HousouYakka); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		latest[p.JanCode] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rows, err = db.Query(`
+SELECT JC000JanCode, COALESCE(JC009YJCode, ''),
+       COALESCE(JC049GenTaniYakka, ''), COALESCE(JC050GenHousouYakka, ''),
+       COALESCE(JC051KyuuTaniYakka, ''), COALESCE(JC052KyuuHousouYakka, ''),
+       COALESCE(JC055YakkaKaiteiNengappi, '')
+  FROM jcshms`)
+	if err != nil {
+		return 0, err
+	}
+	var adds []Price
+	for rows.Next() {
+		var jan, yj, tani, housou, oldTani, oldHousou, kaitei string
+		if err := rows.Scan(&jan, &yj, &tani, &housou, &oldTani, &oldHousou, &kaitei); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		cur := Price{JanCode: jan, YjCode: yj, TaniYakka: parseNum(tani), HousouYakka: parseNum(housou),
+			Source: SourceCurrent, UpdateID: updateID}
+		if cur.TaniYakka <= 0 && cur.HousouYakka <= 0 {
+			continue
+		}
+		revised := dateOf(kaitei)
+		last, ok := latest[jan]
+		switch {
+		case !ok:
+			// 最初の読込: 改定前の旧薬価が分かればその期間も補う
+			prev := Price{JanCode: jan, YjCode: yj, EffectiveFrom: Origin, TaniYakka: parseNum(oldTani),
+				HousouYakka: parseNum(oldHousou), Source: SourcePrevious, UpdateID: updateID}
+			if revised != "" && (prev.TaniYakka > 0 || prev.HousouYakka > 0) &&
+				(prev.TaniYakka != cur.TaniYakka || prev.HousouYakka != cur.HousouYakka) {
+				cur.EffectiveFrom = revised
+				adds = append(adds, prev)
+			} else {
+				cur.EffectiveFrom = Origin
+			}
+		case last.TaniYakka == cur.TaniYakka && last.HousouYakka == cur.HousouYakka:
+			continue
+		case revised != "" && revised >= last.EffectiveFrom:
+			cur.EffectiveFrom = revised
+		default:
+			// 改定日が無い・古い訂正は読込日から適用する
+			cur.EffectiveFrom = loadDate
+			if cur.EffectiveFrom < last.EffectiveFrom {
+				cur.EffectiveFrom = last.EffectiveFrom
+			}
+		}
+		adds = append(adds, cur)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(adds) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+INSERT OR REPLACE INTO yakka_history (janCode, yjCode, effectiveFrom, taniYakka, housouYakka, source, updateId)
+VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, p := range adds {
+		if _, err := stmt.Exec(p.JanCode, p.YjCode, p.EffectiveFrom, p.TaniYakka, p.HousouYakka, p.Source, p.UpdateID); err != nil {
+			return 0, fmt.Errorf("yakka_history insert error JAN=%s: %w", p.JanCode, err)
+		}
+	}
+	return len(adds), tx.Commit()
+}
+
+// PriceAt は date（YYYYMMDD）に適用されていた JAN の薬価を返します。履歴が無ければ ok は false です。
+func PriceAt(jan, date string) (p Price, ok bool, err error) {
+	err = DB.QueryRow(`
+SELECT janCode, yjCode, effectiveFrom, taniYakka, housouYakka, source, updateId
+  FROM yakka_history
+ WHERE janCode = ? AND effectiveFrom <= ?
+ ORDER BY effectiveFrom DESC LIMIT 1`, jan, date).Scan(
+		&p.JanCode, &p.YjCode, &p.EffectiveFrom, &p.TaniYakka, &p.HousouYakka, &p.Source, &p.UpdateID)
+	if err == sql.ErrNoRows {
+		return p, false, nil
+	}
+	return p, err == nil, err
+}
+
+// TaniYakkaSQL は janCol の dateCol の日に適用されていた単位薬価を返す SQL 式です。
+// 履歴が無い（または単位薬価が 0 の）ときは NULL になるため、呼び出し側で現薬価と COALESCE します。
+func TaniYakkaSQL(janCol, dateCol string) string {
+	return `(SELECT NULLIF(h.taniYakka, 0) FROM yakka_history h WHERE h.janCode = ` + janCol +
+		` AND h.effectiveFrom <= ` + dateCol + ` ORDER BY h.effectiveFrom DESC LIMIT 1)`
+}
+
+// History は JAN（または YJ コード）の薬価の履歴を新しい順に返します。
+func History(jan, yj string) ([]Price, error) {
+	query, args := `
+SELECT janCode, yjCode, effectiveFrom, taniYakka, housouYakka, source, updateId
+  FROM yakka_history`, []interface{}{}
+	switch {
+	case jan != "":
+		query += ` WHERE janCode = ?`
+		args = append(args, jan)
+	case yj != "":
+		query += ` WHERE yjCode = ?`
+		args = append(args, yj)
+	}
+	rows, err := DB.Query(query+` ORDER BY janCode, effectiveFrom DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Price, 0)
+	for rows.Next() {
+		var p Price
+		if err := rows.Scan(&p.JanCode, &p.YjCode, &p.EffectiveFrom, &p.TaniYakka, &p.HousouYakka, &p.Source, &p.UpdateID); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// HistoryHandler は /api/yakka/history?jan= または ?yj= の GET で薬価の履歴を返します。
+// date=YYYYMMDD を付けるとその日に適用されていた薬価だけを返します（jan 必須）。
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	jan, yj := q.Get("jan"), q.Get("yj")
+	if jan == "" && yj == "" {
+		http.Error(w, "jan または yj は必須です", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if date := strings.ReplaceAll(q.Get("date"), "-", ""); date != "" && jan != "" {
+		p, ok, err := PriceAt(jan, date)
+		if err != nil {
+			log.Printf("[YAKKA] price lookup error JAN=%s: %v", jan, err)
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "薬価の履歴がありません", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+		return
+	}
+	list, err := History(jan, yj)
+	if err != nil {
+		log.Printf("[YAKKA] history error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,104 @@
+package yakka
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRecordPriceAt(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	DB = db
+
+	const revised, plain, unpriced = "4987000000001", "4987000000002", "4987000000003"
+	// jcshms は JAN・現単位薬価・旧単位薬価・薬価改定年月日だけを置き換える
+	load := func(jan, tani, oldTani, kaitei string) {
+		t.Helper()
+		if _, err := db.Exec(`
+INSERT OR REPLACE INTO jcshms (JC000JanCode, JC009YJCode, JC049GenTaniYakka, JC051KyuuTaniYakka, JC055YakkaKaiteiNengappi)
+VALUES (?, '1111', ?, ?, ?)`, jan, tani, oldTani, kaitei); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type check struct {
+		jan, date string
+		ok        bool
+		tani      float64
+		from      string
+	}
+	verify := func(step string, checks []check) {
+		t.Helper()
+		for _, c := range checks {
+			p, ok, err := PriceAt(c.jan, c.date)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != c.ok || p.TaniYakka != c.tani || p.EffectiveFrom != c.from {
+				t.Errorf("%s: PriceAt(%s, %s) = %v %v from %q, want %v %v from %q",
+					step, c.jan, c.date, p.TaniYakka, ok, p.EffectiveFrom, c.tani, c.ok, c.from)
+			}
+		}
+	}
+	record := func(step string, updateID int64, loadDate string, want int) {
+		t.Helper()
+		n, err := Record(updateID, loadDate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s: recorded %d, want %d", step, n, want)
+		}
+	}
+
+	// 最初の読込: 改定日と旧薬価が分かれば改定前の期間も補う
+	load(revised, "10", "12", "2024/04/01")
+	load(plain, "5", "", "")
+	load(unpriced, "", "", "")
+	record("initial", 1, "20240601", 3)
+	verify("initial", []check{
+		{revised, "20240331", true, 12, Origin},
+		{revised, "20240401", true, 10, "20240401"},
+		{plain, "20200101", true, 5, Origin},
+		{unpriced, "20240601", false, 0, ""},
+	})
+	if p, _, _ := PriceAt(revised, "20240331"); p.Source != SourcePrevious || p.UpdateID != 1 {
+		t.Errorf("previous price: source=%s updateId=%d", p.Source, p.UpdateID)
+	}
+
+	// 薬価が変わらなければ何も記録しない
+	record("unchanged", 2, "20240701", 0)
+
+	// 改定: 改定日から新しい薬価、前日までは改定前の薬価
+	load(revised, "9", "10", "20250401")
+	record("revision", 3, "20250310", 1)
+	verify("revision", []check{
+		{revised, "20250331", true, 10, "20240401"},
+		{revised, "20250401", true, 9, "20250401"},
+		{revised, "20990101", true, 9, "20250401"},
+	})
+
+	// 改定日の無い訂正・前回より古い改定日の訂正は読込日から適用する
+	load(plain, "6", "", "")
+	load(revised, "8", "10", "20240401")
+	record("correction", 4, "20250501", 2)
+	verify("correction", []check{
+		{plain, "20250430", true, 5, Origin},
+		{plain, "20250501", true, 6, "20250501"},
+		{revised, "20250430", true, 9, "20250401"},
+		{revised, "20250501", true, 8, "20250501"},
+	})
+}